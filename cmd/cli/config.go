@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"nextimagescrap/pkg/imports"
+	"nextimagescrap/pkg/jobs"
+	"os"
+)
+
+// loadConfig reads the json config file at path, an empty path yields the defaults
+func loadConfig(path string) (imports.Config, error) {
+	cfg := imports.Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// loadDaemonConfig reads the Daemon section of the json config file at path
+func loadDaemonConfig(path string) (jobs.Config, error) {
+	file := struct{ Daemon jobs.Config }{}
+	if path == "" {
+		return file.Daemon, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return file.Daemon, err
+	}
+	err = json.Unmarshal(data, &file)
+	return file.Daemon, err
+}
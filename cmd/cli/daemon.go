@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"nextimagescrap/pkg/imports"
+	"nextimagescrap/pkg/jobs"
+	"nextimagescrap/pkg/storage"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// daemon actions jobs can run
+const (
+	jobActionScan     = "scan"
+	jobActionHash     = "hash"
+	jobActionDate     = "date"
+	jobActionVerify   = "verify"
+	jobActionDedupe   = "dedupe-report"
+	jobActionRetry    = "retry"
+	jobActionOrganize = "organize"
+)
+
+const statusFileName = "daemon-status.json"
+
+// statusPathOf returns the path of the daemon status, next to the catalog
+func statusPathOf(sourcePath string) string {
+	return filepath.Join(filepath.Dir(catalogPathOf(sourcePath)), statusFileName)
+}
+
+// daemonActions returns the actions of jobs working on the catalog s with
+// the service importService
+func daemonActions(s *storage.DbSourceStorage, importService imports.Service, catalogDir string) map[string]jobs.Action {
+	return map[string]jobs.Action{
+		jobActionScan: func(ctx context.Context, job jobs.JobConfig) (string, error) {
+			before, err := s.MediaCount()
+			if err != nil {
+				return "", err
+			}
+			err = runSteps(ctx,
+				importService.ScanSourceDirectory,
+				func() error { return importService.DetectMimetype(false) },
+				func() error { return importService.ComputeChecksums(false) },
+				func() error { return importService.ExtractCreationDate(false) },
+			)
+			if err != nil {
+				return "", err
+			}
+			after, err := s.MediaCount()
+			return fmt.Sprintf("cataloged %d new media, %d in total", after-before, after), err
+		},
+		jobActionHash: func(ctx context.Context, job jobs.JobConfig) (string, error) {
+			return runOnState(s, imports.StateNeedsHash, "hashed", func() error {
+				return importService.ComputeChecksums(false)
+			})
+		},
+		jobActionDate: func(ctx context.Context, job jobs.JobConfig) (string, error) {
+			return runOnState(s, imports.StateNeedsDate, "dated", func() error {
+				return importService.ExtractCreationDate(false)
+			})
+		},
+		jobActionVerify: func(ctx context.Context, job jobs.JobConfig) (string, error) {
+			report, err := s.Fsck(false)
+			if err != nil {
+				return "", err
+			}
+			summary := fmt.Sprintf("checked %d media, %d checksum groups, %d index entries, %d issues",
+				report.MediaChecked, report.ChecksumChecked, report.IndexChecked, len(report.Issues))
+			if len(report.Issues) > 0 {
+				return summary, fmt.Errorf("found %d issues, run fsck with -repair", len(report.Issues))
+			}
+			return summary, nil
+		},
+		jobActionDedupe: func(ctx context.Context, job jobs.JobConfig) (string, error) {
+			output := job.Output
+			if output == "" {
+				output = filepath.Join(catalogDir, "duplicates-"+time.Now().Format("20060102")+".txt")
+			}
+			groups, redundant, err := writeDuplicateReport(s, output)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d duplicate groups with %d redundant files, report in %v", groups, redundant, output), nil
+		},
+		jobActionRetry: func(ctx context.Context, job jobs.JobConfig) (string, error) {
+			retried, err := importService.RetryFailures()
+			return fmt.Sprintf("retried %d failures", retried), err
+		},
+		jobActionOrganize: func(ctx context.Context, job jobs.JobConfig) (string, error) {
+			err := importService.OrganizeToFolder()
+			return "exported the checksum groups", err
+		},
+	}
+}
+
+// runSteps runs the steps of an action in turn, a cancelled action stops
+// before the next step
+func runSteps(ctx context.Context, steps ...func() error) error {
+	for _, step := range steps {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		err = step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runOnState runs step and reports how many of the media waiting in state
+// it processed
+func runOnState(s *storage.DbSourceStorage, state imports.MediaState, done string, step func() error) (string, error) {
+	before, err := countState(s, state)
+	if err != nil {
+		return "", err
+	}
+	err = step()
+	if err != nil {
+		return "", err
+	}
+	after, err := countState(s, state)
+	return fmt.Sprintf("%s %d media, %d left", done, before-after, after), err
+}
+
+func countState(s *storage.DbSourceStorage, state imports.MediaState) (int, error) {
+	n := 0
+	err := s.ForEachMedia(imports.MediaFilter{State: state}, func(media *imports.SourceMedia) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// writeDuplicateReport lists the checksum groups of more than one media
+// in the file at output
+func writeDuplicateReport(s *storage.DbSourceStorage, output string) (int, int, error) {
+	f, err := os.Create(output)
+	if err != nil {
+		return 0, 0, err
+	}
+	w := bufio.NewWriter(f)
+	groups, redundant := 0, 0
+	err = imports.ForEachDuplicate(s, "", func(group *imports.DuplicateGroup) error {
+		groups++
+		redundant += group.Redundant()
+		fmt.Fprintf(w, "%s\n", group.Checksum)
+		for _, media := range group.Media {
+			if media.ExportedPath != "" {
+				fmt.Fprintf(w, "\t%s\texported as %s\n", media.Path, media.ExportedPath)
+			} else {
+				fmt.Fprintf(w, "\t%s\n", media.Path)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		_, err = fmt.Fprintf(w, "# %d duplicate groups with %d redundant files\n", groups, redundant)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return groups, redundant, err
+}
+
+func runDaemon(sourcePath *string, destPath *string, cfg imports.Config, daemonCfg jobs.Config, options storage.SourceOptions, destOptions storage.DestinationOptions) {
+	if len(daemonCfg.Jobs) == 0 {
+		fmt.Printf("No jobs in the Daemon section of the config\n")
+		os.Exit(0)
+	}
+	log.Printf(*sourcePath)
+	// signals are handled below, a running job gets the chance to finish
+	s, _, scheduler := openScheduler(sourcePath, destPath, cfg, daemonCfg, options, destOptions)
+	defer func(s *storage.DbSourceStorage) {
+		err := s.CloseDb()
+		if err != nil {
+			log.Printf("cannot close source db %v", err)
+			os.Exit(5)
+		}
+	}(s)
+
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("received %v, stopping the daemon", sig)
+		close(stop)
+	}()
+	err := scheduler.Run(stop)
+	if err != nil {
+		log.Printf("Error daemon: %v", err)
+		os.Exit(5)
+	}
+	log.Printf("daemon stopped")
+}
+
+// openScheduler opens the catalog and the files of sourcePath and
+// schedules the jobs of daemonCfg on them, the caller closes the catalog
+func openScheduler(sourcePath *string, destPath *string, cfg imports.Config, daemonCfg jobs.Config, options storage.SourceOptions, destOptions storage.DestinationOptions) (*storage.DbSourceStorage, *storage.SourceFileStorage, *jobs.Scheduler) {
+	for _, job := range daemonCfg.Jobs {
+		if job.Action == jobActionOrganize && *destPath == "" {
+			fmt.Printf("Job %v needs -destPath\n", job.Name)
+			os.Exit(0)
+		}
+	}
+	s, err := openCatalog(*sourcePath)
+	if err != nil {
+		fmt.Printf("Cannot open source db %v", err)
+		os.Exit(0)
+	}
+
+	statusPath := statusPathOf(*sourcePath)
+	fs, err := storage.NewSourceFileStorageWithOptions(*sourcePath, options)
+	if err != nil {
+		s.CloseDb()
+		fmt.Printf("Cannot not find sourceapth %v", err)
+		os.Exit(0)
+	}
+	fs.MountRoots(s.Roots())
+	if sourceDbOptions.catalogPath != "" {
+		fs.ExcludePath(sourceDbOptions.catalogPath)
+	}
+	fs.ExcludePath(statusPath)
+	var dfs imports.DestinationFileRepository
+	if *destPath != "" {
+		dfs, err = storage.NewDestinationFileStorageWithOptions(*destPath, destOptions)
+		if err != nil {
+			s.CloseDb()
+			fmt.Printf("Cannot not find destpath %v", err)
+			os.Exit(0)
+		}
+	}
+	importService := imports.NewConfiguredService(fs, s, dfs, cfg)
+	actions := daemonActions(s, importService, filepath.Dir(statusPath))
+	scheduler, err := jobs.NewScheduler(daemonCfg, actions, s, statusPath)
+	if err != nil {
+		s.CloseDb()
+		fmt.Printf("Cannot schedule jobs %v\n", err)
+		os.Exit(0)
+	}
+	return s, fs, scheduler
+}
+
+// showStatus prints the status of the daemon of the catalog, or the job
+// history if no daemon ran yet
+func showStatus(sourcePath *string) {
+	status, err := jobs.ReadStatus(statusPathOf(*sourcePath))
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No daemon ran for this catalog\n")
+		// the catalog is free, no daemon holds it
+		s, err := openSourceDb(*sourcePath)
+		if err != nil {
+			fmt.Printf("Cannot open source db %v", err)
+			os.Exit(0)
+		}
+		defer s.CloseDb()
+		runs, err := s.GetRuns(20)
+		if err != nil {
+			log.Printf("Cannot read job history %v", err)
+			os.Exit(5)
+		}
+		printRuns(runs)
+		return
+	}
+	if err != nil {
+		log.Printf("Cannot read daemon status %v", err)
+		os.Exit(5)
+	}
+	switch {
+	case status.Stopped:
+		fmt.Printf("daemon %d stopped, last status %v\n", status.PID, status.UpdatedAt.Format(time.RFC3339))
+	case status.Stale(time.Now()):
+		fmt.Printf("daemon %d did not update its status since %v, it may have crashed\n", status.PID, status.UpdatedAt.Format(time.RFC3339))
+	default:
+		fmt.Printf("daemon %d running since %v\n", status.PID, status.StartedAt.Format(time.RFC3339))
+	}
+	if status.Running != nil {
+		fmt.Printf("running: %v (%v) since %v\n", status.Running.Job, status.Running.Action, status.Running.StartedAt.Format(time.RFC3339))
+	}
+	for _, run := range status.Queued {
+		fmt.Printf("queued: %v (%v) since %v\n", run.Job, run.Action, run.QueuedAt.Format(time.RFC3339))
+	}
+	for _, job := range status.Jobs {
+		next := "manual"
+		if !job.NextRun.IsZero() {
+			next = job.NextRun.Format(time.RFC3339)
+		}
+		last := "never ran"
+		if job.LastRun != nil {
+			last = fmt.Sprintf("last %v %v", job.LastRun.State, job.LastRun.StartedAt.Format(time.RFC3339))
+		}
+		fmt.Printf("job %v\t%v\t%q\tnext %v\t%v\n", job.Name, job.Action, job.Schedule, next, last)
+	}
+	printRuns(status.History)
+}
+
+func printRuns(runs []*jobs.Run) {
+	for _, run := range runs {
+		took := ""
+		if !run.StartedAt.IsZero() && !run.FinishedAt.IsZero() {
+			took = run.FinishedAt.Sub(run.StartedAt).Round(time.Second).String()
+		}
+		outcome := run.Summary
+		if run.Error != "" {
+			outcome = run.Error
+		}
+		fmt.Printf("%d\t%v\t%v\t%v\t%v\t%v\t%v\n", run.ID, run.Job, run.Trigger, run.State,
+			run.QueuedAt.Format(time.RFC3339), took, outcome)
+	}
+}
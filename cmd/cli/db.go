@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"nextimagescrap/pkg/storage"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// dbOptions are applied to every source db opened by an action
+type dbOptions struct {
+	batchSize     int
+	batchInterval time.Duration
+	// catalogPath defaults to the catalog inside the source path
+	catalogPath string
+	// rootName is the name of the source path in the catalog
+	rootName string
+	// volumeMarker identifies the source path by a marker file written
+	// to it when its volume has no uuid or label
+	volumeMarker bool
+}
+
+var sourceDbOptions dbOptions
+
+// openSourceDb opens the source db with batched writes, which are
+// committed when the process is interrupted. sourcePath is added to the
+// catalog as source root.
+func openSourceDb(sourcePath string) (*storage.DbSourceStorage, error) {
+	s, err := openCatalog(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	closeOnSignal(s)
+	return s, nil
+}
+
+// catalogPathOf returns the path of the catalog of sourcePath
+func catalogPathOf(sourcePath string) string {
+	if sourceDbOptions.catalogPath != "" {
+		return sourceDbOptions.catalogPath
+	}
+	return storage.DefaultCatalogPath(sourcePath)
+}
+
+// openCatalog is openSourceDb leaving signals to the caller
+func openCatalog(sourcePath string) (*storage.DbSourceStorage, error) {
+	s, err := storage.NewCatalogDbStorage(catalogPathOf(sourcePath))
+	if err != nil {
+		return nil, err
+	}
+	if sourcePath != "" {
+		err = s.AddRoot(sourceDbOptions.rootName, sourcePath, sourceDbOptions.volumeMarker)
+		if err != nil {
+			s.CloseDb()
+			return nil, err
+		}
+	}
+	err = s.EnableBatching(sourceDbOptions.batchSize, sourceDbOptions.batchInterval)
+	if err != nil {
+		s.CloseDb()
+		return nil, err
+	}
+	return s, nil
+}
+
+// closeOnSignal commits pending writes and closes s on SIGINT or SIGTERM
+func closeOnSignal(s *storage.DbSourceStorage) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("received %v, closing source db", sig)
+		err := s.CloseDb()
+		if err != nil {
+			log.Printf("cannot close source db %v", err)
+		}
+		os.Exit(1)
+	}()
+}
@@ -7,11 +7,13 @@ import (
 	"nextimagescrap/pkg/imports"
 	"nextimagescrap/pkg/storage"
 	"os"
+	"strings"
+	"time"
 )
 
-func actionScanSourcepath(sourcePath *string) {
+func actionScanSourcepath(sourcePath *string, cfg imports.Config, options storage.SourceOptions) {
 	log.Printf(*sourcePath)
-	s, err := storage.NewSourceDbStorage(*sourcePath)
+	s, err := openSourceDb(*sourcePath)
 	if err != nil {
 		fmt.Printf("Cannot open source db %v", err)
 		os.Exit(0)
@@ -20,16 +22,20 @@ func actionScanSourcepath(sourcePath *string) {
 		err := s.CloseDb()
 		if err != nil {
 			fmt.Printf("Error closing db %v", err)
-			os.Exit(0)
+			os.Exit(5)
 		}
 	}(s)
 
-	fs, err := storage.NewSourceFileStorage(*sourcePath)
+	fs, err := storage.NewSourceFileStorageWithOptions(*sourcePath, options)
 	if err != nil {
 		fmt.Printf("Cannot not find sourceapth %v", err)
 		os.Exit(0)
 	}
-	importService := imports.NewService(fs, s)
+	fs.MountRoots(s.Roots())
+	if sourceDbOptions.catalogPath != "" {
+		fs.ExcludePath(sourceDbOptions.catalogPath)
+	}
+	importService := imports.NewConfiguredService(fs, s, nil, cfg)
 	err = importService.ScanSourceDirectory()
 	if err != nil {
 		log.Printf("%v", err)
@@ -43,9 +49,9 @@ func actionScanSourcepath(sourcePath *string) {
 
 }
 
-func actionComputeChecksum(sourcePath *string) {
+func actionComputeChecksum(sourcePath *string, cfg imports.Config) {
 	log.Printf(*sourcePath)
-	s, err := storage.NewSourceDbStorage(*sourcePath)
+	s, err := openSourceDb(*sourcePath)
 	if err != nil {
 		log.Printf("Cannot open source db %v", err)
 		os.Exit(0)
@@ -54,7 +60,7 @@ func actionComputeChecksum(sourcePath *string) {
 		err := s.CloseDb()
 		if err != nil {
 			log.Printf("cannot close source db %v", err)
-			os.Exit(0)
+			os.Exit(5)
 		}
 	}(s)
 
@@ -63,14 +69,15 @@ func actionComputeChecksum(sourcePath *string) {
 		log.Printf("Cannot not find sourceapth %v", err)
 		os.Exit(0)
 	}
-	importService := imports.NewService(fs, s)
+	fs.MountRoots(s.Roots())
+	importService := imports.NewConfiguredService(fs, s, nil, cfg)
 	err = importService.ComputeChecksums(false)
 	log.Printf("error %v", err)
 }
 
 func listAll(sourcePath *string) {
 	log.Printf(*sourcePath)
-	s, err := storage.NewSourceDbStorage(*sourcePath)
+	s, err := openSourceDb(*sourcePath)
 	if err != nil {
 		fmt.Printf("Cannot open source db %v", err)
 		os.Exit(0)
@@ -79,25 +86,73 @@ func listAll(sourcePath *string) {
 		err := s.CloseDb()
 		if err != nil {
 			log.Printf("cannot close source db %v", err)
-			os.Exit(0)
+			os.Exit(5)
 		}
 	}(s)
-	me, err := s.GetAllFiles()
+	version, err := s.SchemaVersion()
+	if err != nil {
+		fmt.Printf("Cannot read schema version %v", err)
+		os.Exit(0)
+	}
+	log.Printf("Schema version: %d", version)
+	roots := s.Roots()
+	for i := range roots {
+		log.Printf("Root %s: %v %v mounted: %v", roots[i].Name, roots[i].Path, roots[i].VolumeID, roots[i].Mounted)
+	}
+	i := 0
+	err = s.ForEachMedia(imports.MediaFilter{}, func(media *imports.SourceMedia) error {
+		if media.Id > 660 {
+			log.Printf("Entry: %d: %v", i, media)
+		}
+		i++
+		return nil
+	})
 	if err != nil {
 		fmt.Printf("Cannot get media entries %v", err)
 		os.Exit(0)
 	}
-	for i := range me {
-		if me[i].Id > 660 {
-			log.Printf("Entry: %d: %v", i, me[i])
+
+}
+
+func extractCreationDate(sourcePath *string, cfg imports.Config, force bool) {
+	log.Printf(*sourcePath)
+	s, err := openSourceDb(*sourcePath)
+	if err != nil {
+		fmt.Printf("Cannot open source db %v", err)
+		os.Exit(0)
+	}
+	defer func(s *storage.DbSourceStorage) {
+		err := s.CloseDb()
+		if err != nil {
+			log.Printf("cannot close source db %v", err)
+			os.Exit(5)
 		}
+	}(s)
+
+	fs, err := storage.NewSourceFileStorage(*sourcePath)
+	if err != nil {
+		fmt.Printf("Cannot not find sourceapth %v", err)
+		os.Exit(0)
+	}
+	fs.MountRoots(s.Roots())
+
+	importService := imports.NewConfiguredService(fs, s, nil, cfg)
+	err = importService.ExtractCreationDate(force)
+	if err != nil {
+		log.Printf("%v", err)
+		os.Exit(5)
 	}
 
 }
 
-func extractCreationDate(sourcePath *string) {
+func setCreationDate(sourcePath *string, selector imports.MediaSelector, date string) {
 	log.Printf(*sourcePath)
-	s, err := storage.NewSourceDbStorage(*sourcePath)
+	dt, err := parseDate(date)
+	if err != nil {
+		fmt.Printf("Cannot parse date %v", err)
+		os.Exit(0)
+	}
+	s, err := openSourceDb(*sourcePath)
 	if err != nil {
 		fmt.Printf("Cannot open source db %v", err)
 		os.Exit(0)
@@ -106,7 +161,7 @@ func extractCreationDate(sourcePath *string) {
 		err := s.CloseDb()
 		if err != nil {
 			log.Printf("cannot close source db %v", err)
-			os.Exit(0)
+			os.Exit(5)
 		}
 	}(s)
 
@@ -115,19 +170,34 @@ func extractCreationDate(sourcePath *string) {
 		fmt.Printf("Cannot not find sourceapth %v", err)
 		os.Exit(0)
 	}
+	fs.MountRoots(s.Roots())
 
 	importService := imports.NewService(fs, s)
-	err = importService.ExtractCreationDate(false)
+	count, err := importService.SetCreationDate(selector, dt)
+	log.Printf("set CreationDate %v for %d media", dt, count)
 	if err != nil {
 		log.Printf("%v", err)
 		os.Exit(5)
 	}
+}
 
+// parseDate accepts a date with optional time of day
+func parseDate(date string) (time.Time, error) {
+	layouts := []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+	var err error
+	for i := range layouts {
+		var dt time.Time
+		dt, err = time.Parse(layouts[i], date)
+		if err == nil {
+			return dt, nil
+		}
+	}
+	return time.Time{}, err
 }
 
-func reorganizeToFolder(sourcePath *string, destPath *string) {
+func reorganizeToFolder(sourcePath *string, destPath *string, cfg imports.Config, options storage.DestinationOptions) {
 	log.Printf(*sourcePath)
-	s, err := storage.NewSourceDbStorage(*sourcePath)
+	s, err := openSourceDb(*sourcePath)
 	if err != nil {
 		fmt.Printf("Cannot open source db %v", err)
 		os.Exit(0)
@@ -136,7 +206,7 @@ func reorganizeToFolder(sourcePath *string, destPath *string) {
 		err := s.CloseDb()
 		if err != nil {
 			log.Printf("cannot close source db %v", err)
-			os.Exit(0)
+			os.Exit(5)
 		}
 	}(s)
 
@@ -145,14 +215,15 @@ func reorganizeToFolder(sourcePath *string, destPath *string) {
 		fmt.Printf("Cannot not find sourceapth %v", err)
 		os.Exit(0)
 	}
+	fs.MountRoots(s.Roots())
 
-	dfs, err := storage.NewDestinationFileStorage(*destPath)
+	dfs, err := storage.NewDestinationFileStorageWithOptions(*destPath, options)
 	if err != nil {
 		fmt.Printf("Cannot not find destpath %v", err)
 		os.Exit(0)
 	}
 
-	organizeService := imports.NewOrganizeService(fs, s, dfs)
+	organizeService := imports.NewConfiguredService(fs, s, dfs, cfg)
 	err = organizeService.OrganizeToFolder()
 	if err != nil {
 		log.Printf("Error reornanize: %v", err)
@@ -161,23 +232,344 @@ func reorganizeToFolder(sourcePath *string, destPath *string) {
 	}
 }
 
+func checkCatalog(sourcePath *string, repair bool) {
+	log.Printf(*sourcePath)
+	s, err := openSourceDb(*sourcePath)
+	if err != nil {
+		fmt.Printf("Cannot open source db %v", err)
+		os.Exit(0)
+	}
+	defer func(s *storage.DbSourceStorage) {
+		err := s.CloseDb()
+		if err != nil {
+			log.Printf("cannot close source db %v", err)
+			os.Exit(5)
+		}
+	}(s)
+
+	report, err := s.Fsck(repair)
+	if err != nil {
+		log.Printf("Error fsck: %v", err)
+		os.Exit(5)
+	}
+	log.Printf("checked %d media, %d checksum groups, %d index entries, %d issues",
+		report.MediaChecked, report.ChecksumChecked, report.IndexChecked, len(report.Issues))
+	if len(report.Issues) > 0 && !repair {
+		log.Printf("run with -repair to fix")
+		os.Exit(1)
+	}
+}
+
+func exportCatalog(sourcePath *string, file string, format string) {
+	s, err := openSourceDb(*sourcePath)
+	if err != nil {
+		fmt.Printf("Cannot open source db %v", err)
+		os.Exit(0)
+	}
+	defer func(s *storage.DbSourceStorage) {
+		err := s.CloseDb()
+		if err != nil {
+			log.Printf("cannot close source db %v", err)
+			os.Exit(5)
+		}
+	}(s)
+
+	out := os.Stdout
+	if file != "" && file != "-" {
+		out, err = os.Create(file)
+		if err != nil {
+			log.Printf("Cannot create %v", err)
+			os.Exit(5)
+		}
+		defer out.Close()
+	}
+	count, err := s.ExportCatalog(out, catalogFormat(file, format))
+	if err != nil {
+		log.Printf("Error export catalog: %v", err)
+		os.Exit(5)
+	}
+	log.Printf("exported %d records", count)
+}
+
+func importCatalog(sourcePath *string, file string, format string) {
+	s, err := openSourceDb(*sourcePath)
+	if err != nil {
+		fmt.Printf("Cannot open source db %v", err)
+		os.Exit(0)
+	}
+	defer func(s *storage.DbSourceStorage) {
+		err := s.CloseDb()
+		if err != nil {
+			log.Printf("cannot close source db %v", err)
+			os.Exit(5)
+		}
+	}(s)
+
+	in := os.Stdin
+	if file != "" && file != "-" {
+		in, err = os.Open(file)
+		if err != nil {
+			log.Printf("Cannot open %v", err)
+			os.Exit(5)
+		}
+		defer in.Close()
+	}
+	report, err := s.ImportCatalog(in, catalogFormat(file, format))
+	if err != nil {
+		log.Printf("Error import catalog: %v", err)
+		os.Exit(5)
+	}
+	log.Printf("imported %d roots, %d new media, %d merged, %d unchanged, %d checksum groups",
+		report.Roots, report.Added, report.Merged, report.Unchanged, report.Checksums)
+}
+
+func mergeCatalog(sourcePath *string, otherCatalog string) {
+	s, err := openSourceDb(*sourcePath)
+	if err != nil {
+		fmt.Printf("Cannot open source db %v", err)
+		os.Exit(0)
+	}
+	defer func(s *storage.DbSourceStorage) {
+		err := s.CloseDb()
+		if err != nil {
+			log.Printf("cannot close source db %v", err)
+			os.Exit(5)
+		}
+	}(s)
+
+	report, err := s.MergeCatalog(otherCatalog)
+	if err != nil {
+		log.Printf("Error merge catalog: %v", err)
+		os.Exit(5)
+	}
+	for name, merged := range report.RootNames {
+		log.Printf("root %s merged into %s", name, merged)
+	}
+	log.Printf("merged %d new roots, %d new media of which %d duplicates, %d merged media with %d changed dates, %d unchanged",
+		report.Roots, report.Added, report.Duplicates, report.Merged, report.Dates, report.Unchanged)
+}
+
+func listFailures(sourcePath *string, destPath *string, cfg imports.Config, retry bool, options storage.SourceOptions, destOptions storage.DestinationOptions) {
+	s, err := openSourceDb(*sourcePath)
+	if err != nil {
+		fmt.Printf("Cannot open source db %v", err)
+		os.Exit(0)
+	}
+	defer func(s *storage.DbSourceStorage) {
+		err := s.CloseDb()
+		if err != nil {
+			log.Printf("cannot close source db %v", err)
+			os.Exit(5)
+		}
+	}(s)
+
+	if retry {
+		fs, err := storage.NewSourceFileStorageWithOptions(*sourcePath, options)
+		if err != nil {
+			fmt.Printf("Cannot not find sourceapth %v", err)
+			os.Exit(0)
+		}
+		fs.MountRoots(s.Roots())
+		if sourceDbOptions.catalogPath != "" {
+			fs.ExcludePath(sourceDbOptions.catalogPath)
+		}
+		var dfs imports.DestinationFileRepository
+		if *destPath != "" {
+			dfs, err = storage.NewDestinationFileStorageWithOptions(*destPath, destOptions)
+			if err != nil {
+				fmt.Printf("Cannot not find destpath %v", err)
+				os.Exit(0)
+			}
+		}
+		importService := imports.NewConfiguredService(fs, s, dfs, cfg)
+		retried, err := importService.RetryFailures()
+		if err != nil {
+			log.Printf("Error retry failures: %v", err)
+			os.Exit(5)
+		}
+		log.Printf("retried %d failures", retried)
+	}
+
+	count := 0
+	err = s.ForEachFailure(func(f *imports.Failure) error {
+		fmt.Printf("%s\t%s\t%d attempts\tfirst %s\tlast %s\t%s\n", f.Stage, f.Path, f.Attempts,
+			f.FirstFailedAt.Format(time.RFC3339), f.LastFailedAt.Format(time.RFC3339), f.Error)
+		count++
+		return nil
+	})
+	if err != nil {
+		log.Printf("Cannot list failures %v", err)
+		os.Exit(5)
+	}
+	log.Printf("%d failures", count)
+}
+
+func watchSource(sourcePath *string, destPath *string, cfg imports.Config, options storage.SourceOptions, destOptions storage.DestinationOptions, settle time.Duration) {
+	log.Printf(*sourcePath)
+	s, err := openSourceDb(*sourcePath)
+	if err != nil {
+		fmt.Printf("Cannot open source db %v", err)
+		os.Exit(0)
+	}
+	defer func(s *storage.DbSourceStorage) {
+		err := s.CloseDb()
+		if err != nil {
+			log.Printf("cannot close source db %v", err)
+			os.Exit(5)
+		}
+	}(s)
+
+	fs, err := storage.NewSourceFileStorageWithOptions(*sourcePath, options)
+	if err != nil {
+		fmt.Printf("Cannot not find sourceapth %v", err)
+		os.Exit(0)
+	}
+	fs.MountRoots(s.Roots())
+	if sourceDbOptions.catalogPath != "" {
+		fs.ExcludePath(sourceDbOptions.catalogPath)
+	}
+	var dfs imports.DestinationFileRepository
+	if *destPath != "" {
+		dfs, err = storage.NewDestinationFileStorageWithOptions(*destPath, destOptions)
+		if err != nil {
+			fmt.Printf("Cannot not find destpath %v", err)
+			os.Exit(0)
+		}
+	}
+	importService := imports.NewConfiguredService(fs, s, dfs, cfg)
+	// runs until interrupted, closeOnSignal commits the catalog
+	err = importService.Watch(settle, nil)
+	if err != nil {
+		log.Printf("Error watch: %v", err)
+		os.Exit(5)
+	}
+}
+
+// catalogFormat returns format, or the format of the file extension
+func catalogFormat(file string, format string) string {
+	if format != "" {
+		return format
+	}
+	if strings.HasSuffix(strings.ToLower(file), ".csv") {
+		return storage.CatalogFormatCsv
+	}
+	return storage.CatalogFormatJsonl
+}
+
+// stringList collects the values of a repeated flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
 	action := flag.String("action", "info", "action to do")
 	sourcePath := flag.String("sourcePath", "", "source path of photos")
 	destPath := flag.String("destPath", "", "dest path of photos")
+	mtimeFallback := flag.Bool("mtimeFallback", false, "use file modification time for undated media")
+	neighbourFallback := flag.Bool("neighbourFallback", false, "infer date of undated media from dated files in the same directory")
+	configPath := flag.String("config", "", "path of json config file")
+	flag.StringVar(&sourceDbOptions.catalogPath, "catalog", "", "path of the catalog db, defaults to .boltdb/source.db in sourcePath")
+	flag.StringVar(&sourceDbOptions.rootName, "root", storage.DefaultRootName, "name of sourcePath in the catalog")
+	flag.BoolVar(&sourceDbOptions.volumeMarker, "volumeMarker", false, "write a "+storage.VolumeMarkerName+" file to sourcePath when its volume has no uuid or label")
+	flag.IntVar(&sourceDbOptions.batchSize, "batchSize", 1000, "number of db writes per transaction, 1 disables batching")
+	flag.DurationVar(&sourceDbOptions.batchInterval, "batchInterval", 0, "time a batch of db writes waits for more writes, 0 commits once the previous batch is committed")
+	force := flag.Bool("force", false, "process media again that already have a result")
+	var keys stringList
+	flag.Var(&keys, "key", "key of media to set-date, may be repeated")
+	glob := flag.String("glob", "", "path glob of media to set-date")
+	dir := flag.String("dir", "", "directory of media to set-date")
+	writeDates := flag.Bool("writeDates", false, "write creation date into exported files or xmp sidecars")
+	file := flag.String("file", "", "file of export-catalog and import-catalog, - or empty for stdout and stdin, catalog db of merge-catalog")
+	format := flag.String("format", "", "catalog file format, jsonl or csv, defaults to the file extension")
+	repair := flag.Bool("repair", false, "fix the issues found by fsck")
+	date := flag.String("date", "", "date for set-date, as 2006-01-02 or 2006-01-02 15:04:05")
+	var includes, excludes stringList
+	flag.Var(&includes, "include", "glob of files scan-source catalogs, may be repeated")
+	flag.Var(&excludes, "exclude", "glob of files and directories scan-source skips, may be repeated")
+	minSize := flag.Int64("minSize", 0, "minimum size in bytes of files scan-source catalogs")
+	maxSize := flag.Int64("maxSize", 0, "maximum size in bytes of files scan-source catalogs")
+	hidden := flag.Bool("hidden", false, "catalog hidden files and directories")
+	followSymlinks := flag.Bool("followSymlinks", false, "scan symlinked files and directories outside of sourcePath")
+	settle := flag.Duration("settle", 10*time.Second, "time without writes after which watch imports a new file")
+	listen := flag.String("listen", "localhost:8080", "address serve answers the api on")
+	retry := flag.Bool("retry", false, "retry the failures whose backoff passed before listing them, exports need -destPath")
 	flag.Parse()
 
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Cannot read config %v", err)
+		os.Exit(0)
+	}
+	if *mtimeFallback {
+		cfg.DateFallback.Mtime = true
+	}
+	if *neighbourFallback {
+		cfg.DateFallback.Neighbours = true
+	}
+	cfg.Scan.Include = append(cfg.Scan.Include, includes...)
+	cfg.Scan.Exclude = append(cfg.Scan.Exclude, excludes...)
+	if *minSize > 0 {
+		cfg.Scan.MinSize = *minSize
+	}
+	if *maxSize > 0 {
+		cfg.Scan.MaxSize = *maxSize
+	}
+	if *hidden {
+		cfg.Scan.Hidden = true
+	}
+
 	switch *action {
 	case "info":
 		listAll(sourcePath)
 	case "scan-source":
-		actionScanSourcepath(sourcePath)
+		actionScanSourcepath(sourcePath, cfg, storage.SourceOptions{FollowSymlinks: *followSymlinks})
 	case "compute-checksum":
-		actionComputeChecksum(sourcePath)
+		actionComputeChecksum(sourcePath, cfg)
 	case "extract-creationdate":
-		extractCreationDate(sourcePath)
+		extractCreationDate(sourcePath, cfg, *force)
+	case "set-date":
+		setCreationDate(sourcePath, imports.MediaSelector{Keys: keys, Glob: *glob, Dir: *dir}, *date)
 	case "reorganize":
-		reorganizeToFolder(sourcePath, destPath)
+		reorganizeToFolder(sourcePath, destPath, cfg, storage.DestinationOptions{WriteDates: *writeDates})
+	case "fsck":
+		checkCatalog(sourcePath, *repair)
+	case "export-catalog":
+		exportCatalog(sourcePath, *file, *format)
+	case "import-catalog":
+		importCatalog(sourcePath, *file, *format)
+	case "merge-catalog":
+		mergeCatalog(sourcePath, *file)
+	case "watch":
+		watchSource(sourcePath, destPath, cfg, storage.SourceOptions{FollowSymlinks: *followSymlinks},
+			storage.DestinationOptions{WriteDates: *writeDates}, *settle)
+	case "daemon":
+		daemonCfg, err := loadDaemonConfig(*configPath)
+		if err != nil {
+			fmt.Printf("Cannot read config %v", err)
+			os.Exit(0)
+		}
+		runDaemon(sourcePath, destPath, cfg, daemonCfg, storage.SourceOptions{FollowSymlinks: *followSymlinks},
+			storage.DestinationOptions{WriteDates: *writeDates})
+	case "serve":
+		daemonCfg, err := loadDaemonConfig(*configPath)
+		if err != nil {
+			fmt.Printf("Cannot read config %v", err)
+			os.Exit(0)
+		}
+		serveApi(sourcePath, destPath, *listen, cfg, daemonCfg, storage.SourceOptions{FollowSymlinks: *followSymlinks},
+			storage.DestinationOptions{WriteDates: *writeDates})
+	case "status":
+		showStatus(sourcePath)
+	case "failures":
+		listFailures(sourcePath, destPath, cfg, *retry, storage.SourceOptions{FollowSymlinks: *followSymlinks},
+			storage.DestinationOptions{WriteDates: *writeDates})
 	default:
 		fmt.Printf("Nothing to do\n")
 		fmt.Printf("Nothing to do\n")
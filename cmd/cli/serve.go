@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"nextimagescrap/pkg/api"
+	"nextimagescrap/pkg/imports"
+	"nextimagescrap/pkg/jobs"
+	"nextimagescrap/pkg/storage"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serveActions are the actions the API can start, each gets a job of the
+// same name unless the config has one
+var serveActions = []string{jobActionScan, jobActionHash, jobActionDate, jobActionOrganize}
+
+// serveShutdownTimeout is how long requests may take to finish on shutdown
+const serveShutdownTimeout = 10 * time.Second
+
+// serveApi runs the jobs of the Daemon section of the config like the
+// daemon and answers the API and the web UI on addr until SIGINT or SIGTERM
+func serveApi(sourcePath *string, destPath *string, addr string, cfg imports.Config, daemonCfg jobs.Config, options storage.SourceOptions, destOptions storage.DestinationOptions) {
+	for _, action := range serveActions {
+		if action == jobActionOrganize && *destPath == "" {
+			continue
+		}
+		configured := false
+		for _, job := range daemonCfg.Jobs {
+			configured = configured || job.Name == action
+		}
+		if !configured {
+			daemonCfg.Jobs = append(daemonCfg.Jobs, jobs.JobConfig{Name: action, Action: action})
+		}
+	}
+	log.Printf(*sourcePath)
+	s, fs, scheduler := openScheduler(sourcePath, destPath, cfg, daemonCfg, options, destOptions)
+	defer func(s *storage.DbSourceStorage) {
+		err := s.CloseDb()
+		if err != nil {
+			log.Printf("cannot close source db %v", err)
+			os.Exit(5)
+		}
+	}(s)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Cannot listen on %v: %v", addr, err)
+		return
+	}
+	server := &http.Server{Handler: api.NewServer(s, fs, scheduler, s)}
+	stop := make(chan struct{})
+	// the server stops first, so no run is started after the jobs stopped
+	shutdown := func(reason string) {
+		log.Printf("%v, stopping the server", reason)
+		ctx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("cannot stop the server: %v", err)
+		}
+		close(stop)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ln)
+	}()
+	go func() {
+		select {
+		case sig := <-sigs:
+			shutdown(fmt.Sprintf("received %v", sig))
+		case err := <-served:
+			shutdown(fmt.Sprintf("server failed: %v", err))
+		}
+	}()
+	log.Printf("serving the api on %v", ln.Addr())
+	err = scheduler.Run(stop)
+	if err != nil {
+		log.Printf("Error serve: %v", err)
+		os.Exit(5)
+	}
+	log.Printf("server stopped")
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"nextimagescrap/pkg/imports"
+	"strconv"
+)
+
+// DuplicateGroup is the API form of a checksum group of more than one media
+type DuplicateGroup struct {
+	Checksum  string   `json:"checksum"`
+	Redundant int      `json:"redundant"`
+	Media     []*Media `json:"media"`
+}
+
+// errPageFull stops an iteration once a page is complete
+var errPageFull = errors.New("page full")
+
+// handleDuplicates answers GET /api/duplicates with a page of duplicate
+// groups in checksum order, the cursor is the last checksum of a page
+func (s *Server) handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	limit, err := pageSize(r)
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	after := r.URL.Query().Get("cursor")
+	items := []*DuplicateGroup{}
+	more := false
+	err = imports.ForEachDuplicate(s.sdr, after, func(group *imports.DuplicateGroup) error {
+		if len(items) == limit {
+			more = true
+			return errPageFull
+		}
+		g := &DuplicateGroup{Checksum: group.Checksum, Redundant: group.Redundant()}
+		for _, media := range group.Media {
+			m := newMedia(media)
+			m.Duplicate = true
+			g.Media = append(g.Media, m)
+		}
+		items = append(items, g)
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		writeFailure(w, r, err)
+		return
+	}
+	p := page{Items: items}
+	if more {
+		p.Next = items[len(items)-1].Checksum
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// Stats counts the media of the catalog
+type Stats struct {
+	Media int `json:"media"`
+	// ByDateSource counts undated media as "none" and media dated before
+	// the source was tracked as "unknown"
+	ByDateSource map[string]int `json:"byDateSource"`
+	ByMimetype   map[string]int `json:"byMimetype"`
+	ByState      map[string]int `json:"byState"`
+	// ByYear and ByMonth count the media by the year and the month, as
+	// "2006-01", of their CreationDate
+	ByYear          map[string]int `json:"byYear"`
+	ByMonth         map[string]int `json:"byMonth"`
+	DuplicateGroups int            `json:"duplicateGroups"`
+	RedundantMedia  int            `json:"redundantMedia"`
+	Failures        int            `json:"failures"`
+}
+
+// handleStats answers GET /api/stats
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	stats := &Stats{
+		ByDateSource: make(map[string]int),
+		ByMimetype:   make(map[string]int),
+		ByState:      make(map[string]int),
+		ByYear:       make(map[string]int),
+		ByMonth:      make(map[string]int),
+	}
+	err := s.sdr.ForEachMedia(imports.MediaFilter{}, func(media *imports.SourceMedia) error {
+		stats.Media++
+		if media.CreationDate.IsZero() {
+			stats.ByDateSource["none"]++
+		} else {
+			source := string(media.DateSource)
+			if source == "" {
+				// dated before the source was tracked
+				source = "unknown"
+			}
+			stats.ByDateSource[source]++
+			stats.ByYear[strconv.Itoa(media.CreationDate.Year())]++
+			stats.ByMonth[media.CreationDate.Format("2006-01")]++
+		}
+		mimetype := media.Mimetype
+		if mimetype == "" {
+			mimetype = "unknown"
+		}
+		stats.ByMimetype[mimetype]++
+		for _, state := range media.States() {
+			stats.ByState[string(state)]++
+		}
+		return nil
+	})
+	if err == nil {
+		err = imports.ForEachDuplicate(s.sdr, "", func(group *imports.DuplicateGroup) error {
+			stats.DuplicateGroups++
+			stats.RedundantMedia += group.Redundant()
+			return nil
+		})
+	}
+	if err == nil {
+		err = s.sdr.ForEachFailure(func(f *imports.Failure) error {
+			stats.Failures++
+			return nil
+		})
+	}
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
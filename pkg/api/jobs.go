@@ -0,0 +1,195 @@
+package api
+
+import (
+	"net/http"
+	"nextimagescrap/pkg/jobs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Run is the API form of a run of a job
+type Run struct {
+	ID         uint64       `json:"id"`
+	Job        string       `json:"job"`
+	Action     string       `json:"action"`
+	Trigger    jobs.Trigger `json:"trigger"`
+	State      jobs.State   `json:"state"`
+	QueuedAt   time.Time    `json:"queuedAt"`
+	StartedAt  *time.Time   `json:"startedAt,omitempty"`
+	FinishedAt *time.Time   `json:"finishedAt,omitempty"`
+	Summary    string       `json:"summary,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+func newRun(run *jobs.Run) *Run {
+	if run == nil {
+		return nil
+	}
+	return &Run{
+		ID:         run.ID,
+		Job:        run.Job,
+		Action:     run.Action,
+		Trigger:    run.Trigger,
+		State:      run.State,
+		QueuedAt:   run.QueuedAt,
+		StartedAt:  timeOrNil(run.StartedAt),
+		FinishedAt: timeOrNil(run.FinishedAt),
+		Summary:    run.Summary,
+		Error:      run.Error,
+	}
+}
+
+func newRuns(runs []*jobs.Run) []*Run {
+	items := make([]*Run, 0, len(runs))
+	for _, run := range runs {
+		items = append(items, newRun(run))
+	}
+	return items
+}
+
+// Job is a job which can be started through the API
+type Job struct {
+	Name     string `json:"name"`
+	Action   string `json:"action"`
+	Schedule string `json:"schedule,omitempty"`
+	// NextRun is unset for jobs which only run when started
+	NextRun *time.Time `json:"nextRun,omitempty"`
+	LastRun *Run       `json:"lastRun,omitempty"`
+}
+
+// JobsStatus is the state of the jobs
+type JobsStatus struct {
+	Running *Run   `json:"running,omitempty"`
+	Queued  []*Run `json:"queued"`
+	Jobs    []*Job `json:"jobs"`
+}
+
+// handleJobs answers GET /api/jobs with the jobs and the running and
+// queued runs
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	status, err := s.runner.Status()
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	js := &JobsStatus{
+		Running: newRun(status.Running),
+		Queued:  newRuns(status.Queued),
+		Jobs:    []*Job{},
+	}
+	for _, j := range status.Jobs {
+		js.Jobs = append(js.Jobs, &Job{
+			Name:     j.Name,
+			Action:   j.Action,
+			Schedule: j.Schedule,
+			NextRun:  timeOrNil(j.NextRun),
+			LastRun:  newRun(j.LastRun),
+		})
+	}
+	writeJSON(w, http.StatusOK, js)
+}
+
+// handleJobRuns answers POST /api/jobs/{name}/runs by queuing a run of
+// the job. The run is returned with status 202 and its location, or with
+// status 409 if it was skipped as the job is queued or running already.
+func (s *Server) handleJobRuns(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+	if !strings.HasSuffix(name, "/runs") {
+		writeError(w, http.StatusNotFound, "no such resource")
+		return
+	}
+	name = strings.TrimSuffix(name, "/runs")
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	status, err := s.runner.Status()
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	if status.Stopped {
+		writeError(w, http.StatusServiceUnavailable, "the jobs are stopped")
+		return
+	}
+	known := false
+	for _, j := range status.Jobs {
+		known = known || j.Name == name
+	}
+	if !known {
+		writeError(w, http.StatusNotFound, "no job "+strconv.Quote(name))
+		return
+	}
+	run, err := s.runner.Trigger(name)
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	if run.State == jobs.StateSkipped {
+		writeJSON(w, http.StatusConflict, newRun(run))
+		return
+	}
+	w.Header().Set("Location", "/api/runs/"+strconv.FormatUint(run.ID, 10))
+	writeJSON(w, http.StatusAccepted, newRun(run))
+}
+
+// handleRuns answers GET /api/runs with a page of runs, the latest first,
+// the cursor is the id of the last run of a page
+func (s *Server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	limit, err := pageSize(r)
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	var before uint64
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		before, err = strconv.ParseUint(v, 10, 64)
+		if err != nil || before == 0 {
+			writeFailure(w, r, badRequest("invalid cursor "+strconv.Quote(v)))
+			return
+		}
+	}
+	// one more run tells whether there is a next page
+	runs, err := s.history.GetRunsBefore(before, limit+1)
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	p := page{}
+	if len(runs) > limit {
+		runs = runs[:limit]
+		p.Next = strconv.FormatUint(runs[limit-1].ID, 10)
+	}
+	p.Items = newRuns(runs)
+	writeJSON(w, http.StatusOK, p)
+}
+
+// handleRun answers GET /api/runs/{id}, which is polled for the state of
+// a started run
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	v := strings.TrimPrefix(r.URL.Path, "/api/runs/")
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "no run "+strconv.Quote(v))
+		return
+	}
+	run, err := s.history.GetRun(id)
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	if run == nil {
+		writeError(w, http.StatusNotFound, "no run "+strconv.Quote(v))
+		return
+	}
+	writeJSON(w, http.StatusOK, newRun(run))
+}
@@ -0,0 +1,347 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"nextimagescrap/pkg/imports"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media is the API form of a cataloged media
+type Media struct {
+	Key                  string               `json:"key"`
+	Path                 string               `json:"path"`
+	Root                 string               `json:"root,omitempty"`
+	RelPath              string               `json:"relPath,omitempty"`
+	Mimetype             string               `json:"mimetype,omitempty"`
+	Checksum             string               `json:"checksum,omitempty"`
+	CreationDate         *time.Time           `json:"creationDate,omitempty"`
+	DateSource           imports.DateSource   `json:"dateSource,omitempty"`
+	DateConfidence       int                  `json:"dateConfidence"`
+	OriginalCreationDate *time.Time           `json:"originalCreationDate,omitempty"`
+	ClockOffset          string               `json:"clockOffset,omitempty"`
+	Camera               *Camera              `json:"camera,omitempty"`
+	Sidecar              string               `json:"sidecar,omitempty"`
+	Description          string               `json:"description,omitempty"`
+	People               []string             `json:"people,omitempty"`
+	Location             *Location            `json:"location,omitempty"`
+	ExportedPath         string               `json:"exportedPath,omitempty"`
+	ExportedAt           *time.Time           `json:"exportedAt,omitempty"`
+	States               []imports.MediaState `json:"states"`
+	// Duplicate is set when another media has the same checksum
+	Duplicate bool `json:"duplicate"`
+	// Duplicates holds the keys of the other media with the same
+	// checksum, it is only set for a single media
+	Duplicates []string `json:"duplicates,omitempty"`
+}
+
+// Camera identifies the camera that recorded a media
+type Camera struct {
+	Make   string `json:"make,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Serial string `json:"serial,omitempty"`
+}
+
+// Location is where a media was recorded, in degrees and meters
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+func newMedia(sm *imports.SourceMedia) *Media {
+	m := &Media{
+		Key:                  sm.Key,
+		Path:                 sm.Path,
+		Root:                 sm.Root,
+		RelPath:              sm.RelPath,
+		Mimetype:             sm.Mimetype,
+		Checksum:             sm.Checksum,
+		CreationDate:         timeOrNil(sm.CreationDate),
+		DateSource:           sm.DateSource,
+		DateConfidence:       sm.DateConfidence(),
+		OriginalCreationDate: timeOrNil(sm.OriginalCreationDate),
+		Sidecar:              sm.Sidecar,
+		Description:          sm.Description,
+		People:               sm.People,
+		ExportedPath:         sm.ExportedPath,
+		ExportedAt:           timeOrNil(sm.ExportedAt),
+		States:               sm.States(),
+	}
+	if m.States == nil {
+		m.States = []imports.MediaState{}
+	}
+	if sm.ClockOffset != 0 {
+		m.ClockOffset = sm.ClockOffset.String()
+	}
+	if sm.Camera != (imports.CameraInfo{}) {
+		m.Camera = &Camera{Make: sm.Camera.Make, Model: sm.Camera.Model, Serial: sm.Camera.Serial}
+	}
+	if sm.Location != nil {
+		m.Location = &Location{Latitude: sm.Location.Latitude, Longitude: sm.Location.Longitude, Altitude: sm.Location.Altitude}
+	}
+	return m
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+var mediaStates = []imports.MediaState{imports.StateNeedsHash, imports.StateNeedsDate, imports.StateNotExported}
+
+var dateSources = []imports.DateSource{
+	imports.DateSourceExif, imports.DateSourceMetadata, imports.DateSourceSidecar, imports.DateSourceFilename,
+	imports.DateSourceMtime, imports.DateSourceNeighbour, imports.DateSourceManual,
+}
+
+// mediaQuery selects media by the catalog filter and the conditions the
+// catalog has no index for
+type mediaQuery struct {
+	filter imports.MediaFilter
+	// dateSource is "none" for undated media and "unknown" for media
+	// dated before the source was tracked
+	dateSource string
+	// duplicate is "true" or "false" to select media with or without
+	// another media of the same checksum
+	duplicate string
+}
+
+// parseMediaQuery reads the filter parameters mimetype, state, year,
+// month, dateSource and duplicate of r. mimetype may be repeated or list
+// several mimetypes separated by commas.
+func parseMediaQuery(r *http.Request) (*mediaQuery, error) {
+	q := r.URL.Query()
+	mq := &mediaQuery{}
+	for _, v := range q["mimetype"] {
+		for _, mt := range strings.Split(v, ",") {
+			if mt = strings.TrimSpace(mt); mt != "" {
+				mq.filter.Mimetypes = append(mq.filter.Mimetypes, mt)
+			}
+		}
+	}
+	if v := q.Get("state"); v != "" {
+		mq.filter.State = imports.MediaState(v)
+		if !containsState(mediaStates, mq.filter.State) {
+			return nil, badRequest("unknown state " + strconv.Quote(v))
+		}
+	}
+	var err error
+	mq.filter.Year, err = intParam(r, "year", 0, 1, 9999)
+	if err != nil {
+		return nil, err
+	}
+	mq.filter.Month, err = intParam(r, "month", 0, 1, 12)
+	if err != nil {
+		return nil, err
+	}
+	if mq.filter.Month != 0 && mq.filter.Year == 0 {
+		return nil, badRequest("month needs a year")
+	}
+	if v := q.Get("dateSource"); v != "" {
+		if v != "none" && v != "unknown" && !containsDateSource(dateSources, imports.DateSource(v)) {
+			return nil, badRequest("unknown dateSource " + strconv.Quote(v))
+		}
+		mq.dateSource = v
+	}
+	switch v := q.Get("duplicate"); v {
+	case "", "true", "false":
+		mq.duplicate = v
+	default:
+		return nil, badRequest("duplicate must be true or false")
+	}
+	return mq, nil
+}
+
+func containsState(states []imports.MediaState, state imports.MediaState) bool {
+	for i := range states {
+		if states[i] == state {
+			return true
+		}
+	}
+	return false
+}
+
+func containsDateSource(sources []imports.DateSource, source imports.DateSource) bool {
+	for i := range sources {
+		if sources[i] == source {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks the conditions of mq the catalog filter does not cover,
+// groups caches the group sizes of checksums
+func (s *Server) matches(mq *mediaQuery, media *imports.SourceMedia, groups map[string]int) (bool, error) {
+	if mq.dateSource != "" {
+		source := string(media.DateSource)
+		if media.CreationDate.IsZero() {
+			source = "none"
+		} else if source == "" {
+			source = "unknown"
+		}
+		if source != mq.dateSource {
+			return false, nil
+		}
+	}
+	if mq.duplicate != "" {
+		size, err := s.groupSize(media.Checksum, groups)
+		if err != nil {
+			return false, err
+		}
+		if (size > 1) != (mq.duplicate == "true") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// groupSize returns the number of media with checksum, cached in groups
+func (s *Server) groupSize(checksum string, groups map[string]int) (int, error) {
+	if checksum == "" {
+		return 0, nil
+	}
+	if size, ok := groups[checksum]; ok {
+		return size, nil
+	}
+	group, err := s.sdr.GetChecksum(checksum)
+	if err != nil {
+		return 0, err
+	}
+	size := 0
+	if group != nil {
+		size = len(group.Sources)
+	}
+	groups[checksum] = size
+	return size, nil
+}
+
+// handleMediaList answers GET /api/media with a page of the media
+// selected by the filter parameters, in catalog order
+func (s *Server) handleMediaList(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	mq, err := parseMediaQuery(r)
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	limit, err := pageSize(r)
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	items := []*Media{}
+	groups := make(map[string]int)
+	cursor := r.URL.Query().Get("cursor")
+	// pages are only asked for the missing items, so the cursor of the
+	// catalog always resumes after the last media looked at
+	for {
+		media, next, err := s.sdr.GetMediaPage(mq.filter, cursor, limit-len(items))
+		if err != nil {
+			if errors.Is(err, imports.ErrInvalidCursor) {
+				err = badRequest(err.Error())
+			}
+			writeFailure(w, r, err)
+			return
+		}
+		for _, sm := range media {
+			ok, err := s.matches(mq, sm, groups)
+			if err == nil && ok {
+				var size int
+				size, err = s.groupSize(sm.Checksum, groups)
+				m := newMedia(sm)
+				m.Duplicate = size > 1
+				items = append(items, m)
+			}
+			if err != nil {
+				writeFailure(w, r, err)
+				return
+			}
+		}
+		cursor = next
+		if cursor == "" || len(items) == limit {
+			break
+		}
+	}
+	writeJSON(w, http.StatusOK, page{Items: items, Next: cursor})
+}
+
+// DateEdit is the body of PATCH /api/media/{key}
+type DateEdit struct {
+	// CreationDate is stored as manual date, which no extracted date replaces
+	CreationDate time.Time `json:"creationDate"`
+}
+
+// handleMedia answers GET /api/media/{key} with the media and the keys
+// of its duplicates, PATCH sets its CreationDate
+func (s *Server) handleMedia(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/api/media/")
+	if key == "" {
+		writeError(w, http.StatusNotFound, "no media key")
+		return
+	}
+	if !allowMethods(w, r, http.MethodGet, http.MethodPatch) {
+		return
+	}
+	sm, err := s.sdr.GetFileByKey(key)
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	if sm == nil {
+		writeError(w, http.StatusNotFound, "no media with key "+strconv.Quote(key))
+		return
+	}
+	if r.Method == http.MethodPatch {
+		edit := DateEdit{}
+		err := json.NewDecoder(r.Body).Decode(&edit)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if edit.CreationDate.IsZero() {
+			writeError(w, http.StatusBadRequest, "no creationDate")
+			return
+		}
+		// as set-date does, the recorded date and clock offset are kept
+		sm.SetManualDate(edit.CreationDate)
+		_, err = s.sdr.SaveMedia(sm)
+		if err != nil {
+			writeFailure(w, r, err)
+			return
+		}
+		log.Printf("set manual CreationDate %v of %v", sm.CreationDate, sm.Key)
+	}
+	m := newMedia(sm)
+	if sm.Checksum != "" {
+		group, err := s.sdr.GetChecksum(sm.Checksum)
+		if err != nil {
+			writeFailure(w, r, err)
+			return
+		}
+		if group != nil {
+			for _, name := range group.Sources {
+				// the group may name media by another form of their key
+				other, err := s.sdr.GetFileByKey(name)
+				if err != nil {
+					writeFailure(w, r, err)
+					return
+				}
+				if other != nil && other.Key != sm.Key {
+					m.Duplicates = append(m.Duplicates, other.Key)
+				}
+			}
+		}
+	}
+	m.Duplicate = len(m.Duplicates) > 0
+	writeJSON(w, http.StatusOK, m)
+}
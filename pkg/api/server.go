@@ -0,0 +1,185 @@
+// Package api serves the catalog and the jobs of the import service as a
+// JSON HTTP API, and a web UI on top of it. Server is an http.Handler, it
+// can be run by net/http or driven with httptest.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"nextimagescrap/pkg/imports"
+	"nextimagescrap/pkg/jobs"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Jobs runs the jobs behind the API, as jobs.Scheduler does
+type Jobs interface {
+	// Trigger queues a run of the job name
+	Trigger(name string) (*jobs.Run, error)
+	Status() (*jobs.Status, error)
+}
+
+// Server answers the API requests on the catalog sdr, thumbnails are made
+// of the files of sfr. Jobs are started with runner, their runs are
+// looked up in history.
+type Server struct {
+	sdr        imports.SourceDbRepository
+	sfr        imports.SourceFileRepository
+	runner     Jobs
+	history    jobs.History
+	thumbnails thumbnailCache
+	// decodes holds a token while an image is decoded for a thumbnail
+	decodes chan struct{}
+	mux     *http.ServeMux
+}
+
+// NewServer returns the API on the catalog sdr and the jobs of runner.
+// sfr may be nil, there are no thumbnails then.
+func NewServer(sdr imports.SourceDbRepository, sfr imports.SourceFileRepository, runner Jobs, history jobs.History) *Server {
+	s := &Server{
+		sdr:     sdr,
+		sfr:     sfr,
+		runner:  runner,
+		history: history,
+		decodes: make(chan struct{}, 1),
+		mux:     http.NewServeMux(),
+	}
+	s.mux.Handle("/", uiHandler())
+	s.mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "no such resource")
+	})
+	s.mux.HandleFunc("/api/media", s.handleMediaList)
+	s.mux.HandleFunc("/api/media/", s.handleMedia)
+	s.mux.HandleFunc("/api/thumbnails/", s.handleThumbnail)
+	s.mux.HandleFunc("/api/duplicates", s.handleDuplicates)
+	s.mux.HandleFunc("/api/stats", s.handleStats)
+	s.mux.HandleFunc("/api/jobs", s.handleJobs)
+	s.mux.HandleFunc("/api/jobs/", s.handleJobRuns)
+	s.mux.HandleFunc("/api/runs", s.handleRuns)
+	s.mux.HandleFunc("/api/runs/", s.handleRun)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		writeError(w, http.StatusForbidden, "cross-origin "+r.Method+" not allowed")
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// sameOrigin reports whether r only reads or comes from a page of this
+// server. Browsers send a POST of any site without asking the server
+// first, so changes are refused when the browser tells they come from
+// another origin. Clients which are no browser send neither header.
+func sameOrigin(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "":
+	case "same-origin", "none":
+		return true
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// page is a part of a listing, Next resumes it and is empty on the last page
+type page struct {
+	Items interface{} `json:"items"`
+	Next  string      `json:"next,omitempty"`
+}
+
+// apiError is the body of failed requests
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// errBadRequest marks errors caused by the parameters of a request
+var errBadRequest = errors.New("bad request")
+
+// badRequest returns an error answered with status 400
+func badRequest(msg string) error {
+	return &requestError{msg: msg}
+}
+
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func (e *requestError) Is(target error) bool {
+	return target == errBadRequest
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("cannot write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
+
+// writeFailure answers err, status 400 for bad parameters and 500 otherwise
+func writeFailure(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errBadRequest) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("%v %v failed: %v", r.Method, r.URL.Path, err)
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+// allowMethods answers 405 unless the request uses one of methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method "+r.Method+" not allowed")
+	return false
+}
+
+// pageSize returns the limit parameter of r, defaultPageSize if missing
+func pageSize(r *http.Request) (int, error) {
+	return intParam(r, "limit", defaultPageSize, 1, maxPageSize)
+}
+
+// intParam returns the parameter name of r, def if it is missing
+func intParam(r *http.Request, name string, def, min, max int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		return 0, badRequest(name + " must be a number from " + strconv.Itoa(min) + " to " + strconv.Itoa(max))
+	}
+	return n, nil
+}
@@ -0,0 +1,472 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"nextimagescrap/pkg/imports"
+	"nextimagescrap/pkg/jobs"
+	"nextimagescrap/pkg/storage"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMedia is cataloged by newTestCatalog, the media 1 and 2, 4 and 6,
+// and 7 and 8 are duplicates
+var testMedia = []struct {
+	path       string
+	mimetype   string
+	checksum   string
+	date       string
+	dateSource imports.DateSource
+}{
+	{"/p/1.jpg", "image/jpeg", "aa", "2020-01-05T10:00:00Z", imports.DateSourceExif},
+	{"/p/2.jpg", "image/jpeg", "aa", "2020-01-06T10:00:00Z", imports.DateSourceExif},
+	{"/p/3.jpg", "image/jpeg", "bb", "2020-02-01T10:00:00Z", imports.DateSourceFilename},
+	{"/p/4.jpg", "image/jpeg", "cc", "", ""},
+	// dated before the source was tracked
+	{"/p/5.png", "image/png", "dd", "2021-03-01T10:00:00Z", ""},
+	{"/p/6.jpg", "image/jpeg", "cc", "2019-07-01T10:00:00Z", imports.DateSourceManual},
+	{"/p/7.jpg", "image/jpeg", "ff", "", ""},
+	{"/p/8.jpg", "image/jpeg", "ff", "", ""},
+}
+
+// newTestCatalog returns a catalog without root holding testMedia, so
+// the key of a media is "source:" and its path
+func newTestCatalog(t *testing.T) *storage.DbSourceStorage {
+	t.Helper()
+	s, err := storage.NewCatalogDbStorage(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		err := s.CloseDb()
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	for _, tm := range testMedia {
+		key, err := s.AddFile(tm.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		media, err := s.GetFileByKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		media.Mimetype = tm.mimetype
+		media.Checksum = tm.checksum
+		media.DateSource = tm.dateSource
+		if tm.date != "" {
+			media.CreationDate, err = time.Parse(time.RFC3339, tm.date)
+			if err != nil {
+				t.Fatal(err)
+			}
+			media.OriginalCreationDate = media.CreationDate
+		}
+		_, err = s.SaveMedia(media)
+		if err == nil {
+			err = s.AddChecksum(media)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// request sends a request to h and decodes the JSON answer into v unless
+// v is nil
+func request(t *testing.T, h http.Handler, method, target, body string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if v != nil {
+		err := json.Unmarshal(w.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("%v %v: %v in %q", method, target, err, w.Body.String())
+		}
+	}
+	return w
+}
+
+// mediaPath returns the path of the media with key
+func mediaPath(key string) string {
+	return "/api/media/" + url.PathEscape(key)
+}
+
+// listMedia follows the cursors of GET /api/media with query and returns
+// the paths of all media
+func listMedia(t *testing.T, h http.Handler, query string) []string {
+	t.Helper()
+	paths := []string{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(testMedia) {
+			t.Fatalf("%v does not stop paging", query)
+		}
+		target := "/api/media?" + query
+		if cursor != "" {
+			target += "&cursor=" + url.QueryEscape(cursor)
+		}
+		p := struct {
+			Items []*Media `json:"items"`
+			Next  string   `json:"next"`
+		}{}
+		w := request(t, h, http.MethodGet, target, "", &p)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %v: status %d", target, w.Code)
+		}
+		for _, m := range p.Items {
+			paths = append(paths, m.Path)
+		}
+		if p.Next == "" {
+			return paths
+		}
+		cursor = p.Next
+	}
+}
+
+func TestMediaPaging(t *testing.T) {
+	h := NewServer(newTestCatalog(t), nil, nil, nil)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"limit=3", []string{"/p/1.jpg", "/p/2.jpg", "/p/3.jpg", "/p/4.jpg", "/p/5.png", "/p/6.jpg", "/p/7.jpg", "/p/8.jpg"}},
+		{"limit=1&dateSource=exif", []string{"/p/1.jpg", "/p/2.jpg"}},
+		{"limit=1&dateSource=none", []string{"/p/4.jpg", "/p/7.jpg", "/p/8.jpg"}},
+		{"limit=1&dateSource=unknown", []string{"/p/5.png"}},
+		{"limit=2&duplicate=true", []string{"/p/1.jpg", "/p/2.jpg", "/p/4.jpg", "/p/6.jpg", "/p/7.jpg", "/p/8.jpg"}},
+		{"limit=1&duplicate=false", []string{"/p/3.jpg", "/p/5.png"}},
+		{"limit=1&dateSource=none&duplicate=true", []string{"/p/4.jpg", "/p/7.jpg", "/p/8.jpg"}},
+		{"limit=1&dateSource=manual&duplicate=false", []string{}},
+		{"limit=1&year=2020&month=1", []string{"/p/1.jpg", "/p/2.jpg"}},
+		{"mimetype=image/png,image/gif", []string{"/p/5.png"}},
+	}
+	for _, tt := range tests {
+		got := listMedia(t, h, tt.query)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("media of %v: %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	w := request(t, h, http.MethodGet, "/api/media?limit=2&duplicate=true", "", nil)
+	if !strings.Contains(w.Body.String(), `"duplicate":true`) {
+		t.Errorf("duplicates are not marked in %v", w.Body.String())
+	}
+}
+
+func TestDuplicatesPaging(t *testing.T) {
+	h := NewServer(newTestCatalog(t), nil, nil, nil)
+	checksums := []string{}
+	cursor := ""
+	for pages := 0; pages <= len(testMedia); pages++ {
+		target := "/api/duplicates?limit=2&cursor=" + url.QueryEscape(cursor)
+		p := struct {
+			Items []*DuplicateGroup `json:"items"`
+			Next  string            `json:"next"`
+		}{}
+		w := request(t, h, http.MethodGet, target, "", &p)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %v: status %d", target, w.Code)
+		}
+		for _, g := range p.Items {
+			if len(g.Media) != 2 || g.Redundant != 1 {
+				t.Errorf("group %v has %d media and %d redundant", g.Checksum, len(g.Media), g.Redundant)
+			}
+			checksums = append(checksums, g.Checksum)
+		}
+		if p.Next == "" {
+			break
+		}
+		cursor = p.Next
+	}
+	want := []string{"aa", "cc", "ff"}
+	if !reflect.DeepEqual(checksums, want) {
+		t.Errorf("duplicate groups %v, want %v", checksums, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s := newTestCatalog(t)
+	scheduler, err := jobs.NewScheduler(jobs.Config{Jobs: []jobs.JobConfig{{Name: "scan", Action: "scan"}}},
+		map[string]jobs.Action{"scan": func(ctx context.Context, job jobs.JobConfig) (string, error) { return "", nil }}, s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewServer(s, nil, scheduler, s)
+	key := mediaPath("source:/p/1.jpg")
+	tests := []struct {
+		method, target, body string
+		status               int
+		allow                string
+	}{
+		{http.MethodGet, "/api/media?limit=0", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/media?limit=x", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/media?state=bogus", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/media?month=1", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/media?dateSource=guess", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/media?duplicate=maybe", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/media?cursor=%21%21", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/duplicates?limit=100000", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/runs?limit=-1", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/runs?cursor=x", "", http.StatusBadRequest, ""},
+		{http.MethodPatch, key, "not json", http.StatusBadRequest, ""},
+		{http.MethodPatch, key, "{}", http.StatusBadRequest, ""},
+
+		{http.MethodGet, "/api/nothing", "", http.StatusNotFound, ""},
+		{http.MethodGet, mediaPath("source:/p/none.jpg"), "", http.StatusNotFound, ""},
+		{http.MethodPatch, mediaPath("source:/p/none.jpg"), `{"creationDate":"2020-01-01T00:00:00Z"}`, http.StatusNotFound, ""},
+		{http.MethodGet, "/api/thumbnails/" + url.PathEscape("source:/p/none.jpg"), "", http.StatusNotFound, ""},
+		{http.MethodPost, "/api/jobs/unknown/runs", "", http.StatusNotFound, ""},
+		{http.MethodPost, "/api/jobs/scan", "", http.StatusNotFound, ""},
+		{http.MethodGet, "/api/runs/999", "", http.StatusNotFound, ""},
+		{http.MethodGet, "/api/runs/x", "", http.StatusNotFound, ""},
+
+		{http.MethodPost, "/api/media", "", http.StatusMethodNotAllowed, "GET"},
+		{http.MethodDelete, key, "", http.StatusMethodNotAllowed, "GET, PATCH"},
+		{http.MethodPost, "/api/duplicates", "", http.StatusMethodNotAllowed, "GET"},
+		{http.MethodPut, "/api/stats", "", http.StatusMethodNotAllowed, "GET"},
+		{http.MethodPost, "/api/jobs", "", http.StatusMethodNotAllowed, "GET"},
+		{http.MethodGet, "/api/jobs/scan/runs", "", http.StatusMethodNotAllowed, "POST"},
+		{http.MethodDelete, "/api/runs/1", "", http.StatusMethodNotAllowed, "GET"},
+	}
+	for _, tt := range tests {
+		e := apiError{}
+		w := request(t, h, tt.method, tt.target, tt.body, &e)
+		if w.Code != tt.status {
+			t.Errorf("%v %v: status %d, want %d", tt.method, tt.target, w.Code, tt.status)
+		}
+		if e.Error == "" {
+			t.Errorf("%v %v: no error message", tt.method, tt.target)
+		}
+		if allow := w.Header().Get("Allow"); allow != tt.allow {
+			t.Errorf("%v %v: Allow %q, want %q", tt.method, tt.target, allow, tt.allow)
+		}
+	}
+}
+
+func TestEditDate(t *testing.T) {
+	h := NewServer(newTestCatalog(t), nil, nil, nil)
+	key := "source:/p/4.jpg"
+	m := Media{}
+	w := request(t, h, http.MethodPatch, mediaPath(key), `{"creationDate":"2018-05-06T07:08:09Z"}`, &m)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH status %d: %v", w.Code, w.Body.String())
+	}
+	want := time.Date(2018, 5, 6, 7, 8, 9, 0, time.UTC)
+	check := func(m *Media) {
+		t.Helper()
+		if m.CreationDate == nil || !m.CreationDate.Equal(want) || m.DateSource != imports.DateSourceManual {
+			t.Errorf("media has date %v from %q, want %v from %q", m.CreationDate, m.DateSource, want, imports.DateSourceManual)
+		}
+		if !reflect.DeepEqual(m.Duplicates, []string{"source:/p/6.jpg"}) {
+			t.Errorf("media has duplicates %v", m.Duplicates)
+		}
+	}
+	check(&m)
+
+	m = Media{}
+	w = request(t, h, http.MethodGet, mediaPath(key), "", &m)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET status %d", w.Code)
+	}
+	check(&m)
+
+	got := listMedia(t, h, "year=2018&dateSource=manual")
+	if !reflect.DeepEqual(got, []string{"/p/4.jpg"}) {
+		t.Errorf("media of 2018: %v", got)
+	}
+	got = listMedia(t, h, "dateSource=none")
+	if !reflect.DeepEqual(got, []string{"/p/7.jpg", "/p/8.jpg"}) {
+		t.Errorf("undated media: %v", got)
+	}
+}
+
+func TestJobRuns(t *testing.T) {
+	s := newTestCatalog(t)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	action := func(ctx context.Context, job jobs.JobConfig) (string, error) {
+		started <- struct{}{}
+		<-release
+		return "scanned", nil
+	}
+	scheduler, err := jobs.NewScheduler(jobs.Config{Jobs: []jobs.JobConfig{{Name: "scan", Action: "scan"}}},
+		map[string]jobs.Action{"scan": action}, s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- scheduler.Run(stop)
+	}()
+	h := NewServer(s, nil, scheduler, s)
+
+	run := Run{}
+	w := request(t, h, http.MethodPost, "/api/jobs/scan/runs", "", &run)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST status %d: %v", w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+	if run.Job != "scan" || run.Trigger != jobs.TriggerManual || location == "" {
+		t.Fatalf("started run %+v at %q", run, location)
+	}
+	<-started
+
+	// the job is running, so another run is skipped
+	skipped := Run{}
+	w = request(t, h, http.MethodPost, "/api/jobs/scan/runs", "", &skipped)
+	if w.Code != http.StatusConflict || skipped.State != jobs.StateSkipped {
+		t.Errorf("POST of a running job: status %d, run %+v", w.Code, skipped)
+	}
+	w = request(t, h, http.MethodGet, location, "", &run)
+	if w.Code != http.StatusOK || run.State != jobs.StateRunning {
+		t.Errorf("GET %v: status %d, run %+v", location, w.Code, run)
+	}
+	status := JobsStatus{}
+	request(t, h, http.MethodGet, "/api/jobs", "", &status)
+	if status.Running == nil || status.Running.ID != run.ID {
+		t.Errorf("running run is %+v, want %d", status.Running, run.ID)
+	}
+
+	close(release)
+	deadline := time.Now().Add(10 * time.Second)
+	for run.State != jobs.StateSucceeded {
+		if time.Now().After(deadline) {
+			t.Fatalf("run %+v did not succeed", run)
+		}
+		time.Sleep(10 * time.Millisecond)
+		w = request(t, h, http.MethodGet, location, "", &run)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %v: status %d", location, w.Code)
+		}
+	}
+	if run.Summary != "scanned" || run.FinishedAt == nil {
+		t.Errorf("finished run %+v", run)
+	}
+
+	runs := struct {
+		Items []*Run `json:"items"`
+	}{}
+	request(t, h, http.MethodGet, "/api/runs", "", &runs)
+	if len(runs.Items) != 2 || runs.Items[0].ID != skipped.ID || runs.Items[1].ID != run.ID {
+		t.Errorf("runs %+v, want the skipped and the succeeded run", runs.Items)
+	}
+
+	close(stop)
+	err = <-stopped
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = request(t, h, http.MethodPost, "/api/jobs/scan/runs", "", nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST once stopped: status %d", w.Code)
+	}
+}
+
+func TestRunsPaging(t *testing.T) {
+	s := newTestCatalog(t)
+	for i := 0; i < 5; i++ {
+		err := s.SaveRun(&jobs.Run{Job: "scan", Action: "scan", State: jobs.StateSucceeded})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewServer(s, nil, nil, s)
+	ids := []uint64{}
+	cursor := ""
+	for pages := 0; pages <= 5; pages++ {
+		target := "/api/runs?limit=2&cursor=" + url.QueryEscape(cursor)
+		p := struct {
+			Items []*Run `json:"items"`
+			Next  string `json:"next"`
+		}{}
+		w := request(t, h, http.MethodGet, target, "", &p)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %v: status %d", target, w.Code)
+		}
+		for _, run := range p.Items {
+			ids = append(ids, run.ID)
+		}
+		if p.Next == "" {
+			break
+		}
+		cursor = p.Next
+	}
+	want := []uint64{5, 4, 3, 2, 1}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("runs %v, want %v", ids, want)
+	}
+}
+
+func TestCrossOriginChanges(t *testing.T) {
+	s := newTestCatalog(t)
+	scheduler, err := jobs.NewScheduler(jobs.Config{Jobs: []jobs.JobConfig{{Name: "scan", Action: "scan"}}},
+		map[string]jobs.Action{"scan": func(ctx context.Context, job jobs.JobConfig) (string, error) { return "", nil }}, s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewServer(s, nil, scheduler, s)
+	send := func(method, target, body string, header map[string]string) int {
+		t.Helper()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for name, v := range header {
+			r.Header.Set(name, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	crossSite := map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "http://other.example"}
+	// browsers without Sec-Fetch-Site still send the origin
+	otherOrigin := map[string]string{"Origin": "http://other.example"}
+	key := mediaPath("source:/p/4.jpg")
+	tests := []struct {
+		method, target, body string
+		header               map[string]string
+	}{
+		{http.MethodPost, "/api/jobs/scan/runs", "", crossSite},
+		{http.MethodPost, "/api/jobs/scan/runs", "", otherOrigin},
+		{http.MethodPost, "/api/jobs/scan/runs", "", map[string]string{"Sec-Fetch-Site": "same-site"}},
+		{http.MethodPatch, key, `{"creationDate":"2018-05-06T07:08:09Z"}`, crossSite},
+	}
+	for _, tt := range tests {
+		if status := send(tt.method, tt.target, tt.body, tt.header); status != http.StatusForbidden {
+			t.Errorf("%v %v with %v: status %d, want %d", tt.method, tt.target, tt.header, status, http.StatusForbidden)
+		}
+	}
+	runs, err := s.GetRuns(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 0 {
+		t.Errorf("cross-origin requests queued %d runs", len(runs))
+	}
+	media, err := s.GetFileByKey("source:/p/4.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !media.CreationDate.IsZero() {
+		t.Errorf("cross-origin request set the date %v", media.CreationDate)
+	}
+
+	if status := send(http.MethodGet, "/api/runs", "", crossSite); status != http.StatusOK {
+		t.Errorf("cross-origin GET: status %d", status)
+	}
+	sameOrigin := map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://example.com"}
+	if status := send(http.MethodPost, "/api/jobs/scan/runs", "", sameOrigin); status != http.StatusAccepted {
+		t.Errorf("same-origin POST: status %d", status)
+	}
+	if status := send(http.MethodPatch, key, `{"creationDate":"2018-05-06T07:08:09Z"}`, map[string]string{"Origin": "http://example.com"}); status != http.StatusOK {
+		t.Errorf("PATCH from the own origin: status %d", status)
+	}
+}
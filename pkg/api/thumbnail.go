@@ -0,0 +1,240 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"nextimagescrap/pkg/imports"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// thumbnailSize is the longer side of thumbnails in pixels
+	thumbnailSize = 256
+	// thumbnailCacheSize is the number of thumbnails kept in memory
+	thumbnailCacheSize = 2000
+	// thumbnailSamples is the number of source pixels averaged along
+	// each side of a thumbnail pixel
+	thumbnailSamples = 4
+	// thumbnailMaxPixels is the size of the largest image thumbnails are
+	// made of, decoding it takes up to 4 bytes per pixel
+	thumbnailMaxPixels = 50 << 20
+)
+
+// errImageTooLarge is returned for images of more than thumbnailMaxPixels
+var errImageTooLarge = errors.New("the image is too large for a thumbnail")
+
+// thumbnailCache keeps the latest thumbnails by checksum, the oldest is
+// dropped when it is full
+type thumbnailCache struct {
+	mu    sync.Mutex
+	data  map[string][]byte
+	order []string
+}
+
+func (c *thumbnailCache) get(checksum string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.data[checksum]
+}
+
+func (c *thumbnailCache) put(checksum string, thumbnail []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data == nil {
+		c.data = make(map[string][]byte)
+	}
+	if _, ok := c.data[checksum]; ok {
+		return
+	}
+	if len(c.order) >= thumbnailCacheSize {
+		delete(c.data, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.data[checksum] = thumbnail
+	c.order = append(c.order, checksum)
+}
+
+// thumbnailable reports whether thumbnails of media can be made
+func thumbnailable(media *imports.SourceMedia) bool {
+	switch media.Mimetype {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// makeThumbnail decodes the image of media and returns it scaled down to
+// thumbnailSize as jpeg. Only one image is decoded at a time, as a large
+// image takes much memory.
+func (s *Server) makeThumbnail(ctx context.Context, media *imports.SourceMedia) ([]byte, error) {
+	select {
+	case s.decodes <- struct{}{}:
+		defer func() { <-s.decodes }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	f, err := s.sfr.GetSourceFile(media.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &readErrorReader{r: f}
+	// the header read for the size is decoded again with the image
+	var header bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, r.errOr(err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > thumbnailMaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d pixels", errImageTooLarge, cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, r.errOr(err)
+	}
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, scaleDown(src, thumbnailSize), &jpeg.Options{Quality: 80})
+	return buf.Bytes(), err
+}
+
+// readErrorReader keeps the first read error of r, which the image
+// decoders do not wrap
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// errOr returns the read error, or err if reading did not fail
+func (r *readErrorReader) errOr(err error) error {
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
+
+// scaleDown returns img fitted into a square of size pixels, averaging a
+// grid of samples of the source area of each pixel. Smaller images are
+// returned as they are.
+func scaleDown(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			var r, g, bl, n uint32
+			for sy := 0; sy < thumbnailSamples; sy++ {
+				py := b.Min.Y + (y*thumbnailSamples+sy)*h/(th*thumbnailSamples)
+				for sx := 0; sx < thumbnailSamples; sx++ {
+					px := b.Min.X + (x*thumbnailSamples+sx)*w/(tw*thumbnailSamples)
+					cr, cg, cb, _ := img.At(px, py).RGBA()
+					r, g, bl, n = r+cr, g+cg, bl+cb, n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(bl / n >> 8), A: 0xff})
+		}
+	}
+	return dst
+}
+
+// handleThumbnail answers GET /api/thumbnails/{key} with a jpeg thumbnail
+// of the media, for images only
+func (s *Server) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/api/thumbnails/")
+	media, err := s.sdr.GetFileByKey(key)
+	if err != nil {
+		writeFailure(w, r, err)
+		return
+	}
+	if media == nil {
+		writeError(w, http.StatusNotFound, "no media with key "+strconv.Quote(key))
+		return
+	}
+	if s.sfr == nil || !thumbnailable(media) {
+		writeError(w, http.StatusNotFound, "no thumbnail of "+media.Mimetype)
+		return
+	}
+	// the content of a media is known by its checksum, without one the
+	// thumbnail is made again each time
+	etag := ""
+	if media.Checksum != "" {
+		etag = strconv.Quote(media.Checksum)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	var thumbnail []byte
+	if media.Checksum != "" {
+		thumbnail = s.thumbnails.get(media.Checksum)
+	}
+	if thumbnail == nil {
+		thumbnail, err = s.makeThumbnail(r.Context(), media)
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "the file of the media is not available")
+			return
+		}
+		if errors.Is(err, errImageTooLarge) {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if errors.Is(err, imports.ErrFileBusy) {
+			// the archive streams another entry, which is over soon
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if r.Context().Err() != nil {
+			// the client is gone
+			return
+		}
+		if err != nil {
+			writeFailure(w, r, err)
+			return
+		}
+		if media.Checksum != "" {
+			s.thumbnails.put(media.Checksum, thumbnail)
+		}
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	}
+	w.Write(thumbnail)
+}
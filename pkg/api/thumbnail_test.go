@@ -0,0 +1,161 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"nextimagescrap/pkg/imports"
+	"nextimagescrap/pkg/storage"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testFile is a file of testFiles
+type testFile struct {
+	r     io.Reader
+	close func()
+}
+
+func (f *testFile) Stat() (fs.FileInfo, error) { return nil, fs.ErrInvalid }
+func (f *testFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+func (f *testFile) Close() error               { f.close(); return nil }
+
+// testFiles serves files by path and counts how many are open at once, a
+// file named "busy" fails as a tarball entry whose stream moved on
+type testFiles struct {
+	files   map[string][]byte
+	mu      sync.Mutex
+	open    int
+	maxOpen int
+}
+
+func (t *testFiles) GetSourceFiles(fn func(path string, info fs.DirEntry, err error) error) error {
+	return nil
+}
+
+func (t *testFiles) GetSourceFile(path string) (fs.File, error) {
+	var r io.Reader
+	if path == "busy" {
+		r = io.MultiReader(bytes.NewReader([]byte("GIF89a")), &busyReader{})
+	} else if content, ok := t.files[path]; ok {
+		r = bytes.NewReader(content)
+	} else {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open++
+	if t.open > t.maxOpen {
+		t.maxOpen = t.open
+	}
+	return &testFile{r: r, close: func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.open--
+	}}, nil
+}
+
+type busyReader struct{}
+
+func (r *busyReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("archive entry read after another entry was opened: %w", imports.ErrFileBusy)
+}
+
+// encodeImage returns a png image, or a gif image if gifImage is set
+func encodeImage(t *testing.T, w, h int, gifImage bool) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	var err error
+	if gifImage {
+		err = gif.Encode(&b, image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black, color.White}), nil)
+	} else {
+		err = png.Encode(&b, image.NewRGBA(image.Rect(0, 0, w, h)))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestThumbnails(t *testing.T) {
+	huge := encodeImage(t, 1, 1, true)
+	// the logical screen of the gif, which its config reports
+	copy(huge[6:10], []byte{0xff, 0xff, 0xff, 0xff})
+	files := &testFiles{files: map[string][]byte{"huge": huge}}
+	mimetypes := map[string]string{"huge": "image/gif", "busy": "image/gif"}
+	for i := 0; i < 8; i++ {
+		path := fmt.Sprintf("image%d", i)
+		files.files[path] = encodeImage(t, 600, 400, false)
+		mimetypes[path] = "image/png"
+	}
+
+	s, err := storage.NewCatalogDbStorage(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseDb()
+	for path, mimetype := range mimetypes {
+		key, err := s.AddFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		media, err := s.GetFileByKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		media.Mimetype = mimetype
+		_, err = s.SaveMedia(media)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewServer(s, files, nil, nil)
+	thumbnailPath := func(path string) string {
+		return "/api/thumbnails/" + url.PathEscape("source:"+path)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			w := request(t, h, http.MethodGet, thumbnailPath(path), "", nil)
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+				t.Errorf("thumbnail of %v: status %d, %v", path, w.Code, w.Body.String())
+				return
+			}
+			img, _, err := image.Decode(w.Body)
+			if err != nil {
+				t.Errorf("thumbnail of %v: %v", path, err)
+				return
+			}
+			if b := img.Bounds(); b.Dx() != thumbnailSize || b.Dy() != thumbnailSize*2/3 {
+				t.Errorf("thumbnail of %v is %v", path, b)
+			}
+		}(fmt.Sprintf("image%d", i))
+	}
+	wg.Wait()
+	if files.maxOpen != 1 {
+		t.Errorf("%d images decoded at once", files.maxOpen)
+	}
+
+	w := request(t, h, http.MethodGet, thumbnailPath("huge"), "", nil)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("thumbnail of a huge image: status %d", w.Code)
+	}
+	w = request(t, h, http.MethodGet, thumbnailPath("busy"), "", nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("thumbnail of a busy tarball entry: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if files.open != 0 {
+		t.Errorf("%d files left open", files.open)
+	}
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles is the web UI, a single page using the API
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiHandler serves the files of the web UI
+func uiHandler() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		// the embedded directory always exists
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
@@ -0,0 +1,402 @@
+'use strict';
+
+// the web UI of the catalog, a timeline of the media and the duplicate
+// groups, talking to the JSON API of the server
+
+const pageSize = 500;
+
+async function request(method, path, params, body) {
+  const url = new URL(path, location.href);
+  for (const [name, value] of Object.entries(params || {})) {
+    if (value !== '' && value !== undefined) {
+      url.searchParams.set(name, value);
+    }
+  }
+  const init = {method, headers: {}};
+  if (body !== undefined) {
+    init.headers['Content-Type'] = 'application/json';
+    init.body = JSON.stringify(body);
+  }
+  const resp = await fetch(url, init);
+  const data = await resp.json();
+  if (!resp.ok) {
+    throw new Error(data.error || resp.statusText);
+  }
+  return data;
+}
+
+// keyPath escapes the segments of a media key for use in a path
+function keyPath(key) {
+  return key.split('/').map(encodeURIComponent).join('/');
+}
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs || {})) {
+    if (name === 'class') {
+      e.className = value;
+    } else if (name.startsWith('on')) {
+      e.addEventListener(name.slice(2), value);
+    } else {
+      e.setAttribute(name, value);
+    }
+  }
+  for (const child of children) {
+    if (child !== null && child !== undefined) {
+      e.append(child);
+    }
+  }
+  return e;
+}
+
+function baseName(media) {
+  const path = media.relPath || media.path;
+  return path.slice(path.lastIndexOf('/') + 1);
+}
+
+// thumbnail returns the image of media, or a placeholder naming its type
+// if the server has no thumbnail of it
+function thumbnail(media) {
+  const placeholder = () => el('div', {class: 'placeholder'}, media.mimetype || 'unknown type');
+  if (!media.mimetype || !media.mimetype.startsWith('image/')) {
+    return placeholder();
+  }
+  const img = el('img', {loading: 'lazy', alt: baseName(media), src: '/api/thumbnails/' + keyPath(media.key)});
+  img.addEventListener('error', () => img.replaceWith(placeholder()));
+  return img;
+}
+
+// dates of the catalog are wall clock times, they are shown and edited
+// without converting them to the time zone of the browser
+const datePattern = /^(\d{4}-\d\d-\d\dT\d\d:\d\d(?::\d\d)?)(?:\.\d+)?(Z|[+-]\d\d:\d\d)?$/;
+
+function formatDate(iso) {
+  const m = iso && iso.match(datePattern);
+  return m ? m[1].replace('T', ' ') : '';
+}
+
+function badges(media) {
+  const list = [];
+  if (!media.creationDate) {
+    list.push(el('span', {class: 'badge'}, 'undated'));
+  } else if (media.dateSource === 'manual') {
+    list.push(el('span', {class: 'badge manual'}, 'manual'));
+  } else if (media.dateSource && media.dateSource !== 'exif' && media.dateSource !== 'metadata') {
+    list.push(el('span', {class: 'badge'}, media.dateSource));
+  }
+  if (media.duplicate) {
+    list.push(el('span', {class: 'badge duplicate'}, 'duplicate'));
+  }
+  return list;
+}
+
+async function refreshStats() {
+  const stats = await request('GET', '/api/stats');
+  document.getElementById('stats').textContent =
+    `${stats.media} media, ${stats.byDateSource.none || 0} undated, ` +
+    `${stats.duplicateGroups} duplicate groups, ${stats.failures} failures`;
+  return stats;
+}
+
+// timeline
+
+const timeline = {
+  stats: null,
+  // sections are the months still to load, the latest first
+  sections: [],
+  // generation is increased when the filters change, loads of an older
+  // generation are dropped
+  generation: 0,
+  loading: false,
+  // tiles maps media keys to their tiles, to update them after an edit
+  tiles: new Map(),
+};
+
+function filterParams() {
+  const form = document.getElementById('filters');
+  return {
+    mimetype: form.mimetype.value,
+    dateSource: form.dateSource.value,
+    duplicate: form.duplicate.value,
+  };
+}
+
+function resetTimeline() {
+  const params = filterParams();
+  timeline.generation++;
+  timeline.loading = false;
+  timeline.tiles.clear();
+  timeline.sections = [];
+  if (params.dateSource !== 'none') {
+    const months = Object.keys(timeline.stats.byMonth).sort().reverse();
+    for (const month of months) {
+      const [year, m] = month.split('-');
+      timeline.sections.push({label: month, params: {year, month: String(Number(m))}});
+    }
+  }
+  if (params.dateSource === '' || params.dateSource === 'none') {
+    timeline.sections.push({label: 'Undated', params: {dateSource: 'none'}});
+  }
+  document.getElementById('timeline').replaceChildren();
+  loadSections();
+}
+
+function sentinelVisible() {
+  if (document.getElementById('timeline-view').hidden) {
+    return false;
+  }
+  const rect = document.getElementById('timeline-end').getBoundingClientRect();
+  return rect.top < window.innerHeight + 800;
+}
+
+// loadSections loads months until the end of the timeline is out of sight
+async function loadSections() {
+  if (timeline.loading) {
+    return;
+  }
+  const generation = timeline.generation;
+  timeline.loading = true;
+  try {
+    while (generation === timeline.generation && timeline.sections.length > 0 && sentinelVisible()) {
+      const section = timeline.sections.shift();
+      const items = await loadSection(section);
+      if (generation !== timeline.generation) {
+        return;
+      }
+      if (items.length > 0) {
+        renderSection(section, items);
+      }
+    }
+    if (generation === timeline.generation && timeline.sections.length === 0 &&
+        document.getElementById('timeline').children.length === 0) {
+      document.getElementById('timeline').append(el('p', {class: 'status'}, 'No media match the filters.'));
+    }
+  } catch (err) {
+    document.getElementById('timeline').append(el('p', {class: 'status'}, 'Cannot load media: ' + err.message));
+  } finally {
+    if (generation === timeline.generation) {
+      timeline.loading = false;
+    }
+  }
+}
+
+async function loadSection(section) {
+  const params = {...filterParams(), ...section.params, limit: pageSize};
+  const items = [];
+  let cursor = '';
+  do {
+    const page = await request('GET', '/api/media', {...params, cursor});
+    items.push(...page.items);
+    cursor = page.next || '';
+  } while (cursor !== '');
+  items.sort((a, b) => (a.creationDate || '').localeCompare(b.creationDate || '') || a.key.localeCompare(b.key));
+  return items;
+}
+
+function renderSection(section, items) {
+  const grid = el('div', {class: 'grid'});
+  for (const media of items) {
+    grid.append(renderTile(media));
+  }
+  document.getElementById('timeline').append(
+    el('div', {class: 'month'}, el('h2', {}, section.label, ' ', el('small', {}, `${items.length} media`)), grid));
+}
+
+function renderTile(media) {
+  const tile = document.getElementById('tile').content.firstElementChild.cloneNode(true);
+  tile.querySelector('img').replaceWith(thumbnail(media));
+  updateTile(tile, media);
+  tile.addEventListener('click', () => showDetail(media.key));
+  tile.addEventListener('keydown', e => {
+    if (e.key === 'Enter') {
+      showDetail(media.key);
+    }
+  });
+  timeline.tiles.set(media.key, tile);
+  return tile;
+}
+
+function updateTile(tile, media) {
+  tile.title = media.path;
+  tile.querySelector('figcaption').replaceChildren(...badges(media), formatDate(media.creationDate) || baseName(media));
+}
+
+// detail and date editing
+
+async function showDetail(key) {
+  const dialog = document.getElementById('detail');
+  const body = document.getElementById('detail-body');
+  let media;
+  try {
+    media = await request('GET', '/api/media/' + keyPath(key));
+  } catch (err) {
+    body.replaceChildren(el('p', {class: 'status'}, 'Cannot load media: ' + err.message));
+    if (!dialog.open) {
+      dialog.showModal();
+    }
+    return;
+  }
+  body.replaceChildren(thumbnail(media), el('div', {class: 'info'}, metaTable(media), dateEditor(media), duplicateLinks(media)));
+  if (!dialog.open) {
+    dialog.showModal();
+  }
+}
+
+function metaRows(media) {
+  return [
+    ['Path', media.path],
+    ['Key', media.key],
+    ['Type', media.mimetype],
+    ['Date', formatDate(media.creationDate) || 'undated'],
+    ['Date source', media.dateSource || (media.creationDate ? 'unknown' : '')],
+    ['Recorded date', media.clockOffset ? `${formatDate(media.originalCreationDate)} (clock off by ${media.clockOffset})` : ''],
+    ['Camera', media.camera ? [media.camera.make, media.camera.model].filter(Boolean).join(' ') : ''],
+    ['Description', media.description],
+    ['People', (media.people || []).join(', ')],
+    ['Location', media.location ? `${media.location.latitude}, ${media.location.longitude}` : ''],
+    ['Checksum', media.checksum],
+    ['Exported', media.exportedPath],
+    ['Pending', media.states.join(', ')],
+  ];
+}
+
+function metaTable(media, reference) {
+  const table = el('table', {class: 'meta'});
+  const refRows = reference ? metaRows(reference) : null;
+  metaRows(media).forEach(([name, value], i) => {
+    if (!value && !(refRows && refRows[i][1])) {
+      return;
+    }
+    const differs = refRows && name !== 'Path' && name !== 'Key' && refRows[i][1] !== value;
+    table.append(el('tr', {}, el('th', {}, name), el('td', differs ? {class: 'differs'} : {}, value || '')));
+  });
+  return table;
+}
+
+function dateEditor(media) {
+  const m = media.creationDate && media.creationDate.match(datePattern);
+  const input = el('input', {type: 'datetime-local', step: '1', required: ''});
+  if (m) {
+    input.value = m[1].length === 16 ? m[1] + ':00' : m[1];
+  }
+  const zone = (m && m[2]) || 'Z';
+  const message = el('span', {class: 'message'});
+  const form = el('form', {class: 'date-edit'},
+    el('label', {}, 'Set date ', input),
+    el('button', {type: 'submit'}, 'Save'),
+    message);
+  form.addEventListener('submit', async e => {
+    e.preventDefault();
+    let value = input.value;
+    if (value.length === 16) {
+      value += ':00';
+    }
+    message.className = 'message';
+    message.textContent = 'saving…';
+    try {
+      const saved = await request('PATCH', '/api/media/' + keyPath(media.key), undefined, {creationDate: value + zone});
+      const tile = timeline.tiles.get(saved.key);
+      if (tile) {
+        updateTile(tile, saved);
+      }
+      refreshStats();
+      await showDetail(saved.key);
+    } catch (err) {
+      message.className = 'message error';
+      message.textContent = err.message;
+    }
+  });
+  return form;
+}
+
+function duplicateLinks(media) {
+  if (!media.duplicate) {
+    return null;
+  }
+  const list = el('ul');
+  for (const key of media.duplicates) {
+    list.append(el('li', {}, el('a', {class: 'key', onclick: () => showDetail(key)}, key)));
+  }
+  return el('div', {}, el('h4', {}, 'Same content as'), list);
+}
+
+// duplicate groups
+
+const duplicates = {cursor: '', loaded: false};
+
+async function loadGroups() {
+  const button = document.getElementById('more-groups');
+  button.disabled = true;
+  try {
+    const page = await request('GET', '/api/duplicates', {limit: 20, cursor: duplicates.cursor});
+    const groups = document.getElementById('groups');
+    for (const group of page.items) {
+      groups.append(renderGroup(group));
+    }
+    if (groups.children.length === 0) {
+      groups.append(el('p', {class: 'status'}, 'No duplicates in the catalog.'));
+    }
+    duplicates.cursor = page.next || '';
+    button.hidden = duplicates.cursor === '';
+  } catch (err) {
+    document.getElementById('groups').append(el('p', {class: 'status'}, 'Cannot load duplicates: ' + err.message));
+  } finally {
+    button.disabled = false;
+  }
+}
+
+// renderGroup shows the media of group side by side, metadata differing
+// from the first media is highlighted
+function renderGroup(group) {
+  const compare = el('div', {class: 'compare'});
+  for (const media of group.media) {
+    const image = thumbnail(media);
+    image.addEventListener('click', () => showDetail(media.key));
+    compare.append(el('div', {class: 'candidate'}, image, metaTable(media, media === group.media[0] ? null : group.media[0])));
+  }
+  return el('div', {class: 'group'},
+    el('h3', {}, `${group.checksum} · ${group.media.length} copies, ${group.redundant} redundant`), compare);
+}
+
+// navigation
+
+function showView() {
+  const view = location.hash === '#duplicates' ? 'duplicates' : 'timeline';
+  document.getElementById('timeline-view').hidden = view !== 'timeline';
+  document.getElementById('duplicates-view').hidden = view !== 'duplicates';
+  document.getElementById('nav-timeline').classList.toggle('active', view === 'timeline');
+  document.getElementById('nav-duplicates').classList.toggle('active', view === 'duplicates');
+  if (view === 'duplicates' && !duplicates.loaded) {
+    duplicates.loaded = true;
+    loadGroups();
+  }
+  if (view === 'timeline') {
+    loadSections();
+  }
+}
+
+async function init() {
+  try {
+    timeline.stats = await refreshStats();
+  } catch (err) {
+    document.getElementById('timeline').append(el('p', {class: 'status'}, 'Cannot reach the server: ' + err.message));
+    return;
+  }
+  const select = document.getElementById('filters').mimetype;
+  // media without detected mimetype are counted as unknown
+  for (const mimetype of Object.keys(timeline.stats.byMimetype).filter(m => m !== 'unknown').sort()) {
+    select.append(el('option', {value: mimetype}, `${mimetype} (${timeline.stats.byMimetype[mimetype]})`));
+  }
+  document.getElementById('filters').addEventListener('change', resetTimeline);
+  document.getElementById('more-groups').addEventListener('click', loadGroups);
+  new IntersectionObserver(entries => {
+    if (entries.some(e => e.isIntersecting)) {
+      loadSections();
+    }
+  }, {rootMargin: '800px'}).observe(document.getElementById('timeline-end'));
+  window.addEventListener('hashchange', showView);
+  resetTimeline();
+  showView();
+}
+
+init();
@@ -0,0 +1,113 @@
+package imports
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Config holds the optional behaviour of the import service
+type Config struct {
+	Scan             ScanConfig
+	Retry            RetryConfig
+	DateFallback     DateFallbackConfig
+	ClockCorrections []ClockCorrection
+}
+
+// DateFallbackConfig switches on the low-confidence date sources used
+// for media without exif data or a date in the filename
+type DateFallbackConfig struct {
+	// Mtime uses the filesystem modification time
+	Mtime bool
+	// Neighbours uses the median date of the dated files in the same
+	// directory, if they cluster tightly
+	Neighbours bool
+	// NeighbourMinCount is the minimum number of dated files required
+	NeighbourMinCount int
+	// NeighbourMaxSpread is the maximum distance between the oldest and
+	// newest dated file
+	NeighbourMaxSpread Duration
+}
+
+// ClockCorrection shifts the exif dates of one camera whose clock was
+// set wrong. Empty camera fields match any value, a zero From or To
+// leaves the date range open on that side.
+type ClockCorrection struct {
+	Make   string
+	Model  string
+	Serial string
+	From   time.Time
+	To     time.Time
+	// Offset is added to the recorded date
+	Offset Duration
+}
+
+// Duration is a time.Duration written as "1h5m" in the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+const defaultNeighbourMinCount = 3
+const defaultNeighbourMaxSpread = 72 * time.Hour
+
+func (c DateFallbackConfig) neighbourMinCount() int {
+	if c.NeighbourMinCount > 0 {
+		return c.NeighbourMinCount
+	}
+	return defaultNeighbourMinCount
+}
+
+func (c DateFallbackConfig) neighbourMaxSpread() time.Duration {
+	if c.NeighbourMaxSpread > 0 {
+		return time.Duration(c.NeighbourMaxSpread)
+	}
+	return defaultNeighbourMaxSpread
+}
+
+// matches reports whether the correction applies to a date recorded by camera
+func (c ClockCorrection) matches(camera CameraInfo, recorded time.Time) bool {
+	if c.Make == "" && c.Model == "" && c.Serial == "" {
+		return false
+	}
+	if c.Make != "" && c.Make != camera.Make {
+		return false
+	}
+	if c.Model != "" && c.Model != camera.Model {
+		return false
+	}
+	if c.Serial != "" && c.Serial != camera.Serial {
+		return false
+	}
+	if !c.From.IsZero() && recorded.Before(c.From) {
+		return false
+	}
+	if !c.To.IsZero() && recorded.After(c.To) {
+		return false
+	}
+	return true
+}
+
+// clockOffset returns the offset of the first correction matching camera
+func (c Config) clockOffset(camera CameraInfo, recorded time.Time) time.Duration {
+	for i := range c.ClockCorrections {
+		if c.ClockCorrections[i].matches(camera, recorded) {
+			return time.Duration(c.ClockCorrections[i].Offset)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package imports
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockCorrectionMatches(t *testing.T) {
+	camera := CameraInfo{Make: "Canon", Model: "EOS 80D", Serial: "123456"}
+	may := func(day int) time.Time { return time.Date(2021, 5, day, 12, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name       string
+		correction ClockCorrection
+		camera     CameraInfo
+		recorded   time.Time
+		want       bool
+	}{
+		{"make", ClockCorrection{Make: "Canon"}, camera, may(10), true},
+		{"make and model", ClockCorrection{Make: "Canon", Model: "EOS 80D"}, camera, may(10), true},
+		{"other model", ClockCorrection{Make: "Canon", Model: "EOS 5D"}, camera, may(10), false},
+		{"serial", ClockCorrection{Serial: "123456"}, camera, may(10), true},
+		{"other serial", ClockCorrection{Make: "Canon", Serial: "654321"}, camera, may(10), false},
+		{"no camera fields", ClockCorrection{From: may(1)}, camera, may(10), false},
+		{"unknown camera", ClockCorrection{Make: "Canon"}, CameraInfo{}, may(10), false},
+		{"within range", ClockCorrection{Make: "Canon", From: may(1), To: may(20)}, camera, may(10), true},
+		{"on range start", ClockCorrection{Make: "Canon", From: may(10)}, camera, may(10), true},
+		{"before range", ClockCorrection{Make: "Canon", From: may(11)}, camera, may(10), false},
+		{"on range end", ClockCorrection{Make: "Canon", To: may(10)}, camera, may(10), true},
+		{"after range", ClockCorrection{Make: "Canon", To: may(9)}, camera, may(10), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.correction.matches(tt.camera, tt.recorded); got != tt.want {
+				t.Errorf("matches %v at %v: %v, want %v", tt.camera, tt.recorded, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClockOffset(t *testing.T) {
+	cfg := Config{ClockCorrections: []ClockCorrection{
+		{Make: "Canon", Serial: "1", Offset: Duration(-time.Hour)},
+		{Make: "Canon", Offset: Duration(2 * time.Minute)},
+	}}
+	recorded := time.Date(2021, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		camera CameraInfo
+		want   time.Duration
+	}{
+		// the first matching correction applies
+		{CameraInfo{Make: "Canon", Serial: "1"}, -time.Hour},
+		{CameraInfo{Make: "Canon", Serial: "2"}, 2 * time.Minute},
+		{CameraInfo{Make: "Nikon", Serial: "1"}, 0},
+	}
+	for _, tt := range tests {
+		if got := cfg.clockOffset(tt.camera, recorded); got != tt.want {
+			t.Errorf("offset of %v is %v, want %v", tt.camera, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package imports
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// directoryDates collects the CreationDates of medium or higher
+// confidence per directory, for the neighbour inference
+type directoryDates map[string][]time.Time
+
+func newDirectoryDates() directoryDates {
+	return make(directoryDates)
+}
+
+func (d directoryDates) add(media *SourceMedia) {
+	if media.DateConfidence() < ConfidenceMedium {
+		return
+	}
+	dir := filepath.Dir(media.Path)
+	d[dir] = append(d[dir], media.CreationDate)
+}
+
+// applyDateFallbacks tries the low-confidence date sources enabled in the
+// config for media where neither exif nor filename yielded a date. The
+// neighbour inference runs first, a tight cluster of dated siblings is
+// stronger evidence than a modification time most copy tools reset.
+func (s service) applyDateFallbacks(dirDates directoryDates, undated []*SourceMedia) error {
+	fc := s.cfg.DateFallback
+	if fc.Neighbours {
+		remaining := undated[:0]
+		medians := dirDates.medians(fc.neighbourMinCount(), fc.neighbourMaxSpread())
+		for i := range undated {
+			dt, ok := medians[filepath.Dir(undated[i].Path)]
+			if !ok {
+				remaining = append(remaining, undated[i])
+				continue
+			}
+			err := s.applyCreationDate(undated[i], dt, 0, DateSourceNeighbour)
+			if err != nil {
+				return err
+			}
+		}
+		undated = remaining
+	}
+	if fc.Mtime {
+		for i := range undated {
+			dt, err := s.ExtractDateByMtime(undated[i])
+			if err != nil {
+				log.Printf("could not read mtime of %v: %v", undated[i].Path, err)
+				continue
+			}
+			err = s.applyCreationDate(undated[i], dt, 0, DateSourceMtime)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ExtractDateByMtime returns the filesystem modification time of media
+func (s service) ExtractDateByMtime(media *SourceMedia) (time.Time, error) {
+	fob, err := s.sfr.GetSourceFile(media.Path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer fob.Close()
+	info, err := fob.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// medians returns the median date per directory for all directories
+// holding at least minCount dates spread over no more than maxSpread
+func (d directoryDates) medians(minCount int, maxSpread time.Duration) map[string]time.Time {
+	result := make(map[string]time.Time)
+	for dir, dates := range d {
+		if len(dates) < minCount {
+			continue
+		}
+		sort.Slice(dates, func(a, b int) bool { return dates[a].Before(dates[b]) })
+		if dates[len(dates)-1].Sub(dates[0]) > maxSpread {
+			log.Printf("dates in %v spread too wide for neighbour inference", dir)
+			continue
+		}
+		result[dir] = dates[len(dates)/2]
+	}
+	return result
+}
@@ -0,0 +1,126 @@
+package imports_test
+
+import (
+	"nextimagescrap/pkg/imports"
+	"nextimagescrap/pkg/storage"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// catalogFile adds the file at name to the catalog with mimetype
+func catalogFile(t *testing.T, sdr *storage.MemSourceStorage, name string, mimetype string) {
+	t.Helper()
+	key, err := sdr.AddFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	media, err := sdr.GetFileByKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	media.Mimetype = mimetype
+	_, err = sdr.SaveMedia(media)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestService returns a service over an in-memory catalog holding the
+// files, all cataloged with mimetype
+func newTestService(t *testing.T, files fstest.MapFS, mimetype string, cfg imports.Config) (imports.Service, *storage.MemSourceStorage) {
+	t.Helper()
+	sfr, err := storage.NewFSSourceStorage(files, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdr := storage.NewMemSourceStorage()
+	for name := range files {
+		catalogFile(t, sdr, name, mimetype)
+	}
+	return imports.NewConfiguredService(sfr, sdr, nil, cfg), sdr
+}
+
+func TestDateFallbacks(t *testing.T) {
+	mtime := time.Date(2022, 7, 8, 9, 10, 11, 0, time.UTC)
+	day := func(month time.Month, d int) time.Time { return time.Date(2020, month, d, 0, 0, 0, 0, time.UTC) }
+	// the siblings of a/x.jpg are dated by their names
+	tight := []string{"a/20200101_1.jpg", "a/20200102_2.jpg", "a/20200103_3.jpg"}
+	wide := []string{"a/20200101_1.jpg", "a/20200601_2.jpg", "a/20201201_3.jpg"}
+	both := imports.DateFallbackConfig{Mtime: true, Neighbours: true}
+	tests := []struct {
+		name     string
+		siblings []string
+		cfg      imports.DateFallbackConfig
+		want     time.Time
+		source   imports.DateSource
+	}{
+		{"disabled", tight, imports.DateFallbackConfig{}, time.Time{}, imports.DateSourceNone},
+		{"neighbour median", tight, imports.DateFallbackConfig{Neighbours: true}, day(1, 2), imports.DateSourceNeighbour},
+		{"neighbour before mtime", tight, both, day(1, 2), imports.DateSourceNeighbour},
+		{"too few neighbours", tight[:2], imports.DateFallbackConfig{Neighbours: true}, time.Time{}, imports.DateSourceNone},
+		{"lower minimum count", tight[:2], imports.DateFallbackConfig{Neighbours: true, NeighbourMinCount: 2}, day(1, 2), imports.DateSourceNeighbour},
+		{"spread too wide", wide, imports.DateFallbackConfig{Neighbours: true}, time.Time{}, imports.DateSourceNone},
+		{"wider spread allowed", wide, imports.DateFallbackConfig{Neighbours: true, NeighbourMaxSpread: imports.Duration(365 * 24 * time.Hour)},
+			day(6, 1), imports.DateSourceNeighbour},
+		{"mtime when neighbours spread", wide, both, mtime, imports.DateSourceMtime},
+		{"mtime", nil, imports.DateFallbackConfig{Mtime: true}, mtime, imports.DateSourceMtime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := fstest.MapFS{"a/x.jpg": {Data: []byte("jpeg"), ModTime: mtime}}
+			for _, name := range tt.siblings {
+				files[name] = &fstest.MapFile{Data: []byte("jpeg"), ModTime: mtime}
+			}
+			s, sdr := newTestService(t, files, "image/jpeg", imports.Config{DateFallback: tt.cfg})
+			err := s.ExtractCreationDate(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			media, err := sdr.GetFileByKey("a/x.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !media.CreationDate.Equal(tt.want) || media.DateSource != tt.source {
+				t.Errorf("date %v from %q, want %v from %q", media.CreationDate, media.DateSource, tt.want, tt.source)
+			}
+		})
+	}
+}
+
+func TestLowConfidenceDateSearchedAgain(t *testing.T) {
+	mtime := time.Date(2022, 7, 8, 0, 0, 0, 0, time.UTC)
+	files := fstest.MapFS{
+		"a/x.jpg":          {Data: []byte("jpeg"), ModTime: mtime},
+		"a/20200101_1.jpg": {Data: []byte("jpeg")},
+		"a/20200102_2.jpg": {Data: []byte("jpeg")},
+	}
+	cfg := imports.Config{DateFallback: imports.DateFallbackConfig{Mtime: true, Neighbours: true}}
+	s, sdr := newTestService(t, files, "image/jpeg", cfg)
+	err := s.ExtractCreationDate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	media, err := sdr.GetFileByKey("a/x.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media.DateSource != imports.DateSourceMtime {
+		t.Fatalf("date from %q, want mtime", media.DateSource)
+	}
+	// with a third dated sibling the neighbours replace the mtime
+	files["a/20200103_3.jpg"] = &fstest.MapFile{Data: []byte("jpeg")}
+	catalogFile(t, sdr, "a/20200103_3.jpg", "image/jpeg")
+	err = s.ExtractCreationDate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	media, err = sdr.GetFileByKey("a/x.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	if !media.CreationDate.Equal(want) || media.DateSource != imports.DateSourceNeighbour {
+		t.Errorf("date %v from %q, want neighbour date %v", media.CreationDate, media.DateSource, want)
+	}
+}
@@ -0,0 +1,39 @@
+package imports
+
+import "strings"
+
+// DuplicateGroup is a checksum group of more than one media
+type DuplicateGroup struct {
+	Checksum string
+	Media    []*SourceMedia
+}
+
+// Redundant returns the number of media beyond the first
+func (g *DuplicateGroup) Redundant() int {
+	return len(g.Media) - 1
+}
+
+// ForEachDuplicate calls fn for every checksum group of sdr with more
+// than one media whose checksum sorts after after, all for "". fn may
+// modify the catalog.
+func ForEachDuplicate(sdr SourceDbRepository, after string, fn func(group *DuplicateGroup) error) error {
+	return sdr.ForEachChecksum(after, func(checksum *SourceChecksum) error {
+		if len(checksum.Sources) < 2 {
+			return nil
+		}
+		group := &DuplicateGroup{Checksum: strings.TrimPrefix(checksum.Key, "checksum:")}
+		for _, name := range checksum.Sources {
+			media, err := sdr.GetFileByKey(name)
+			if err != nil {
+				return err
+			}
+			if media != nil {
+				group.Media = append(group.Media, media)
+			}
+		}
+		if len(group.Media) < 2 {
+			return nil
+		}
+		return fn(group)
+	})
+}
@@ -0,0 +1,261 @@
+package imports
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Stage names a processing step which can fail for a single file
+type Stage string
+
+const (
+	StageScan     Stage = "scan"
+	StageMimetype Stage = "mimetype"
+	StageChecksum Stage = "checksum"
+	StageExport   Stage = "export"
+)
+
+// Failure records a stage which failed for one media, or for one path of
+// the source while scanning. The stages go on with the next media.
+type Failure struct {
+	Stage Stage
+	// Key is the key of the media, empty for scan failures
+	Key           string
+	Path          string
+	Error         string
+	Attempts      int
+	FirstFailedAt time.Time
+	LastFailedAt  time.Time
+}
+
+// ID returns what the failure is recorded for, the media key or the path
+func (f *Failure) ID() string {
+	if f.Key != "" {
+		return f.Key
+	}
+	return f.Path
+}
+
+// RetryConfig sets the backoff of failed stages, after a failure the
+// media is skipped for Backoff, doubled with every further attempt
+type RetryConfig struct {
+	// Backoff defaults to one minute, MaxBackoff to one day
+	Backoff    Duration
+	MaxBackoff Duration
+	// MaxAttempts gives up media after that many failures, zero never does
+	MaxAttempts int
+}
+
+const defaultRetryBackoff = time.Minute
+const defaultRetryMaxBackoff = 24 * time.Hour
+
+// retryAt returns when the stage of f is due again, zero time if never
+func (c RetryConfig) retryAt(f *Failure) time.Time {
+	if c.MaxAttempts > 0 && f.Attempts >= c.MaxAttempts {
+		return time.Time{}
+	}
+	backoff := time.Duration(c.Backoff)
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	maxBackoff := time.Duration(c.MaxBackoff)
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+	for i := 1; i < f.Attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return f.LastFailedAt.Add(backoff)
+}
+
+// fileError marks a failure to read or write the file of a media, it is
+// recorded as Failure instead of ending the stage
+type fileError struct {
+	err error
+}
+
+func (e *fileError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fileError) Unwrap() error {
+	return e.err
+}
+
+func asFileError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fileError{err: err}
+}
+
+// stageFailures are the recorded failures of one stage, loaded when the
+// stage starts
+type stageFailures struct {
+	stage    Stage
+	failures map[string]*Failure
+}
+
+func (s service) loadFailures(stage Stage) (*stageFailures, error) {
+	sf := &stageFailures{stage: stage, failures: make(map[string]*Failure)}
+	err := s.sdr.ForEachFailure(func(f *Failure) error {
+		if f.Stage == stage {
+			sf.failures[f.ID()] = f
+		}
+		return nil
+	})
+	return sf, err
+}
+
+// due reports whether the stage may run for media, media which failed
+// before wait for their backoff unless force is set
+func (s service) due(sf *stageFailures, media *SourceMedia, force bool) bool {
+	f, ok := sf.failures[media.Key]
+	if !ok || force {
+		return true
+	}
+	at := s.cfg.Retry.retryAt(f)
+	if at.IsZero() {
+		log.Printf("skip %v, %s failed %d times", media.Path, sf.stage, f.Attempts)
+		return false
+	}
+	if time.Now().Before(at) {
+		log.Printf("skip %v, %s failed %d times, retry after %v", media.Path, sf.stage, f.Attempts, at.Format(time.RFC3339))
+		return false
+	}
+	return true
+}
+
+// settle records a file error of the stage for media as failure, clears
+// the failure of media the stage succeeded for and returns other errors
+func (s service) settle(sf *stageFailures, media *SourceMedia, err error) error {
+	var fe *fileError
+	if errors.As(err, &fe) {
+		log.Printf("%s failed for %v: %v", sf.stage, media.Path, fe.err)
+		return s.sdr.RecordFailure(&Failure{Stage: sf.stage, Key: media.Key, Path: media.Path, Error: fe.err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := sf.failures[media.Key]; ok {
+		delete(sf.failures, media.Key)
+		return s.sdr.ClearFailure(sf.stage, media.Key)
+	}
+	return nil
+}
+
+// settleScan clears the scan failures below root which did not recur in
+// the scan, it walked all paths below root again
+func (s service) settleScan(root string, failed map[string]bool) error {
+	sf, err := s.loadFailures(StageScan)
+	if err != nil {
+		return err
+	}
+	for id, f := range sf.failures {
+		if failed[f.Path] || root == "" || !isWithin(root, f.Path) {
+			continue
+		}
+		err = s.sdr.ClearFailure(StageScan, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetryFailures runs the failed stages again for all media whose backoff
+// passed and returns the number of media retried. Scan failures are
+// retried by scanning the source again.
+func (s service) RetryFailures() (int, error) {
+	var due []*Failure
+	now := time.Now()
+	err := s.sdr.ForEachFailure(func(f *Failure) error {
+		at := s.cfg.Retry.retryAt(f)
+		if !at.IsZero() && !now.Before(at) {
+			due = append(due, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	retried := 0
+	scanned := false
+	for _, f := range due {
+		if f.Stage == StageScan {
+			if !scanned {
+				log.Printf("retry scan of the source for %v", f.Path)
+				err = s.ScanSourceDirectory()
+				if err != nil {
+					return retried, err
+				}
+				scanned = true
+			}
+			retried++
+			continue
+		}
+		media, err := s.sdr.GetFileByKey(f.Key)
+		if err != nil {
+			return retried, err
+		}
+		if media == nil {
+			log.Printf("media %v of failure is gone", f.Key)
+			err = s.sdr.ClearFailure(f.Stage, f.ID())
+			if err != nil {
+				return retried, err
+			}
+			continue
+		}
+		log.Printf("retry %s of %v, attempt %d", f.Stage, media.Path, f.Attempts+1)
+		sf := &stageFailures{stage: f.Stage, failures: map[string]*Failure{f.ID(): f}}
+		switch f.Stage {
+		case StageMimetype:
+			err = s.settle(sf, media, s.detectMimetype(media))
+		case StageChecksum:
+			err = s.settle(sf, media, s.computeChecksum(media))
+		case StageExport:
+			if s.drf == nil {
+				log.Printf("no destination to retry the export of %v", media.Path)
+				continue
+			}
+			err = s.retryExport(sf, media)
+		default:
+			log.Printf("cannot retry unknown stage %q", f.Stage)
+			continue
+		}
+		if err != nil {
+			return retried, err
+		}
+		retried++
+	}
+	return retried, nil
+}
+
+// isWithin reports whether path is dir or inside it
+func isWithin(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// retryExport exports media again, its checksum group is exported by
+// the next OrganizeToFolder
+func (s service) retryExport(sf *stageFailures, media *SourceMedia) error {
+	fob, err := s.sfr.GetSourceFile(media.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("skip unavailable %v", media.Path)
+		return nil
+	}
+	if err != nil {
+		return s.settle(sf, media, asFileError(err))
+	}
+	defer fob.Close()
+	checksum := &SourceChecksum{Key: media.Checksum, Sources: []string{media.Key}}
+	return s.settle(sf, media, s.exportMedia(media, fob, checksum))
+}
@@ -0,0 +1,54 @@
+package imports
+
+import "errors"
+
+// ErrInvalidCursor is returned by GetMediaPage for a cursor it did not hand out
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// MediaFilter selects media for ForEachMedia and GetMediaPage, empty
+// fields match all media
+type MediaFilter struct {
+	Mimetypes []string
+	State     MediaState
+	// Year and Month select by CreationDate, a zero Month selects the whole Year
+	Year  int
+	Month int
+}
+
+// Matches reports whether media is selected by the filter
+func (f MediaFilter) Matches(media *SourceMedia) bool {
+	if len(f.Mimetypes) > 0 {
+		found := false
+		for i := range f.Mimetypes {
+			if f.Mimetypes[i] == media.Mimetype {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.State != "" {
+		found := false
+		states := media.States()
+		for i := range states {
+			if states[i] == f.State {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Year != 0 {
+		if media.CreationDate.IsZero() || media.CreationDate.Year() != f.Year {
+			return false
+		}
+		if f.Month != 0 && int(media.CreationDate.Month()) != f.Month {
+			return false
+		}
+	}
+	return true
+}
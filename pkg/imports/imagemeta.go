@@ -0,0 +1,251 @@
+package imports
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/dsoprea/go-exif/v3"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// exifHeader prefixes exif data in jpeg segments and in some webp files
+var exifHeader = []byte("Exif\x00\x00")
+
+// imageMetadata holds the date related metadata found in png and webp containers
+type imageMetadata struct {
+	rawExif      []byte
+	creationTime string
+	xmp          []byte
+}
+
+// searchRawExif returns the exif data of the image, looking into the
+// container chunks for png and webp
+func searchRawExif(mimetype string, data []byte) ([]byte, error) {
+	var md imageMetadata
+	var err error
+	switch mimetype {
+	case "image/png":
+		md, err = parsePngChunks(data)
+	case "image/webp":
+		md, err = parseWebpChunks(data)
+	default:
+		return exif.SearchAndExtractExif(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if md.rawExif == nil {
+		return exif.SearchAndExtractExif(data)
+	}
+	return md.rawExif, nil
+}
+
+// extractTextDate returns the date of the png "Creation Time" text or of
+// the xmp packet of the image
+func extractTextDate(mimetype string, data []byte) (time.Time, error) {
+	var md imageMetadata
+	var err error
+	switch mimetype {
+	case "image/png":
+		md, err = parsePngChunks(data)
+	case "image/webp":
+		md, err = parseWebpChunks(data)
+	default:
+		md.xmp = data
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if md.creationTime != "" {
+		dt, err := parseMetadataDate(md.creationTime)
+		if err == nil {
+			return dt, nil
+		}
+	}
+	if md.xmp != nil {
+		return parseXmpDate(md.xmp)
+	}
+	return time.Time{}, errors.New("no metadata date")
+}
+
+// parsePngChunks collects the eXIf, tEXt, zTXt and iTXt chunks of a png
+func parsePngChunks(data []byte) (imageMetadata, error) {
+	md := imageMetadata{}
+	if !bytes.HasPrefix(data, pngSignature) {
+		return md, errors.New("not a png")
+	}
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		ctype := string(data[pos+4 : pos+8])
+		start := pos + 8
+		end := start + length
+		if length < 0 || end+4 > len(data) {
+			return md, fmt.Errorf("truncated png chunk %q", ctype)
+		}
+		chunk := data[start:end]
+		switch ctype {
+		case "eXIf":
+			md.rawExif = chunk
+		case "tEXt":
+			keyword, text, _ := bytes.Cut(chunk, []byte{0})
+			md.addText(string(keyword), text)
+		case "zTXt":
+			keyword, rest, _ := bytes.Cut(chunk, []byte{0})
+			if len(rest) > 0 {
+				text, err := inflate(rest[1:])
+				if err == nil {
+					md.addText(string(keyword), text)
+				}
+			}
+		case "iTXt":
+			keyword, text, err := parseITxt(chunk)
+			if err == nil {
+				md.addText(keyword, text)
+			}
+		case "IEND":
+			return md, nil
+		}
+		pos = end + 4
+	}
+	return md, nil
+}
+
+func (md *imageMetadata) addText(keyword string, text []byte) {
+	switch keyword {
+	case "Creation Time":
+		md.creationTime = string(text)
+	case "XML:com.adobe.xmp":
+		md.xmp = text
+	}
+}
+
+// parseITxt decodes an international text chunk:
+// keyword\0 flag method language\0 translated keyword\0 text
+func parseITxt(chunk []byte) (string, []byte, error) {
+	keyword, rest, ok := bytes.Cut(chunk, []byte{0})
+	if !ok || len(rest) < 2 {
+		return "", nil, errors.New("invalid iTXt chunk")
+	}
+	compressed := rest[0] == 1
+	rest = rest[2:]
+	_, rest, ok = bytes.Cut(rest, []byte{0})
+	if !ok {
+		return "", nil, errors.New("invalid iTXt chunk")
+	}
+	_, text, ok := bytes.Cut(rest, []byte{0})
+	if !ok {
+		return "", nil, errors.New("invalid iTXt chunk")
+	}
+	if compressed {
+		var err error
+		text, err = inflate(text)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return string(keyword), text, nil
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// parseWebpChunks collects the EXIF and XMP chunks of a webp RIFF container
+func parseWebpChunks(data []byte) (imageMetadata, error) {
+	md := imageMetadata{}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return md, errors.New("not a webp")
+	}
+	pos := 12
+	for pos+8 <= len(data) {
+		fourcc := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		start := pos + 8
+		end := start + length
+		if length < 0 || end > len(data) {
+			return md, fmt.Errorf("truncated webp chunk %q", fourcc)
+		}
+		switch fourcc {
+		case "EXIF":
+			md.rawExif = bytes.TrimPrefix(data[start:end], exifHeader)
+		case "XMP ":
+			md.xmp = data[start:end]
+		}
+		// chunks are padded to an even size
+		pos = end + length%2
+	}
+	return md, nil
+}
+
+// xmpDateTags match the date properties in order of preference, written
+// either as attribute or as element
+var xmpDateTags = []*regexp.Regexp{
+	regexp.MustCompile(`exif:DateTimeOriginal(?:\s*=\s*"([^"]+)"|>([^<]+)<)`),
+	regexp.MustCompile(`photoshop:DateCreated(?:\s*=\s*"([^"]+)"|>([^<]+)<)`),
+	regexp.MustCompile(`xmp:CreateDate(?:\s*=\s*"([^"]+)"|>([^<]+)<)`),
+}
+
+// parseXmpDate returns the first date of xmpDateTags found in the xmp packet
+func parseXmpDate(xmp []byte) (time.Time, error) {
+	for i := range xmpDateTags {
+		m := xmpDateTags[i].FindSubmatch(xmp)
+		if m == nil {
+			continue
+		}
+		value := m[1]
+		if value == nil {
+			value = m[2]
+		}
+		dt, err := parseMetadataDate(string(bytes.TrimSpace(value)))
+		if err == nil {
+			return dt, nil
+		}
+	}
+	return time.Time{}, errors.New("no date in xmp")
+}
+
+var metadataDateLayouts = []struct {
+	layout string
+	// zoned layouts hold the offset of the date
+	zoned bool
+}{
+	{time.RFC3339Nano, true},
+	{"2006-01-02T15:04:05", false},
+	{"2006-01-02T15:04Z07:00", true},
+	{"2006-01-02T15:04", false},
+	{"2006-01-02", false},
+	{time.RFC1123Z, true},
+	{time.RFC1123, false},
+	{"2006:01:02 15:04:05", false},
+	{"2006-01-02 15:04:05", false},
+}
+
+// parseMetadataDate parses the date formats written by common software,
+// a recorded offset is kept as fixed zone even if it is +00:00
+func parseMetadataDate(value string) (time.Time, error) {
+	for i := range metadataDateLayouts {
+		dt, err := time.Parse(metadataDateLayouts[i].layout, value)
+		if err != nil {
+			continue
+		}
+		if metadataDateLayouts[i].zoned {
+			_, offset := dt.Zone()
+			dt = dt.In(time.FixedZone("", offset))
+		}
+		return dt, nil
+	}
+	return time.Time{}, fmt.Errorf("unknown date format %q", value)
+}
@@ -0,0 +1,150 @@
+package imports
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+// pngOf returns a png holding chunks, given as type and data pairs
+func pngOf(chunks ...string) []byte {
+	b := bytes.NewBuffer(append([]byte{}, pngSignature...))
+	for i := 0; i+1 < len(chunks); i += 2 {
+		binary.Write(b, binary.BigEndian, uint32(len(chunks[i+1])))
+		b.WriteString(chunks[i])
+		b.WriteString(chunks[i+1])
+		binary.Write(b, binary.BigEndian, crc32.ChecksumIEEE([]byte(chunks[i]+chunks[i+1])))
+	}
+	return b.Bytes()
+}
+
+// webpOf returns a webp RIFF container holding chunks, given as fourcc
+// and data pairs
+func webpOf(chunks ...string) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for i := 0; i+1 < len(chunks); i += 2 {
+		body.WriteString(chunks[i])
+		binary.Write(&body, binary.LittleEndian, uint32(len(chunks[i+1])))
+		body.WriteString(chunks[i+1])
+		if len(chunks[i+1])%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+	b := bytes.NewBufferString("RIFF")
+	binary.Write(b, binary.LittleEndian, uint32(body.Len()))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+func deflate(text string) string {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write([]byte(text))
+	w.Close()
+	return b.String()
+}
+
+func TestParsePngChunks(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         []byte
+		creationTime string
+		xmp          string
+		rawExif      string
+		wantErr      bool
+	}{
+		{"tEXt", pngOf("IHDR", "header", "tEXt", "Creation Time\x002020-01-02T03:04:05Z", "IEND", ""),
+			"2020-01-02T03:04:05Z", "", "", false},
+		{"zTXt", pngOf("zTXt", "Creation Time\x00\x00"+deflate("2020:01:02 03:04:05"), "IEND", ""),
+			"2020:01:02 03:04:05", "", "", false},
+		{"iTXt xmp", pngOf("iTXt", "XML:com.adobe.xmp\x00\x00\x00en\x00\x00<x:xmpmeta/>", "IEND", ""),
+			"", "<x:xmpmeta/>", "", false},
+		{"compressed iTXt", pngOf("iTXt", "Creation Time\x00\x01\x00\x00\x00"+deflate("2021-02-03"), "IEND", ""),
+			"2021-02-03", "", "", false},
+		{"eXIf", pngOf("eXIf", "MM\x00\x2aexif", "IEND", ""), "", "", "MM\x00\x2aexif", false},
+		{"other keyword", pngOf("tEXt", "Software\x00editor", "IEND", ""), "", "", "", false},
+		{"chunks after IEND", pngOf("IEND", "", "tEXt", "Creation Time\x002020-01-02"), "", "", "", false},
+		{"truncated", pngOf("tEXt", "Creation Time\x002020-01-02")[:20], "", "", "", true},
+		{"no png", []byte("GIF89a"), "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, err := parsePngChunks(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if md.creationTime != tt.creationTime || string(md.xmp) != tt.xmp || string(md.rawExif) != tt.rawExif {
+				t.Errorf("found creation time %q, xmp %q, exif %q", md.creationTime, md.xmp, md.rawExif)
+			}
+		})
+	}
+}
+
+func TestParseWebpChunks(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		xmp     string
+		rawExif string
+		wantErr bool
+	}{
+		{"exif with header", webpOf("VP8X", "0123456789", "EXIF", "Exif\x00\x00II\x2a\x00x"), "", "II\x2a\x00x", false},
+		{"exif without header", webpOf("EXIF", "MM\x00\x2a"), "", "MM\x00\x2a", false},
+		// the odd sized chunk is padded before the next one
+		{"padded xmp", webpOf("ICCP", "odd", "XMP ", "<x:xmpmeta/>"), "<x:xmpmeta/>", "", false},
+		{"truncated", webpOf("EXIF", "MM\x00\x2a")[:22], "", "", true},
+		{"no webp", []byte("RIFF\x04\x00\x00\x00WAVE"), "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, err := parseWebpChunks(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if string(md.xmp) != tt.xmp || string(md.rawExif) != tt.rawExif {
+				t.Errorf("found xmp %q, exif %q", md.xmp, md.rawExif)
+			}
+		})
+	}
+}
+
+func TestParseXmpDate(t *testing.T) {
+	zone := time.FixedZone("", 2*60*60)
+	tests := []struct {
+		name    string
+		xmp     string
+		want    time.Time
+		zoned   bool
+		wantErr bool
+	}{
+		{"attribute", `<rdf:Description exif:DateTimeOriginal="2020-01-02T03:04:05"/>`,
+			time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), false, false},
+		{"element with offset", `<photoshop:DateCreated>2020-01-02T03:04:05+02:00</photoshop:DateCreated>`,
+			time.Date(2020, 1, 2, 3, 4, 5, 0, zone), true, false},
+		{"utc offset", `<xmp:CreateDate>2020-01-02T03:04:05Z</xmp:CreateDate>`,
+			time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), true, false},
+		{"preferred tag", `xmp:CreateDate="2019-01-01" exif:DateTimeOriginal="2020-01-02"`,
+			time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), false, false},
+		{"invalid date falls back", `exif:DateTimeOriginal="sometime" xmp:CreateDate="2019-05-06 07:08:09"`,
+			time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC), false, false},
+		{"no date", `<x:xmpmeta/>`, time.Time{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseXmpDate([]byte(tt.xmp))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("date %v, want %v", got, tt.want)
+			}
+			if err == nil && hasRecordedZone(got) != tt.zoned {
+				t.Errorf("date %v has recorded zone %v", got, !tt.zoned)
+			}
+		})
+	}
+}
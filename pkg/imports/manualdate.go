@@ -0,0 +1,88 @@
+package imports
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MediaSelector picks media by key, path glob or directory. All set
+// criteria are combined, a media matching any of them is selected.
+type MediaSelector struct {
+	Keys []string
+	Glob string
+	Dir  string
+}
+
+func (ms MediaSelector) isEmpty() bool {
+	return len(ms.Keys) == 0 && ms.Glob == "" && ms.Dir == ""
+}
+
+// matchesPath reports whether the glob or the directory selects path
+func (ms MediaSelector) matchesPath(path string) (bool, error) {
+	if ms.Glob != "" {
+		ok, err := filepath.Match(ms.Glob, path)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	if ms.Dir != "" {
+		dir := filepath.Clean(ms.Dir) + string(filepath.Separator)
+		if strings.HasPrefix(path, dir) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetCreationDate sets dt as manual CreationDate of all selected media
+// and returns their number. Manual dates are never replaced by
+// ExtractCreationDate, not even when forced, the recorded date and clock
+// offset of the media are kept.
+func (s service) SetCreationDate(selector MediaSelector, dt time.Time) (int, error) {
+	if selector.isEmpty() {
+		return 0, errors.New("no media selected")
+	}
+	var selected []*SourceMedia
+	for i := range selector.Keys {
+		media, err := s.sdr.GetFileByKey(selector.Keys[i])
+		if err != nil {
+			return 0, err
+		}
+		if media == nil {
+			log.Printf("no media with key %v", selector.Keys[i])
+			continue
+		}
+		selected = append(selected, media)
+	}
+	if selector.Glob != "" || selector.Dir != "" {
+		err := s.sdr.ForEachMedia(MediaFilter{}, func(media *SourceMedia) error {
+			ok, err := selector.matchesPath(media.Path)
+			if ok {
+				selected = append(selected, media)
+			}
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	seen := make(map[string]bool)
+	count := 0
+	for i := range selected {
+		if seen[selected[i].Key] {
+			continue
+		}
+		seen[selected[i].Key] = true
+		selected[i].SetManualDate(dt)
+		log.Printf("set manual CreationDate %v of %v", dt, selected[i].Key)
+		_, err := s.sdr.SaveMedia(selected[i])
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
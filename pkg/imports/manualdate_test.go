@@ -0,0 +1,81 @@
+package imports_test
+
+import (
+	"nextimagescrap/pkg/imports"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+)
+
+// exifData returns the exif data of an image recorded by a camera of
+// make and model at the wall-clock time dt
+func exifData(t *testing.T, make string, model string, dt time.Time) []byte {
+	t.Helper()
+	im, err := exifcommon.NewIfdMappingWithStandard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := exif.NewTagIndex()
+	rootIb := exif.NewIfdBuilder(im, ti, exifcommon.IfdStandardIfdIdentity, exifcommon.EncodeDefaultByteOrder)
+	err = rootIb.SetStandardWithName("Make", make)
+	if err == nil {
+		err = rootIb.SetStandardWithName("Model", model)
+	}
+	if err == nil {
+		err = rootIb.SetStandardWithName("DateTime", dt.Format("2006:01:02 15:04:05"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := exif.NewIfdByteEncoder().EncodeToExif(rootIb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestManualDateKeepsClockCorrection(t *testing.T) {
+	recorded := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	files := fstest.MapFS{
+		"a/1.jpg": {Data: exifData(t, "Cam", "One", recorded)},
+	}
+	cfg := imports.Config{ClockCorrections: []imports.ClockCorrection{
+		{Make: "Cam", Model: "One", Offset: imports.Duration(time.Hour)},
+	}}
+	s, sdr := newTestService(t, files, "image/jpeg", cfg)
+	err := s.ExtractCreationDate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	media, err := sdr.GetFileByPath("a/1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !media.CreationDate.Equal(recorded.Add(time.Hour)) || media.ClockOffset != time.Hour {
+		t.Fatalf("corrected date %v by %v, want %v by 1h", media.CreationDate, media.ClockOffset, recorded.Add(time.Hour))
+	}
+
+	manual := time.Date(2019, 5, 30, 8, 0, 0, 0, time.UTC)
+	n, err := s.SetCreationDate(imports.MediaSelector{Glob: "a/*.jpg"}, manual)
+	if err != nil || n != 1 {
+		t.Fatalf("set date of %d media: %v", n, err)
+	}
+	// forcing the extraction leaves the manual date alone
+	err = s.ExtractCreationDate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	media, err = sdr.GetFileByPath("a/1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !media.CreationDate.Equal(manual) || media.DateSource != imports.DateSourceManual {
+		t.Errorf("date %v from %q, want manual %v", media.CreationDate, media.DateSource, manual)
+	}
+	if !media.OriginalCreationDate.Equal(recorded) || media.ClockOffset != time.Hour {
+		t.Errorf("recorded date %v with offset %v, want %v with 1h", media.OriginalCreationDate, media.ClockOffset, recorded)
+	}
+}
@@ -2,16 +2,156 @@ package imports
 
 import "time"
 
+// DateSource names the method a CreationDate was obtained with
+type DateSource string
+
+const (
+	DateSourceNone      DateSource = ""
+	DateSourceExif      DateSource = "exif"
+	DateSourceMetadata  DateSource = "metadata"
+	DateSourceSidecar   DateSource = "sidecar"
+	DateSourceFilename  DateSource = "filename"
+	DateSourceMtime     DateSource = "mtime"
+	DateSourceNeighbour DateSource = "neighbour"
+	DateSourceManual    DateSource = "manual"
+)
+
+// confidence levels of a CreationDate, higher values win
+const (
+	ConfidenceNone = iota
+	ConfidenceLow
+	ConfidenceMedium
+	ConfidenceHigh
+	ConfidenceManual
+)
+
+// Confidence returns how much a date from this source can be trusted
+func (d DateSource) Confidence() int {
+	switch d {
+	case DateSourceManual:
+		return ConfidenceManual
+	case DateSourceExif, DateSourceMetadata, DateSourceSidecar:
+		return ConfidenceHigh
+	case DateSourceFilename:
+		return ConfidenceMedium
+	case DateSourceMtime, DateSourceNeighbour:
+		return ConfidenceLow
+	}
+	// dates stored before the source was tracked came from exif or filename
+	return ConfidenceMedium
+}
+
+// CameraInfo identifies the camera that recorded a media
+type CameraInfo struct {
+	Make   string
+	Model  string
+	Serial string
+}
+
+// GeoLocation is where a media was recorded, in degrees and meters
+type GeoLocation struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+}
+
 // Media defines the storage form for source-media objects
 type SourceMedia struct {
-	Key          string
-	Path         string
-	Mimetype     string
-	Checksum     string
+	Key  string
+	Path string
+	// Root names the source root the media was scanned in, RelPath is
+	// its slash separated path inside the root
+	Root     string
+	RelPath  string
+	Mimetype string
+	Checksum string
+	// Size and ModTime describe the file when its Checksum was computed
+	Size         int64
+	ModTime      time.Time
 	CreationDate time.Time
+	DateSource   DateSource
+	// OriginalCreationDate is the date as recorded, before ClockOffset was added
+	OriginalCreationDate time.Time
+	ClockOffset          time.Duration
+	// OffsetKnown tells whether the zone offset of CreationDate was
+	// recorded with it, otherwise CreationDate is wall-clock time kept as UTC
+	OffsetKnown bool
+	Camera      CameraInfo
+	// Sidecar is the name of the metadata file next to the media, e.g. a
+	// Google Takeout json, Description, People and Location come from it
+	Sidecar     string
+	Description string
+	People      []string
+	Location    *GeoLocation
+	// ExportedPath is the destination the content was last exported to
+	ExportedPath string
+	ExportedAt   time.Time
 	Id           int
 }
 
+// DateConfidence returns the confidence of the current CreationDate
+func (m *SourceMedia) DateConfidence() int {
+	if m.CreationDate.IsZero() {
+		return ConfidenceNone
+	}
+	return m.DateSource.Confidence()
+}
+
+// SetManualDate sets dt as manual CreationDate, a wall-clock time.
+// OriginalCreationDate and ClockOffset still describe the date the camera
+// recorded, so a clock correction can be told apart from it.
+func (m *SourceMedia) SetManualDate(dt time.Time) {
+	m.CreationDate = dt
+	m.DateSource = DateSourceManual
+	m.OffsetKnown = false
+}
+
+// forgetContent clears what was learned from the content of a file which
+// was rewritten, so all stages run for it again. A manual date and the
+// metadata of the sidecar are kept, a former export stays at the
+// destination.
+func (m *SourceMedia) forgetContent() {
+	m.Mimetype = ""
+	m.Checksum = ""
+	m.Size = 0
+	m.ModTime = time.Time{}
+	m.ExportedPath = ""
+	m.ExportedAt = time.Time{}
+	if m.DateSource == DateSourceManual {
+		return
+	}
+	m.CreationDate = time.Time{}
+	m.DateSource = DateSourceNone
+	m.OriginalCreationDate = time.Time{}
+	m.ClockOffset = 0
+	m.OffsetKnown = false
+	m.Camera = CameraInfo{}
+}
+
+// MediaState names a processing step a media still waits for
+type MediaState string
+
+const (
+	StateNeedsHash   MediaState = "needs-hash"
+	StateNeedsDate   MediaState = "needs-date"
+	StateNotExported MediaState = "not-exported"
+)
+
+// States returns the processing steps still pending for the media
+func (m *SourceMedia) States() []MediaState {
+	var states []MediaState
+	if m.Checksum == "" {
+		states = append(states, StateNeedsHash)
+	}
+	if m.DateConfidence() < ConfidenceMedium {
+		states = append(states, StateNeedsDate)
+	}
+	if m.ExportedPath == "" {
+		states = append(states, StateNotExported)
+	}
+	return states
+}
+
 type SourceChecksum struct {
 	Key     string
 	Sources []string
@@ -0,0 +1,56 @@
+package imports
+
+// MergeMedia merges what other knows about the same file into media and
+// reports whether media changed. Missing values, sidecar metadata
+// included, are taken from other, the CreationDate of higher confidence
+// wins, ties keep the date of media, and the later export is kept.
+func MergeMedia(media *SourceMedia, other *SourceMedia) bool {
+	changed := false
+	if media.Mimetype == "" && other.Mimetype != "" {
+		media.Mimetype = other.Mimetype
+		changed = true
+	}
+	if media.Checksum == "" && other.Checksum != "" {
+		media.Checksum = other.Checksum
+		media.Size = other.Size
+		media.ModTime = other.ModTime
+		changed = true
+	}
+	if other.DateConfidence() > media.DateConfidence() {
+		media.CreationDate = other.CreationDate
+		media.DateSource = other.DateSource
+		media.OriginalCreationDate = other.OriginalCreationDate
+		media.ClockOffset = other.ClockOffset
+		media.OffsetKnown = other.OffsetKnown
+		if other.Camera != (CameraInfo{}) {
+			media.Camera = other.Camera
+		}
+		changed = true
+	}
+	if media.Camera == (CameraInfo{}) && other.Camera != (CameraInfo{}) {
+		media.Camera = other.Camera
+		changed = true
+	}
+	if media.Sidecar == "" && other.Sidecar != "" {
+		media.Sidecar = other.Sidecar
+		changed = true
+	}
+	if media.Description == "" && other.Description != "" {
+		media.Description = other.Description
+		changed = true
+	}
+	if len(media.People) == 0 && len(other.People) > 0 {
+		media.People = other.People
+		changed = true
+	}
+	if media.Location == nil && other.Location != nil {
+		media.Location = other.Location
+		changed = true
+	}
+	if other.ExportedAt.After(media.ExportedAt) {
+		media.ExportedPath = other.ExportedPath
+		media.ExportedAt = other.ExportedAt
+		changed = true
+	}
+	return changed
+}
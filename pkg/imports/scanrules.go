@@ -0,0 +1,240 @@
+package imports
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFileName is the per directory file listing paths the scan skips,
+// in gitignore syntax
+const IgnoreFileName = ".nextimageignore"
+
+// DefaultScanExcludes are the thumbnail caches and tool directories which
+// never hold media worth cataloging
+var DefaultScanExcludes = []string{
+	".DS_Store", "Thumbs.db", "desktop.ini", "@eaDir", ".thumbnails", "node_modules",
+}
+
+// ScanConfig selects the files ScanSourceDirectory catalogs. Globs match
+// the slash separated path relative to the source, globs without a slash
+// match the name in any directory and "**" matches any number of
+// directories.
+type ScanConfig struct {
+	// Include restricts the cataloged files to those matching a glob, as
+	// do the size limits. The sidecars of cataloged media are attached
+	// regardless.
+	Include []string
+	// Exclude skips files and directories matching a glob, in addition
+	// to DefaultScanExcludes unless NoDefaultExcludes is set
+	Exclude           []string
+	NoDefaultExcludes bool
+	// MinSize and MaxSize limit the size of cataloged files, zero is no limit
+	MinSize int64
+	MaxSize int64
+	// Hidden catalogs files and directories whose name starts with a dot
+	Hidden bool
+}
+
+// ignoreRule is a pattern of an ignore file
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// parseIgnoreRules reads patterns in gitignore syntax
+func parseIgnoreRules(f fs.File) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		r.anchored = strings.Contains(line, "/")
+		r.pattern = strings.TrimPrefix(line, "/")
+		if r.pattern == "" {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+// matches reports whether the rule selects rel, the path relative to the
+// directory of the ignore file
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.anchored {
+		return matchGlob(r.pattern, rel)
+	}
+	return matchGlob(r.pattern, path.Base(rel))
+}
+
+// matchGlob matches the slash separated name against pattern, where "**"
+// stands for any number of path elements
+func matchGlob(pattern string, name string) bool {
+	return matchElements(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElements(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchElements(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchAnyGlob reports whether one of the globs matches rel, globs
+// without a slash are matched against the name
+func matchAnyGlob(globs []string, rel string) bool {
+	for _, g := range globs {
+		if strings.Contains(g, "/") {
+			if matchGlob(strings.TrimPrefix(g, "/"), rel) {
+				return true
+			}
+		} else if matchGlob(g, path.Base(rel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanRules decides which walked paths the scan catalogs
+type scanRules struct {
+	cfg     ScanConfig
+	exclude []string
+	// ignores holds the rules of the ignore file of each directory
+	ignores map[string][]ignoreRule
+	// loaded marks the directories whose ignore file was looked for
+	loaded  map[string]bool
+	skipped int
+}
+
+func newScanRules(cfg ScanConfig) *scanRules {
+	exclude := cfg.Exclude
+	if !cfg.NoDefaultExcludes {
+		exclude = append(append([]string{}, DefaultScanExcludes...), exclude...)
+	}
+	return &scanRules{cfg: cfg, exclude: exclude, ignores: make(map[string][]ignoreRule), loaded: make(map[string]bool)}
+}
+
+// skip reports whether the entry at rel, relative to the source, is left
+// out of the scan. Directories left out are not descended into.
+func (r *scanRules) skip(rel string, info fs.DirEntry) bool {
+	return r.skipPath(rel, info.IsDir())
+}
+
+func (r *scanRules) skipPath(rel string, isDir bool) bool {
+	if rel == "." {
+		return false
+	}
+	name := path.Base(rel)
+	if !isDir && name == IgnoreFileName {
+		return true
+	}
+	if !r.cfg.Hidden && strings.HasPrefix(name, ".") {
+		return true
+	}
+	if matchAnyGlob(r.exclude, rel) {
+		return true
+	}
+	return r.ignored(rel, isDir)
+}
+
+// ignored applies the ignore files of the directories above rel, the
+// last matching rule of the innermost file decides
+func (r *scanRules) ignored(rel string, isDir bool) bool {
+	var dirs []string
+	for dir := path.Dir(rel); ; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == "." {
+			break
+		}
+	}
+	for _, dir := range dirs {
+		rules := r.ignores[dir]
+		within := rel
+		if dir != "." {
+			within = strings.TrimPrefix(rel, dir+"/")
+		}
+		for i := len(rules) - 1; i >= 0; i-- {
+			if rules[i].matches(within, isDir) {
+				return !rules[i].negate
+			}
+		}
+	}
+	return false
+}
+
+// selects reports whether a file passes the include globs and the size
+// limits
+func (r *scanRules) selects(rel string, info fs.DirEntry) bool {
+	if len(r.cfg.Include) > 0 && !matchAnyGlob(r.cfg.Include, rel) {
+		return false
+	}
+	if r.cfg.MinSize == 0 && r.cfg.MaxSize == 0 {
+		return true
+	}
+	fi, err := info.Info()
+	if err != nil {
+		log.Printf("cannot read size of %v: %v", rel, err)
+		return false
+	}
+	if fi.Size() < r.cfg.MinSize {
+		return false
+	}
+	return r.cfg.MaxSize == 0 || fi.Size() <= r.cfg.MaxSize
+}
+
+// loadIgnoreFile reads the ignore file of the directory at dirPath, rel
+// is the directory relative to the source
+func (s service) loadIgnoreFile(r *scanRules, dirPath string, rel string) error {
+	f, err := s.sfr.GetSourceFile(filepath.Join(dirPath, IgnoreFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules, err := parseIgnoreRules(f)
+	if err != nil {
+		return err
+	}
+	r.ignores[rel] = rules
+	return nil
+}
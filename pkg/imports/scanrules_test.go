@@ -0,0 +1,141 @@
+package imports
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// ignoreRulesOf parses the ignore file content
+func ignoreRulesOf(t *testing.T, content string) []ignoreRule {
+	t.Helper()
+	f, err := fstest.MapFS{IgnoreFileName: {Data: []byte(content)}}.Open(IgnoreFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rules, err := parseIgnoreRules(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestParseIgnoreRules(t *testing.T) {
+	content := "# comment\n\n*.tmp  \n!keep.tmp\n/raw\ncache/\nsub/*.xmp\n\\!bang\n!\n/\n"
+	want := []ignoreRule{
+		{pattern: "*.tmp"},
+		{pattern: "keep.tmp", negate: true},
+		{pattern: "raw", anchored: true},
+		{pattern: "cache", dirOnly: true},
+		{pattern: "sub/*.xmp", anchored: true},
+		{pattern: "!bang"},
+	}
+	got := ignoreRulesOf(t, content)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rules %+v, want %+v", got, want)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.jpg", "a.jpg", true},
+		{"*.jpg", "a/b.jpg", false},
+		{"a/*.jpg", "a/b.jpg", true},
+		{"**/b.jpg", "b.jpg", true},
+		{"**/b.jpg", "a/c/b.jpg", true},
+		{"a/**", "a/c/b.jpg", true},
+		{"a/**/b.jpg", "a/b.jpg", true},
+		{"a/**/b.jpg", "a/c/d/b.jpg", true},
+		{"a/**/b.jpg", "x/c/b.jpg", false},
+		{"a", "a/b.jpg", false},
+		{"[", "[", false},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("%q matches %q: %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	r := newScanRules(ScanConfig{})
+	r.ignores["."] = ignoreRulesOf(t, "*.tmp\n!keep.tmp\n/raw\ncache/\ndocs/**/*.pdf\n")
+	r.ignores["a"] = ignoreRulesOf(t, "!*.tmp\nlocal.jpg\n/top.jpg\n")
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"x.tmp", false, true},
+		{"b/x.tmp", false, true},
+		// a later negation re-includes
+		{"keep.tmp", false, false},
+		{"b/keep.tmp", false, false},
+		// anchored patterns only match below the ignore file
+		{"raw", true, true},
+		{"raw", false, true},
+		{"b/raw", true, false},
+		// directory patterns skip directories only
+		{"cache", true, true},
+		{"b/cache", true, true},
+		{"cache", false, false},
+		{"docs/x.pdf", false, true},
+		{"docs/b/c/x.pdf", false, true},
+		{"b/docs/x.pdf", false, false},
+		// the innermost ignore file wins
+		{"a/x.tmp", false, false},
+		{"a/b/x.tmp", false, false},
+		{"a/local.jpg", false, true},
+		{"a/b/local.jpg", false, true},
+		{"local.jpg", false, false},
+		{"a/top.jpg", false, true},
+		{"a/b/top.jpg", false, false},
+	}
+	for _, tt := range tests {
+		if got := r.ignored(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("%v (dir %v) ignored: %v, want %v", tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   ScanConfig
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"root", ScanConfig{Exclude: []string{"*"}}, ".", true, false},
+		{"ignore file", ScanConfig{Hidden: true}, "a/" + IgnoreFileName, false, true},
+		{"hidden", ScanConfig{}, "a/.cache", true, true},
+		{"hidden allowed", ScanConfig{Hidden: true}, "a/.cache", true, false},
+		{"default exclude", ScanConfig{}, "a/@eaDir", true, true},
+		{"no default excludes", ScanConfig{NoDefaultExcludes: true}, "a/@eaDir", true, false},
+		{"exclude name", ScanConfig{Exclude: []string{"*.raw"}}, "a/b.raw", false, true},
+		{"exclude path", ScanConfig{Exclude: []string{"/a/*.raw"}}, "a/b.raw", false, true},
+		{"exclude other path", ScanConfig{Exclude: []string{"a/*.raw"}}, "b/a/b.raw", false, false},
+		{"kept", ScanConfig{}, "a/b.jpg", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode := fs.FileMode(0)
+			if tt.isDir {
+				mode = fs.ModeDir
+			}
+			info, err := fs.Stat(fstest.MapFS{tt.rel: {Mode: mode}}, tt.rel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := newScanRules(tt.cfg).skip(tt.rel, fs.FileInfoToDirEntry(info)); got != tt.want {
+				t.Errorf("%v skipped: %v, want %v", tt.rel, got, tt.want)
+			}
+		})
+	}
+}
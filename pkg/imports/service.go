@@ -4,24 +4,35 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/dsoprea/go-exif/v3"
 	exifcommon "github.com/dsoprea/go-exif/v3/common"
 	"github.com/gabriel-vasile/mimetype"
 	"io"
 	"io/fs"
 	"log"
-	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 )
 
+// ErrFileBusy is returned by a file of a SourceFileRepository which cannot
+// be read now as it shares its stream with another file, opening the file
+// again may succeed
+var ErrFileBusy = errors.New("file busy")
+
 type SourceFileRepository interface {
 	GetSourceFiles(func(path string, info fs.DirEntry, err error) error) error
-	GetSourceFile(fpath string) (*os.File, error)
+	GetSourceFile(fpath string) (fs.File, error)
 }
 
 type DestinationFileRepository interface {
-	ExportToDirectory(media *SourceMedia, ext string) error
+	// ExportToDirectory writes content, the file of media, to the place
+	// of media and returns the path of the copy
+	ExportToDirectory(media *SourceMedia, ext string, content io.Reader) (string, error)
 }
 
 type Service interface {
@@ -29,24 +40,51 @@ type Service interface {
 	DetectMimetype(force bool) error
 	ComputeChecksums(force bool) error
 	ExtractCreationDate(force bool) error
+	SetCreationDate(selector MediaSelector, dt time.Time) (int, error)
 	OrganizeToFolder() error
+	// RetryFailures runs the failed stages of media again once their backoff passed
+	RetryFailures() (int, error)
+	// Watch imports the files appearing in the source until stop is closed
+	Watch(settle time.Duration, stop <-chan struct{}) error
 }
 
+// SourceDbRepository is the catalog, its methods may be called from
+// several goroutines
 type SourceDbRepository interface {
 	AddFile(filename string) (string, error)
 	HasFile(fileName string) (bool, error)
 	GetFilesByMimetypeFilter(filter []string) ([]*SourceMedia, error)
+	GetFilesByState(state MediaState) ([]*SourceMedia, error)
+	GetFilesByCreationDate(year int, month int) ([]*SourceMedia, error)
 	GetAllFiles() ([]*SourceMedia, error)
 	SaveMedia(media *SourceMedia) (string, error)
 	AddChecksum(media *SourceMedia) error
 	GetAllCheckSum() (error, []*SourceChecksum)
+	// ForEachMedia calls fn for every media matching filter, fn may modify the catalog
+	ForEachMedia(filter MediaFilter, fn func(media *SourceMedia) error) error
+	// GetMediaPage returns up to limit media after cursor and the cursor of the next page
+	GetMediaPage(filter MediaFilter, cursor string, limit int) ([]*SourceMedia, string, error)
+	// ForEachChecksum calls fn for every checksum group in checksum order
+	// whose checksum sorts after after, all groups for "". fn may modify
+	// the catalog.
+	ForEachChecksum(after string, fn func(checksum *SourceChecksum) error) error
+	// GetChecksum returns the group of media with checksum, nil if there is none
+	GetChecksum(checksum string) (*SourceChecksum, error)
 	GetFileByKey(path string) (*SourceMedia, error)
+	// GetFileByPath returns the media at path, nil if it is not cataloged
+	GetFileByPath(path string) (*SourceMedia, error)
+	// RecordFailure stores f, counting the attempts of a failure recorded before
+	RecordFailure(f *Failure) error
+	// ClearFailure removes the failure of stage for id, the media key or scanned path
+	ClearFailure(stage Stage, id string) error
+	ForEachFailure(fn func(f *Failure) error) error
 }
 
 type service struct {
 	sfr SourceFileRepository
 	sdr SourceDbRepository
 	drf DestinationFileRepository
+	cfg Config
 }
 
 func NewService(sfr SourceFileRepository, sdr SourceDbRepository) Service {
@@ -64,175 +102,460 @@ func NewOrganizeService(sfr SourceFileRepository, sdr SourceDbRepository, dfr De
 	}
 }
 
+// NewConfiguredService creates a service with non-default behaviour, dfr may be nil
+func NewConfiguredService(sfr SourceFileRepository, sdr SourceDbRepository, dfr DestinationFileRepository, cfg Config) Service {
+	return &service{
+		sfr: sfr,
+		sdr: sdr,
+		drf: dfr,
+		cfg: cfg,
+	}
+}
+
+// ScanSourceDirectory adds the files of the source selected by the scan
+// config and the ignore files to the catalog, json sidecars found next to
+// media are attached to them after the walk. Paths which cannot be read
+// are recorded as failures and left out.
 func (s service) ScanSourceDirectory() error {
+	dirs := make(map[string]*scannedDir)
+	rules := newScanRules(s.cfg.Scan)
+	failed := make(map[string]bool)
+	adder := newFileAdder(s)
+	// the walk starts at the source, paths are matched relative to it
+	root := ""
 	err := s.sfr.GetSourceFiles(func(path string, info fs.DirEntry, err error) error {
-		if err != nil {
-			log.Printf("prevent panic by handling failure accessing a path %q: %v\n", path, err)
-			return err
+		if root == "" {
+			root = path
 		}
-		if info.IsDir() {
-			return nil
+		if err != nil {
+			failed[path] = true
+			return s.recordScanFailure(path, err)
 		}
-		hf, err := s.sdr.HasFile(path)
+		rel, err := filepath.Rel(root, path)
 		if err != nil {
 			return err
 		}
-		if hf == false {
-			key, err := s.sdr.AddFile(path)
+		rel = filepath.ToSlash(rel)
+		if rules.skip(rel, info) {
+			if info.IsDir() {
+				log.Printf("skip directory %v", path)
+				return fs.SkipDir
+			}
+			rules.skipped++
+			return nil
+		}
+		if info.IsDir() {
+			err = s.loadIgnoreFile(rules, path, rel)
 			if err != nil {
-				return err
+				// without its ignore file the directory would be scanned wrongly
+				failed[path] = true
+				err = s.recordScanFailure(path, err)
+				if err != nil {
+					return err
+				}
+				return fs.SkipDir
 			}
-			log.Printf("Added key %s", key)
+			return nil
 		}
-		return nil
+		dir := filepath.Dir(path)
+		d, ok := dirs[dir]
+		if !ok {
+			d = &scannedDir{}
+			dirs[dir] = d
+		}
+		if isSidecarName(info.Name()) {
+			d.addSidecar(info.Name(), rules.selects(rel, info))
+			return nil
+		}
+		if !rules.selects(rel, info) {
+			rules.skipped++
+			return nil
+		}
+		d.media = append(d.media, info.Name())
+		return adder.add(path)
 	})
+	// the adds still running are waited for even if the walk failed
+	if aerr := adder.wait(); err == nil {
+		err = aerr
+	}
+	if err != nil {
+		return err
+	}
+	err = s.settleScan(root, failed)
+	if err != nil {
+		return err
+	}
+	err = s.attachSidecars(dirs, rules)
+	log.Printf("skipped %d files by scan rules", rules.skipped)
 	return err
 }
 
-func (s service) ComputeChecksums(force bool) error {
-	importFiles, err := s.sdr.GetAllFiles()
+// recordScanFailure records that path could not be scanned, the scan
+// goes on with the next path
+func (s service) recordScanFailure(path string, err error) error {
+	log.Printf("cannot scan %q: %v", path, err)
+	return s.sdr.RecordFailure(&Failure{Stage: StageScan, Path: path, Error: err.Error()})
+}
+
+// scanWriters is the number of files the scan adds concurrently, so a
+// batching catalog commits them in shared transactions
+const scanWriters = 64
+
+// fileAdder adds files to the catalog from up to scanWriters goroutines
+// and keeps the first error
+type fileAdder struct {
+	s   service
+	sem chan struct{}
+	wg  sync.WaitGroup
+	mu  sync.Mutex
+	err error
+}
+
+func newFileAdder(s service) *fileAdder {
+	return &fileAdder{s: s, sem: make(chan struct{}, scanWriters)}
+}
 
+// add starts adding the file at path, it returns the error of an earlier
+// add so the walk stops at the first failure
+func (a *fileAdder) add(path string) error {
+	err := a.failure()
 	if err != nil {
 		return err
 	}
-	for index, entry := range importFiles {
-		log.Printf("%v %v", index, entry.Checksum)
-		if entry.Checksum != "" && force == false {
-			log.Printf("checksum da")
-			continue
-		}
-		fob, err := s.sfr.GetSourceFile(entry.Path)
+	a.sem <- struct{}{}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		err := a.s.addFile(path)
+		<-a.sem
 		if err != nil {
-			return err
+			a.mu.Lock()
+			if a.err == nil {
+				a.err = err
+			}
+			a.mu.Unlock()
 		}
-		h := sha1.New()
-		_, err = io.Copy(h, fob)
+	}()
+	return nil
+}
+
+func (a *fileAdder) failure() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// wait waits for the running adds and returns the first error
+func (a *fileAdder) wait() error {
+	a.wg.Wait()
+	return a.failure()
+}
+
+// addFile adds the file at path unless it is cataloged already
+func (s service) addFile(path string) error {
+	hf, err := s.sdr.HasFile(path)
+	if err != nil {
+		return err
+	}
+	if hf == false {
+		key, err := s.sdr.AddFile(path)
 		if err != nil {
 			return err
 		}
-		entry.Checksum = hex.EncodeToString(h.Sum(nil))
-		log.Printf("%s %s", entry.Path, entry.Checksum)
-		_, err = s.sdr.SaveMedia(entry)
-		err = s.sdr.AddChecksum(entry)
-		if err != nil {
-			return err
+		log.Printf("Added key %s", key)
+	}
+	return nil
+}
+
+func (s service) ComputeChecksums(force bool) error {
+	filter := MediaFilter{State: StateNeedsHash}
+	if force {
+		filter = MediaFilter{}
+	}
+	sf, err := s.loadFailures(StageChecksum)
+	if err != nil {
+		return err
+	}
+	index := 0
+	return s.sdr.ForEachMedia(filter, func(entry *SourceMedia) error {
+		log.Printf("%v %v", index, entry.Checksum)
+		index++
+		if !s.due(sf, entry, force) {
+			return nil
 		}
-		err = fob.Close()
+		return s.settle(sf, entry, s.computeChecksum(entry))
+	})
+}
 
+// computeChecksum hashes the file of entry and adds it to its checksum group
+func (s service) computeChecksum(entry *SourceMedia) error {
+	fob, err := s.sfr.GetSourceFile(entry.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// the catalog holds media of other source roots, which need not be mounted
+		log.Printf("skip unavailable %v", entry.Path)
+		return nil
 	}
-	return nil
+	if err != nil {
+		return asFileError(err)
+	}
+	defer fob.Close()
+	info, err := fob.Stat()
+	if err != nil {
+		return asFileError(err)
+	}
+	h := sha1.New()
+	_, err = io.Copy(h, fob)
+	if err != nil {
+		return asFileError(err)
+	}
+	entry.Checksum = hex.EncodeToString(h.Sum(nil))
+	entry.Size = info.Size()
+	entry.ModTime = info.ModTime()
+	log.Printf("%s %s", entry.Path, entry.Checksum)
+	_, err = s.sdr.SaveMedia(entry)
+	if err != nil {
+		return err
+	}
+	return s.sdr.AddChecksum(entry)
 }
 
 func (s service) DetectMimetype(force bool) error {
-	importFiles, err := s.sdr.GetAllFiles()
-
+	// media without mimetype are indexed under the empty mimetype
+	filter := MediaFilter{Mimetypes: []string{""}}
+	if force {
+		filter = MediaFilter{}
+	}
+	sf, err := s.loadFailures(StageMimetype)
 	if err != nil {
 		return err
 	}
-	for index, entry := range importFiles {
+	index := 0
+	return s.sdr.ForEachMedia(filter, func(entry *SourceMedia) error {
 		log.Printf("%v %v", index, entry)
-		if entry.Mimetype != "" && force == false {
-			continue
-		}
-		fob, err := os.Open(entry.Path)
-		if err != nil {
-			return err
-		}
-		b := make([]byte, 512)
-		_, err = fob.Read(b)
-		var mtype *mimetype.MIME
-		if err == nil {
-			mtype, err = mimetype.DetectReader(bytes.NewReader(b))
-			log.Printf("%s %s", entry.Path, mtype.String())
-		}
-		if err != nil {
-			log.Printf("could not detect mimetype for %v", entry.Path)
-			entry.Mimetype = "unknown/error"
-		} else {
-			entry.Mimetype = mtype.String()
-		}
-		_, err = s.sdr.SaveMedia(entry)
-		if err != nil {
-			return err
-		}
-		err = fob.Close()
-		if err != nil {
-			return err
+		index++
+		if !s.due(sf, entry, force) {
+			return nil
 		}
+		return s.settle(sf, entry, s.detectMimetype(entry))
+	})
+}
+
+// detectMimetype sniffs the mimetype of entry from the start of its file
+func (s service) detectMimetype(entry *SourceMedia) error {
+	fob, err := s.sfr.GetSourceFile(entry.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("skip unavailable %v", entry.Path)
+		return nil
 	}
+	if err != nil {
+		return asFileError(err)
+	}
+	defer fob.Close()
+	b := make([]byte, 512)
+	_, err = fob.Read(b)
+	var mtype *mimetype.MIME
+	if err == nil {
+		mtype, err = mimetype.DetectReader(bytes.NewReader(b))
+		log.Printf("%s %s", entry.Path, mtype.String())
+	}
+	if err != nil {
+		log.Printf("could not detect mimetype for %v", entry.Path)
+		entry.Mimetype = "unknown/error"
+	} else {
+		entry.Mimetype = mtype.String()
+	}
+	_, err = s.sdr.SaveMedia(entry)
 	return err
 }
 
+// mimetypes whose creation date is extracted
+var dateMimetypes = []string{"image/jpeg", "image/png", "image/webp"}
+
 func (s service) ExtractCreationDate(force bool) error {
-	mtFilter := []string{"image/jpeg", "image/png"}
 	//mtFilter := []string{"video/mp4"}
-	medialist, err := s.sdr.GetFilesByMimetypeFilter(mtFilter)
-	if err != nil {
-		return err
-	}
-	for i := range medialist {
-		if medialist[i].CreationDate.Year() > 2000 && !force {
+	var undated []*SourceMedia
+	dirDates := newDirectoryDates()
+	err := s.sdr.ForEachMedia(MediaFilter{Mimetypes: dateMimetypes}, func(media *SourceMedia) error {
+		if media.DateSource == DateSourceManual {
+			dirDates.add(media)
+			return nil
+		}
+		if media.CreationDate.Year() > 2000 && media.DateConfidence() > ConfidenceLow && !force {
 			//if medialist[i].Id != 19192 { // --C:\Data\Bilder\samples
 			//log.Printf("CreationDate alr3eday present %v %v", medialist[i].Path, medialist[i].CreationDate)
-			continue
+			dirDates.add(media)
+			return nil
 
 		}
-		log.Printf("search exif CreationDate for %v", medialist[i].Path)
-		var dt time.Time
-		if medialist[i].Mimetype != "video/mp4" {
-			dt, err = s.ExtractExifDataFromFile(medialist[i])
+		found, err := s.extractCreationDate(media)
+		if err != nil {
+			return err
 		}
-		if err != nil || medialist[i].Mimetype == "video/mp4" {
-			log.Printf("%v", err)
-			dt, err = s.ExtractDateByFilename(medialist[i])
+		if found {
+			dirDates.add(media)
+		} else {
+			undated = append(undated, media)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.applyDateFallbacks(dirDates, undated)
+}
+
+// extractCreationDate searches the exif data, the sidecar, the metadata
+// and the filename of media for its date and reports whether one was found
+func (s service) extractCreationDate(media *SourceMedia) (bool, error) {
+	log.Printf("search exif CreationDate for %v", media.Path)
+	var dt time.Time
+	var offset time.Duration
+	err := errors.New("no exif data in videos")
+	source := DateSourceExif
+	if media.Mimetype != "video/mp4" {
+		var camera CameraInfo
+		dt, camera, err = s.ExtractExifDataFromFile(media)
 		if err == nil {
-			medialist[i].CreationDate = dt
-			log.Printf("found CreationDate for %v", medialist[i])
-			_, err = s.sdr.SaveMedia(medialist[i])
-			if err != nil {
-				return err
-			}
-		} else {
-			log.Printf("could not find CreationDate for %v", medialist[i].Path)
+			media.Camera = camera
+			offset = s.cfg.clockOffset(camera, dt)
 		}
 	}
-	return nil
+	if err != nil && media.Sidecar != "" {
+		log.Printf("%v", err)
+		source = DateSourceSidecar
+		dt, err = s.ExtractDateBySidecar(media)
+	}
+	if err != nil && media.Mimetype != "video/mp4" {
+		log.Printf("%v", err)
+		source = DateSourceMetadata
+		dt, err = s.ExtractMetadataDateFromFile(media)
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		dt, err = s.ExtractDateByFilename(media)
+		source = DateSourceFilename
+	}
+	if err != nil {
+		log.Printf("could not find CreationDate for %v", media.Path)
+		return false, nil
+	}
+	return true, s.applyCreationDate(media, dt, offset, source)
 }
 
-func (s service) ExtractExifDataFromFile(media *SourceMedia) (time.Time, error) {
-	fob, err := os.Open(media.Path)
-	defer fob.Close()
+// applyCreationDate stores dt corrected by offset as CreationDate unless
+// the media already carries a date of higher confidence
+func (s service) applyCreationDate(media *SourceMedia, dt time.Time, offset time.Duration, source DateSource) error {
+	if media.DateConfidence() > source.Confidence() {
+		log.Printf("keep %s CreationDate for %v, ignore %s date %v", media.DateSource, media.Path, source, dt)
+		return nil
+	}
+	if offset != 0 {
+		log.Printf("correct clock of %v %v by %v", media.Camera.Make, media.Camera.Model, offset)
+	}
+	media.CreationDate = dt.Add(offset)
+	media.OriginalCreationDate = dt
+	media.ClockOffset = offset
+	media.OffsetKnown = hasRecordedZone(dt)
+	media.DateSource = source
+	log.Printf("found CreationDate for %v", media)
+	_, err := s.sdr.SaveMedia(media)
+	return err
+}
+
+// hasRecordedZone reports whether an extracted date carries the zone
+// offset recorded with it. The extraction returns dates without a zone as
+// UTC and recorded zones, +00:00 included, as fixed zones.
+func hasRecordedZone(dt time.Time) bool {
+	return dt.Location() != time.UTC
+}
+
+// ExtractExifDataFromFile returns the recorded date and the camera of media
+func (s service) ExtractExifDataFromFile(media *SourceMedia) (time.Time, CameraInfo, error) {
+	camera := CameraInfo{}
+	fob, err := s.sfr.GetSourceFile(media.Path)
 	if err != nil {
-		return time.Time{}, err
+		return time.Time{}, camera, err
 	}
+	defer fob.Close()
 	data, err := io.ReadAll(fob)
 	if err != nil {
-		return time.Time{}, err
+		return time.Time{}, camera, err
 	}
-	rawExif, err := exif.SearchAndExtractExif(data)
+	rawExif, err := searchRawExif(media.Mimetype, data)
 	if err != nil {
-		return time.Time{}, err
+		return time.Time{}, camera, err
 	}
 	im, err := exifcommon.NewIfdMappingWithStandard()
 	ti := exif.NewTagIndex()
 	_, index, err := exif.Collect(im, ti, rawExif)
 	if err != nil {
-		return time.Time{}, err
+		return time.Time{}, camera, err
 	}
 	rootIfd := index.RootIfd
 	entries := rootIfd.DumpTags()
 	createTime := time.Time{}
+	offsetTime := ""
 	for j := range entries {
 
 		t := entries[j].TagName()
 		log.Printf(t)
-		if t == "DateTimeOriginal" || t == "DateTime" {
+		switch t {
+		case "DateTimeOriginal", "DateTime":
 			v, _ := entries[j].Value()
 			createTime, err = time.Parse("2006:01:02 15:04:05", v.(string))
+		case "OffsetTimeOriginal":
+			offsetTime = exifString(entries[j])
+		case "Make":
+			camera.Make = exifString(entries[j])
+		case "Model":
+			camera.Model = exifString(entries[j])
+		case "BodySerialNumber", "SerialNumber", "CameraSerialNumber":
+			if camera.Serial == "" {
+				camera.Serial = exifString(entries[j])
+			}
+		}
+	}
+	if err == nil && createTime.IsZero() {
+		err = fmt.Errorf("no exif date in %v", media.Path)
+	}
+	if err == nil && offsetTime != "" {
+		// keep the recorded zone, so it can be written back on export
+		zone, zerr := time.Parse("-07:00", offsetTime)
+		if zerr == nil {
+			_, offset := zone.Zone()
+			createTime, err = time.ParseInLocation("2006:01:02 15:04:05",
+				createTime.Format("2006:01:02 15:04:05"), time.FixedZone("", offset))
 		}
 	}
-	return createTime, err
+	return createTime, camera, err
+}
+
+// ExtractMetadataDateFromFile returns the date of the png text chunks or
+// of the xmp packet embedded in media
+func (s service) ExtractMetadataDateFromFile(media *SourceMedia) (time.Time, error) {
+	fob, err := s.sfr.GetSourceFile(media.Path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer fob.Close()
+	data, err := io.ReadAll(fob)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return extractTextDate(media.Mimetype, data)
+}
+
+// exifString returns the trimmed value of an ascii tag
+func exifString(ite *exif.IfdTagEntry) string {
+	v, err := ite.Value()
+	if err != nil {
+		return ""
+	}
+	str, ok := v.(string)
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(str, "\x00"))
 }
 
 func (s service) ExtractDateByFilename(media *SourceMedia) (time.Time, error) {
@@ -248,31 +571,94 @@ func (s service) ExtractDateByFilename(media *SourceMedia) (time.Time, error) {
 			return dt, nil
 		}
 	}
-	return time.Time{}, err
+	return time.Time{}, fmt.Errorf("no date in filename %v", media.Path)
 }
 
+// exported mimetypes and the extensions of their exports
+var exportMimetypes = []string{"image/jpeg", "video/mp4", "image/png", "image/webp"}
+var exportExtensions = []string{"jpg", "mp4", "png", "webp"}
+
 func (s service) OrganizeToFolder() error {
-	mtFilter := []string{"image/jpeg", "video/mp4", "image/png"}
-	mtExt := []string{"jpg", "mp4", "png"}
-	//mtFilter := []string{"video/mp4", "image/png"}
-	err, sourceChecks := s.sdr.GetAllCheckSum()
+	sf, err := s.loadFailures(StageExport)
 	if err != nil {
 		return err
 	}
-	for j := range sourceChecks {
-		path := sourceChecks[j].Sources[0]
-		media, err := s.sdr.GetFileByKey(path)
+	return s.sdr.ForEachChecksum("", func(sourceCheck *SourceChecksum) error {
+		media, fob, err := s.openChecksumSource(sf, sourceCheck)
 		if err != nil {
 			return err
 		}
-		for i := range mtFilter {
-			if mtFilter[i] == media.Mimetype {
-				err = s.drf.ExportToDirectory(media, mtExt[i])
-				if err != nil {
-					return err
-				}
+		if media == nil {
+			log.Printf("no available media for checksum %v", sourceCheck.Key)
+			return nil
+		}
+		defer fob.Close()
+		return s.settle(sf, media, s.exportMedia(media, fob, sourceCheck))
+	})
+}
+
+// exportMedia copies fob, the open file of media, to the destination and
+// marks the checksum group exported. Other mimetypes are not exported.
+func (s service) exportMedia(media *SourceMedia, fob fs.File, checksum *SourceChecksum) error {
+	for i := range exportMimetypes {
+		if exportMimetypes[i] == media.Mimetype {
+			exportedPath, err := s.drf.ExportToDirectory(media, exportExtensions[i], fob)
+			if err != nil {
+				return asFileError(err)
 			}
+			return s.markExported(checksum, exportedPath)
 		}
 	}
-	return err
+	return nil
+}
+
+// openChecksumSource opens the first file of the checksum group which is
+// available, the others may be on unmounted roots or fail to open. It
+// returns nil media if none is.
+func (s service) openChecksumSource(sf *stageFailures, checksum *SourceChecksum) (*SourceMedia, fs.File, error) {
+	for _, name := range checksum.Sources {
+		media, err := s.sdr.GetFileByKey(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if media == nil {
+			log.Printf("no media for checksum source %v", name)
+			continue
+		}
+		fob, err := s.sfr.GetSourceFile(media.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("skip unavailable %v", media.Path)
+			continue
+		}
+		if err != nil {
+			err = s.settle(sf, media, asFileError(err))
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		return media, fob, nil
+	}
+	return nil, nil, nil
+}
+
+// markExported records the export of a checksum group on all its media
+func (s service) markExported(checksum *SourceChecksum, exportedPath string) error {
+	now := time.Now()
+	for i := range checksum.Sources {
+		media, err := s.sdr.GetFileByKey(checksum.Sources[i])
+		if err != nil {
+			return err
+		}
+		if media == nil {
+			continue
+		}
+		media.ExportedPath = exportedPath
+		media.ExportedAt = now
+		_, err = s.sdr.SaveMedia(media)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,72 @@
+package imports_test
+
+import (
+	"nextimagescrap/pkg/imports"
+	"nextimagescrap/pkg/storage"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/fstest"
+)
+
+// catalogedPaths returns the sorted paths of all media of sdr
+func catalogedPaths(t *testing.T, sdr imports.SourceDbRepository) []string {
+	t.Helper()
+	var paths []string
+	err := sdr.ForEachMedia(imports.MediaFilter{}, func(media *imports.SourceMedia) error {
+		paths = append(paths, media.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestScanRulesApplyToJsonFiles(t *testing.T) {
+	sidecar := []byte(`{"title": "1.jpg", "photoTakenTime": {"timestamp": "1577934245"}}`)
+	files := fstest.MapFS{
+		"a/1.jpg":      {Data: []byte("jpeg")},
+		"a/1.jpg.json": {Data: sidecar},
+		"a/notes.json": {Data: []byte(`{}`)},
+		"a/big.json":   {Data: make([]byte, 2000)},
+		"b/2.png":      {Data: []byte("png")},
+		"b/2.png.json": {Data: sidecar},
+	}
+	tests := []struct {
+		name string
+		cfg  imports.ScanConfig
+		want []string
+	}{
+		{"all", imports.ScanConfig{}, []string{"a/1.jpg", "a/big.json", "a/notes.json", "b/2.png"}},
+		{"include", imports.ScanConfig{Include: []string{"*.jpg"}}, []string{"a/1.jpg"}},
+		{"exclude", imports.ScanConfig{Exclude: []string{"notes.json"}}, []string{"a/1.jpg", "a/big.json", "b/2.png"}},
+		{"max size", imports.ScanConfig{MaxSize: 1000}, []string{"a/1.jpg", "a/notes.json", "b/2.png"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sfr, err := storage.NewFSSourceStorage(files, ".")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sdr := storage.NewMemSourceStorage()
+			s := imports.NewConfiguredService(sfr, sdr, nil, imports.Config{Scan: tt.cfg})
+			err = s.ScanSourceDirectory()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := catalogedPaths(t, sdr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cataloged %v, want %v", got, tt.want)
+			}
+			// sidecars of cataloged media are attached whatever the rules
+			media, err := sdr.GetFileByPath("a/1.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if media.Sidecar != "1.jpg.json" {
+				t.Errorf("a/1.jpg has sidecar %q", media.Sidecar)
+			}
+		})
+	}
+}
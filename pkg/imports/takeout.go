@@ -0,0 +1,260 @@
+package imports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// takeoutNameLength is the length Google Takeout truncates sidecar names
+// to, without the ".json" extension
+const takeoutNameLength = 46
+
+// takeoutSupplemental is inserted before ".json" by newer Takeout exports
+const takeoutSupplemental = ".supplemental-metadata"
+
+// takeoutCopyPattern matches the "(1)" Takeout appends to the name of a
+// second file of the same name, before the extension
+var takeoutCopyPattern = regexp.MustCompile(`^(.*)(\(\d+\))(\.[^.]*)$`)
+
+// takeoutSidecar is the part of a Google Takeout metadata json we use
+type takeoutSidecar struct {
+	Title          string `json:"title"`
+	Description    string `json:"description"`
+	PhotoTakenTime struct {
+		Timestamp string `json:"timestamp"`
+	} `json:"photoTakenTime"`
+	GeoData     takeoutGeoData `json:"geoData"`
+	GeoDataExif takeoutGeoData `json:"geoDataExif"`
+	People      []struct {
+		Name string `json:"name"`
+	} `json:"people"`
+}
+
+type takeoutGeoData struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+// location returns the geo data, Takeout writes zeros when it has none
+func (g takeoutGeoData) location() *GeoLocation {
+	if g.Latitude == 0 && g.Longitude == 0 {
+		return nil
+	}
+	return &GeoLocation{Latitude: g.Latitude, Longitude: g.Longitude, Altitude: g.Altitude}
+}
+
+// isSidecarName tells whether name may be a metadata sidecar
+func isSidecarName(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".json")
+}
+
+// truncateTakeoutName cuts name to the length of Takeout sidecar names
+func truncateTakeoutName(name string) string {
+	r := []rune(name)
+	if len(r) > takeoutNameLength {
+		return string(r[:takeoutNameLength])
+	}
+	return name
+}
+
+// sidecarCandidates returns the names Takeout may have given the sidecar
+// of the media file name, best match first. The sidecar of "a(1).jpg" is
+// "a.jpg(1).json", edited copies share the sidecar of their original.
+func sidecarCandidates(name string) []string {
+	copySuffix := ""
+	if m := takeoutCopyPattern.FindStringSubmatch(name); m != nil {
+		name = m[1] + m[3]
+		copySuffix = m[2]
+	}
+	ext := filepath.Ext(name)
+	bases := []string{name}
+	if stem := strings.TrimSuffix(name, ext); strings.HasSuffix(stem, "-edited") {
+		bases = append(bases, strings.TrimSuffix(stem, "-edited")+ext)
+	}
+	var candidates []string
+	for _, base := range bases {
+		candidates = append(candidates,
+			truncateTakeoutName(base)+copySuffix+".json",
+			truncateTakeoutName(base+takeoutSupplemental)+copySuffix+".json",
+			truncateTakeoutName(strings.TrimSuffix(base, ext))+copySuffix+".json",
+		)
+	}
+	return candidates
+}
+
+// matchSidecars returns the sidecar of each media name found in sidecars
+func matchSidecars(media []string, sidecars []string) map[string]string {
+	available := make(map[string]bool, len(sidecars))
+	for _, name := range sidecars {
+		available[name] = true
+	}
+	matches := make(map[string]string)
+	for _, name := range media {
+		for _, candidate := range sidecarCandidates(name) {
+			if available[candidate] {
+				matches[name] = candidate
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// scannedDir collects the file names of a directory during the scan
+type scannedDir struct {
+	media    []string
+	sidecars []string
+	// unselected marks the json files the scan rules leave out, unless
+	// they are the sidecar of a media
+	unselected map[string]bool
+}
+
+// addSidecar records the json file name, selected tells whether the scan
+// rules catalog it when it is no sidecar of a media
+func (d *scannedDir) addSidecar(name string, selected bool) {
+	d.sidecars = append(d.sidecars, name)
+	if selected {
+		return
+	}
+	if d.unselected == nil {
+		d.unselected = make(map[string]bool)
+	}
+	d.unselected[name] = true
+}
+
+// attachSidecars stores the metadata of the sidecars matched to media of
+// the scanned directories. Json files which are no sidecar of a media are
+// cataloged like any other file if the scan rules select them.
+func (s service) attachSidecars(dirs map[string]*scannedDir, rules *scanRules) error {
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+	for _, dir := range names {
+		d := dirs[dir]
+		if len(d.sidecars) == 0 {
+			continue
+		}
+		matched := make(map[string]bool)
+		matches := matchSidecars(d.media, d.sidecars)
+		for _, name := range d.media {
+			sidecar, ok := matches[name]
+			if !ok {
+				continue
+			}
+			ok, err := s.attachSidecar(filepath.Join(dir, name), sidecar)
+			if err != nil {
+				return err
+			}
+			if ok {
+				matched[sidecar] = true
+			}
+		}
+		for _, sidecar := range d.sidecars {
+			if matched[sidecar] {
+				continue
+			}
+			if d.unselected[sidecar] {
+				rules.skipped++
+				continue
+			}
+			err := s.addFile(filepath.Join(dir, sidecar))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// attachSidecar stores the metadata of sidecar with the media at path and
+// reports whether sidecar is a Takeout sidecar
+func (s service) attachSidecar(path string, sidecar string) (bool, error) {
+	media, err := s.sdr.GetFileByPath(path)
+	if err != nil || media == nil {
+		return false, err
+	}
+	if media.Sidecar == sidecar {
+		return true, nil
+	}
+	media.Sidecar = sidecar
+	metadata, err := s.readSidecar(media)
+	if err != nil {
+		log.Printf("ignore sidecar %v: %v", sidecar, err)
+		return false, nil
+	}
+	applySidecarMetadata(media, metadata)
+	log.Printf("found sidecar %v for %v", sidecar, media.Key)
+	_, err = s.sdr.SaveMedia(media)
+	return true, err
+}
+
+// readSidecar reads the Takeout sidecar of media
+func (s service) readSidecar(media *SourceMedia) (*takeoutSidecar, error) {
+	if media.Sidecar == "" {
+		return nil, errors.New("no sidecar")
+	}
+	fob, err := s.sfr.GetSourceFile(filepath.Join(filepath.Dir(media.Path), media.Sidecar))
+	if err != nil {
+		return nil, err
+	}
+	defer fob.Close()
+	metadata := &takeoutSidecar{}
+	err = json.NewDecoder(fob).Decode(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Title == "" && metadata.PhotoTakenTime.Timestamp == "" {
+		return nil, errors.New("not a takeout sidecar")
+	}
+	return metadata, nil
+}
+
+// applySidecarMetadata copies description, people and location of the
+// sidecar to media, a location from the media itself is kept
+func applySidecarMetadata(media *SourceMedia, metadata *takeoutSidecar) {
+	if metadata.Description != "" {
+		media.Description = metadata.Description
+	}
+	if len(metadata.People) > 0 {
+		media.People = nil
+		for _, p := range metadata.People {
+			media.People = append(media.People, p.Name)
+		}
+	}
+	if media.Location == nil {
+		media.Location = metadata.GeoData.location()
+		if media.Location == nil {
+			media.Location = metadata.GeoDataExif.location()
+		}
+	}
+}
+
+// ExtractDateBySidecar returns the date the sidecar of media records as
+// taken and fills in its location
+func (s service) ExtractDateBySidecar(media *SourceMedia) (time.Time, error) {
+	metadata, err := s.readSidecar(media)
+	if err != nil {
+		return time.Time{}, err
+	}
+	applySidecarMetadata(media, metadata)
+	if metadata.PhotoTakenTime.Timestamp == "" {
+		return time.Time{}, fmt.Errorf("no photoTakenTime in %v", media.Sidecar)
+	}
+	ts, err := strconv.ParseInt(metadata.PhotoTakenTime.Timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// the timestamp is an instant, so its zone is known
+	return time.Unix(ts, 0).In(time.FixedZone("", 0)), nil
+}
@@ -0,0 +1,72 @@
+package imports
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSidecarCandidates(t *testing.T) {
+	long := strings.Repeat("a", 50) + ".jpg"
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"a.jpg", []string{"a.jpg.json", "a.jpg.supplemental-metadata.json", "a.json"}},
+		{"a(1).jpg", []string{"a.jpg(1).json", "a.jpg.supplemental-metadata(1).json", "a(1).json"}},
+		{"a-edited.jpg", []string{
+			"a-edited.jpg.json", "a-edited.jpg.supplemental-metadata.json", "a-edited.json",
+			"a.jpg.json", "a.jpg.supplemental-metadata.json", "a.json",
+		}},
+		{long, []string{
+			strings.Repeat("a", 46) + ".json", strings.Repeat("a", 46) + ".json", strings.Repeat("a", 46) + ".json",
+		}},
+		// the supplemental suffix is cut at the name length
+		{"IMG_20200102_030405_123.jpg", []string{
+			"IMG_20200102_030405_123.jpg.json", "IMG_20200102_030405_123.jpg.supplemental-metad.json", "IMG_20200102_030405_123.json",
+		}},
+		// runes, not bytes, are counted
+		{strings.Repeat("ä", 50) + ".jpg", []string{
+			strings.Repeat("ä", 46) + ".json", strings.Repeat("ä", 46) + ".json", strings.Repeat("ä", 46) + ".json",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sidecarCandidates(tt.name)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchSidecars(t *testing.T) {
+	long := strings.Repeat("b", 44) + ".jpg"
+	tests := []struct {
+		name     string
+		media    []string
+		sidecars []string
+		want     map[string]string
+	}{
+		{"plain", []string{"a.jpg"}, []string{"a.jpg.json"}, map[string]string{"a.jpg": "a.jpg.json"}},
+		{"copies", []string{"a.jpg", "a(1).jpg"}, []string{"a.jpg.json", "a.jpg(1).json"},
+			map[string]string{"a.jpg": "a.jpg.json", "a(1).jpg": "a.jpg(1).json"}},
+		{"edited shares sidecar", []string{"a.jpg", "a-edited.jpg"}, []string{"a.jpg.json"},
+			map[string]string{"a.jpg": "a.jpg.json", "a-edited.jpg": "a.jpg.json"}},
+		{"supplemental", []string{"a.jpg"}, []string{"a.jpg.supplemental-metadata.json"},
+			map[string]string{"a.jpg": "a.jpg.supplemental-metadata.json"}},
+		{"without extension", []string{"a.mp4"}, []string{"a.json"}, map[string]string{"a.mp4": "a.json"}},
+		{"truncated", []string{long}, []string{strings.Repeat("b", 44) + ".j.json"},
+			map[string]string{long: strings.Repeat("b", 44) + ".j.json"}},
+		{"best match first", []string{"a.jpg"}, []string{"a.json", "a.jpg.json"}, map[string]string{"a.jpg": "a.jpg.json"}},
+		{"no sidecar", []string{"a.jpg", "b.jpg"}, []string{"c.jpg.json", "b(1).jpg.json"}, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchSidecars(tt.media, tt.sidecars)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matches %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package imports
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WatchedFile is a file of the source which was created or written and
+// then left alone for the settle time
+type WatchedFile struct {
+	Path string
+	// Rel is the slash separated path relative to the source
+	Rel  string
+	Info fs.DirEntry
+}
+
+// SourceWatcher is a SourceFileRepository which reports files as they
+// appear in the source
+type SourceWatcher interface {
+	// WatchSourceFiles calls fn with the files created or written below
+	// the source once no write happened to them for settle, the files of
+	// directories and archives moved into the source included. It returns
+	// when stop is closed, a nil stop watches until the process ends.
+	WatchSourceFiles(settle time.Duration, stop <-chan struct{}, fn func(files []WatchedFile) error) error
+}
+
+// Watch imports the files appearing in the source until stop is closed.
+// Each file runs through the scan rules, mimetype detection, hashing,
+// date extraction and, if the service has a destination, the export.
+func (s service) Watch(settle time.Duration, stop <-chan struct{}) error {
+	watcher, ok := s.sfr.(SourceWatcher)
+	if !ok {
+		return fmt.Errorf("source %T cannot be watched", s.sfr)
+	}
+	return watcher.WatchSourceFiles(settle, stop, s.importFiles)
+}
+
+// watchStages are the failures of the stages a watched file runs through
+type watchStages struct {
+	mimetype *stageFailures
+	checksum *stageFailures
+	export   *stageFailures
+}
+
+func (s service) loadWatchStages() (*watchStages, error) {
+	var err error
+	ws := &watchStages{}
+	ws.mimetype, err = s.loadFailures(StageMimetype)
+	if err != nil {
+		return nil, err
+	}
+	ws.checksum, err = s.loadFailures(StageChecksum)
+	if err != nil {
+		return nil, err
+	}
+	ws.export, err = s.loadFailures(StageExport)
+	return ws, err
+}
+
+// importFiles catalogs the files selected by the scan rules and runs the
+// stages for the media among them
+func (s service) importFiles(files []WatchedFile) error {
+	log.Printf("import %d new files", len(files))
+	rules := newScanRules(s.cfg.Scan)
+	dirs := make(map[string]*scannedDir)
+	var paths []string
+	for _, f := range files {
+		skip, err := s.skipWatched(rules, f)
+		if err != nil {
+			return err
+		}
+		if skip {
+			rules.skipped++
+			continue
+		}
+		dir := filepath.Dir(f.Path)
+		d, ok := dirs[dir]
+		if !ok {
+			d = &scannedDir{}
+			dirs[dir] = d
+		}
+		if isSidecarName(f.Info.Name()) {
+			d.addSidecar(f.Info.Name(), rules.selects(f.Rel, f.Info))
+			continue
+		}
+		if !rules.selects(f.Rel, f.Info) {
+			rules.skipped++
+			continue
+		}
+		d.media = append(d.media, f.Info.Name())
+		err = s.addWatchedFile(f)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, f.Path)
+	}
+	s.addCatalogedNeighbours(dirs)
+	err := s.attachSidecars(dirs, rules)
+	if err != nil {
+		return err
+	}
+	if rules.skipped > 0 {
+		log.Printf("skipped %d files by scan rules", rules.skipped)
+	}
+	return s.processFiles(paths)
+}
+
+// addWatchedFile catalogs the file of f. A cataloged file whose size or
+// mtime differs from when it was hashed was rewritten, what was learned
+// from its former content is dropped so the stages run for it again.
+func (s service) addWatchedFile(f WatchedFile) error {
+	media, err := s.sdr.GetFileByPath(f.Path)
+	if err != nil {
+		return err
+	}
+	if media == nil {
+		return s.addFile(f.Path)
+	}
+	info, err := f.Info.Info()
+	if err != nil {
+		// the file is gone again, the next scan will find it missing
+		log.Printf("cannot stat %v: %v", f.Path, err)
+		return nil
+	}
+	if media.Size == info.Size() && media.ModTime.Equal(info.ModTime()) {
+		return nil
+	}
+	log.Printf("%v was rewritten, processing it again", f.Path)
+	media.forgetContent()
+	_, err = s.sdr.SaveMedia(media)
+	return err
+}
+
+// skipWatched reports whether the scan rules leave out f or a directory
+// above it, the ignore files of the directories are read on the way
+func (s service) skipWatched(rules *scanRules, f WatchedFile) (bool, error) {
+	root := strings.TrimSuffix(f.Path, filepath.FromSlash(f.Rel))
+	rel := "."
+	for _, name := range strings.Split(path.Dir(f.Rel), "/") {
+		if name != "." {
+			rel = path.Join(rel, name)
+		}
+		if rules.skipPath(rel, true) {
+			return true, nil
+		}
+		if rules.loaded[rel] {
+			continue
+		}
+		rules.loaded[rel] = true
+		dirPath := filepath.Join(root, filepath.FromSlash(rel))
+		err := s.loadIgnoreFile(rules, dirPath, rel)
+		if err != nil {
+			return true, s.recordScanFailure(dirPath, err)
+		}
+	}
+	return rules.skipPath(f.Rel, false), nil
+}
+
+// addCatalogedNeighbours adds the other files of directories with new
+// sidecars to their media, the sidecar may arrive after its media
+func (s service) addCatalogedNeighbours(dirs map[string]*scannedDir) {
+	for dir, d := range dirs {
+		if len(d.sidecars) == 0 {
+			continue
+		}
+		f, err := s.sfr.GetSourceFile(dir)
+		if err != nil {
+			log.Printf("cannot list %v: %v", dir, err)
+			continue
+		}
+		rd, ok := f.(fs.ReadDirFile)
+		if !ok {
+			f.Close()
+			continue
+		}
+		entries, err := rd.ReadDir(-1)
+		f.Close()
+		if err != nil {
+			log.Printf("cannot list %v: %v", dir, err)
+		}
+		known := make(map[string]bool)
+		for _, name := range d.media {
+			known[name] = true
+		}
+		for _, e := range entries {
+			if e.IsDir() || known[e.Name()] || isSidecarName(e.Name()) {
+				continue
+			}
+			d.media = append(d.media, e.Name())
+		}
+	}
+}
+
+// processFiles runs the stages for the media at paths, media waiting for
+// the backoff of a failed stage stop there
+func (s service) processFiles(paths []string) error {
+	ws, err := s.loadWatchStages()
+	if err != nil {
+		return err
+	}
+	var media []*SourceMedia
+	var undated []*SourceMedia
+	dirDates := newDirectoryDates()
+	for _, p := range paths {
+		m, err := s.sdr.GetFileByPath(p)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			continue
+		}
+		ok, err := s.prepareMedia(ws, m)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		media = append(media, m)
+		if needsDate(m) {
+			undated = append(undated, m)
+		} else {
+			dirDates.add(m)
+		}
+	}
+	err = s.applyDateFallbacks(dirDates, undated)
+	if err != nil {
+		return err
+	}
+	if s.drf == nil {
+		return nil
+	}
+	for _, m := range media {
+		err = s.exportWatched(ws, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareMedia detects the mimetype, hashes and dates media as far as not
+// done before and reports whether media got through
+func (s service) prepareMedia(ws *watchStages, media *SourceMedia) (bool, error) {
+	if media.Mimetype == "" {
+		ok, err := s.runStage(ws.mimetype, media, s.detectMimetype)
+		if !ok || err != nil || media.Mimetype == "" {
+			return false, err
+		}
+	}
+	if media.Checksum == "" {
+		ok, err := s.runStage(ws.checksum, media, s.computeChecksum)
+		if !ok || err != nil || media.Checksum == "" {
+			return false, err
+		}
+	}
+	if needsDate(media) {
+		_, err := s.extractCreationDate(media)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// runStage runs the stage fn for media unless it waits for its backoff
+// and reports whether it succeeded
+func (s service) runStage(sf *stageFailures, media *SourceMedia, fn func(media *SourceMedia) error) (bool, error) {
+	if !s.due(sf, media, false) {
+		return false, nil
+	}
+	stageErr := fn(media)
+	err := s.settle(sf, media, stageErr)
+	return stageErr == nil && err == nil, err
+}
+
+// exportWatched exports media unless a file of its checksum group was
+// exported before, then media takes over that export
+func (s service) exportWatched(ws *watchStages, media *SourceMedia) error {
+	group, err := s.sdr.GetChecksum(media.Checksum)
+	if err != nil || group == nil {
+		return err
+	}
+	for _, name := range group.Sources {
+		other, err := s.sdr.GetFileByKey(name)
+		if err != nil {
+			return err
+		}
+		if other == nil || other.ExportedPath == "" {
+			continue
+		}
+		if other.Key != media.Key {
+			log.Printf("%v is a duplicate of %v, exported as %v", media.Path, other.Path, other.ExportedPath)
+			media.ExportedPath = other.ExportedPath
+			media.ExportedAt = other.ExportedAt
+			_, err = s.sdr.SaveMedia(media)
+		}
+		return err
+	}
+	if !s.due(ws.export, media, false) {
+		return nil
+	}
+	fob, err := s.sfr.GetSourceFile(media.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("skip unavailable %v", media.Path)
+		return nil
+	}
+	if err != nil {
+		return s.settle(ws.export, media, asFileError(err))
+	}
+	defer fob.Close()
+	return s.settle(ws.export, media, s.exportMedia(media, fob, group))
+}
+
+// needsDate reports whether ExtractCreationDate would search the date of media
+func needsDate(media *SourceMedia) bool {
+	if !containsMimetype(dateMimetypes, media.Mimetype) || media.DateSource == DateSourceManual {
+		return false
+	}
+	return media.CreationDate.Year() <= 2000 || media.DateConfidence() <= ConfidenceLow
+}
+
+func containsMimetype(mimetypes []string, mimetype string) bool {
+	for i := range mimetypes {
+		if mimetypes[i] == mimetype {
+			return true
+		}
+	}
+	return false
+}
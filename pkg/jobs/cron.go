@@ -0,0 +1,217 @@
+package jobs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression
+type Schedule struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// domAny and dowAny are set when the field is "*", a restricted day of
+	// month and day of week match either, as in cron
+	domAny bool
+	dowAny bool
+}
+
+// scheduleDescriptors are the named schedules
+var scheduleDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronField is the range of a field of a cron expression
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseSchedule parses a cron expression of the five fields minute, hour,
+// day of month, month and day of week, or one of @yearly, @monthly,
+// @weekly, @daily and @hourly. Fields are "*", numbers, ranges "1-5",
+// steps "*/15" or "0-30/10" and lists of those. Sunday is 0 or 7.
+func ParseSchedule(expr string) (*Schedule, error) {
+	spec := strings.TrimSpace(expr)
+	if d, ok := scheduleDescriptors[spec]; ok {
+		spec = d
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("schedule %q has %d fields, want %d", expr, len(fields), len(cronFields))
+	}
+	bits := make([]uint64, len(fields))
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", expr, err)
+		}
+		bits[i] = b
+	}
+	s := &Schedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	// Sunday may be written as 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseCronField returns the values selected by field as bits
+func parseCronField(field string, r cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %s %q", r.name, part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := r.min, r.max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s %q", r.name, part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid %s %q", r.name, part)
+				}
+			} else if step > 1 {
+				// "5/15" runs from 5 to the end of the range
+				hi = r.max
+			}
+		}
+		if lo < r.min || hi > r.max {
+			return 0, fmt.Errorf("%s %q is outside of %d-%d", r.name, part, r.min, r.max)
+		}
+		if lo > hi {
+			return 0, fmt.Errorf("%s %q is an empty range", r.name, part)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first time after t the schedule fires, in the location
+// of t. It returns the zero time if there is none within five years. A
+// time skipped when the clock is set forward fires once the gap is over,
+// a time repeated when the clock is set back fires only once.
+func (s *Schedule) Next(t time.Time) time.Time {
+	// the fields are matched on the wall clock of t, kept in UTC so that
+	// every wall time is stepped through once
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	end := wall.AddDate(5, 0, 0)
+	for {
+		wall = s.nextWall(wall, end)
+		if wall.IsZero() {
+			return time.Time{}
+		}
+		next := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, t.Location())
+		if next.Hour() != wall.Hour() || next.Minute() != wall.Minute() {
+			// the wall time falls into the gap of a clock set forward,
+			// the zone in effect after the gap starts where it ends
+			next, _ = next.ZoneBounds()
+		} else if first, ok := firstOccurrence(next); ok {
+			// a clock set back repeats the wall time, it fires once
+			next = first
+		}
+		if next.After(t) {
+			return next
+		}
+	}
+}
+
+// firstOccurrence returns the first time with the wall clock of t if the
+// clock was set back and t is the repetition
+func firstOccurrence(t time.Time) (time.Time, bool) {
+	start, _ := t.ZoneBounds()
+	if start.IsZero() {
+		return time.Time{}, false
+	}
+	_, offset := t.Zone()
+	_, before := start.Add(-time.Nanosecond).Zone()
+	if before <= offset {
+		return time.Time{}, false
+	}
+	first := t.Add(-time.Duration(before-offset) * time.Second)
+	if !first.Before(start) {
+		return time.Time{}, false
+	}
+	return first, true
+}
+
+// nextWall returns the first wall time after wall the schedule matches,
+// or the zero time if there is none before end
+func (s *Schedule) nextWall(wall time.Time, end time.Time) time.Time {
+	t := wall.Add(time.Minute)
+	for t.Before(end) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
@@ -0,0 +1,113 @@
+package jobs_test
+
+import (
+	"nextimagescrap/pkg/jobs"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"x * * * *",
+		"1-x * * * *",
+		"@never",
+	}
+	for _, expr := range tests {
+		if _, err := jobs.ParseSchedule(expr); err == nil {
+			t.Errorf("schedule %q parsed", expr)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"step", "*/15 * * * *", utc(10, 1, 10, 7), utc(10, 1, 10, 15)},
+		{"strictly after", "*/15 * * * *", utc(10, 1, 10, 15), utc(10, 1, 10, 30)},
+		{"seconds", "*/15 * * * *", utc(10, 1, 10, 7).Add(30 * time.Second), utc(10, 1, 10, 15)},
+		{"range with step", "0-30/10 * * * *", utc(10, 1, 10, 31), utc(10, 1, 11, 0)},
+		{"start with step", "5/20 * * * *", utc(10, 1, 10, 26), utc(10, 1, 10, 45)},
+		{"list", "0 8,20 * * *", utc(10, 1, 9, 0), utc(10, 1, 20, 0)},
+		{"hour and weekday ranges", "0 9-17 * * 1-5", utc(10, 16, 17, 30), utc(10, 19, 9, 0)},
+		{"sunday as 0", "0 0 * * 0", utc(10, 1, 0, 0), utc(10, 4, 0, 0)},
+		{"sunday as 7", "0 0 * * 7", utc(10, 1, 0, 0), utc(10, 4, 0, 0)},
+		{"weekly", "@weekly", utc(10, 1, 0, 0), utc(10, 4, 0, 0)},
+		{"day of month", "0 0 13 * *", utc(10, 1, 0, 0), utc(10, 13, 0, 0)},
+		{"day of week before day of month", "0 0 13 * 5", utc(10, 1, 0, 0), utc(10, 2, 0, 0)},
+		{"day of month before day of week", "0 0 13 * 5", utc(10, 9, 0, 0), utc(10, 13, 0, 0)},
+		{"short month", "0 0 31 * *", utc(9, 1, 0, 0), utc(10, 31, 0, 0)},
+		{"month", "0 12 * 2 *", utc(10, 1, 0, 0), time.Date(2027, 2, 1, 12, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", utc(3, 1, 0, 0), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"impossible date", "0 0 30 2 *", utc(3, 1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := jobs.ParseSchedule(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("next of %q after %v is %v, want %v", tt.expr, tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleNextDaylightSaving(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	// the clock is set forward from 02:00 to 03:00 on 2026-03-29 and back
+	// from 03:00 to 02:00 on 2026-10-25, the times are given in UTC
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, time.UTC).In(berlin)
+	}
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"skipped hour fires after the gap", "0 2 * * *", at(3, 28, 22, 59), at(3, 29, 1, 0)},
+		{"skipped minute fires after the gap", "30 2 * * *", at(3, 28, 22, 59), at(3, 29, 1, 0)},
+		{"day after the gap", "0 2 * * *", at(3, 29, 1, 0), at(3, 30, 0, 0)},
+		{"hourly across the gap", "0 * * * *", at(3, 29, 0, 30), at(3, 29, 1, 0)},
+		{"repeated time fires once", "30 2 * * *", at(10, 25, 0, 30), at(10, 26, 1, 30)},
+		{"hourly into the repeated hour", "0 * * * *", at(10, 24, 23, 30), at(10, 25, 0, 0)},
+		{"hourly after the repeated hour", "0 * * * *", at(10, 25, 0, 0), at(10, 25, 2, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := jobs.ParseSchedule(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.Next(tt.from)
+			if !got.Equal(tt.want) {
+				t.Errorf("next of %q after %v is %v, want %v", tt.expr, tt.from, got, tt.want)
+			}
+			if got.Location() != berlin {
+				t.Errorf("next is in %v, want %v", got.Location(), berlin)
+			}
+		})
+	}
+}
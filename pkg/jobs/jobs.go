@@ -0,0 +1,89 @@
+// Package jobs runs the actions of the command line on cron schedules,
+// one at a time, and keeps the history of their runs.
+package jobs
+
+import (
+	"context"
+	"nextimagescrap/pkg/imports"
+	"time"
+)
+
+// State is the state of a run
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	// StateSkipped marks a run left out as the job was queued or running
+	StateSkipped State = "skipped"
+	// StateInterrupted marks a run which did not finish before the daemon stopped
+	StateInterrupted State = "interrupted"
+)
+
+// Trigger tells why a job ran
+type Trigger string
+
+const (
+	TriggerSchedule Trigger = "schedule"
+	TriggerManual   Trigger = "manual"
+)
+
+// Run is one run of a job
+type Run struct {
+	// ID orders the runs, it is assigned when the run is queued
+	ID         uint64
+	Job        string
+	Action     string
+	Trigger    Trigger
+	State      State
+	QueuedAt   time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Summary is what the action reports when it succeeds
+	Summary string
+	Error   string
+}
+
+// History stores the runs of jobs
+type History interface {
+	// SaveRun stores run, a run without ID gets the next one
+	SaveRun(run *Run) error
+	// GetRuns returns up to limit runs, the latest first, all for limit 0
+	GetRuns(limit int) ([]*Run, error)
+	// GetRunsBefore returns up to limit runs older than the run with id,
+	// the latest first, starting at the latest for id 0
+	GetRunsBefore(id uint64, limit int) ([]*Run, error)
+	// GetRun returns the run with id, nil if there is none
+	GetRun(id uint64) (*Run, error)
+}
+
+// Action runs job and returns a summary of what it did. ctx is cancelled
+// when the scheduler stops and the shutdown timeout passed, the action
+// should return soon then.
+type Action func(ctx context.Context, job JobConfig) (string, error)
+
+// JobConfig schedules an action
+type JobConfig struct {
+	Name string
+	// Schedule is a cron expression, see ParseSchedule
+	Schedule string
+	// Action names the action to run, as given to NewScheduler
+	Action string
+	// Output is a file the action writes, like the dedupe report
+	Output string
+}
+
+// Config holds the jobs of the daemon
+type Config struct {
+	Jobs []JobConfig
+	// ShutdownTimeout is how long a running job may take to finish once
+	// the daemon is stopped before it is cancelled, one minute by default
+	ShutdownTimeout imports.Duration
+	// StatusHistory is the number of past runs in the status, 20 by default
+	StatusHistory int
+}
+
+const defaultShutdownTimeout = time.Minute
+const defaultStatusHistory = 20
@@ -0,0 +1,437 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// statusHeartbeat is how often the status file is refreshed at the least
+const statusHeartbeat = time.Minute
+
+// scheduledJob is a configured job with its schedule and action
+type scheduledJob struct {
+	cfg      JobConfig
+	schedule *Schedule
+	action   Action
+	next     time.Time
+	last     *Run
+}
+
+// result is the outcome of the action of a run
+type result struct {
+	run     *Run
+	summary string
+	err     error
+}
+
+// Scheduler runs jobs on their schedules. Only one job runs at a time,
+// due jobs queue up behind it, and a job is not queued twice.
+type Scheduler struct {
+	cfg        Config
+	jobs       []*scheduledJob
+	history    History
+	statusPath string
+	startedAt  time.Time
+
+	mu      sync.Mutex
+	running *Run
+	// cancel cancels the context of the action of the running run
+	cancel  context.CancelFunc
+	queue   []*Run
+	stopped bool
+	wake    chan struct{}
+	done    chan result
+}
+
+// NewScheduler checks the jobs of cfg, whose actions are looked up in
+// actions. Runs are kept in history, the status is written to statusPath
+// unless it is empty. Jobs without a schedule only run when triggered.
+func NewScheduler(cfg Config, actions map[string]Action, history History, statusPath string) (*Scheduler, error) {
+	s := &Scheduler{
+		cfg:        cfg,
+		history:    history,
+		statusPath: statusPath,
+		wake:       make(chan struct{}, 1),
+		// buffered, an action may finish after Run returned on an error
+		done: make(chan result, 1),
+	}
+	names := make(map[string]bool)
+	for _, jc := range cfg.Jobs {
+		if jc.Name == "" {
+			return nil, errors.New("job without name")
+		}
+		if names[jc.Name] {
+			return nil, fmt.Errorf("job %q is configured twice", jc.Name)
+		}
+		names[jc.Name] = true
+		action, ok := actions[jc.Action]
+		if !ok {
+			return nil, fmt.Errorf("job %q has unknown action %q", jc.Name, jc.Action)
+		}
+		j := &scheduledJob{cfg: jc, action: action}
+		if jc.Schedule != "" {
+			schedule, err := ParseSchedule(jc.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("job %q: %w", jc.Name, err)
+			}
+			j.schedule = schedule
+		}
+		s.jobs = append(s.jobs, j)
+	}
+	return s, nil
+}
+
+func (s *Scheduler) job(name string) *scheduledJob {
+	for _, j := range s.jobs {
+		if j.cfg.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// Run runs the jobs on their schedules until stop is closed. Then it
+// waits for the running job up to the shutdown timeout, if it did not
+// finish it is cancelled and recorded as interrupted. Run returns once
+// its action returned, so the catalog can be closed. Queued runs are
+// dropped and recorded as interrupted too.
+func (s *Scheduler) Run(stop <-chan struct{}) error {
+	err := s.start()
+	if err != nil {
+		return err
+	}
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		for _, j := range s.jobs {
+			if j.next.IsZero() || now.Before(j.next) {
+				continue
+			}
+			_, err = s.enqueue(j, TriggerSchedule, now)
+			if err != nil {
+				break
+			}
+			j.next = j.schedule.Next(now)
+		}
+		if err == nil {
+			err = s.startNext(now)
+		}
+		wait := s.untilNext(now)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		s.writeStatus()
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return s.shutdown()
+		case res := <-s.done:
+			timer.Stop()
+			err = s.finish(res)
+			if err != nil {
+				return err
+			}
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// start records runs left queued or running by a daemon which did not
+// shut down as interrupted and schedules the jobs
+func (s *Scheduler) start() error {
+	runs, err := s.history.GetRuns(0)
+	if err != nil {
+		return err
+	}
+	// the API reads the status while the history is read
+	s.mu.Lock()
+	s.startedAt = time.Now()
+	// runs triggered before the loop started are queued by this scheduler
+	queued := make(map[uint64]bool)
+	for _, run := range s.queue {
+		queued[run.ID] = true
+	}
+	s.mu.Unlock()
+	last := make(map[*scheduledJob]*Run)
+	for _, run := range runs {
+		if (run.State == StateRunning || run.State == StateQueued) && !queued[run.ID] {
+			log.Printf("run %d of %v was interrupted", run.ID, run.Job)
+			run.Error = "the daemon stopped during the run"
+			if run.State == StateQueued {
+				run.Error = "the daemon stopped before the run started"
+			}
+			run.State = StateInterrupted
+			err = s.history.SaveRun(run)
+			if err != nil {
+				return err
+			}
+		}
+		if j := s.job(run.Job); j != nil && last[j] == nil && run.State != StateSkipped && !queued[run.ID] {
+			last[j] = run
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.last == nil {
+			j.last = last[j]
+		}
+		if j.schedule != nil {
+			j.next = j.schedule.Next(s.startedAt)
+			log.Printf("job %v runs %v next at %v", j.cfg.Name, j.cfg.Action, j.next.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Trigger queues a run of the job name, which is recorded as skipped if
+// the job is queued or running already
+func (s *Scheduler) Trigger(name string) (*Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil, errors.New("the scheduler is stopped")
+	}
+	j := s.job(name)
+	if j == nil {
+		return nil, fmt.Errorf("unknown job %q", name)
+	}
+	run, err := s.enqueue(j, TriggerManual, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	c := *run
+	return &c, nil
+}
+
+// enqueue queues a run of j unless j is queued or running, s.mu is held
+func (s *Scheduler) enqueue(j *scheduledJob, trigger Trigger, now time.Time) (*Run, error) {
+	run := &Run{
+		Job:      j.cfg.Name,
+		Action:   j.cfg.Action,
+		Trigger:  trigger,
+		State:    StateQueued,
+		QueuedAt: now,
+	}
+	busy := ""
+	if s.running != nil && s.running.Job == j.cfg.Name {
+		busy = "the job is still running"
+	}
+	for _, queued := range s.queue {
+		if queued.Job == j.cfg.Name {
+			busy = "the job is queued already"
+		}
+	}
+	if busy != "" {
+		log.Printf("skip %s run of %v, %s", trigger, j.cfg.Name, busy)
+		run.State = StateSkipped
+		run.Error = busy
+		run.FinishedAt = now
+		return run, s.history.SaveRun(run)
+	}
+	// saved at once, the ID lets callers follow the run
+	err := s.history.SaveRun(run)
+	if err != nil {
+		return nil, err
+	}
+	s.queue = append(s.queue, run)
+	return run, nil
+}
+
+// startNext starts the first queued run unless a run is going on, s.mu is held
+func (s *Scheduler) startNext(now time.Time) error {
+	if s.running != nil || len(s.queue) == 0 {
+		return nil
+	}
+	run := s.queue[0]
+	s.queue = s.queue[1:]
+	run.State = StateRunning
+	run.StartedAt = now
+	err := s.history.SaveRun(run)
+	if err != nil {
+		return err
+	}
+	s.running = run
+	j := s.job(run.Job)
+	log.Printf("start %s run %d of %v", run.Trigger, run.ID, run.Job)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go func() {
+		summary, err := j.action(ctx, j.cfg)
+		s.done <- result{run: run, summary: summary, err: err}
+	}()
+	return nil
+}
+
+// finish records the outcome of a run
+func (s *Scheduler) finish(res result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run := res.run
+	run.FinishedAt = time.Now()
+	run.Summary = res.summary
+	run.State = StateSucceeded
+	if res.err != nil {
+		run.State = StateFailed
+		run.Error = res.err.Error()
+		log.Printf("run %d of %v failed after %v: %v", run.ID, run.Job, run.FinishedAt.Sub(run.StartedAt), res.err)
+	} else {
+		log.Printf("run %d of %v succeeded after %v: %v", run.ID, run.Job, run.FinishedAt.Sub(run.StartedAt), res.summary)
+	}
+	if s.running == run {
+		s.running = nil
+		s.cancel()
+		s.cancel = nil
+	}
+	if j := s.job(run.Job); j != nil {
+		j.last = run
+	}
+	return s.history.SaveRun(run)
+}
+
+// untilNext returns the time until the next job is due, at most the
+// status heartbeat, s.mu is held
+func (s *Scheduler) untilNext(now time.Time) time.Duration {
+	wait := statusHeartbeat
+	for _, j := range s.jobs {
+		if j.next.IsZero() {
+			continue
+		}
+		if d := j.next.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+func (s *Scheduler) shutdown() error {
+	s.mu.Lock()
+	s.stopped = true
+	var err error
+	for _, run := range s.queue {
+		log.Printf("drop queued run %d of %v", run.ID, run.Job)
+		run.State = StateInterrupted
+		run.Error = "the daemon stopped before the run started"
+		run.FinishedAt = time.Now()
+		if serr := s.history.SaveRun(run); err == nil {
+			err = serr
+		}
+	}
+	s.queue = nil
+	running := s.running
+	s.mu.Unlock()
+	if running != nil {
+		timeout := time.Duration(s.cfg.ShutdownTimeout)
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		log.Printf("waiting up to %v for run %d of %v to finish", timeout, running.ID, running.Job)
+		select {
+		case res := <-s.done:
+			if ferr := s.finish(res); err == nil {
+				err = ferr
+			}
+		case <-time.After(timeout):
+			log.Printf("cancel run %d of %v", running.ID, running.Job)
+			s.mu.Lock()
+			s.cancel()
+			s.mu.Unlock()
+			// the action may still write to the catalog
+			res := <-s.done
+			s.mu.Lock()
+			running.State = StateInterrupted
+			running.Error = "the daemon stopped during the run"
+			if res.err != nil {
+				running.Error += ": " + res.err.Error()
+			}
+			running.FinishedAt = time.Now()
+			s.running = nil
+			s.cancel = nil
+			if j := s.job(running.Job); j != nil {
+				j.last = running
+			}
+			if serr := s.history.SaveRun(running); err == nil {
+				err = serr
+			}
+			s.mu.Unlock()
+			log.Printf("run %d of %v interrupted", running.ID, running.Job)
+		}
+	}
+	s.writeStatus()
+	return err
+}
+
+// Status returns a snapshot of the jobs, the current run and the latest runs
+func (s *Scheduler) Status() (*Status, error) {
+	limit := s.cfg.StatusHistory
+	if limit <= 0 {
+		limit = defaultStatusHistory
+	}
+	history, err := s.history.GetRuns(limit)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := &Status{
+		PID:       os.Getpid(),
+		StartedAt: s.startedAt,
+		UpdatedAt: time.Now(),
+		Stopped:   s.stopped,
+		Running:   copyRun(s.running),
+		Queued:    []*Run{},
+		History:   history,
+	}
+	for _, run := range s.queue {
+		status.Queued = append(status.Queued, copyRun(run))
+	}
+	for _, j := range s.jobs {
+		status.Jobs = append(status.Jobs, JobStatus{
+			Name:     j.cfg.Name,
+			Action:   j.cfg.Action,
+			Schedule: j.cfg.Schedule,
+			NextRun:  j.next,
+			LastRun:  copyRun(j.last),
+		})
+	}
+	return status, nil
+}
+
+// writeStatus refreshes the status file, failures are only logged as the
+// jobs go on without it
+func (s *Scheduler) writeStatus() {
+	if s.statusPath == "" {
+		return
+	}
+	status, err := s.Status()
+	if err == nil {
+		err = WriteStatus(s.statusPath, status)
+	}
+	if err != nil {
+		log.Printf("cannot write status %v: %v", s.statusPath, err)
+	}
+}
+
+func copyRun(run *Run) *Run {
+	if run == nil {
+		return nil
+	}
+	c := *run
+	return &c
+}
@@ -0,0 +1,154 @@
+package jobs_test
+
+import (
+	"context"
+	"nextimagescrap/pkg/imports"
+	"nextimagescrap/pkg/jobs"
+	"nextimagescrap/pkg/storage"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitsForCancelledAction(t *testing.T) {
+	s, err := storage.NewCatalogDbStorage(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseDb()
+	started := make(chan struct{})
+	var returned int32
+	action := func(ctx context.Context, job jobs.JobConfig) (string, error) {
+		close(started)
+		<-ctx.Done()
+		// the action writes its last batch after it was cancelled
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&returned, 1)
+		return "", ctx.Err()
+	}
+	cfg := jobs.Config{
+		Jobs:            []jobs.JobConfig{{Name: "scan", Action: "scan"}},
+		ShutdownTimeout: imports.Duration(10 * time.Millisecond),
+	}
+	scheduler, err := jobs.NewScheduler(cfg, map[string]jobs.Action{"scan": action}, s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := scheduler.Trigger("scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- scheduler.Run(stop)
+	}()
+	<-started
+	close(stop)
+	err = <-stopped
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&returned) != 1 {
+		t.Error("Run returned before the action")
+	}
+	got, err := s.GetRun(run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != jobs.StateInterrupted || !strings.Contains(got.Error, context.Canceled.Error()) {
+		t.Errorf("run is %v: %v", got.State, got.Error)
+	}
+}
+
+// waitForRun polls the run with id until it is in state
+func waitForRun(t *testing.T, s *storage.DbSourceStorage, id uint64, state jobs.State) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		run, err := s.GetRun(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run != nil && run.State == state {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("run %d is %+v, want %v", id, run, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobNotQueuedTwice(t *testing.T) {
+	s, err := storage.NewCatalogDbStorage(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseDb()
+	release := make(chan struct{})
+	var calls int32
+	action := func(ctx context.Context, job jobs.JobConfig) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		if job.Name == "scan" {
+			<-release
+		}
+		return job.Name, nil
+	}
+	cfg := jobs.Config{Jobs: []jobs.JobConfig{
+		{Name: "scan", Action: "run"},
+		{Name: "dedupe", Action: "run"},
+	}}
+	scheduler, err := jobs.NewScheduler(cfg, map[string]jobs.Action{"run": action}, s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- scheduler.Run(stop)
+	}()
+
+	trigger := func(name string) *jobs.Run {
+		t.Helper()
+		run, err := scheduler.Trigger(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return run
+	}
+	scan := trigger("scan")
+	waitForRun(t, s, scan.ID, jobs.StateRunning)
+	dedupe := trigger("dedupe")
+	if dedupe.State != jobs.StateQueued {
+		t.Errorf("dedupe run is %v behind the running scan", dedupe.State)
+	}
+	// neither the running nor the queued job is queued again
+	for _, name := range []string{"scan", "dedupe"} {
+		again := trigger(name)
+		if again.State != jobs.StateSkipped || again.Error == "" {
+			t.Errorf("second %v run is %v: %v", name, again.State, again.Error)
+		}
+	}
+	status, err := scheduler.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Running == nil || status.Running.ID != scan.ID || len(status.Queued) != 1 || status.Queued[0].ID != dedupe.ID {
+		t.Errorf("running %+v, queued %+v", status.Running, status.Queued)
+	}
+
+	close(release)
+	waitForRun(t, s, scan.ID, jobs.StateSucceeded)
+	waitForRun(t, s, dedupe.ID, jobs.StateSucceeded)
+	close(stop)
+	err = <-stopped
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("actions ran %d times, want 2", n)
+	}
+}
@@ -0,0 +1,73 @@
+package jobs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// JobStatus is the state of a scheduled job
+type JobStatus struct {
+	Name     string
+	Action   string
+	Schedule string
+	NextRun  time.Time
+	LastRun  *Run `json:",omitempty"`
+}
+
+// Status is a snapshot of the daemon, written to a file as the catalog
+// cannot be read while the daemon holds it open
+type Status struct {
+	PID       int
+	StartedAt time.Time
+	// UpdatedAt is refreshed at least every minute while the daemon runs
+	UpdatedAt time.Time
+	// Stopped is set when the daemon shut down
+	Stopped bool
+	Running *Run `json:",omitempty"`
+	Queued  []*Run
+	Jobs    []JobStatus
+	// History holds the latest runs, the latest first
+	History []*Run
+}
+
+// WriteStatus replaces the status file at path
+func WriteStatus(path string, status *Status) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// ReadStatus reads the status file at path
+func ReadStatus(path string) (*Status, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{}
+	err = json.Unmarshal(data, status)
+	return status, err
+}
+
+// Stale reports whether the daemon which wrote status stopped without
+// saying so, it missed refreshing the status twice
+func (s *Status) Stale(now time.Time) bool {
+	return !s.Stopped && now.Sub(s.UpdatedAt) > 2*statusHeartbeat
+}
@@ -0,0 +1,644 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"nextimagescrap/pkg/imports"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveSuffix marks a zip or tar archive shown as directory by
+// NewArchiveFS, its entries are "<archive>!/<path inside>"
+const ArchiveSuffix = "!"
+
+// kinds of archives
+const (
+	archiveZip = "zip"
+	archiveTar = "tar"
+	archiveTgz = "tgz"
+)
+
+// archiveKind returns the kind of archive by the extension of name, or ""
+func archiveKind(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveZip
+	case strings.HasSuffix(lower, ".tar"):
+		return archiveTar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveTgz
+	}
+	return ""
+}
+
+// splitArchivePath splits name at its first archive directory into the
+// path of the archive and the path inside, "." for the archive itself
+func splitArchivePath(name string) (string, string, bool) {
+	elems := strings.Split(name, "/")
+	for i := range elems {
+		if !strings.HasSuffix(elems[i], ArchiveSuffix) {
+			continue
+		}
+		archive := strings.TrimSuffix(elems[i], ArchiveSuffix)
+		if archiveKind(archive) == "" {
+			continue
+		}
+		inner := path.Join(elems[i+1:]...)
+		if inner == "" {
+			inner = "."
+		}
+		return path.Join(append(elems[:i:i], archive)...), inner, true
+	}
+	return "", "", false
+}
+
+// archiveFS shows the zip and tar archives of fsys as directories. Entries
+// are read by streaming from the archive, entries of compressed tarballs
+// are read sequentially and are fastest to read in archive order, the
+// recently opened ones are kept in memory.
+// Archives inside archives are plain files.
+type archiveFS struct {
+	fsys     fs.FS
+	mu       sync.Mutex
+	archives map[string]*archiveIndex
+	// uses counts the lookups of archives, for dropping the least
+	// recently used
+	uses int
+}
+
+// archiveIndexLimit is the number of archives an archiveFS keeps indexed.
+// The stream of a compressed tarball holds a file open and up to
+// tarStreamCacheSize of entries, they are dropped with the index.
+const archiveIndexLimit = 8
+
+// NewArchiveFS returns fsys with each .zip, .tar, .tar.gz and .tgz file
+// replaced by a directory of its entries, named after the archive with
+// ArchiveSuffix
+func NewArchiveFS(fsys fs.FS) fs.FS {
+	return &archiveFS{fsys: fsys, archives: make(map[string]*archiveIndex)}
+}
+
+func (f *archiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	archive, inner, ok := splitArchivePath(name)
+	if !ok {
+		return f.openOutside(name)
+	}
+	a, err := f.archive(archive)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if children, ok := a.dirs[inner]; ok {
+		return &archiveDir{info: archiveDirInfo{name: path.Base(name), modTime: a.modTime}, entries: children}, nil
+	}
+	e, ok := a.entries[inner]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	file, err := a.open(f.fsys, e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return file, nil
+}
+
+// openOutside opens a file of fsys, directories list archives like ReadDir
+func (f *archiveFS) openOutside(name string) (fs.File, error) {
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || !info.IsDir() {
+		return file, err
+	}
+	file.Close()
+	entries, err := f.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveDir{info: info, entries: entries}, nil
+}
+
+func (f *archiveFS) Stat(name string) (fs.FileInfo, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+func (f *archiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	archive, inner, ok := splitArchivePath(name)
+	if ok {
+		a, err := f.archive(archive)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		children, ok := a.dirs[inner]
+		if !ok {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+		}
+		return children, nil
+	}
+	entries, err := fs.ReadDir(f.fsys, name)
+	for i := range entries {
+		if entries[i].Type().IsRegular() && archiveKind(entries[i].Name()) != "" {
+			info, ierr := entries[i].Info()
+			modTime := time.Time{}
+			if ierr == nil {
+				modTime = info.ModTime()
+			}
+			entries[i] = fs.FileInfoToDirEntry(archiveDirInfo{name: entries[i].Name() + ArchiveSuffix, modTime: modTime})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+// archive returns the index of the archive at name, it is read again
+// when the size or the mtime of the archive changed
+func (f *archiveFS) archive(name string) (*archiveIndex, error) {
+	info, err := fs.Stat(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uses++
+	old, ok := f.archives[name]
+	if ok && old.size == info.Size() && old.modTime.Equal(info.ModTime()) {
+		old.lastUse = f.uses
+		return old, nil
+	}
+	a, err := readArchiveIndex(f.fsys, name)
+	if ok {
+		old.close()
+		delete(f.archives, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.lastUse = f.uses
+	f.archives[name] = a
+	f.dropArchives()
+	return a, nil
+}
+
+// dropArchives closes the least recently used archives beyond
+// archiveIndexLimit, they are indexed again when opened next
+func (f *archiveFS) dropArchives() {
+	for len(f.archives) > archiveIndexLimit {
+		var oldest *archiveIndex
+		for _, a := range f.archives {
+			if oldest == nil || a.lastUse < oldest.lastUse {
+				oldest = a
+			}
+		}
+		oldest.close()
+		delete(f.archives, oldest.name)
+	}
+}
+
+// archiveEntry locates a file inside an archive
+type archiveEntry struct {
+	info fs.FileInfo
+	// offset and size of the stored data, for zip the compressed data
+	offset int64
+	size   int64
+	method uint16
+	// ordinal is the position of the entry in a compressed tarball
+	ordinal int
+}
+
+// archiveIndex lists the files and directories of an archive
+type archiveIndex struct {
+	name string
+	kind string
+	// size and modTime of the archive when it was indexed
+	size    int64
+	modTime time.Time
+	entries map[string]*archiveEntry
+	dirs    map[string][]fs.DirEntry
+	stream  *tarStream
+	// lastUse is the lookup of the archiveFS which used the index last
+	lastUse int
+}
+
+func readArchiveIndex(fsys fs.FS, name string) (*archiveIndex, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	a := &archiveIndex{
+		name:    name,
+		kind:    archiveKind(name),
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		entries: make(map[string]*archiveEntry),
+		dirs:    map[string][]fs.DirEntry{".": nil},
+	}
+	switch a.kind {
+	case archiveZip:
+		ra, ok := file.(io.ReaderAt)
+		if !ok {
+			return nil, fmt.Errorf("%v does not support random access", name)
+		}
+		zr, err := zip.NewReader(ra, info.Size())
+		if err != nil {
+			return nil, err
+		}
+		for _, zf := range zr.File {
+			if strings.HasSuffix(zf.Name, "/") {
+				continue
+			}
+			offset, err := zf.DataOffset()
+			if err != nil {
+				return nil, err
+			}
+			a.add(zf.Name, &archiveEntry{info: zf.FileInfo(), offset: offset, size: int64(zf.CompressedSize64), method: zf.Method})
+		}
+	case archiveTar:
+		counter := &countingReader{r: file}
+		var r io.Reader = counter
+		if seeker, ok := file.(io.Seeker); ok {
+			// tar.Reader seeks past the data of the entries
+			r = &countingSeeker{countingReader: counter, s: seeker}
+		}
+		err = readTarIndex(a, tar.NewReader(r), counter)
+	case archiveTgz:
+		a.stream = &tarStream{}
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		err = readTarIndex(a, tar.NewReader(gz), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for dir := range a.dirs {
+		children := a.dirs[dir]
+		sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	}
+	return a, nil
+}
+
+// readTarIndex adds the regular files of tr, with their offset if counter
+// tells the position in an uncompressed tarball
+func readTarIndex(a *archiveIndex, tr *tar.Reader, counter *countingReader) error {
+	for ordinal := 0; ; ordinal++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		e := &archiveEntry{info: hdr.FileInfo(), size: hdr.Size, ordinal: ordinal}
+		if counter != nil {
+			e.offset = counter.n
+		}
+		a.add(hdr.Name, e)
+	}
+}
+
+// add adds a file and its parent directories to the index
+func (a *archiveIndex) add(name string, e *archiveEntry) {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if !fs.ValidPath(name) || name == "." {
+		return
+	}
+	if _, ok := a.entries[name]; ok {
+		return
+	}
+	a.entries[name] = e
+	child := fs.FileInfoToDirEntry(e.info)
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		_, known := a.dirs[dir]
+		a.dirs[dir] = append(a.dirs[dir], child)
+		if known || dir == "." {
+			return
+		}
+		child = fs.FileInfoToDirEntry(archiveDirInfo{name: path.Base(dir), modTime: a.modTime})
+	}
+}
+
+// open returns a reader of the entry, streamed from the archive
+func (a *archiveIndex) open(fsys fs.FS, e *archiveEntry) (fs.File, error) {
+	if a.kind == archiveTgz {
+		return a.openStream(fsys, e)
+	}
+	file, err := fsys.Open(a.name)
+	if err != nil {
+		return nil, err
+	}
+	ra, ok := file.(io.ReaderAt)
+	if !ok {
+		file.Close()
+		return nil, fmt.Errorf("%v does not support random access", a.name)
+	}
+	var r io.Reader = io.NewSectionReader(ra, e.offset, e.size)
+	if a.kind == archiveZip {
+		switch e.method {
+		case zip.Store:
+		case zip.Deflate:
+			fr := flate.NewReader(r)
+			return &archiveFile{info: e.info, r: fr, closers: []io.Closer{fr, file}}, nil
+		default:
+			file.Close()
+			return nil, fmt.Errorf("unsupported zip compression method %d", e.method)
+		}
+	}
+	return &archiveFile{info: e.info, r: r, closers: []io.Closer{file}}, nil
+}
+
+// close closes the stream of a compressed tarball, its open entries
+// cannot be read anymore
+func (a *archiveIndex) close() {
+	if a.stream == nil {
+		return
+	}
+	s := a.stream
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	s.closed = true
+	s.cached = nil
+	s.cachedSize = 0
+}
+
+// tarStreamCacheSize bounds the bytes of the recently opened entries of a
+// compressed tarball kept in memory. The date stage opens a media for its
+// exif and its metadata and its sidecar in between, reopening a cached
+// entry does not decompress the tarball from its start again.
+const tarStreamCacheSize = 64 << 20
+
+// tarStream is a position in a compressed tarball, kept open to read the
+// following entries without decompressing the start again
+type tarStream struct {
+	mu   sync.Mutex
+	file fs.File
+	tr   *tar.Reader
+	next int
+	// closed is set when the index was dropped, the stream is not opened again
+	closed bool
+	// generation invalidates the readers of former entries
+	generation int
+	// cached holds the content of recently opened entries, oldest first
+	cached     []cachedEntry
+	cachedSize int64
+}
+
+// cachedEntry is the content of an entry of a tarStream
+type cachedEntry struct {
+	ordinal int
+	data    []byte
+}
+
+// lookup returns the content of the entry ordinal if it is cached and
+// marks it as recently used
+func (s *tarStream) lookup(ordinal int) ([]byte, bool) {
+	for i := range s.cached {
+		if s.cached[i].ordinal != ordinal {
+			continue
+		}
+		c := s.cached[i]
+		s.cached = append(append(s.cached[:i:i], s.cached[i+1:]...), c)
+		return c.data, true
+	}
+	return nil, false
+}
+
+// cache keeps data of the entry ordinal, dropping the least recently
+// used entries beyond tarStreamCacheSize
+func (s *tarStream) cache(ordinal int, data []byte) {
+	s.cached = append(s.cached, cachedEntry{ordinal: ordinal, data: data})
+	s.cachedSize += int64(len(data))
+	for s.cachedSize > tarStreamCacheSize {
+		s.cachedSize -= int64(len(s.cached[0].data))
+		s.cached = s.cached[1:]
+	}
+}
+
+func (a *archiveIndex) openStream(fsys fs.FS, e *archiveEntry) (fs.File, error) {
+	s := a.stream
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		// the index was dropped while the entry was looked up
+		return openTarEntry(fsys, a.name, e)
+	}
+	if data, ok := s.lookup(e.ordinal); ok {
+		return &archiveFile{info: e.info, r: bytes.NewReader(data)}, nil
+	}
+	if s.file == nil || e.ordinal < s.next {
+		if s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+		file, err := fsys.Open(a.name)
+		if err != nil {
+			return nil, err
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		s.file = file
+		s.tr = tar.NewReader(gz)
+		s.next = 0
+	}
+	for s.next <= e.ordinal {
+		_, err := s.tr.Next()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			s.file.Close()
+			s.file = nil
+			return nil, err
+		}
+		s.next++
+	}
+	s.generation++
+	if e.size <= tarStreamCacheSize {
+		data, err := io.ReadAll(s.tr)
+		if err != nil {
+			s.file.Close()
+			s.file = nil
+			return nil, err
+		}
+		s.cache(e.ordinal, data)
+		return &archiveFile{info: e.info, r: bytes.NewReader(data)}, nil
+	}
+	return &archiveFile{info: e.info, r: &streamReader{s: s, generation: s.generation}}, nil
+}
+
+// openTarEntry streams the entry e from a compressed tarball opened for
+// it alone, the file is closed with the entry
+func openTarEntry(fsys fs.FS, name string, e *archiveEntry) (fs.File, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for i := 0; i <= e.ordinal; i++ {
+		_, err = tr.Next()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &archiveFile{info: e.info, r: tr, closers: []io.Closer{file}}, nil
+}
+
+// streamReader reads the current entry of a tarStream
+type streamReader struct {
+	s          *tarStream
+	generation int
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if r.s.generation != r.generation || r.s.file == nil {
+		return 0, fmt.Errorf("archive entry read after another entry was opened: %w", imports.ErrFileBusy)
+	}
+	return r.s.tr.Read(p)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingSeeker is a countingReader of a file which can seek, the count
+// follows the seeks
+type countingSeeker struct {
+	*countingReader
+	s io.Seeker
+}
+
+func (c *countingSeeker) Seek(offset int64, whence int) (int64, error) {
+	n, err := c.s.Seek(offset, whence)
+	if err == nil {
+		c.n = n
+	}
+	return n, err
+}
+
+// archiveFile is an open file inside an archive
+type archiveFile struct {
+	info    fs.FileInfo
+	r       io.Reader
+	closers []io.Closer
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *archiveFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *archiveFile) Close() error {
+	var err error
+	for _, c := range f.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// archiveDir is an open directory inside an archive
+type archiveDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    int
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *archiveDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *archiveDir) Close() error {
+	return nil
+}
+
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.read:]
+	if n <= 0 {
+		d.read = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.read += n
+	return rest[:n], nil
+}
+
+// archiveDirInfo describes an archive or a directory inside one
+type archiveDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (i archiveDirInfo) Name() string       { return i.name }
+func (i archiveDirInfo) Size() int64        { return 0 }
+func (i archiveDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (i archiveDirInfo) ModTime() time.Time { return i.modTime }
+func (i archiveDirInfo) IsDir() bool        { return true }
+func (i archiveDirInfo) Sys() interface{}   { return nil }
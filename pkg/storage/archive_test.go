@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func readArchiveFile(t *testing.T, fsys fs.FS, name string) string {
+	t.Helper()
+	f, err := fsys.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestArchiveReplaced(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := fstest.MapFS{
+		"b.zip": &fstest.MapFile{Data: zipOf(t, map[string][]byte{"x.jpg": []byte("first")}), ModTime: mtime},
+	}
+	fsys := NewArchiveFS(src)
+	if got := readArchiveFile(t, fsys, "b.zip!/x.jpg"); got != "first" {
+		t.Fatalf("read %q, want first", got)
+	}
+
+	src["b.zip"] = &fstest.MapFile{
+		Data:    zipOf(t, map[string][]byte{"x.jpg": []byte("second"), "y.jpg": []byte("added")}),
+		ModTime: mtime.Add(time.Minute),
+	}
+	if got := readArchiveFile(t, fsys, "b.zip!/x.jpg"); got != "second" {
+		t.Errorf("read %q from the replaced archive, want second", got)
+	}
+	entries, err := fs.ReadDir(fsys, "b.zip!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("replaced archive lists %d entries, want 2", len(entries))
+	}
+}
+
+// tarOf returns a tarball holding files in the order of names
+func tarOf(t *testing.T, names []string, files map[string][]byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, name := range names {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		if err == nil {
+			_, err = tw.Write(files[name])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// tgzOf returns a compressed tarball holding files in the order of names
+func tgzOf(t *testing.T, names []string, files map[string][]byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	_, err := gz.Write(tarOf(t, names, files))
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestTruncatedTarball(t *testing.T) {
+	names := []string{"a.jpg", "b.jpg", "c.jpg"}
+	files := map[string][]byte{
+		"a.jpg": bytes.Repeat([]byte("a"), 2000),
+		"b.jpg": bytes.Repeat([]byte("b"), 2000),
+		"c.jpg": bytes.Repeat([]byte("c"), 2000),
+	}
+	tgz := tgzOf(t, names, files)
+	fsys := NewArchiveFS(fstest.MapFS{"b.tgz": &fstest.MapFile{Data: tgz[:len(tgz)/2]}})
+
+	_, err := fs.ReadDir(fsys, "b.tgz!")
+	if err == nil {
+		t.Fatal("listing a truncated tarball succeeded")
+	}
+	_, err = fsys.Open("b.tgz!/a.jpg")
+	if err == nil {
+		t.Fatal("opening an entry of a truncated tarball succeeded")
+	}
+}
+
+// countingFS counts the opens of each file of an fs.FS, not counting stats
+type countingFS struct {
+	fs.FS
+	opens map[string]int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	c.opens[name]++
+	return c.FS.Open(name)
+}
+
+func (c *countingFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(c.FS, name)
+}
+
+func TestTarballEntriesReopened(t *testing.T) {
+	names := []string{"a.jpg", "a.jpg.json", "b.jpg"}
+	files := map[string][]byte{
+		"a.jpg":      []byte("jpeg a"),
+		"a.jpg.json": []byte("{}"),
+		"b.jpg":      []byte("jpeg b"),
+	}
+	src := &countingFS{FS: fstest.MapFS{"b.tgz": &fstest.MapFile{Data: tgzOf(t, names, files)}}, opens: make(map[string]int)}
+	fsys := NewArchiveFS(src)
+
+	// as the date stage does: exif of the media, its sidecar, the
+	// metadata of the media again
+	for _, name := range []string{"b.jpg", "a.jpg", "a.jpg.json", "a.jpg", "b.jpg"} {
+		if got := readArchiveFile(t, fsys, "b.tgz!/"+name); got != string(files[name]) {
+			t.Errorf("read %q from %v", got, name)
+		}
+	}
+	// reading the index, streaming to b.jpg and streaming again from a.jpg
+	if src.opens["b.tgz"] != 3 {
+		t.Errorf("the tarball was opened %d times, want 3", src.opens["b.tgz"])
+	}
+}
+
+// readCountingFS counts the bytes read from its files
+type readCountingFS struct {
+	fs.FS
+	read int64
+}
+
+func (c *readCountingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountingFile{File: f, fsys: c}, nil
+}
+
+// readCountingFile is a file of a readCountingFS, it can seek and be read
+// at an offset like the files of a fstest.MapFS
+type readCountingFile struct {
+	fs.File
+	fsys *readCountingFS
+}
+
+func (f *readCountingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.fsys.read += int64(n)
+	return n, err
+}
+
+func (f *readCountingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.(io.ReaderAt).ReadAt(p, off)
+	f.fsys.read += int64(n)
+	return n, err
+}
+
+func (f *readCountingFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+func TestTarIndexSeeksPastEntries(t *testing.T) {
+	names := []string{"big.mp4", "a.jpg"}
+	files := map[string][]byte{
+		"big.mp4": bytes.Repeat([]byte("v"), 8<<20),
+		"a.jpg":   []byte("jpeg a"),
+	}
+	src := &readCountingFS{FS: fstest.MapFS{"b.tar": &fstest.MapFile{Data: tarOf(t, names, files)}}}
+	fsys := NewArchiveFS(src)
+
+	entries, err := fs.ReadDir(fsys, "b.tar!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("tarball lists %d entries, want 2", len(entries))
+	}
+	if src.read > 64<<10 {
+		t.Errorf("listing the tarball read %d bytes", src.read)
+	}
+	if got := readArchiveFile(t, fsys, "b.tar!/a.jpg"); got != "jpeg a" {
+		t.Errorf("read %q from a.jpg", got)
+	}
+}
+
+// openFilesFS counts the files of an fs.FS which are open
+type openFilesFS struct {
+	fs.FS
+	open int
+}
+
+func (o *openFilesFS) Open(name string) (fs.File, error) {
+	f, err := o.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	o.open++
+	return &openFile{File: f, fsys: o}, nil
+}
+
+type openFile struct {
+	fs.File
+	fsys *openFilesFS
+}
+
+func (f *openFile) Close() error {
+	f.fsys.open--
+	return f.File.Close()
+}
+
+func TestArchiveIndexLimit(t *testing.T) {
+	files := map[string][]byte{"a.jpg": []byte("jpeg a")}
+	src := fstest.MapFS{}
+	var names []string
+	for i := 0; i < archiveIndexLimit+3; i++ {
+		name := fmt.Sprintf("b%02d.tgz", i)
+		src[name] = &fstest.MapFile{Data: tgzOf(t, []string{"a.jpg"}, files)}
+		names = append(names, name)
+	}
+	counter := &openFilesFS{FS: src}
+	fsys := NewArchiveFS(counter)
+	for _, name := range append(names, names[0]) {
+		if got := readArchiveFile(t, fsys, name+"!/a.jpg"); got != "jpeg a" {
+			t.Errorf("read %q from %v", got, name)
+		}
+	}
+	if n := len(fsys.(*archiveFS).archives); n != archiveIndexLimit {
+		t.Errorf("%d archives are indexed, want %d", n, archiveIndexLimit)
+	}
+	// each indexed tarball keeps its stream open
+	if counter.open > archiveIndexLimit {
+		t.Errorf("%d files are open", counter.open)
+	}
+}
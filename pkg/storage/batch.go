@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// batchWriter groups the write operations of concurrent callers into
+// shared transactions, as bolt's DB.Batch does, so a scan adding files
+// from several goroutines does not pay one fsync per file. A batch is
+// committed once the previous commit finished and interval passed since
+// its first operation, or at once when maxOps are queued. Every caller
+// waits for the commit of its own operation and gets its error.
+type batchWriter struct {
+	mu       sync.Mutex
+	db       *bolt.DB
+	ops      []*batchOp
+	maxOps   int
+	interval time.Duration
+	// committing is set while the commit loop runs
+	committing bool
+	// full wakes the commit loop before interval passed
+	full chan struct{}
+}
+
+// batchOp is a queued operation, done receives its result
+type batchOp struct {
+	fn   func(txn *bolt.Tx) error
+	done chan error
+}
+
+func newBatchWriter(db *bolt.DB, maxOps int, interval time.Duration) *batchWriter {
+	return &batchWriter{
+		db:       db,
+		maxOps:   maxOps,
+		interval: interval,
+		full:     make(chan struct{}, 1),
+	}
+}
+
+// add queues fn and returns the error of fn or of the commit of its
+// batch. It returns once fn is committed, so its writes are visible to
+// the reads of the caller.
+func (b *batchWriter) add(fn func(txn *bolt.Tx) error) error {
+	op := &batchOp{fn: fn, done: make(chan error, 1)}
+	b.mu.Lock()
+	b.ops = append(b.ops, op)
+	if !b.committing {
+		b.committing = true
+		go b.commitLoop()
+	}
+	if len(b.ops) >= b.maxOps {
+		b.wake()
+	}
+	b.mu.Unlock()
+	return <-op.done
+}
+
+// wake ends the wait of the commit loop for more operations
+func (b *batchWriter) wake() {
+	select {
+	case b.full <- struct{}{}:
+	default:
+	}
+}
+
+// commitLoop commits batches until no operation is queued
+func (b *batchWriter) commitLoop() {
+	for {
+		b.mu.Lock()
+		waiting := len(b.ops) < b.maxOps
+		b.mu.Unlock()
+		if waiting && b.interval > 0 {
+			timer := time.NewTimer(b.interval)
+			select {
+			case <-timer.C:
+			case <-b.full:
+				timer.Stop()
+			}
+		}
+		b.mu.Lock()
+		ops := b.ops
+		if len(ops) > b.maxOps {
+			ops = ops[:b.maxOps]
+		}
+		b.ops = b.ops[len(ops):]
+		select {
+		case <-b.full:
+		default:
+		}
+		if len(ops) == 0 {
+			b.committing = false
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+		b.commit(ops)
+	}
+}
+
+// commit runs ops in one transaction. If that fails, every operation is
+// retried in its own transaction, so only the failing ones are lost.
+func (b *batchWriter) commit(ops []*batchOp) {
+	err := b.db.Update(func(txn *bolt.Tx) error {
+		for i := range ops {
+			err := ops[i].fn(txn)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		for i := range ops {
+			ops[i].done <- nil
+		}
+		return
+	}
+	if len(ops) > 1 {
+		log.Printf("batch of %d operations failed, retrying one by one: %v", len(ops), err)
+	}
+	for i := range ops {
+		if len(ops) > 1 {
+			err = b.db.Update(ops[i].fn)
+		}
+		ops[i].done <- err
+	}
+}
+
+// flush commits the queued operations without waiting for interval
+func (b *batchWriter) flush() error {
+	b.mu.Lock()
+	if !b.committing {
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Unlock()
+	b.wake()
+	// batches are committed in order, so the queued operations are
+	// committed when a no-op queued after them is
+	return b.add(func(txn *bolt.Tx) error {
+		return nil
+	})
+}
+
+// EnableBatching groups the writes of concurrent callers into
+// transactions of up to maxOps operations, a batch waits up to interval
+// for more operations. CloseDb commits the queued ones.
+func (s *DbSourceStorage) EnableBatching(maxOps int, interval time.Duration) error {
+	err := s.Flush()
+	if err != nil {
+		return err
+	}
+	if maxOps <= 1 {
+		s.batch = nil
+		return nil
+	}
+	s.batch = newBatchWriter(s.dbClient, maxOps, interval)
+	return nil
+}
+
+// Flush commits the queued batched writes
+func (s *DbSourceStorage) Flush() error {
+	if s.batch == nil {
+		return nil
+	}
+	return s.batch.flush()
+}
+
+// update runs fn in a write transaction, shared with the writes of other
+// callers when batching
+func (s *DbSourceStorage) update(fn func(txn *bolt.Tx) error) error {
+	if s.batch == nil {
+		return s.dbClient.Update(fn)
+	}
+	return s.batch.add(fn)
+}
+
+// view runs fn in a read transaction, it sees every write that returned
+func (s *DbSourceStorage) view(fn func(txn *bolt.Tx) error) error {
+	return s.dbClient.View(fn)
+}
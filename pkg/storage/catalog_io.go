@@ -0,0 +1,784 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"nextimagescrap/pkg/imports"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// formats of ExportCatalog and ImportCatalog
+const (
+	// CatalogFormatJsonl writes one record envelope per line, as stored in the catalog
+	CatalogFormatJsonl = "jsonl"
+	// CatalogFormatCsv writes one row per record, the type column tells
+	// which of the other columns are used
+	CatalogFormatCsv = "csv"
+)
+
+var catalogCsvHeader = []string{
+	"type", "key", "root", "relPath", "path", "mimetype", "checksum",
+	"size", "modTime", "creationDate", "dateSource", "originalCreationDate", "clockOffset",
+	"offsetKnown", "cameraMake", "cameraModel", "cameraSerial", "sidecar", "description",
+	"people", "latitude", "longitude", "altitude", "exportedPath", "exportedAt",
+	"id", "sources", "volumeId", "volumeRel", "value",
+}
+
+// recordTypeMeta is the type of exported catalog metadata, like the
+// schema version
+const recordTypeMeta = "meta"
+
+const metaRecordVersion = 1
+
+// metaRecord is an entry of the meta bucket
+type metaRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ImportReport counts the records read by ImportCatalog
+type ImportReport struct {
+	Roots     int
+	Added     int
+	Merged    int
+	Unchanged int
+	Checksums int
+	// Dates counts merged media whose date was replaced by one of higher confidence
+	Dates int
+	// Duplicates counts added media whose content was already cataloged
+	Duplicates int
+}
+
+func (r *ImportReport) add(o ImportReport) {
+	r.Roots += o.Roots
+	r.Added += o.Added
+	r.Merged += o.Merged
+	r.Unchanged += o.Unchanged
+	r.Checksums += o.Checksums
+	r.Dates += o.Dates
+	r.Duplicates += o.Duplicates
+}
+
+// catalogWriter writes records in one of the catalog formats
+type catalogWriter interface {
+	writeMeta(m *metaRecord) error
+	writeRoot(r *SourceRoot) error
+	writeMedia(m *DbSourceMedia) error
+	writeChecksum(cs *DbSourceChecksum) error
+	flush() error
+}
+
+// ExportCatalog writes the metadata, roots, media and checksum groups of
+// the catalog to w and returns the number of records written. Records are
+// written in key order, so exports of two catalogs can be diffed. The
+// export journal is part of the media records, their ExportedPath and
+// ExportedAt. Failures and job runs belong to the machine running the
+// stages and are not exported.
+func (s *DbSourceStorage) ExportCatalog(w io.Writer, format string) (int, error) {
+	var cw catalogWriter
+	var err error
+	switch format {
+	case CatalogFormatJsonl:
+		cw = &jsonlCatalogWriter{w: bufio.NewWriter(w)}
+	case CatalogFormatCsv:
+		cw, err = newCsvCatalogWriter(w)
+	default:
+		err = fmt.Errorf("unknown catalog format %q", format)
+	}
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = s.forEachRecord(metaBucket, func(k, v []byte) error {
+		count++
+		return cw.writeMeta(&metaRecord{Key: string(k), Value: string(v)})
+	})
+	if err != nil {
+		return count, err
+	}
+	roots := s.Roots()
+	for i := range roots {
+		err = cw.writeRoot(&roots[i])
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	err = s.forEachRecord(mediaSourceBucket, func(k, v []byte) error {
+		m := DbSourceMedia{}
+		err := m.unmarshalMedia(v)
+		if err != nil {
+			return fmt.Errorf("record %s: %w", k, err)
+		}
+		count++
+		return cw.writeMedia(&m)
+	})
+	if err != nil {
+		return count, err
+	}
+	err = s.forEachRecord(mediaCheckSumBucket, func(k, v []byte) error {
+		cs := DbSourceChecksum{}
+		err := cs.unmarshalChecksum(v)
+		if err != nil {
+			return fmt.Errorf("record %s: %w", k, err)
+		}
+		count++
+		return cw.writeChecksum(&cs)
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, cw.flush()
+}
+
+type jsonlCatalogWriter struct {
+	w *bufio.Writer
+}
+
+func (c *jsonlCatalogWriter) writeLine(d []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(append(d, '\n'))
+	return err
+}
+
+func (c *jsonlCatalogWriter) writeMeta(m *metaRecord) error {
+	return c.writeLine(marshalRecord(recordTypeMeta, metaRecordVersion, m))
+}
+
+func (c *jsonlCatalogWriter) writeRoot(r *SourceRoot) error {
+	return c.writeLine(r.marshalRoot())
+}
+
+func (c *jsonlCatalogWriter) writeMedia(m *DbSourceMedia) error {
+	return c.writeLine(m.marshalMedia())
+}
+
+func (c *jsonlCatalogWriter) writeChecksum(cs *DbSourceChecksum) error {
+	return c.writeLine(cs.marshalChecksum())
+}
+
+func (c *jsonlCatalogWriter) flush() error {
+	return c.w.Flush()
+}
+
+type csvCatalogWriter struct {
+	w *csv.Writer
+}
+
+func newCsvCatalogWriter(w io.Writer) (*csvCatalogWriter, error) {
+	c := &csvCatalogWriter{w: csv.NewWriter(w)}
+	return c, c.w.Write(catalogCsvHeader)
+}
+
+func (c *csvCatalogWriter) write(row map[string]string) error {
+	record := make([]string, len(catalogCsvHeader))
+	for i := range catalogCsvHeader {
+		record[i] = row[catalogCsvHeader[i]]
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvCatalogWriter) writeMeta(m *metaRecord) error {
+	return c.write(map[string]string{
+		"type":  recordTypeMeta,
+		"key":   m.Key,
+		"value": m.Value,
+	})
+}
+
+func (c *csvCatalogWriter) writeRoot(r *SourceRoot) error {
+	return c.write(map[string]string{
+		"type":      recordTypeRoot,
+		"key":       r.Name,
+		"path":      r.Path,
+		"volumeId":  r.VolumeID,
+		"volumeRel": r.VolumeRel,
+	})
+}
+
+func (c *csvCatalogWriter) writeMedia(m *DbSourceMedia) error {
+	row := map[string]string{
+		"type":                 recordTypeMedia,
+		"key":                  m.Key,
+		"root":                 m.Root,
+		"relPath":              m.RelPath,
+		"path":                 m.Path,
+		"mimetype":             m.Mimetype,
+		"checksum":             m.Checksum,
+		"modTime":              formatCsvTime(m.ModTime),
+		"creationDate":         formatCsvTime(m.CreationDate),
+		"dateSource":           m.DateSource,
+		"originalCreationDate": formatCsvTime(m.OriginalCreationDate),
+		"clockOffset":          formatCsvDuration(m.ClockOffset),
+		"cameraMake":           m.CameraMake,
+		"cameraModel":          m.CameraModel,
+		"cameraSerial":         m.CameraSerial,
+		"sidecar":              m.Sidecar,
+		"description":          m.Description,
+		"people":               strings.Join(m.People, "\n"),
+		"exportedPath":         m.ExportedPath,
+		"exportedAt":           formatCsvTime(m.ExportedAt),
+		"id":                   strconv.Itoa(m.Id),
+	}
+	if m.Size != 0 {
+		row["size"] = strconv.FormatInt(m.Size, 10)
+	}
+	if m.OffsetKnown {
+		row["offsetKnown"] = "true"
+	}
+	if m.Location != nil {
+		row["latitude"] = formatCsvFloat(m.Location.Latitude)
+		row["longitude"] = formatCsvFloat(m.Location.Longitude)
+		row["altitude"] = formatCsvFloat(m.Location.Altitude)
+	}
+	return c.write(row)
+}
+
+func (c *csvCatalogWriter) writeChecksum(cs *DbSourceChecksum) error {
+	return c.write(map[string]string{
+		"type":    recordTypeChecksum,
+		"key":     cs.Key,
+		"sources": strings.Join(cs.Sources, "\n"),
+	})
+}
+
+func (c *csvCatalogWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func formatCsvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseCsvTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func formatCsvFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseCsvLocation returns the location of a row, nil if it has none
+func parseCsvLocation(row map[string]string) (*DbLocation, error) {
+	if row["latitude"] == "" && row["longitude"] == "" {
+		return nil, nil
+	}
+	l := &DbLocation{}
+	var err error
+	if l.Latitude, err = strconv.ParseFloat(row["latitude"], 64); err != nil {
+		return nil, err
+	}
+	if l.Longitude, err = strconv.ParseFloat(row["longitude"], 64); err != nil {
+		return nil, err
+	}
+	if row["altitude"] != "" {
+		if l.Altitude, err = strconv.ParseFloat(row["altitude"], 64); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func formatCsvDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func parseCsvDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// ImportCatalog reads records written by ExportCatalog and merges them
+// into the catalog. Unknown media are added, known media are merged by
+// imports.MergeMedia, so importing the same file again changes nothing.
+// Roots are added unless a root of the same name exists. Records are
+// written in transactions of migrationBatchSize records, the report
+// counts the committed ones. On an error the records of its transaction
+// are not imported, importing the file again completes the import.
+func (s *DbSourceStorage) ImportCatalog(r io.Reader, format string) (*ImportReport, error) {
+	imp, err := s.newCatalogImport()
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case CatalogFormatJsonl:
+		err = imp.readJsonl(r)
+	case CatalogFormatCsv:
+		err = imp.readCsv(r)
+	default:
+		err = fmt.Errorf("unknown catalog format %q", format)
+	}
+	if err != nil {
+		imp.rollback()
+		return &imp.report, err
+	}
+	err = imp.commit()
+	if err != nil {
+		return &imp.report, err
+	}
+	return &imp.report, s.loadRoots()
+}
+
+// catalogImport keeps the state of one ImportCatalog
+type catalogImport struct {
+	s      *DbSourceStorage
+	report ImportReport
+	// usedIds holds the ids of the catalog, imported media keep their
+	// id unless it is taken or newIds is set
+	usedIds map[int]bool
+	newIds  bool
+	// rootNames maps the roots of the export to the roots here
+	rootNames map[string]string
+	// txn holds the records written since the last commit, pending counts
+	// them and pendingIds holds their ids until txn is committed
+	txn        *bolt.Tx
+	records    int
+	pending    ImportReport
+	pendingIds map[int]bool
+}
+
+func (s *DbSourceStorage) newCatalogImport() (*catalogImport, error) {
+	imp := &catalogImport{
+		s:          s,
+		usedIds:    make(map[int]bool),
+		rootNames:  make(map[string]string),
+		pendingIds: make(map[int]bool),
+	}
+	err := s.forEachRecord(mediaSourceBucket, func(k, v []byte) error {
+		m := DbSourceMedia{}
+		err := m.unmarshalMedia(v)
+		if err != nil {
+			return fmt.Errorf("record %s: %w", k, err)
+		}
+		imp.usedIds[m.Id] = true
+		return nil
+	})
+	return imp, err
+}
+
+// write runs fn in the transaction of the import, which is committed
+// every migrationBatchSize records. A failing fn rolls it back.
+func (imp *catalogImport) write(fn func(txn *bolt.Tx) error) error {
+	if imp.txn == nil {
+		txn, err := imp.s.dbClient.Begin(true)
+		if err != nil {
+			return err
+		}
+		imp.txn = txn
+	}
+	err := fn(imp.txn)
+	if err != nil {
+		imp.rollback()
+		return err
+	}
+	imp.records++
+	if imp.records >= migrationBatchSize {
+		return imp.commit()
+	}
+	return nil
+}
+
+// commit commits the written records and counts them in the report
+func (imp *catalogImport) commit() error {
+	if imp.txn == nil {
+		return nil
+	}
+	err := imp.txn.Commit()
+	if err == nil {
+		imp.report.add(imp.pending)
+		for id := range imp.pendingIds {
+			imp.usedIds[id] = true
+		}
+	}
+	imp.reset()
+	return err
+}
+
+// rollback drops the records written since the last commit
+func (imp *catalogImport) rollback() {
+	if imp.txn != nil {
+		imp.txn.Rollback()
+	}
+	imp.reset()
+}
+
+func (imp *catalogImport) reset() {
+	imp.txn = nil
+	imp.records = 0
+	imp.pending = ImportReport{}
+	imp.pendingIds = make(map[int]bool)
+}
+
+// idUsed reports whether id is taken by a media of the catalog or of the
+// records written since the last commit
+func (imp *catalogImport) idUsed(id int) bool {
+	return imp.usedIds[id] || imp.pendingIds[id]
+}
+
+// importMeta checks that the export is not newer than this catalog, the
+// catalog keeps its own metadata
+func (imp *catalogImport) importMeta(m *metaRecord) error {
+	if m.Key != string(schemaVersionKey) {
+		return nil
+	}
+	version, err := strconv.Atoi(m.Value)
+	if err != nil {
+		return fmt.Errorf("invalid schema version %q", m.Value)
+	}
+	if version > schemaVersion() {
+		return fmt.Errorf("export of catalog schema version %d is newer than supported version %d", version, schemaVersion())
+	}
+	return nil
+}
+
+func (imp *catalogImport) readJsonl(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		d := scanner.Bytes()
+		if len(strings.TrimSpace(string(d))) == 0 {
+			continue
+		}
+		env := recordEnvelope{}
+		err := json.Unmarshal(d, &env)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		switch env.Type {
+		case recordTypeMeta:
+			m := &metaRecord{}
+			err = unmarshalRecord(d, recordTypeMeta, metaRecordVersion, m)
+			if err == nil {
+				err = imp.importMeta(m)
+			}
+		case recordTypeRoot:
+			root := SourceRoot{}
+			err = root.unmarshalRoot(d)
+			if err == nil {
+				err = imp.importRoot(&root)
+			}
+		case recordTypeMedia:
+			m := &DbSourceMedia{}
+			err = m.unmarshalMedia(d)
+			if err == nil {
+				err = imp.importMedia(m)
+			}
+		case recordTypeChecksum:
+			cs := &DbSourceChecksum{}
+			err = cs.unmarshalChecksum(d)
+			if err == nil {
+				err = imp.importChecksum(cs)
+			}
+		default:
+			err = fmt.Errorf("unknown record type %q", env.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (imp *catalogImport) readCsv(r io.Reader) error {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]int)
+	for i := range header {
+		columns[header[i]] = i
+	}
+	if _, ok := columns["type"]; !ok {
+		return fmt.Errorf("csv header without type column")
+	}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+		row := make(map[string]string)
+		for name, i := range columns {
+			if i < len(record) {
+				row[name] = record[i]
+			}
+		}
+		err = imp.importCsvRow(row)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+func (imp *catalogImport) importCsvRow(row map[string]string) error {
+	var err error
+	switch row["type"] {
+	case recordTypeMeta:
+		return imp.importMeta(&metaRecord{Key: row["key"], Value: row["value"]})
+	case recordTypeRoot:
+		return imp.importRoot(&SourceRoot{
+			Name:      row["key"],
+			Path:      row["path"],
+			VolumeID:  row["volumeId"],
+			VolumeRel: row["volumeRel"],
+		})
+	case recordTypeMedia:
+		m := &DbSourceMedia{
+			Key:          row["key"],
+			Root:         row["root"],
+			RelPath:      row["relPath"],
+			Path:         row["path"],
+			Mimetype:     row["mimetype"],
+			Checksum:     row["checksum"],
+			DateSource:   row["dateSource"],
+			CameraMake:   row["cameraMake"],
+			CameraModel:  row["cameraModel"],
+			CameraSerial: row["cameraSerial"],
+			Sidecar:      row["sidecar"],
+			Description:  row["description"],
+			ExportedPath: row["exportedPath"],
+		}
+		if row["people"] != "" {
+			m.People = strings.Split(row["people"], "\n")
+		}
+		if row["size"] != "" {
+			if m.Size, err = strconv.ParseInt(row["size"], 10, 64); err != nil {
+				return err
+			}
+		}
+		if m.ModTime, err = parseCsvTime(row["modTime"]); err != nil {
+			return err
+		}
+		if m.CreationDate, err = parseCsvTime(row["creationDate"]); err != nil {
+			return err
+		}
+		if offsetKnown, ok := row["offsetKnown"]; !ok {
+			// exported before the column existed
+			m.inferOffsetKnown()
+		} else if offsetKnown != "" {
+			if m.OffsetKnown, err = strconv.ParseBool(offsetKnown); err != nil {
+				return err
+			}
+		}
+		if m.Location, err = parseCsvLocation(row); err != nil {
+			return err
+		}
+		if m.OriginalCreationDate, err = parseCsvTime(row["originalCreationDate"]); err != nil {
+			return err
+		}
+		if m.ExportedAt, err = parseCsvTime(row["exportedAt"]); err != nil {
+			return err
+		}
+		if m.ClockOffset, err = parseCsvDuration(row["clockOffset"]); err != nil {
+			return err
+		}
+		if row["id"] != "" {
+			if m.Id, err = strconv.Atoi(row["id"]); err != nil {
+				return err
+			}
+		}
+		return imp.importMedia(m)
+	case recordTypeChecksum:
+		cs := &DbSourceChecksum{Key: row["key"]}
+		if row["sources"] != "" {
+			cs.Sources = strings.Split(row["sources"], "\n")
+		}
+		return imp.importChecksum(cs)
+	default:
+		return fmt.Errorf("unknown record type %q", row["type"])
+	}
+}
+
+// importRoot maps root to the root here at the same place, by volume or
+// path. A root found nowhere is added, under a free name if its own is
+// taken by another root.
+func (imp *catalogImport) importRoot(root *SourceRoot) error {
+	if root.Name == "" {
+		return fmt.Errorf("root without name")
+	}
+	return imp.write(func(txn *bolt.Tx) error {
+		bucket, err := getBucket(rootsBucket, txn)
+		if err != nil {
+			return err
+		}
+		place := ""
+		err = bucket.ForEach(func(k, v []byte) error {
+			local := SourceRoot{}
+			err := local.unmarshalRoot(v)
+			if err == nil && place == "" && samePlace(local, *root) {
+				place = local.Name
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if place != "" {
+			imp.rootNames[root.Name] = place
+			return nil
+		}
+		r := *root
+		r.Name = freeRootName(root.Name, func(name string) bool {
+			return bucket.Get([]byte(name)) != nil
+		})
+		item, err := r.marshalRoot()
+		if err != nil {
+			return err
+		}
+		log.Printf("import source root %q at %v as %q", root.Name, r.Path, r.Name)
+		imp.rootNames[root.Name] = r.Name
+		imp.pending.Roots++
+		return bucket.Put([]byte(r.Name), item)
+	})
+}
+
+// renameRoot moves m to the root here its root was imported as
+func (imp *catalogImport) renameRoot(m *DbSourceMedia) {
+	name, ok := imp.rootNames[m.Root]
+	if m.Root == "" || !ok || name == m.Root {
+		return
+	}
+	m.Root = name
+	m.Key = mediaSourceKeyPrefix + name + "/" + m.RelPath
+}
+
+// renameSource returns the checksum source, "<root>/<rel>", in the root
+// here its root was imported as
+func (imp *catalogImport) renameSource(source string) string {
+	root, rel, ok := strings.Cut(source, "/")
+	if name, mapped := imp.rootNames[root]; ok && mapped {
+		return name + "/" + rel
+	}
+	return source
+}
+
+func (imp *catalogImport) importMedia(m *DbSourceMedia) error {
+	if !strings.HasPrefix(m.Key, mediaSourceKeyPrefix) {
+		return fmt.Errorf("invalid media key %q", m.Key)
+	}
+	imp.renameRoot(m)
+	return imp.write(func(txn *bolt.Tx) error {
+		bucket, err := getBucket(mediaSourceBucket, txn)
+		if err != nil {
+			return err
+		}
+		merged := m
+		if item := bucket.Get([]byte(m.Key)); item != nil {
+			local := DbSourceMedia{}
+			err = local.unmarshalMedia(item)
+			if err != nil {
+				return err
+			}
+			sm := local.toSourceMedia()
+			if !imports.MergeMedia(sm, m.toSourceMedia()) {
+				imp.pending.Unchanged++
+				return nil
+			}
+			merged = newDbSourceMedia(sm)
+			imp.pending.Merged++
+			if !merged.CreationDate.Equal(local.CreationDate) || merged.DateSource != local.DateSource {
+				imp.pending.Dates++
+			}
+		} else {
+			if m.Checksum != "" {
+				checksums, err := getBucket(mediaCheckSumBucket, txn)
+				if err != nil {
+					return err
+				}
+				if checksums.Get([]byte(checksumKeyPrefix+m.Checksum)) != nil {
+					imp.pending.Duplicates++
+				}
+			}
+			if m.Id <= 0 || imp.idUsed(m.Id) || imp.newIds {
+				id, err := bucket.NextSequence()
+				if err != nil {
+					return err
+				}
+				m.Id = int(id)
+			}
+			if uint64(m.Id) > bucket.Sequence() {
+				err = bucket.SetSequence(uint64(m.Id))
+				if err != nil {
+					return err
+				}
+			}
+			imp.pendingIds[m.Id] = true
+			imp.pending.Added++
+		}
+		err = putMedia(txn, merged)
+		if err != nil {
+			return err
+		}
+		if merged.Checksum == "" {
+			return nil
+		}
+		return addChecksumSource(txn, merged.Checksum, checksumSourceOf(merged.Key))
+	})
+}
+
+// importChecksum adds the sources of cs which are cataloged with its
+// checksum, groups are otherwise built from the imported media
+func (imp *catalogImport) importChecksum(cs *DbSourceChecksum) error {
+	if !strings.HasPrefix(cs.Key, checksumKeyPrefix) {
+		return fmt.Errorf("invalid checksum key %q", cs.Key)
+	}
+	checksum := strings.TrimPrefix(cs.Key, checksumKeyPrefix)
+	return imp.write(func(txn *bolt.Tx) error {
+		source, err := getBucket(mediaSourceBucket, txn)
+		if err != nil {
+			return err
+		}
+		imp.pending.Checksums++
+		for _, name := range cs.Sources {
+			name = imp.renameSource(name)
+			item := source.Get([]byte(mediaSourceKeyPrefix + name))
+			if item == nil {
+				continue
+			}
+			m := DbSourceMedia{}
+			err = m.unmarshalMedia(item)
+			if err != nil {
+				return err
+			}
+			if m.Checksum != checksum {
+				continue
+			}
+			err = addChecksumSource(txn, checksum, name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bytes"
+	"nextimagescrap/pkg/imports"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newRootCatalog returns a catalog with the root name at dir, holding the
+// media at the relative paths with their checksums
+func newRootCatalog(t *testing.T, name string, dir string, checksums map[string]string) *DbSourceStorage {
+	t.Helper()
+	s, err := NewCatalogDbStorage(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.CloseDb() })
+	err = s.AddRoot(name, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := time.FixedZone("", 2*60*60)
+	rels := make([]string, 0, len(checksums))
+	for rel := range checksums {
+		rels = append(rels, rel)
+	}
+	// checksum groups list their sources in the order they were added
+	sort.Strings(rels)
+	for _, rel := range rels {
+		checksum := checksums[rel]
+		key, err := s.AddFile(filepath.Join(dir, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		media, err := s.GetFileByKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		media.Mimetype = "image/jpeg"
+		media.Checksum = checksum
+		media.Size = 1234
+		media.ModTime = time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+		media.CreationDate = time.Date(2020, 1, 2, 3, 4, 5, 0, zone)
+		media.DateSource = imports.DateSourceExif
+		media.OriginalCreationDate = time.Date(2020, 1, 2, 2, 4, 5, 0, zone)
+		media.ClockOffset = time.Hour
+		media.OffsetKnown = true
+		media.Camera = imports.CameraInfo{Make: "Cam", Model: "One", Serial: "1"}
+		media.Sidecar = rel + ".json"
+		media.Description = "a, \"quoted\"\ndescription"
+		media.People = []string{"Ann", "Bob"}
+		media.Location = &imports.GeoLocation{Latitude: 48.1, Longitude: 11.5, Altitude: 520}
+		media.ExportedPath = "/dest/" + rel
+		media.ExportedAt = time.Date(2022, 5, 6, 7, 8, 9, 0, time.UTC)
+		_, err = s.SaveMedia(media)
+		if err == nil {
+			err = s.AddChecksum(media)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func exportCatalog(t *testing.T, s *DbSourceStorage, format string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	_, err := s.ExportCatalog(&b, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestCatalogRoundTrip(t *testing.T) {
+	for _, format := range []string{CatalogFormatJsonl, CatalogFormatCsv} {
+		t.Run(format, func(t *testing.T) {
+			s := newRootCatalog(t, "card", t.TempDir(), map[string]string{"a/x.jpg": "c1", "a/y.jpg": "c1", "z.jpg": "c2"})
+			exported := exportCatalog(t, s, format)
+
+			imported, err := NewCatalogDbStorage(filepath.Join(t.TempDir(), "catalog.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer imported.CloseDb()
+			report, err := imported.ImportCatalog(bytes.NewReader(exported), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Roots != 1 || report.Added != 3 || report.Checksums != 2 {
+				t.Errorf("import report %+v", report)
+			}
+			again := exportCatalog(t, imported, format)
+			if !bytes.Equal(again, exported) {
+				t.Errorf("export of the imported catalog\n%s\ndiffers from\n%s", again, exported)
+			}
+
+			// importing the file again changes nothing
+			report, err = imported.ImportCatalog(bytes.NewReader(exported), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Roots != 0 || report.Added != 0 || report.Merged != 0 || report.Unchanged != 3 {
+				t.Errorf("second import report %+v", report)
+			}
+		})
+	}
+}
+
+func TestImportCatalogRootNameClash(t *testing.T) {
+	for _, format := range []string{CatalogFormatJsonl, CatalogFormatCsv} {
+		t.Run(format, func(t *testing.T) {
+			otherDir := t.TempDir()
+			other := newRootCatalog(t, "card", otherDir, map[string]string{"x.jpg": "a1", "y.jpg": "a1"})
+			exported := exportCatalog(t, other, format)
+
+			// a root of the same name at another place
+			localDir := t.TempDir()
+			s := newRootCatalog(t, "card", localDir, map[string]string{"x.jpg": "b1"})
+			report, err := s.ImportCatalog(bytes.NewReader(exported), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Roots != 1 || report.Added != 2 || report.Merged != 0 {
+				t.Errorf("import report %+v", report)
+			}
+			roots := s.Roots()
+			if len(roots) != 2 || roots[0].Name != "card" || roots[0].Path != localDir || roots[1].Name != "card-2" || roots[1].Path != otherDir {
+				t.Fatalf("roots %+v", roots)
+			}
+			local, err := s.GetFileByPath(filepath.Join(localDir, "x.jpg"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if local == nil || local.Checksum != "b1" {
+				t.Errorf("local media %+v", local)
+			}
+			imported, err := s.GetFileByPath(filepath.Join(otherDir, "x.jpg"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imported == nil || imported.Root != "card-2" || imported.Key != "source:card-2/x.jpg" || imported.Checksum != "a1" {
+				t.Errorf("imported media %+v", imported)
+			}
+			groups := map[string][]string{"a1": {"card-2/x.jpg", "card-2/y.jpg"}, "b1": {"card/x.jpg"}}
+			for checksum, want := range groups {
+				cs, err := s.GetChecksum(checksum)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cs == nil || !reflect.DeepEqual(cs.Sources, want) {
+					t.Errorf("checksum group %v is %+v, want %v", checksum, cs, want)
+				}
+			}
+
+			// the renamed root is found again by its place
+			report, err = s.ImportCatalog(bytes.NewReader(exported), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Roots != 0 || report.Added != 0 || report.Unchanged != 2 {
+				t.Errorf("second import report %+v", report)
+			}
+		})
+	}
+}
+
+func TestImportCatalogRootAtKnownPlace(t *testing.T) {
+	dir := t.TempDir()
+	other := newRootCatalog(t, "card", dir, map[string]string{"x.jpg": "a1"})
+	exported := exportCatalog(t, other, CatalogFormatJsonl)
+	s := newRootCatalog(t, "sd", dir, nil)
+	report, err := s.ImportCatalog(bytes.NewReader(exported), CatalogFormatJsonl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Roots != 0 || report.Added != 1 {
+		t.Errorf("import report %+v", report)
+	}
+	if roots := s.Roots(); len(roots) != 1 {
+		t.Errorf("roots %+v", roots)
+	}
+	media, err := s.GetFileByPath(filepath.Join(dir, "x.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media == nil || media.Key != "source:sd/x.jpg" {
+		t.Errorf("imported media %+v", media)
+	}
+	cs, err := s.GetChecksum("a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs == nil || !reflect.DeepEqual(cs.Sources, []string{"sd/x.jpg"}) {
+		t.Errorf("checksum group a1 is %+v", cs)
+	}
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"nextimagescrap/pkg/imports"
+	"nextimagescrap/pkg/storage/storagetest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestSourceDbRepository(t *testing.T) {
+	// the catalogs have no root, so media keys hold the paths unchanged
+	newDb := func(maxOps int, interval time.Duration) func() (imports.SourceDbRepository, error) {
+		return func() (imports.SourceDbRepository, error) {
+			s, err := NewCatalogDbStorage(filepath.Join(t.TempDir(), "catalog.db"))
+			if err != nil {
+				return nil, err
+			}
+			t.Cleanup(func() {
+				err := s.CloseDb()
+				if err != nil {
+					t.Error(err)
+				}
+			})
+			return s, s.EnableBatching(maxOps, interval)
+		}
+	}
+	repos := []struct {
+		name    string
+		newRepo func() (imports.SourceDbRepository, error)
+	}{
+		{"mem", func() (imports.SourceDbRepository, error) {
+			return NewMemSourceStorage(), nil
+		}},
+		{"db", newDb(1, 0)},
+		{"db batched", newDb(100, 0)},
+		{"db batched with interval", newDb(100, time.Millisecond)},
+	}
+	for _, r := range repos {
+		t.Run(r.name, func(t *testing.T) {
+			err := storagetest.TestSourceDbRepository(r.newRepo)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// zipOf returns a zip archive holding files
+func zipOf(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err == nil {
+			_, err = w.Write(content)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSourceFileRepository(t *testing.T) {
+	files := map[string][]byte{
+		"a.jpg":     []byte("jpeg"),
+		"sub/b.png": []byte("png"),
+		"sub/c.zip": zipOf(t, map[string][]byte{"d.jpg": []byte("zipped jpeg")}),
+	}
+	want := map[string][]byte{
+		"a.jpg":            files["a.jpg"],
+		"sub/b.png":        files["sub/b.png"],
+		"sub/c.zip!/d.jpg": []byte("zipped jpeg"),
+	}
+
+	t.Run("fs", func(t *testing.T) {
+		fsys := fstest.MapFS{}
+		for name, content := range files {
+			fsys["src/"+name] = &fstest.MapFile{Data: content}
+		}
+		r, err := NewFSSourceStorage(fsys, "src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths := make(map[string][]byte)
+		for name, content := range want {
+			paths["src/"+name] = content
+		}
+		err = storagetest.TestSourceFileRepository(r, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dir := t.TempDir()
+		for name, content := range files {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			err := os.MkdirAll(filepath.Dir(path), 0700)
+			if err == nil {
+				err = os.WriteFile(path, content, 0600)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		r, err := NewSourceFileStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths := make(map[string][]byte)
+		for name, content := range want {
+			paths[filepath.Join(dir, filepath.FromSlash(name))] = content
+		}
+		err = storagetest.TestSourceFileRepository(r, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestDestinationFileRepository(t *testing.T) {
+	content := []byte("exported")
+
+	t.Run("mem", func(t *testing.T) {
+		r := NewMemDestinationStorage()
+		err := storagetest.TestDestinationFileRepository(r, r.ReadFile, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		r, err := NewDestinationFileStorage(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = storagetest.TestDestinationFileRepository(r, os.ReadFile, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
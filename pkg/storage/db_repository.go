@@ -1,16 +1,18 @@
 package storage
 
 import (
-	"bytes"
-	"encoding/gob"
 	bolt "go.etcd.io/bbolt"
 	"log"
 	"nextimagescrap/pkg/imports"
+	"os"
 	"path/filepath"
+	"strings"
 )
 
 type DbSourceStorage struct {
 	dbClient *bolt.DB
+	batch    *batchWriter
+	roots    map[string]SourceRoot
 }
 
 const mediaSourceKeyPrefix = "source:"
@@ -34,11 +36,34 @@ func getBucket(bucketname []byte, tx *bolt.Tx) (*bolt.Bucket, error) {
 	return bucket, err
 }
 
-// NewDbStorage create new storage for data
+// DefaultCatalogPath returns the path of the catalog kept inside sourcePath
+func DefaultCatalogPath(sourcePath string) string {
+	return filepath.Join(sourcePath, dbSubPath)
+}
+
+// NewSourceDbStorage opens the catalog kept inside sourcePath, with
+// sourcePath as its default root
 func NewSourceDbStorage(sourcePath string) (*DbSourceStorage, error) {
-	dbPath := filepath.Join(sourcePath, dbSubPath)
+	s, err := NewCatalogDbStorage(DefaultCatalogPath(sourcePath))
+	if err != nil {
+		return nil, err
+	}
+	err = s.AddRoot(DefaultRootName, sourcePath, false)
+	if err != nil {
+		s.dbClient.Close()
+		return nil, err
+	}
+	return s, nil
+}
 
-	dbClient, err := bolt.Open(dbPath, 0600, nil)
+// NewCatalogDbStorage opens the catalog at catalogPath, which may be
+// outside of any source, creating its directory when missing
+func NewCatalogDbStorage(catalogPath string) (*DbSourceStorage, error) {
+	err := os.MkdirAll(filepath.Dir(catalogPath), 0700)
+	if err != nil {
+		return nil, err
+	}
+	dbClient, err := bolt.Open(catalogPath, 0600, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -52,20 +77,52 @@ func NewSourceDbStorage(sourcePath string) (*DbSourceStorage, error) {
 		return err
 	})
 	if err != nil {
+		s.dbClient.Close()
+		return nil, err
+	}
+	err = s.loadRoots()
+	if err == nil {
+		err = s.migrate()
+	}
+	if err != nil {
+		s.dbClient.Close()
 		return nil, err
 	}
 	return &s, err
 }
 
-// CloseDb closes link to db
+// CloseDb commits pending batched writes and closes link to db
 func (s *DbSourceStorage) CloseDb() error {
-	err := s.dbClient.Close()
+	err := s.Flush()
+	if err != nil {
+		log.Printf("cannot commit pending writes %v", err)
+	}
+	cerr := s.dbClient.Close()
+	if err == nil {
+		err = cerr
+	}
 	return err
 }
 
+// MediaCount returns the number of cataloged media
+func (s *DbSourceStorage) MediaCount() (int, error) {
+	count := 0
+	err := s.view(func(txn *bolt.Tx) error {
+		bucket := txn.Bucket(mediaSourceBucket)
+		if bucket != nil {
+			count = bucket.Stats().KeyN
+		}
+		return nil
+	})
+	return count, err
+}
+
+// AddFile adds the media at filePath, relative to the source root
+// containing it
 func (s *DbSourceStorage) AddFile(filePath string) (string, error) {
-	key := mediaSourceKeyPrefix + filePath
-	err := s.dbClient.Update(func(txn *bolt.Tx) error {
+	key := s.mediaKeyOfPath(filePath)
+	root, rel, _ := s.rootOf(filePath)
+	err := s.update(func(txn *bolt.Tx) error {
 		bucket, err := getBucket(mediaSourceBucket, txn)
 		if err != nil {
 			log.Printf("%v", err)
@@ -75,18 +132,13 @@ func (s *DbSourceStorage) AddFile(filePath string) (string, error) {
 		id, _ := bucket.NextSequence()
 		// convert to storage model
 		sMedia := &DbSourceMedia{
-			Id:   int(id),
-			Key:  key,
-			Path: filePath,
+			Id:      int(id),
+			Key:     key,
+			Path:    filePath,
+			Root:    root,
+			RelPath: rel,
 		}
-
-		d, errint := sMedia.marshalMedia()
-		if errint != nil {
-			return errint
-		}
-		bkey := []byte(key)
-		errint = bucket.Put(bkey, d)
-		return errint
+		return putMedia(txn, sMedia)
 	})
 	if err != nil {
 		log.Printf("%v", err)
@@ -96,13 +148,13 @@ func (s *DbSourceStorage) AddFile(filePath string) (string, error) {
 }
 
 func (s *DbSourceStorage) HasFile(filePath string) (bool, error) {
+	key := s.mediaKeyOfPath(filePath)
 	hasFile := false
-	err := s.dbClient.View(func(txn *bolt.Tx) error {
+	err := s.view(func(txn *bolt.Tx) error {
 		bucket, err := getBucket(mediaSourceBucket, txn)
 		if err != nil {
 			return err
 		}
-		key := mediaSourceKeyPrefix + filePath
 		item := bucket.Get([]byte(key))
 		if item != nil {
 			hasFile = true
@@ -111,138 +163,71 @@ func (s *DbSourceStorage) HasFile(filePath string) (bool, error) {
 	})
 	return hasFile, err
 }
-func (s *DbSourceStorage) GetFilesByMimetypeFilter(filter []string) ([]*imports.SourceMedia, error) {
-	var me []*imports.SourceMedia
-	err := s.dbClient.View(func(txn *bolt.Tx) error {
-		bucket, err := getBucket(mediaSourceBucket, txn)
-		if err != nil {
-			return err
-		}
 
-		c := bucket.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() { //sm := imports.SourceMedia{}
-			dbsm := DbSourceMedia{}
-			errint := dbsm.unmarshalMedia(v)
-			if errint != nil {
-				return errint
-			}
-			for i := range filter {
-				if filter[i] == dbsm.Mimetype {
-					sm := &imports.SourceMedia{
-						Id:           dbsm.Id,
-						Key:          dbsm.Key,
-						Path:         dbsm.Path,
-						Mimetype:     dbsm.Mimetype,
-						Checksum:     dbsm.Checksum,
-						CreationDate: dbsm.CreationDate,
-					}
-					me = append(me, sm)
-					break
-				}
-			}
-		}
-		return err
-	})
-	return me, err
+// GetFilesByMimetypeFilter returns all media of the mimetypes in filter
+func (s *DbSourceStorage) GetFilesByMimetypeFilter(filter []string) ([]*imports.SourceMedia, error) {
+	if len(filter) == 0 {
+		return nil, nil
+	}
+	return s.collectMedia(imports.MediaFilter{Mimetypes: filter})
 }
 
 func (s *DbSourceStorage) GetAllFiles() ([]*imports.SourceMedia, error) {
-	var me []*imports.SourceMedia
-	err := s.dbClient.View(func(txn *bolt.Tx) error {
-		bucket, err := getBucket(mediaSourceBucket, txn)
-		if err != nil {
-			return err
-		}
-
-		c := bucket.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() { //sm := imports.SourceMedia{}
-			dbsm := DbSourceMedia{}
-			errint := dbsm.unmarshalMedia(v)
-			if errint != nil {
-				return errint
-			}
-			sm := &imports.SourceMedia{
-				Id:           dbsm.Id,
-				Key:          dbsm.Key,
-				Path:         dbsm.Path,
-				Mimetype:     dbsm.Mimetype,
-				Checksum:     dbsm.Checksum,
-				CreationDate: dbsm.CreationDate,
-			}
+	return s.collectMedia(imports.MediaFilter{})
+}
 
-			me = append(me, sm)
-		}
+// collectMedia returns all media matching filter as slice
+func (s *DbSourceStorage) collectMedia(filter imports.MediaFilter) ([]*imports.SourceMedia, error) {
+	var me []*imports.SourceMedia
+	err := s.ForEachMedia(filter, func(media *imports.SourceMedia) error {
+		me = append(me, media)
 		return nil
 	})
 	return me, err
 }
 
+// AddChecksum adds media to the group of its checksum, unless it is
+// already listed there. Groups list the keys of their media without prefix.
 func (s *DbSourceStorage) AddChecksum(media *imports.SourceMedia) error {
 	if media.Checksum == "" {
 		return nil
 	}
-	err := s.dbClient.Update(func(txn *bolt.Tx) error {
+	checksum := media.Checksum
+	source := checksumSourceOf(media.Key)
+	return s.update(func(txn *bolt.Tx) error {
+		return addChecksumSource(txn, checksum, source)
+	})
+}
+
+// GetChecksum returns the group of media with checksum, nil if there is none
+func (s *DbSourceStorage) GetChecksum(checksum string) (*imports.SourceChecksum, error) {
+	var cs *imports.SourceChecksum
+	err := s.view(func(txn *bolt.Tx) error {
 		bucket, err := getBucket(mediaCheckSumBucket, txn)
 		if err != nil {
-			log.Printf("%v", err)
 			return err
 		}
-		var errint error
-		key := checksumKeyPrefix + media.Checksum
-		item := bucket.Get([]byte(key))
+		item := bucket.Get([]byte(checksumKeyPrefix + checksum))
 		if item == nil {
-			checksum := &DbSourceChecksum{
-				Key:     key,
-				Sources: []string{media.Path},
-			}
-			item, errint = checksum.marshalChecksum()
-		} else {
-			checksum := DbSourceChecksum{}
-			errint = checksum.unmarshalChecksum(item)
-			if errint != nil {
-				return errint
-			}
-			checksum.Sources = append(checksum.Sources, media.Path)
-			item, errint = checksum.marshalChecksum()
+			return nil
 		}
-		if errint != nil {
-			return errint
+		dbcs := DbSourceChecksum{}
+		err = dbcs.unmarshalChecksum(item)
+		if err != nil {
+			return err
 		}
-		bkey := []byte(key)
-		errint = bucket.Put(bkey, item)
-		return errint
+		cs = &imports.SourceChecksum{Key: dbcs.Key, Sources: dbcs.Sources}
+		return nil
 	})
-	return err
+	return cs, err
 }
 
 func (s *DbSourceStorage) SaveMedia(media *imports.SourceMedia) (string, error) {
 	key := media.Key
-	err := s.dbClient.Update(func(txn *bolt.Tx) error {
-		bucket, err := getBucket(mediaSourceBucket, txn)
-		if err != nil {
-			log.Printf("%v", err)
-			return err
-		}
-
-		// convert to storage model
-		sMedia := &DbSourceMedia{
-			Id:           media.Id,
-			Key:          key,
-			Path:         media.Path,
-			Mimetype:     media.Mimetype,
-			Checksum:     media.Checksum,
-			CreationDate: media.CreationDate,
-		}
-
-		d, errint := sMedia.marshalMedia()
-		if errint != nil {
-			return errint
-		}
-		bkey := []byte(key)
-		errint = bucket.Put(bkey, d)
-		return errint
+	// convert to storage model
+	sMedia := newDbSourceMedia(media)
+	err := s.update(func(txn *bolt.Tx) error {
+		return putMedia(txn, sMedia)
 	})
 	if err != nil {
 		log.Printf("%v", err)
@@ -251,14 +236,18 @@ func (s *DbSourceStorage) SaveMedia(media *imports.SourceMedia) (string, error)
 	return key, nil
 }
 
+// GetFileByKey returns the media stored under key, the key prefix may be omitted
 func (s *DbSourceStorage) GetFileByKey(path string) (*imports.SourceMedia, error) {
 	var media *imports.SourceMedia
-	err := s.dbClient.View(func(txn *bolt.Tx) error {
+	err := s.view(func(txn *bolt.Tx) error {
 		bucket, err := getBucket(mediaSourceBucket, txn)
 		if err != nil {
 			return err
 		}
-		key := mediaSourceKeyPrefix + path
+		key := path
+		if !strings.HasPrefix(key, mediaSourceKeyPrefix) {
+			key = mediaSourceKeyPrefix + path
+		}
 		item := bucket.Get([]byte(key))
 		if item != nil {
 			dbsm := DbSourceMedia{}
@@ -266,72 +255,222 @@ func (s *DbSourceStorage) GetFileByKey(path string) (*imports.SourceMedia, error
 			if errint != nil {
 				return errint
 			}
-			media = &imports.SourceMedia{
-				Id:           dbsm.Id,
-				Key:          dbsm.Key,
-				Path:         dbsm.Path,
-				Mimetype:     dbsm.Mimetype,
-				Checksum:     dbsm.Checksum,
-				CreationDate: dbsm.CreationDate,
-			}
-
+			media = dbsm.toSourceMedia()
+			media.Path = s.resolvePath(&dbsm)
 		}
 		return err
 	})
 	return media, err
 }
 
+// GetFileByPath returns the media at filePath, nil if it is not cataloged
+func (s *DbSourceStorage) GetFileByPath(filePath string) (*imports.SourceMedia, error) {
+	var media *imports.SourceMedia
+	key := s.mediaKeyOfPath(filePath)
+	err := s.view(func(txn *bolt.Tx) error {
+		bucket, err := getBucket(mediaSourceBucket, txn)
+		if err != nil {
+			return err
+		}
+		item := bucket.Get([]byte(key))
+		if item == nil {
+			return nil
+		}
+		dbsm := DbSourceMedia{}
+		err = dbsm.unmarshalMedia(item)
+		if err != nil {
+			return err
+		}
+		media = dbsm.toSourceMedia()
+		media.Path = s.resolvePath(&dbsm)
+		return nil
+	})
+	return media, err
+}
+
 func (s *DbSourceStorage) GetAllCheckSum() (error, []*imports.SourceChecksum) {
 	var cs []*imports.SourceChecksum
-	err := s.dbClient.View(func(txn *bolt.Tx) error {
-		bucket, err := getBucket(mediaCheckSumBucket, txn)
+	err := s.ForEachChecksum("", func(checksum *imports.SourceChecksum) error {
+		cs = append(cs, checksum)
+		return nil
+	})
+	return err, cs
+}
+
+// addChecksumSource adds source to the checksum group, which is created
+// when missing
+func addChecksumSource(txn *bolt.Tx, checksum string, source string) error {
+	bucket, err := getBucket(mediaCheckSumBucket, txn)
+	if err != nil {
+		log.Printf("%v", err)
+		return err
+	}
+	key := []byte(checksumKeyPrefix + checksum)
+	cs := DbSourceChecksum{Key: string(key)}
+	if item := bucket.Get(key); item != nil {
+		err = cs.unmarshalChecksum(item)
 		if err != nil {
 			return err
 		}
+	}
+	if containsString(cs.Sources, source) {
+		return nil
+	}
+	cs.Sources = append(cs.Sources, source)
+	item, err := cs.marshalChecksum()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, item)
+}
+
+// removeChecksumSource removes source from the checksum group, which is
+// deleted once empty
+func removeChecksumSource(txn *bolt.Tx, checksum string, source string) error {
+	bucket, err := getBucket(mediaCheckSumBucket, txn)
+	if err != nil {
+		return err
+	}
+	key := []byte(checksumKeyPrefix + checksum)
+	item := bucket.Get(key)
+	if item == nil {
+		return nil
+	}
+	cs := DbSourceChecksum{}
+	err = cs.unmarshalChecksum(item)
+	if err != nil {
+		return err
+	}
+	sources := cs.Sources[:0]
+	for i := range cs.Sources {
+		if cs.Sources[i] != source {
+			sources = append(sources, cs.Sources[i])
+		}
+	}
+	if len(sources) == 0 {
+		return bucket.Delete(key)
+	}
+	cs.Sources = sources
+	item, err = cs.marshalChecksum()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, item)
+}
 
-		c := bucket.Cursor()
+// renameChecksumSource replaces source by renamed in the checksum group,
+// keeping its position
+func renameChecksumSource(txn *bolt.Tx, checksum string, source string, renamed string) error {
+	bucket, err := getBucket(mediaCheckSumBucket, txn)
+	if err != nil {
+		return err
+	}
+	key := []byte(checksumKeyPrefix + checksum)
+	item := bucket.Get(key)
+	if item == nil {
+		return addChecksumSource(txn, checksum, renamed)
+	}
+	cs := DbSourceChecksum{}
+	err = cs.unmarshalChecksum(item)
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range cs.Sources {
+		if cs.Sources[i] == source {
+			cs.Sources[i] = renamed
+			found = true
+		}
+	}
+	if !found {
+		return addChecksumSource(txn, checksum, renamed)
+	}
+	item, err = cs.marshalChecksum()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, item)
+}
 
-		for k, v := c.First(); k != nil; k, v = c.Next() { //sm := imports.SourceMedia{}
-			dbsm := DbSourceChecksum{}
-			errint := dbsm.unmarshalChecksum(v)
-			if errint != nil {
-				return errint
-			}
-			s := &imports.SourceChecksum{
-				Key:     dbsm.Key,
-				Sources: dbsm.Sources,
-			}
-			cs = append(cs, s)
+func containsString(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
 		}
-		return nil
-	})
-	return err, cs
+	}
+	return false
 }
 
-func (m *DbSourceMedia) marshalMedia() ([]byte, error) {
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-	err := enc.Encode(m)
-	return b.Bytes(), err
+// newDbSourceMedia converts media to the storage model
+func newDbSourceMedia(media *imports.SourceMedia) *DbSourceMedia {
+	return &DbSourceMedia{
+		Id:                   media.Id,
+		Key:                  media.Key,
+		Path:                 media.Path,
+		Root:                 media.Root,
+		RelPath:              media.RelPath,
+		Mimetype:             media.Mimetype,
+		Checksum:             media.Checksum,
+		Size:                 media.Size,
+		ModTime:              media.ModTime,
+		CreationDate:         media.CreationDate,
+		DateSource:           string(media.DateSource),
+		OriginalCreationDate: media.OriginalCreationDate,
+		ClockOffset:          media.ClockOffset,
+		OffsetKnown:          media.OffsetKnown,
+		CameraMake:           media.Camera.Make,
+		CameraModel:          media.Camera.Model,
+		CameraSerial:         media.Camera.Serial,
+		Sidecar:              media.Sidecar,
+		Description:          media.Description,
+		People:               media.People,
+		Location:             newDbLocation(media.Location),
+		ExportedPath:         media.ExportedPath,
+		ExportedAt:           media.ExportedAt,
+	}
 }
 
-func (m *DbSourceMedia) unmarshalMedia(d []byte) error {
-	b := bytes.NewBuffer(d)
-	dec := gob.NewDecoder(b)
-	err := dec.Decode(m)
-	return err
+// toSourceMedia converts the storage model to media
+func (m *DbSourceMedia) toSourceMedia() *imports.SourceMedia {
+	return &imports.SourceMedia{
+		Id:                   m.Id,
+		Key:                  m.Key,
+		Path:                 m.Path,
+		Root:                 m.Root,
+		RelPath:              m.RelPath,
+		Mimetype:             m.Mimetype,
+		Checksum:             m.Checksum,
+		Size:                 m.Size,
+		ModTime:              m.ModTime,
+		CreationDate:         m.CreationDate,
+		DateSource:           imports.DateSource(m.DateSource),
+		OriginalCreationDate: m.OriginalCreationDate,
+		ClockOffset:          m.ClockOffset,
+		OffsetKnown:          m.OffsetKnown,
+		Camera: imports.CameraInfo{
+			Make:   m.CameraMake,
+			Model:  m.CameraModel,
+			Serial: m.CameraSerial,
+		},
+		Sidecar:      m.Sidecar,
+		Description:  m.Description,
+		People:       m.People,
+		Location:     m.Location.toGeoLocation(),
+		ExportedPath: m.ExportedPath,
+		ExportedAt:   m.ExportedAt,
+	}
 }
 
-func (m *DbSourceChecksum) marshalChecksum() ([]byte, error) {
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-	err := enc.Encode(m)
-	return b.Bytes(), err
+func newDbLocation(l *imports.GeoLocation) *DbLocation {
+	if l == nil {
+		return nil
+	}
+	return &DbLocation{Latitude: l.Latitude, Longitude: l.Longitude, Altitude: l.Altitude}
 }
 
-func (m *DbSourceChecksum) unmarshalChecksum(d []byte) error {
-	b := bytes.NewBuffer(d)
-	dec := gob.NewDecoder(b)
-	err := dec.Decode(m)
-	return err
+func (l *DbLocation) toGeoLocation() *imports.GeoLocation {
+	if l == nil {
+		return nil
+	}
+	return &imports.GeoLocation{Latitude: l.Latitude, Longitude: l.Longitude, Altitude: l.Altitude}
 }
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// records are stored as json wrapped in an envelope naming the record
+// type and the version of its encoding
+const (
+	recordTypeMedia    = "media"
+	recordTypeChecksum = "checksum"
+
+	// version 2 records whether the offset of the CreationDate is known
+	mediaRecordVersion    = 2
+	checksumRecordVersion = 1
+)
+
+type recordEnvelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"v"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func marshalRecord(recordType string, version int, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(recordEnvelope{
+		Type:    recordType,
+		Version: version,
+		Data:    data,
+	})
+}
+
+// unmarshalRecord decodes d into v, records written before the envelope
+// was introduced are gob encoded and decoded as such
+func unmarshalRecord(d []byte, recordType string, maxVersion int, v interface{}) error {
+	_, err := unmarshalVersionedRecord(d, recordType, maxVersion, v)
+	return err
+}
+
+// unmarshalVersionedRecord decodes d into v and returns the version of
+// its encoding, 0 for gob records
+func unmarshalVersionedRecord(d []byte, recordType string, maxVersion int, v interface{}) (int, error) {
+	env, ok := decodeEnvelope(d)
+	if !ok {
+		return 0, gob.NewDecoder(bytes.NewBuffer(d)).Decode(v)
+	}
+	if env.Type != recordType {
+		return 0, fmt.Errorf("expected %s record, found %s", recordType, env.Type)
+	}
+	if env.Version > maxVersion {
+		return 0, fmt.Errorf("%s record version %d is newer than supported version %d", recordType, env.Version, maxVersion)
+	}
+	return env.Version, json.Unmarshal(env.Data, v)
+}
+
+// decodeEnvelope decodes the envelope of a json record, ok is false for
+// gob records. These may start with a '{' length byte too, so the whole
+// record must decode.
+func decodeEnvelope(d []byte) (env recordEnvelope, ok bool) {
+	if len(d) == 0 || d[0] != '{' {
+		return env, false
+	}
+	err := json.Unmarshal(d, &env)
+	return env, err == nil && env.Type != "" && env.Data != nil
+}
+
+func (m *DbSourceMedia) marshalMedia() ([]byte, error) {
+	return marshalRecord(recordTypeMedia, mediaRecordVersion, m)
+}
+
+func (m *DbSourceMedia) unmarshalMedia(d []byte) error {
+	version, err := unmarshalVersionedRecord(d, recordTypeMedia, mediaRecordVersion, m)
+	if err == nil && version < 2 {
+		m.inferOffsetKnown()
+	}
+	return err
+}
+
+// inferOffsetKnown sets OffsetKnown for records which did not store it.
+// They kept dates without offset as UTC, so only a non-zero offset tells
+// that one was recorded.
+func (m *DbSourceMedia) inferOffsetKnown() {
+	_, offset := m.CreationDate.Zone()
+	m.OffsetKnown = offset != 0
+}
+
+func (m *DbSourceChecksum) marshalChecksum() ([]byte, error) {
+	return marshalRecord(recordTypeChecksum, checksumRecordVersion, m)
+}
+
+func (m *DbSourceChecksum) unmarshalChecksum(d []byte) error {
+	return unmarshalRecord(d, recordTypeChecksum, checksumRecordVersion, m)
+}
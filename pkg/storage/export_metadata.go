@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"nextimagescrap/pkg/imports"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dsoprea/go-exif/v3"
+	jpegstructure "github.com/dsoprea/go-jpeg-image-structure/v2"
+)
+
+// DestinationOptions controls how exported files are written
+type DestinationOptions struct {
+	// WriteDates stores the CreationDate in the exif data of exported
+	// jpegs, or in a xmp sidecar for other formats, and sets the mtime of
+	// the exported file to the CreationDate. Source files are never changed.
+	WriteDates bool
+}
+
+const exifDateLayout = "2006:01:02 15:04:05"
+const xmpDateLayout = "2006-01-02T15:04:05"
+
+// writeDates stores the CreationDate of media into the exported file
+func writeDates(media *imports.SourceMedia, destFilename string) error {
+	dt := media.CreationDate
+	if dt.IsZero() {
+		return nil
+	}
+	var err error
+	if media.Mimetype == "image/jpeg" {
+		err = writeExifDate(destFilename, dt, media.OffsetKnown)
+		if err != nil {
+			log.Printf("cannot write exif date to %v, writing sidecar: %v", destFilename, err)
+			err = writeXmpSidecar(destFilename, dt, media.OffsetKnown)
+		}
+	} else {
+		err = writeXmpSidecar(destFilename, dt, media.OffsetKnown)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(destFilename, dt, dt)
+}
+
+// writeExifDate sets DateTimeOriginal, and OffsetTimeOriginal if the
+// offset is known, in the jpeg at path
+func writeExifDate(path string, dt time.Time, offsetKnown bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	mc, err := jpegstructure.NewJpegMediaParser().ParseBytes(data)
+	if err != nil {
+		return err
+	}
+	sl := mc.(*jpegstructure.SegmentList)
+	rootIb, err := sl.ConstructExifBuilder()
+	if err != nil {
+		return err
+	}
+	exifIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/Exif")
+	if err != nil {
+		return err
+	}
+	err = exifIb.SetStandardWithName("DateTimeOriginal", dt.Format(exifDateLayout))
+	if err != nil {
+		return err
+	}
+	if offsetKnown {
+		err = exifIb.SetStandardWithName("OffsetTimeOriginal", dt.Format("-07:00"))
+		if err != nil {
+			return err
+		}
+	}
+	err = sl.SetExif(rootIb)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	err = sl.Write(&b)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, b.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+const xmpSidecarTemplate = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    exif:DateTimeOriginal="%[1]s"
+    xmp:CreateDate="%[1]s"
+    photoshop:DateCreated="%[1]s"/>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+
+// writeXmpSidecar writes the date to <path>.xmp, dates without known
+// offset as wall-clock time
+func writeXmpSidecar(path string, dt time.Time, offsetKnown bool) error {
+	date := dt.Format(xmpDateLayout)
+	if offsetKnown {
+		date = dt.Format(xmpDateLayout + "-07:00")
+	}
+	sidecar := path + ".xmp"
+	err := os.WriteFile(sidecar, []byte(fmt.Sprintf(xmpSidecarTemplate, date)), 0644)
+	if err != nil {
+		return err
+	}
+	log.Printf("wrote sidecar %v", filepath.Base(sidecar))
+	return os.Chtimes(sidecar, dt, dt)
+}
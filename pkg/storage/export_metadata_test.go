@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"nextimagescrap/pkg/imports"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+	jpegstructure "github.com/dsoprea/go-jpeg-image-structure/v2"
+)
+
+func TestExportRecordedUtcOffset(t *testing.T) {
+	s, err := NewCatalogDbStorage(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseDb()
+	dt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("", 0))
+	for _, name := range []string{"/p/zoned.png", "/p/wallclock.png"} {
+		key, err := s.AddFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		media, err := s.GetFileByKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		media.Mimetype = "image/png"
+		media.CreationDate = dt
+		media.OffsetKnown = name == "/p/zoned.png"
+		_, err = s.SaveMedia(media)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := NewDestinationFileStorageWithOptions(t.TempDir(), DestinationOptions{WriteDates: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/p/zoned.png":     `"2020-01-02T03:04:05+00:00"`,
+		"/p/wallclock.png": `"2020-01-02T03:04:05"`,
+	}
+	for name, date := range want {
+		// the media is read back from the catalog, where the date is UTC
+		media, err := s.GetFileByPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported, err := d.ExportToDirectory(media, "png", strings.NewReader("png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		xmp, err := os.ReadFile(exported + ".xmp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(xmp), "exif:DateTimeOriginal="+date) {
+			t.Errorf("sidecar of %v does not hold date %v:\n%s", name, date, xmp)
+		}
+	}
+}
+
+// jpegOf returns a small jpeg, with an exif segment recording make if it
+// is not empty
+func jpegOf(t *testing.T, make string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	err := jpeg.Encode(&b, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if make == "" {
+		return b.Bytes()
+	}
+	mc, err := jpegstructure.NewJpegMediaParser().ParseBytes(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := mc.(*jpegstructure.SegmentList)
+	im, err := exifcommon.NewIfdMappingWithStandard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootIb := exif.NewIfdBuilder(im, exif.NewTagIndex(), exifcommon.IfdStandardIfdIdentity, exifcommon.EncodeDefaultByteOrder)
+	err = rootIb.SetStandardWithName("Make", make)
+	if err == nil {
+		err = sl.SetExif(rootIb)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	err = sl.Write(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// exifTags returns the string values of the exif tags in data by name
+func exifTags(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	rawExif, err := exif.SearchAndExtractExif(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := exifcommon.NewIfdMappingWithStandard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, index, err := exif.Collect(im, exif.NewTagIndex(), rawExif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := make(map[string]string)
+	for _, ifd := range index.Ifds {
+		for _, entry := range ifd.Entries() {
+			if v, err := entry.Value(); err == nil {
+				if s, ok := v.(string); ok {
+					tags[entry.TagName()] = s
+				}
+			}
+		}
+	}
+	return tags
+}
+
+func TestExportJpegExifDate(t *testing.T) {
+	zoned := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("", 2*60*60))
+	tests := []struct {
+		name        string
+		make        string
+		offsetKnown bool
+		wantOffset  string
+	}{
+		{"without exif", "", false, ""},
+		{"without exif, known offset", "", true, "+02:00"},
+		{"with exif", "Cam", false, ""},
+		{"with exif, known offset", "Cam", true, "+02:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDestinationFileStorageWithOptions(t.TempDir(), DestinationOptions{WriteDates: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			media := &imports.SourceMedia{Key: "source:/p/a.jpg", Path: "/p/a.jpg", Mimetype: "image/jpeg",
+				CreationDate: zoned, OffsetKnown: tt.offsetKnown}
+			exported, err := d.ExportToDirectory(media, "jpg", bytes.NewReader(jpegOf(t, tt.make)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(exported)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tags := exifTags(t, data)
+			if tags["DateTimeOriginal"] != "2020:01:02 03:04:05" || tags["OffsetTimeOriginal"] != tt.wantOffset {
+				t.Errorf("exported exif %v", tags)
+			}
+			if tags["Make"] != tt.make {
+				t.Errorf("exported make %q, want %q", tags["Make"], tt.make)
+			}
+			if _, err := os.Stat(exported + ".xmp"); !os.IsNotExist(err) {
+				t.Errorf("sidecar written for %v: %v", exported, err)
+			}
+			info, err := os.Stat(exported)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ModTime().Equal(zoned) {
+				t.Errorf("mtime %v, want %v", info.ModTime(), zoned)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"nextimagescrap/pkg/imports"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// failuresBucket maps "<stage>\x00<media key or path>" to a DbFailure
+var failuresBucket = []byte("failures")
+
+const recordTypeFailure = "failure"
+const failureRecordVersion = 1
+
+// DbFailure is the storage form of imports.Failure
+type DbFailure struct {
+	Stage         string    `json:"stage"`
+	Key           string    `json:"key,omitempty"`
+	Path          string    `json:"path"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"firstFailedAt"`
+	LastFailedAt  time.Time `json:"lastFailedAt"`
+}
+
+func failureKey(stage imports.Stage, id string) []byte {
+	return []byte(string(stage) + indexSeparator + id)
+}
+
+func (f *DbFailure) toFailure() *imports.Failure {
+	return &imports.Failure{
+		Stage:         imports.Stage(f.Stage),
+		Key:           f.Key,
+		Path:          f.Path,
+		Error:         f.Error,
+		Attempts:      f.Attempts,
+		FirstFailedAt: f.FirstFailedAt,
+		LastFailedAt:  f.LastFailedAt,
+	}
+}
+
+// RecordFailure stores f, a failure recorded before for the same stage
+// and media counts one more attempt
+func (s *DbSourceStorage) RecordFailure(f *imports.Failure) error {
+	now := time.Now()
+	dbf := &DbFailure{
+		Stage:         string(f.Stage),
+		Key:           f.Key,
+		Path:          f.Path,
+		Error:         f.Error,
+		Attempts:      1,
+		FirstFailedAt: now,
+		LastFailedAt:  now,
+	}
+	key := failureKey(f.Stage, f.ID())
+	return s.update(func(txn *bolt.Tx) error {
+		bucket, err := getBucket(failuresBucket, txn)
+		if err != nil {
+			return err
+		}
+		if item := bucket.Get(key); item != nil {
+			old := DbFailure{}
+			err = unmarshalRecord(item, recordTypeFailure, failureRecordVersion, &old)
+			if err != nil {
+				return err
+			}
+			dbf.Attempts = old.Attempts + 1
+			dbf.FirstFailedAt = old.FirstFailedAt
+		}
+		item, err := marshalRecord(recordTypeFailure, failureRecordVersion, dbf)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, item)
+	})
+}
+
+// ClearFailure removes the failure of stage for id, the media key or the path
+func (s *DbSourceStorage) ClearFailure(stage imports.Stage, id string) error {
+	key := failureKey(stage, id)
+	return s.update(func(txn *bolt.Tx) error {
+		bucket, err := getBucket(failuresBucket, txn)
+		if err != nil {
+			return err
+		}
+		return bucket.Delete(key)
+	})
+}
+
+// ForEachFailure calls fn for every failure ordered by stage and media,
+// fn may modify the catalog
+func (s *DbSourceStorage) ForEachFailure(fn func(f *imports.Failure) error) error {
+	return s.forEachRecord(failuresBucket, func(k, v []byte) error {
+		dbf := DbFailure{}
+		err := unmarshalRecord(v, recordTypeFailure, failureRecordVersion, &dbf)
+		if err != nil {
+			return err
+		}
+		return fn(dbf.toFailure())
+	})
+}
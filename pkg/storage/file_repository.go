@@ -8,11 +8,24 @@ import (
 	"log"
 	"nextimagescrap/pkg/imports"
 	"os"
+	"path"
 	"path/filepath"
 )
 
+// SourceFileStorage reads the files below sourcePath through an fs.FS
+// of the directory. Its paths are sourcePath joined with the path of the
+// file inside, like the paths of filepath.WalkDir, archives are read as
+// directories by NewSourceFileStorage. The catalog is never walked.
+// Files of the other roots of the catalog are read from the fs.FS of
+// their root once they are mounted by MountRoots.
 type SourceFileStorage struct {
 	sourcePath string
+	fsys       fs.FS
+	// roots holds the fs.FS of the mounted roots besides the source by path
+	roots map[string]fs.FS
+	// excluded are the paths of catalogs inside the source
+	excluded []string
+	options  SourceOptions
 }
 
 // NewFileStorage create new file storage object
@@ -20,24 +33,100 @@ func NewSourceFileStorage(sourcePath string) (*SourceFileStorage, error) {
 	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
 		return nil, err
 	}
+	abs, err := filepath.Abs(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSourceFileStorageFS(abs, NewArchiveFS(os.DirFS(abs)))
+	s.ExcludePath(filepath.Dir(DefaultCatalogPath(abs)))
+	return s, nil
+}
 
-	s := SourceFileStorage{
-		sourcePath: sourcePath,
+// NewSourceFileStorageWithOptions creates a file storage walking the
+// source as set in options
+func NewSourceFileStorageWithOptions(sourcePath string, options SourceOptions) (*SourceFileStorage, error) {
+	s, err := NewSourceFileStorage(sourcePath)
+	if err != nil {
+		return nil, err
 	}
+	s.options = options
+	return s, nil
+}
 
-	return &s, nil
+// ExcludePath leaves the file or directory at p out of GetSourceFiles,
+// e.g. a catalog kept inside the source
+func (s *SourceFileStorage) ExcludePath(p string) {
+	abs, err := filepath.Abs(p)
+	if err == nil {
+		s.excluded = append(s.excluded, abs)
+	}
+}
+
+// NewSourceFileStorageFS creates a file storage reading the files below
+// sourcePath from fsys, which holds the content of sourcePath
+func NewSourceFileStorageFS(sourcePath string, fsys fs.FS) *SourceFileStorage {
+	return &SourceFileStorage{
+		sourcePath: sourcePath,
+		fsys:       fsys,
+	}
 }
-func (s SourceFileStorage) GetSourceFiles(walkFunc func(path string, info fs.DirEntry, err error) error) error {
-	err := filepath.WalkDir(s.sourcePath, walkFunc)
+
+// GetSourceFiles walks the source like fs.WalkDir. Sockets, fifos and
+// devices are left out, as are further hardlinks of a file and symlinks
+// unless they are followed.
+func (s *SourceFileStorage) GetSourceFiles(walkFunc func(path string, info fs.DirEntry, err error) error) error {
+	report, err := s.walkSource(walkFunc)
+	if report != (WalkReport{}) {
+		log.Printf("skipped %d symlinks, %d directory loops, %d hardlinks, %d special files",
+			report.Symlinks, report.Loops, report.Hardlinks, report.Special)
+	}
 	return err
 }
 
+// MountRoots reads the files of the mounted roots other than the source
+// from their directories, so the media of all sources of a catalog can
+// be processed. Only the source is walked.
+func (s *SourceFileStorage) MountRoots(roots []SourceRoot) {
+	for _, r := range roots {
+		if !r.Mounted || r.Path == s.sourcePath {
+			continue
+		}
+		if s.roots == nil {
+			s.roots = make(map[string]fs.FS)
+		}
+		s.roots[r.Path] = NewArchiveFS(os.DirFS(r.Path))
+	}
+}
+
+// GetSourceFile opens the file at fpath through the fs.FS of the
+// innermost of the source and the mounted roots containing it, files
+// outside of them do not exist
+func (s *SourceFileStorage) GetSourceFile(fpath string) (fs.File, error) {
+	dir := ""
+	var fsys fs.FS
+	if _, ok := withinDir(s.sourcePath, fpath); ok {
+		dir, fsys = s.sourcePath, s.fsys
+	}
+	for p, rfs := range s.roots {
+		if _, ok := withinDir(p, fpath); ok && len(p) > len(dir) {
+			dir, fsys = p, rfs
+		}
+	}
+	if fsys == nil {
+		return nil, &fs.PathError{Op: "open", Path: fpath, Err: fs.ErrNotExist}
+	}
+	rel, _ := withinDir(dir, fpath)
+	return fsys.Open(filepath.ToSlash(rel))
+}
+
 type DestinationFileStorage struct {
 	destinationPath string
+	options         DestinationOptions
 }
 
-func (d *DestinationFileStorage) getTargetPath(media *imports.SourceMedia) (string, error) {
-	var datepath string
+// exportDir returns the slash separated directory media is exported to,
+// relative to the destination
+func exportDir(media *imports.SourceMedia) string {
 	var mtypep string
 	if media.Mimetype == "video/mp4" {
 		mtypep = "video"
@@ -45,11 +134,18 @@ func (d *DestinationFileStorage) getTargetPath(media *imports.SourceMedia) (stri
 		mtypep = "images"
 	}
 	if media.CreationDate.Year() > 200 {
-		datepath = filepath.Join(d.destinationPath, mtypep, media.CreationDate.Format("2006"),
-			media.CreationDate.Format("01"))
-	} else {
-		datepath = "unknown"
+		return path.Join(mtypep, media.CreationDate.Format("2006"), media.CreationDate.Format("01"))
 	}
+	return "unknown"
+}
+
+// exportFileName returns the name media is exported as
+func exportFileName(media *imports.SourceMedia, ext string) string {
+	return fmt.Sprintf("image_%s_%d.%s", media.CreationDate.Format("20060102"), media.Id, ext)
+}
+
+func (d *DestinationFileStorage) getTargetPath(media *imports.SourceMedia) (string, error) {
+	datepath := filepath.Join(d.destinationPath, filepath.FromSlash(exportDir(media)))
 	if _, err := os.Stat(datepath); errors.Is(err, os.ErrNotExist) {
 		if err := os.MkdirAll(datepath, os.ModePerm); err != nil {
 			return "", err
@@ -58,21 +154,21 @@ func (d *DestinationFileStorage) getTargetPath(media *imports.SourceMedia) (stri
 	return datepath, nil
 }
 
-func (d *DestinationFileStorage) ExportToDirectory(media *imports.SourceMedia, ext string) error {
+func (d *DestinationFileStorage) ExportToDirectory(media *imports.SourceMedia, ext string, content io.Reader) (string, error) {
 	log.Printf("exporting %v", media)
 	targetPath, err := d.getTargetPath(media)
 	if err != nil {
-		return err
+		return "", err
 	}
-	basefilename := fmt.Sprintf("image_%s_%d.%s", media.CreationDate.Format("20060102"), media.Id, ext)
-	destFilename := filepath.Join(targetPath, basefilename)
-	_, err = copyFile(media.Path, destFilename)
-	return err
-}
-
-// GetSourceFile returns origina file by path
-func (s *SourceFileStorage) GetSourceFile(fpath string) (*os.File, error) {
-	return os.Open(fpath)
+	destFilename := filepath.Join(targetPath, exportFileName(media, ext))
+	_, err = copyFile(content, destFilename)
+	if err != nil {
+		return "", err
+	}
+	if d.options.WriteDates {
+		err = writeDates(media, destFilename)
+	}
+	return destFilename, err
 }
 
 // NewFileStorage create new file storage object
@@ -87,32 +183,26 @@ func NewDestinationFileStorage(destPath string) (*DestinationFileStorage, error)
 	return &s, nil
 }
 
-func copyFile(src string, dst string) (int64, error) {
-	sourceFileStat, err := os.Stat(src)
-	if err != nil {
-		return 0, err
-	}
-
-	if !sourceFileStat.Mode().IsRegular() {
-		return 0, fmt.Errorf("%s is not a regular file", src)
-	}
-
-	source, err := os.Open(src)
+// NewDestinationFileStorageWithOptions create new file storage object writing exports as set in options
+func NewDestinationFileStorageWithOptions(destPath string, options DestinationOptions) (*DestinationFileStorage, error) {
+	s, err := NewDestinationFileStorage(destPath)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer func(source *os.File) {
-		err = source.Close()
-	}(source)
+	s.options = options
+	return s, nil
+}
 
+// copyFile writes src to the new file dst
+func copyFile(src io.Reader, dst string) (int64, error) {
 	destination, err := os.Create(dst)
 	if err != nil {
 		return 0, err
 	}
-	defer func(destination *os.File) {
-		err = destination.Close()
-	}(destination)
-
-	nBytes, err := io.Copy(destination, source)
+	nBytes, err := io.Copy(destination, src)
+	cerr := destination.Close()
+	if err == nil {
+		err = cerr
+	}
 	return nBytes, err
 }
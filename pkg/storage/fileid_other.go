@@ -0,0 +1,14 @@
+//go:build !unix
+
+package storage
+
+import "io/fs"
+
+// fileIDOf is only implemented for unix, elsewhere hardlinks are not detected
+func fileIDOf(info fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+func linkCount(info fs.FileInfo) uint64 {
+	return 1
+}
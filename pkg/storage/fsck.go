@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// kinds of inconsistencies found by Fsck
+const (
+	FsckUndecodable      = "undecodable-record"
+	FsckOrphanSource     = "orphan-checksum-source"
+	FsckWrongGroup       = "wrong-checksum-group"
+	FsckDuplicateSource  = "duplicate-checksum-source"
+	FsckMissingFromGroup = "missing-from-checksum-group"
+	FsckMissingIndex     = "missing-index-entry"
+	FsckStaleIndex       = "stale-index-entry"
+)
+
+// FsckIssue is one inconsistency of the catalog
+type FsckIssue struct {
+	Kind   string
+	Key    string
+	Detail string
+}
+
+// FsckReport lists the inconsistencies found by Fsck
+type FsckReport struct {
+	MediaChecked    int
+	ChecksumChecked int
+	IndexChecked    int
+	Issues          []FsckIssue
+	Repaired        bool
+}
+
+// Count returns the number of issues of kind
+func (r *FsckReport) Count(kind string) int {
+	n := 0
+	for i := range r.Issues {
+		if r.Issues[i].Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *FsckReport) add(kind string, key []byte, format string, args ...interface{}) {
+	issue := FsckIssue{Kind: kind, Key: string(key), Detail: fmt.Sprintf(format, args...)}
+	log.Printf("fsck %s %q: %s", issue.Kind, issue.Key, issue.Detail)
+	r.Issues = append(r.Issues, issue)
+}
+
+// repairFunc fixes one issue inside a write transaction
+type repairFunc func(txn *bolt.Tx) error
+
+// Fsck cross-checks the source bucket, the checksum groups and the
+// indexes. The media records are the reference: checksum groups list
+// exactly the paths of the media with that checksum, once. With repair
+// set, orphan and wrong entries are removed and missing ones added.
+func (s *DbSourceStorage) Fsck(repair bool) (*FsckReport, error) {
+	report := &FsckReport{Repaired: repair}
+	err := s.fsckPages(mediaCheckSumBucket, repair, func(txn *bolt.Tx, k, v []byte) (repairFunc, error) {
+		report.ChecksumChecked++
+		return checkChecksumGroup(txn, report, k, v), nil
+	})
+	if err != nil {
+		return report, err
+	}
+	err = s.fsckPages(mediaSourceBucket, repair, func(txn *bolt.Tx, k, v []byte) (repairFunc, error) {
+		report.MediaChecked++
+		return checkMedia(txn, report, k, v), nil
+	})
+	if err != nil {
+		return report, err
+	}
+	for _, name := range indexBuckets {
+		indexName := name
+		err = s.fsckPages(indexName, repair, func(txn *bolt.Tx, k, v []byte) (repairFunc, error) {
+			report.IndexChecked++
+			return checkIndexEntry(txn, report, indexName, k), nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// fsckPages runs check for all records of bucket, a page per read
+// transaction, and applies the repairs of each page in one write transaction
+func (s *DbSourceStorage) fsckPages(bucketName []byte, repair bool, check func(txn *bolt.Tx, k, v []byte) (repairFunc, error)) error {
+	var after []byte
+	for {
+		var repairs []repairFunc
+		n := 0
+		err := s.view(func(txn *bolt.Tx) error {
+			bucket := txn.Bucket(bucketName)
+			if bucket == nil {
+				return nil
+			}
+			c := bucket.Cursor()
+			k, v := c.First()
+			if after != nil {
+				k, v = c.Seek(after)
+				if k != nil && bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && n < pageSize; k, v = c.Next() {
+				fix, err := check(txn, k, v)
+				if err != nil {
+					return err
+				}
+				if fix != nil {
+					repairs = append(repairs, fix)
+				}
+				after = append(after[:0], k...)
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if repair && len(repairs) > 0 {
+			err = s.dbClient.Update(func(txn *bolt.Tx) error {
+				for i := range repairs {
+					err := repairs[i](txn)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if n < pageSize {
+			return nil
+		}
+	}
+}
+
+// checkChecksumGroup reports sources without media, sources whose media
+// has another checksum and sources listed twice
+func checkChecksumGroup(txn *bolt.Tx, report *FsckReport, k, v []byte) repairFunc {
+	key := append([]byte{}, k...)
+	cs := DbSourceChecksum{}
+	err := cs.unmarshalChecksum(v)
+	if err != nil {
+		report.add(FsckUndecodable, key, "%v", err)
+		return deleteRecord(mediaCheckSumBucket, key)
+	}
+	checksum := string(bytes.TrimPrefix(key, []byte(checksumKeyPrefix)))
+	source := txn.Bucket(mediaSourceBucket)
+	seen := make(map[string]bool)
+	var valid []string
+	for _, path := range cs.Sources {
+		if seen[path] {
+			report.add(FsckDuplicateSource, key, "%v listed more than once", path)
+			continue
+		}
+		seen[path] = true
+		var item []byte
+		if source != nil {
+			item = source.Get([]byte(mediaSourceKeyPrefix + path))
+		}
+		if item == nil {
+			report.add(FsckOrphanSource, key, "no media for %v", path)
+			continue
+		}
+		dbsm := DbSourceMedia{}
+		err = dbsm.unmarshalMedia(item)
+		if err != nil {
+			// reported when checking the source bucket
+			valid = append(valid, path)
+			continue
+		}
+		if dbsm.Checksum != checksum {
+			report.add(FsckWrongGroup, key, "media %v has checksum %q", path, dbsm.Checksum)
+			continue
+		}
+		valid = append(valid, path)
+	}
+	if len(valid) == len(cs.Sources) && cs.Key == string(key) {
+		return nil
+	}
+	if len(valid) == 0 {
+		return deleteRecord(mediaCheckSumBucket, key)
+	}
+	cs.Key = string(key)
+	cs.Sources = valid
+	return func(txn *bolt.Tx) error {
+		item, err := cs.marshalChecksum()
+		if err != nil {
+			return err
+		}
+		return txn.Bucket(mediaCheckSumBucket).Put(key, item)
+	}
+}
+
+// checkMedia reports media missing from their checksum group or from an index
+func checkMedia(txn *bolt.Tx, report *FsckReport, k, v []byte) repairFunc {
+	key := append([]byte{}, k...)
+	dbsm := DbSourceMedia{}
+	err := dbsm.unmarshalMedia(v)
+	if err != nil {
+		report.add(FsckUndecodable, key, "%v", err)
+		return nil
+	}
+	var fixes []repairFunc
+	if dbsm.Checksum != "" {
+		listed := false
+		checksums := txn.Bucket(mediaCheckSumBucket)
+		if checksums != nil {
+			item := checksums.Get([]byte(checksumKeyPrefix + dbsm.Checksum))
+			cs := DbSourceChecksum{}
+			if item != nil && cs.unmarshalChecksum(item) == nil {
+				listed = containsString(cs.Sources, checksumSourceOf(dbsm.Key))
+			}
+		}
+		if !listed {
+			report.add(FsckMissingFromGroup, key, "not in group of checksum %v", dbsm.Checksum)
+			fixes = append(fixes, func(txn *bolt.Tx) error {
+				return addChecksumSource(txn, dbsm.Checksum, checksumSourceOf(dbsm.Key))
+			})
+		}
+	}
+	entries := indexEntries(&dbsm)
+	missing := false
+	for _, name := range indexBuckets {
+		bucket := txn.Bucket(name)
+		for _, ik := range entries[string(name)] {
+			if bucket == nil || bucket.Get(ik) == nil {
+				report.add(FsckMissingIndex, key, "%s has no entry %q", name, ik)
+				missing = true
+			}
+		}
+	}
+	if missing {
+		fixes = append(fixes, func(txn *bolt.Tx) error {
+			return updateIndexes(txn, &dbsm, &dbsm)
+		})
+	}
+	if len(fixes) == 0 {
+		return nil
+	}
+	return func(txn *bolt.Tx) error {
+		for i := range fixes {
+			err := fixes[i](txn)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// checkIndexEntry reports index entries of missing media or of values
+// the media no longer has
+func checkIndexEntry(txn *bolt.Tx, report *FsckReport, indexName []byte, k []byte) repairFunc {
+	key := append([]byte{}, k...)
+	if bytes.Index(key, []byte(indexSeparator)) < 0 {
+		report.add(FsckStaleIndex, key, "invalid entry of %s", indexName)
+		return deleteRecord(indexName, key)
+	}
+	mediaKey := mediaKeyOfIndexKey(key)
+	var item []byte
+	if source := txn.Bucket(mediaSourceBucket); source != nil {
+		item = source.Get(mediaKey)
+	}
+	if item == nil {
+		report.add(FsckStaleIndex, key, "%s entry of missing media", indexName)
+		return deleteRecord(indexName, key)
+	}
+	dbsm := DbSourceMedia{}
+	if dbsm.unmarshalMedia(item) != nil {
+		return nil
+	}
+	for _, ik := range indexEntries(&dbsm)[string(indexName)] {
+		if bytes.Equal(ik, key) {
+			return nil
+		}
+	}
+	report.add(FsckStaleIndex, key, "%s entry does not match media", indexName)
+	return deleteRecord(indexName, key)
+}
+
+func deleteRecord(bucketName []byte, key []byte) repairFunc {
+	return func(txn *bolt.Tx) error {
+		bucket := txn.Bucket(bucketName)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(key)
+	}
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"nextimagescrap/pkg/imports"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// index buckets map "<value>\x00<media key>" to an empty value, so all
+// media with a value are found by a cursor seek to "<value>\x00"
+var mimetypeIndexBucket = []byte("index:mimetype")
+var dateIndexBucket = []byte("index:date")
+var stateIndexBucket = []byte("index:state")
+
+var indexBuckets = [][]byte{mimetypeIndexBucket, dateIndexBucket, stateIndexBucket}
+
+const indexSeparator = "\x00"
+
+// undatedIndexValue is the date index value of media without CreationDate
+const undatedIndexValue = "unknown"
+
+func indexKey(value string, mediaKey string) []byte {
+	return []byte(value + indexSeparator + mediaKey)
+}
+
+func indexPrefix(value string) []byte {
+	return []byte(value + indexSeparator)
+}
+
+// dateIndexValue returns "<year>/<month>" of the CreationDate
+func dateIndexValue(m *DbSourceMedia) string {
+	if m.CreationDate.IsZero() {
+		return undatedIndexValue
+	}
+	return m.CreationDate.Format("2006/01")
+}
+
+// indexEntries returns the keys of m in each index bucket
+func indexEntries(m *DbSourceMedia) map[string][][]byte {
+	entries := map[string][][]byte{
+		string(mimetypeIndexBucket): {indexKey(m.Mimetype, m.Key)},
+		string(dateIndexBucket):     {indexKey(dateIndexValue(m), m.Key)},
+	}
+	states := m.toSourceMedia().States()
+	for i := range states {
+		entries[string(stateIndexBucket)] = append(entries[string(stateIndexBucket)], indexKey(string(states[i]), m.Key))
+	}
+	return entries
+}
+
+// updateIndexes replaces the index entries of old, which may be nil, by those of m
+func updateIndexes(txn *bolt.Tx, old *DbSourceMedia, m *DbSourceMedia) error {
+	var oldEntries map[string][][]byte
+	if old != nil {
+		oldEntries = indexEntries(old)
+	}
+	newEntries := indexEntries(m)
+	for _, name := range indexBuckets {
+		bucket, err := getBucket(name, txn)
+		if err != nil {
+			return err
+		}
+		for _, k := range oldEntries[string(name)] {
+			err = bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		for _, k := range newEntries[string(name)] {
+			err = bucket.Put(k, []byte{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// putMedia stores m and keeps the indexes and checksum groups in sync
+func putMedia(txn *bolt.Tx, m *DbSourceMedia) error {
+	bucket, err := getBucket(mediaSourceBucket, txn)
+	if err != nil {
+		return err
+	}
+	bkey := []byte(m.Key)
+	var old *DbSourceMedia
+	if item := bucket.Get(bkey); item != nil {
+		old = &DbSourceMedia{}
+		err = old.unmarshalMedia(item)
+		if err != nil {
+			return err
+		}
+	}
+	err = updateIndexes(txn, old, m)
+	if err != nil {
+		return err
+	}
+	// a changed hash moves the media out of its former checksum group,
+	// AddChecksum adds it to the new one
+	if old != nil && old.Checksum != "" && old.Checksum != m.Checksum {
+		err = removeChecksumSource(txn, old.Checksum, checksumSourceOf(old.Key))
+		if err != nil {
+			return err
+		}
+	}
+	d, err := m.marshalMedia()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(bkey, d)
+}
+
+// migrateToIndexes adds the index entries of existing media records
+func migrateToIndexes(txn *bolt.Tx, bucket []byte, k, v []byte) ([]byte, error) {
+	dbsm := DbSourceMedia{}
+	err := dbsm.unmarshalMedia(v)
+	if err != nil {
+		return nil, err
+	}
+	return nil, updateIndexes(txn, nil, &dbsm)
+}
+
+// GetFilesByState returns all media in the given processing state
+func (s *DbSourceStorage) GetFilesByState(state imports.MediaState) ([]*imports.SourceMedia, error) {
+	return s.collectMedia(imports.MediaFilter{State: state})
+}
+
+// GetFilesByCreationDate returns all media created in year and month, a
+// zero month selects the whole year
+func (s *DbSourceStorage) GetFilesByCreationDate(year int, month int) ([]*imports.SourceMedia, error) {
+	return s.collectMedia(imports.MediaFilter{Year: year, Month: month})
+}
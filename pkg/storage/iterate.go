@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"nextimagescrap/pkg/imports"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// pageSize is the number of records ForEachMedia and ForEachChecksum
+// read per transaction
+const pageSize = 500
+
+// scanRange is a key prefix of the bucket a query walks. Keys of index
+// buckets end with the media key, keys of the source bucket are media keys.
+type scanRange struct {
+	bucket  []byte
+	prefix  []byte
+	indexed bool
+}
+
+// scanRanges picks the most selective index for filter, the remaining
+// criteria are checked on each record
+func scanRanges(filter imports.MediaFilter) []scanRange {
+	var ranges []scanRange
+	switch {
+	case filter.State != "":
+		ranges = append(ranges, scanRange{bucket: stateIndexBucket, prefix: indexPrefix(string(filter.State)), indexed: true})
+	case len(filter.Mimetypes) > 0:
+		mimetypes := append([]string{}, filter.Mimetypes...)
+		sort.Strings(mimetypes)
+		for i := range mimetypes {
+			if i > 0 && mimetypes[i] == mimetypes[i-1] {
+				continue
+			}
+			ranges = append(ranges, scanRange{bucket: mimetypeIndexBucket, prefix: indexPrefix(mimetypes[i]), indexed: true})
+		}
+	case filter.Year != 0:
+		prefix := []byte(fmt.Sprintf("%04d/", filter.Year))
+		if filter.Month != 0 {
+			prefix = indexPrefix(fmt.Sprintf("%04d/%02d", filter.Year, filter.Month))
+		}
+		ranges = append(ranges, scanRange{bucket: dateIndexBucket, prefix: prefix, indexed: true})
+	default:
+		ranges = append(ranges, scanRange{bucket: mediaSourceBucket, prefix: []byte(mediaSourceKeyPrefix)})
+	}
+	return ranges
+}
+
+func encodeCursor(k []byte) string {
+	if k == nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(k)
+}
+
+func decodeCursor(cursor string) ([]byte, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	return base64.RawURLEncoding.DecodeString(cursor)
+}
+
+// GetMediaPage returns up to limit media matching filter, starting after
+// cursor. The returned cursor resumes the query, it is empty after the
+// last page.
+func (s *DbSourceStorage) GetMediaPage(filter imports.MediaFilter, cursor string, limit int) ([]*imports.SourceMedia, string, error) {
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", imports.ErrInvalidCursor, err)
+	}
+	var me []*imports.SourceMedia
+	var last []byte
+	err = s.view(func(txn *bolt.Tx) error {
+		source := txn.Bucket(mediaSourceBucket)
+		if source == nil {
+			return nil
+		}
+		ranges := scanRanges(filter)
+		for _, r := range ranges {
+			bucket := txn.Bucket(r.bucket)
+			if bucket == nil {
+				continue
+			}
+			c := bucket.Cursor()
+			start := r.prefix
+			if after != nil && bytes.Compare(after, start) > 0 {
+				start = after
+			}
+			k, v := c.Seek(start)
+			if k != nil && after != nil && bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+			for ; k != nil && bytes.HasPrefix(k, r.prefix); k, v = c.Next() {
+				if r.indexed {
+					v = source.Get(mediaKeyOfIndexKey(k))
+					if v == nil {
+						continue
+					}
+				}
+				dbsm := DbSourceMedia{}
+				err := dbsm.unmarshalMedia(v)
+				if err != nil {
+					return err
+				}
+				sm := dbsm.toSourceMedia()
+				sm.Path = s.resolvePath(&dbsm)
+				if !filter.Matches(sm) {
+					continue
+				}
+				me = append(me, sm)
+				if limit > 0 && len(me) >= limit {
+					last = append([]byte{}, k...)
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return me, encodeCursor(last), nil
+}
+
+// mediaKeyOfIndexKey strips the index value from an index key
+func mediaKeyOfIndexKey(k []byte) []byte {
+	i := bytes.Index(k, []byte(indexSeparator))
+	return k[i+1:]
+}
+
+// ForEachMedia calls fn for every media matching filter. The media are
+// read in pages, fn runs outside of any transaction and may modify the
+// catalog.
+func (s *DbSourceStorage) ForEachMedia(filter imports.MediaFilter, fn func(media *imports.SourceMedia) error) error {
+	cursor := ""
+	for {
+		page, next, err := s.GetMediaPage(filter, cursor, pageSize)
+		if err != nil {
+			return err
+		}
+		for i := range page {
+			err = fn(page[i])
+			if err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// ForEachChecksum calls fn for every checksum group after the checksum
+// after, like ForEachMedia
+func (s *DbSourceStorage) ForEachChecksum(after string, fn func(checksum *imports.SourceChecksum) error) error {
+	var start []byte
+	if after != "" {
+		start = []byte(checksumKeyPrefix + after)
+	}
+	return s.forEachRecordAfter(mediaCheckSumBucket, start, func(k, v []byte) error {
+		dbcs := DbSourceChecksum{}
+		err := dbcs.unmarshalChecksum(v)
+		if err != nil {
+			return err
+		}
+		return fn(&imports.SourceChecksum{
+			Key:     dbcs.Key,
+			Sources: dbcs.Sources,
+		})
+	})
+}
+
+// forEachRecord calls fn with copies of all keys and values of bucket.
+// The records are read in pages, fn runs outside of any transaction.
+func (s *DbSourceStorage) forEachRecord(bucketName []byte, fn func(k, v []byte) error) error {
+	return s.forEachRecordAfter(bucketName, nil, fn)
+}
+
+// forEachRecordAfter is forEachRecord for the keys after after, all keys
+// if it is nil
+func (s *DbSourceStorage) forEachRecordAfter(bucketName []byte, after []byte, fn func(k, v []byte) error) error {
+	for {
+		type record struct{ k, v []byte }
+		var page []record
+		err := s.view(func(txn *bolt.Tx) error {
+			bucket := txn.Bucket(bucketName)
+			if bucket == nil {
+				return nil
+			}
+			c := bucket.Cursor()
+			k, v := c.First()
+			if after != nil {
+				k, v = c.Seek(after)
+				if k != nil && bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(page) < pageSize; k, v = c.Next() {
+				page = append(page, record{k: append([]byte{}, k...), v: append([]byte{}, v...)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range page {
+			err = fn(page[i].k, page[i].v)
+			if err != nil {
+				return err
+			}
+		}
+		if len(page) < pageSize {
+			return nil
+		}
+		after = page[len(page)-1].k
+	}
+}
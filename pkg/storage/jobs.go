@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"encoding/binary"
+	"nextimagescrap/pkg/jobs"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// jobsBucket maps the big endian id of job runs to a jobs.Run
+var jobsBucket = []byte("jobs")
+
+const recordTypeJobRun = "jobrun"
+const jobRunRecordVersion = 1
+
+func jobRunKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// SaveRun stores run, a run without ID gets the next one. Runs are written
+// at once, not waiting for a batch, so the daemon status reflects them.
+func (s *DbSourceStorage) SaveRun(run *jobs.Run) error {
+	return s.dbClient.Update(func(txn *bolt.Tx) error {
+		bucket, err := getBucket(jobsBucket, txn)
+		if err != nil {
+			return err
+		}
+		if run.ID == 0 {
+			run.ID, err = bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+		}
+		item, err := marshalRecord(recordTypeJobRun, jobRunRecordVersion, run)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(jobRunKey(run.ID), item)
+	})
+}
+
+// GetRuns returns up to limit runs, the latest first, all for limit 0
+func (s *DbSourceStorage) GetRuns(limit int) ([]*jobs.Run, error) {
+	return s.GetRunsBefore(0, limit)
+}
+
+// GetRunsBefore returns up to limit runs older than the run with id, the
+// latest first. Id 0 starts at the latest run, limit 0 returns all.
+func (s *DbSourceStorage) GetRunsBefore(id uint64, limit int) ([]*jobs.Run, error) {
+	var runs []*jobs.Run
+	err := s.view(func(txn *bolt.Tx) error {
+		bucket := txn.Bucket(jobsBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		k, v := c.Last()
+		if id != 0 {
+			// the cursor stops at the run or the first one after it
+			k, v = c.Seek(jobRunKey(id))
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil && (limit <= 0 || len(runs) < limit); k, v = c.Prev() {
+			run := &jobs.Run{}
+			err := unmarshalRecord(v, recordTypeJobRun, jobRunRecordVersion, run)
+			if err != nil {
+				return err
+			}
+			runs = append(runs, run)
+		}
+		return nil
+	})
+	return runs, err
+}
+
+// GetRun returns the run with id, nil if there is none
+func (s *DbSourceStorage) GetRun(id uint64) (*jobs.Run, error) {
+	var run *jobs.Run
+	err := s.view(func(txn *bolt.Tx) error {
+		bucket := txn.Bucket(jobsBucket)
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get(jobRunKey(id))
+		if v == nil {
+			return nil
+		}
+		run = &jobs.Run{}
+		return unmarshalRecord(v, recordTypeJobRun, jobRunRecordVersion, run)
+	})
+	return run, err
+}
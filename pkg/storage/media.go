@@ -4,15 +4,42 @@ import "time"
 
 // Media defines the storage form for source-media objects
 type DbSourceMedia struct {
-	Key          string
-	Path         string
-	Mimetype     string
-	Checksum     string
-	CreationDate time.Time
-	Id           int
+	Key  string `json:"key"`
+	Path string `json:"path"`
+	// Root names the source root of the media, RelPath is its slash
+	// separated path inside it. Both are empty for media outside of roots.
+	Root         string    `json:"root,omitempty"`
+	RelPath      string    `json:"relPath,omitempty"`
+	Mimetype     string    `json:"mimetype,omitempty"`
+	Checksum     string    `json:"checksum,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+	ModTime      time.Time `json:"modTime"`
+	CreationDate time.Time `json:"creationDate"`
+	DateSource   string    `json:"dateSource,omitempty"`
+	// OriginalCreationDate is the date as recorded, before ClockOffset was added
+	OriginalCreationDate time.Time     `json:"originalCreationDate"`
+	ClockOffset          time.Duration `json:"clockOffset,omitempty"`
+	OffsetKnown          bool          `json:"offsetKnown,omitempty"`
+	CameraMake           string        `json:"cameraMake,omitempty"`
+	CameraModel          string        `json:"cameraModel,omitempty"`
+	CameraSerial         string        `json:"cameraSerial,omitempty"`
+	Sidecar              string        `json:"sidecar,omitempty"`
+	Description          string        `json:"description,omitempty"`
+	People               []string      `json:"people,omitempty"`
+	Location             *DbLocation   `json:"location,omitempty"`
+	ExportedPath         string        `json:"exportedPath,omitempty"`
+	ExportedAt           time.Time     `json:"exportedAt"`
+	Id                   int           `json:"id"`
+}
+
+// DbLocation is the storage form of imports.GeoLocation
+type DbLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude,omitempty"`
 }
 
 type DbSourceChecksum struct {
-	Key     string
-	Sources []string
+	Key     string   `json:"key"`
+	Sources []string `json:"sources"`
 }
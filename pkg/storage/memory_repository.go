@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"nextimagescrap/pkg/imports"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemSourceStorage is an imports.SourceDbRepository kept in memory, with
+// the semantics of DbSourceStorage for media outside of source roots
+type MemSourceStorage struct {
+	mu        sync.Mutex
+	media     map[string]*imports.SourceMedia
+	checksums map[string][]string
+	failures  map[string]*imports.Failure
+	sequence  int
+}
+
+// NewMemSourceStorage creates an empty in-memory catalog
+func NewMemSourceStorage() *MemSourceStorage {
+	return &MemSourceStorage{
+		media:     make(map[string]*imports.SourceMedia),
+		checksums: make(map[string][]string),
+		failures:  make(map[string]*imports.Failure),
+	}
+}
+
+func cloneMedia(media *imports.SourceMedia) *imports.SourceMedia {
+	c := *media
+	c.People = append([]string(nil), media.People...)
+	if media.Location != nil {
+		location := *media.Location
+		c.Location = &location
+	}
+	return &c
+}
+
+func (s *MemSourceStorage) AddFile(filePath string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sequence++
+	key := mediaSourceKeyPrefix + filePath
+	s.putMedia(&imports.SourceMedia{
+		Id:   s.sequence,
+		Key:  key,
+		Path: filePath,
+	})
+	return key, nil
+}
+
+func (s *MemSourceStorage) HasFile(filePath string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.media[mediaSourceKeyPrefix+filePath]
+	return ok, nil
+}
+
+// GetFilesByMimetypeFilter returns all media of the mimetypes in filter
+func (s *MemSourceStorage) GetFilesByMimetypeFilter(filter []string) ([]*imports.SourceMedia, error) {
+	if len(filter) == 0 {
+		return nil, nil
+	}
+	return s.collectMedia(imports.MediaFilter{Mimetypes: filter})
+}
+
+// GetFilesByState returns all media in the given processing state
+func (s *MemSourceStorage) GetFilesByState(state imports.MediaState) ([]*imports.SourceMedia, error) {
+	return s.collectMedia(imports.MediaFilter{State: state})
+}
+
+// GetFilesByCreationDate returns all media created in year and month, a
+// zero month selects the whole year
+func (s *MemSourceStorage) GetFilesByCreationDate(year int, month int) ([]*imports.SourceMedia, error) {
+	return s.collectMedia(imports.MediaFilter{Year: year, Month: month})
+}
+
+func (s *MemSourceStorage) GetAllFiles() ([]*imports.SourceMedia, error) {
+	return s.collectMedia(imports.MediaFilter{})
+}
+
+func (s *MemSourceStorage) collectMedia(filter imports.MediaFilter) ([]*imports.SourceMedia, error) {
+	var me []*imports.SourceMedia
+	err := s.ForEachMedia(filter, func(media *imports.SourceMedia) error {
+		me = append(me, media)
+		return nil
+	})
+	return me, err
+}
+
+func (s *MemSourceStorage) SaveMedia(media *imports.SourceMedia) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putMedia(cloneMedia(media))
+	return media.Key, nil
+}
+
+// putMedia stores m and moves it out of its former checksum group, like
+// the bolt putMedia
+func (s *MemSourceStorage) putMedia(m *imports.SourceMedia) {
+	if old, ok := s.media[m.Key]; ok && old.Checksum != "" && old.Checksum != m.Checksum {
+		s.removeChecksumSource(old.Checksum, checksumSourceOf(old.Key))
+	}
+	s.media[m.Key] = m
+}
+
+// AddChecksum adds media to the group of its checksum, unless it is
+// already listed there
+func (s *MemSourceStorage) AddChecksum(media *imports.SourceMedia) error {
+	if media.Checksum == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := checksumKeyPrefix + media.Checksum
+	source := checksumSourceOf(media.Key)
+	if !containsString(s.checksums[key], source) {
+		s.checksums[key] = append(s.checksums[key], source)
+	}
+	return nil
+}
+
+func (s *MemSourceStorage) removeChecksumSource(checksum string, source string) {
+	key := checksumKeyPrefix + checksum
+	var sources []string
+	for _, name := range s.checksums[key] {
+		if name != source {
+			sources = append(sources, name)
+		}
+	}
+	if len(sources) == 0 {
+		delete(s.checksums, key)
+		return
+	}
+	s.checksums[key] = sources
+}
+
+func (s *MemSourceStorage) GetAllCheckSum() (error, []*imports.SourceChecksum) {
+	var cs []*imports.SourceChecksum
+	err := s.ForEachChecksum("", func(checksum *imports.SourceChecksum) error {
+		cs = append(cs, checksum)
+		return nil
+	})
+	return err, cs
+}
+
+// GetFileByKey returns the media stored under key, the key prefix may be omitted
+func (s *MemSourceStorage) GetFileByKey(path string) (*imports.SourceMedia, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := path
+	if !strings.HasPrefix(key, mediaSourceKeyPrefix) {
+		key = mediaSourceKeyPrefix + path
+	}
+	media, ok := s.media[key]
+	if !ok {
+		return nil, nil
+	}
+	return cloneMedia(media), nil
+}
+
+// GetFileByPath returns the media at path, nil if it is not cataloged
+func (s *MemSourceStorage) GetFileByPath(path string) (*imports.SourceMedia, error) {
+	return s.GetFileByKey(mediaSourceKeyPrefix + path)
+}
+
+// GetMediaPage returns up to limit media matching filter in key order,
+// starting after cursor
+func (s *MemSourceStorage) GetMediaPage(filter imports.MediaFilter, cursor string, limit int) ([]*imports.SourceMedia, string, error) {
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", imports.ErrInvalidCursor, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.media))
+	for k := range s.media {
+		if k > string(after) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var me []*imports.SourceMedia
+	for _, k := range keys {
+		if !filter.Matches(s.media[k]) {
+			continue
+		}
+		me = append(me, cloneMedia(s.media[k]))
+		if limit > 0 && len(me) >= limit {
+			return me, encodeCursor([]byte(k)), nil
+		}
+	}
+	return me, "", nil
+}
+
+// ForEachMedia calls fn for every media matching filter, fn may modify the catalog
+func (s *MemSourceStorage) ForEachMedia(filter imports.MediaFilter, fn func(media *imports.SourceMedia) error) error {
+	cursor := ""
+	for {
+		page, next, err := s.GetMediaPage(filter, cursor, pageSize)
+		if err != nil {
+			return err
+		}
+		for i := range page {
+			err = fn(page[i])
+			if err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// ForEachChecksum calls fn for every checksum group after the checksum
+// after in key order, fn may modify the catalog
+func (s *MemSourceStorage) ForEachChecksum(after string, fn func(checksum *imports.SourceChecksum) error) error {
+	s.mu.Lock()
+	groups := make([]*imports.SourceChecksum, 0, len(s.checksums))
+	for k, sources := range s.checksums {
+		if after != "" && k <= checksumKeyPrefix+after {
+			continue
+		}
+		groups = append(groups, &imports.SourceChecksum{Key: k, Sources: append([]string{}, sources...)})
+	}
+	s.mu.Unlock()
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Key < groups[j].Key })
+	for i := range groups {
+		err := fn(groups[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetChecksum returns the group of media with checksum, nil if there is none
+func (s *MemSourceStorage) GetChecksum(checksum string) (*imports.SourceChecksum, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := checksumKeyPrefix + checksum
+	sources, ok := s.checksums[key]
+	if !ok {
+		return nil, nil
+	}
+	return &imports.SourceChecksum{Key: key, Sources: append([]string{}, sources...)}, nil
+}
+
+// RecordFailure stores f, a failure recorded before for the same stage
+// and media counts one more attempt
+func (s *MemSourceStorage) RecordFailure(f *imports.Failure) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	c := *f
+	c.Attempts = 1
+	c.FirstFailedAt = now
+	c.LastFailedAt = now
+	key := string(failureKey(f.Stage, f.ID()))
+	if old, ok := s.failures[key]; ok {
+		c.Attempts = old.Attempts + 1
+		c.FirstFailedAt = old.FirstFailedAt
+	}
+	s.failures[key] = &c
+	return nil
+}
+
+// ClearFailure removes the failure of stage for id, the media key or the path
+func (s *MemSourceStorage) ClearFailure(stage imports.Stage, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, string(failureKey(stage, id)))
+	return nil
+}
+
+// ForEachFailure calls fn for every failure ordered by stage and media,
+// fn may modify the catalog
+func (s *MemSourceStorage) ForEachFailure(fn func(f *imports.Failure) error) error {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.failures))
+	for k := range s.failures {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	failures := make([]imports.Failure, len(keys))
+	for i, k := range keys {
+		failures[i] = *s.failures[k]
+	}
+	s.mu.Unlock()
+	for i := range failures {
+		err := fn(&failures[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FSSourceStorage is an imports.SourceFileRepository reading the tree
+// below root of fsys, e.g. a testing/fstest.MapFS. Paths are slash
+// separated fs.FS paths.
+type FSSourceStorage struct {
+	fsys fs.FS
+	root string
+}
+
+// NewFSSourceStorage creates a source of the files below root of fsys,
+// archives are read as directories like in SourceFileStorage
+func NewFSSourceStorage(fsys fs.FS, root string) (*FSSourceStorage, error) {
+	if _, err := fs.Stat(fsys, root); err != nil {
+		return nil, err
+	}
+	return &FSSourceStorage{fsys: NewArchiveFS(fsys), root: root}, nil
+}
+
+func (s *FSSourceStorage) GetSourceFiles(walkFunc func(path string, info fs.DirEntry, err error) error) error {
+	return fs.WalkDir(s.fsys, s.root, func(path string, info fs.DirEntry, err error) error {
+		// the volume marker is not a media
+		if err == nil && info.Name() == VolumeMarkerName && !info.IsDir() {
+			return nil
+		}
+		return walkFunc(path, info, err)
+	})
+}
+
+// GetSourceFile opens the file at fpath
+func (s *FSSourceStorage) GetSourceFile(fpath string) (fs.File, error) {
+	return s.fsys.Open(fpath)
+}
+
+// MemDestinationStorage is an imports.DestinationFileRepository keeping
+// exported files in memory, under the paths DestinationFileStorage uses
+// relative to its destination
+type MemDestinationStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemDestinationStorage creates an empty destination
+func NewMemDestinationStorage() *MemDestinationStorage {
+	return &MemDestinationStorage{
+		files: make(map[string][]byte),
+	}
+}
+
+func (d *MemDestinationStorage) ExportToDirectory(media *imports.SourceMedia, ext string, content io.Reader) (string, error) {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+	destFilename := path.Join(exportDir(media), exportFileName(media, ext))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.files[destFilename] = data
+	return destFilename, nil
+}
+
+// Files returns the exported files by path
+func (d *MemDestinationStorage) Files() map[string][]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	files := make(map[string][]byte, len(d.files))
+	for k, v := range d.files {
+		files[k] = v
+	}
+	return files
+}
+
+// ReadFile returns the content of an exported file
+func (d *MemDestinationStorage) ReadFile(name string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, ok := d.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	return data, nil
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MergeReport tells what MergeCatalog merged
+type MergeReport struct {
+	ImportReport
+	// RootNames maps the roots of the other catalog to the roots here
+	RootNames map[string]string
+}
+
+// MergeCatalog merges the catalog at otherPath, which is only read, into
+// this one. Its roots are matched to the roots here by volume or path,
+// unmatched roots are added and renamed if their name is taken. Added
+// media get new ids, known media are merged by imports.MergeMedia and
+// checksum groups are unified from the checksums of the media.
+func (s *DbSourceStorage) MergeCatalog(otherPath string) (*MergeReport, error) {
+	other, err := bolt.Open(otherPath, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer other.Close()
+	version, err := schemaVersionOf(other)
+	if err != nil {
+		return nil, err
+	}
+	if version > schemaVersion() {
+		return nil, fmt.Errorf("catalog schema version %d is newer than supported version %d", version, schemaVersion())
+	}
+
+	report := &MergeReport{RootNames: make(map[string]string)}
+	roots, err := readRoots(other)
+	if err != nil {
+		return report, err
+	}
+	// media of catalogs kept inside their source before roots existed
+	legacyPath, legacy := legacyRootPath(otherPath)
+	if legacy {
+		if _, ok := roots[DefaultRootName]; !ok {
+			volumeID, volumeRel := identifyVolume(legacyPath, false)
+			roots[DefaultRootName] = SourceRoot{Name: DefaultRootName, Path: legacyPath, VolumeID: volumeID, VolumeRel: volumeRel}
+		}
+	}
+	// roots without media are not merged
+	used := make(map[string]bool)
+	err = forEachOtherMedia(other, legacyPath, legacy, func(m *DbSourceMedia) error {
+		used[m.Root] = true
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	for name := range roots {
+		if !used[name] {
+			delete(roots, name)
+		}
+	}
+	err = s.mergeRoots(roots, report)
+	if err != nil {
+		return report, err
+	}
+
+	imp, err := s.newCatalogImport()
+	if err != nil {
+		return report, err
+	}
+	imp.newIds = true
+	err = forEachOtherMedia(other, legacyPath, legacy, func(m *DbSourceMedia) error {
+		if m.Root != "" {
+			if name, ok := report.RootNames[m.Root]; ok {
+				m.Root = name
+			}
+			m.Key = mediaSourceKeyPrefix + m.Root + "/" + m.RelPath
+		}
+		return imp.importMedia(m)
+	})
+	if err != nil {
+		imp.rollback()
+		return report, err
+	}
+	err = imp.commit()
+	imp.report.Roots = report.Roots
+	report.ImportReport = imp.report
+	return report, err
+}
+
+// forEachOtherMedia passes the media of the other catalog db to fn. If
+// the catalog is legacy, kept inside its source before roots existed, its
+// media are moved under the default root at legacyPath, and the record
+// of the catalog file itself is skipped.
+func forEachOtherMedia(db *bolt.DB, legacyPath string, legacy bool, fn func(m *DbSourceMedia) error) error {
+	return db.View(func(txn *bolt.Tx) error {
+		bucket := txn.Bucket(mediaSourceBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			m := &DbSourceMedia{}
+			err := m.unmarshalMedia(v)
+			if err != nil {
+				return fmt.Errorf("record %s: %w", k, err)
+			}
+			if m.Root == "" && legacy {
+				path := legacyAbsPath(legacyPath, m.Path)
+				if rel, ok := relativePath(legacyPath, path); ok {
+					if rel == dbSubPath {
+						return nil
+					}
+					m.Path = path
+					m.Root = DefaultRootName
+					m.RelPath = rel
+				}
+			}
+			return fn(m)
+		})
+	})
+}
+
+// readRoots returns the roots stored in db by name
+func readRoots(db *bolt.DB) (map[string]SourceRoot, error) {
+	roots := make(map[string]SourceRoot)
+	err := db.View(func(txn *bolt.Tx) error {
+		bucket := txn.Bucket(rootsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			r := SourceRoot{}
+			err := r.unmarshalRoot(v)
+			if err != nil {
+				return err
+			}
+			roots[r.Name] = r
+			return nil
+		})
+	})
+	return roots, err
+}
+
+// mergeRoots maps roots to the roots here at the same place, and adds the
+// others under a free name
+func (s *DbSourceStorage) mergeRoots(roots map[string]SourceRoot, report *MergeReport) error {
+	for name, r := range roots {
+		found := false
+		for _, local := range s.roots {
+			if samePlace(local, r) {
+				report.RootNames[name] = local.Name
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		r.Name = freeRootName(name, func(name string) bool {
+			_, taken := s.roots[name]
+			return taken
+		})
+		log.Printf("merge source root %q at %v as %q", name, r.Path, r.Name)
+		err := s.dbClient.Update(func(txn *bolt.Tx) error {
+			bucket, err := getBucket(rootsBucket, txn)
+			if err != nil {
+				return err
+			}
+			item, err := r.marshalRoot()
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(r.Name), item)
+		})
+		if err != nil {
+			return err
+		}
+		s.roots[r.Name] = r
+		report.RootNames[name] = r.Name
+		report.Roots++
+	}
+	return s.loadRoots()
+}
+
+// freeRootName returns name, or name with the lowest "-<n>" suffix taken
+// reports as free
+func freeRootName(name string, taken func(name string) bool) string {
+	free := name
+	for i := 2; taken(free); i++ {
+		free = fmt.Sprintf("%s-%d", name, i)
+	}
+	return free
+}
+
+// samePlace reports whether two roots are the same directory, by volume
+// if both know it, else by path
+func samePlace(a SourceRoot, b SourceRoot) bool {
+	if a.VolumeID != "" && b.VolumeID != "" {
+		return a.VolumeID == b.VolumeID && a.VolumeRel == b.VolumeRel
+	}
+	return a.Path == b.Path
+}
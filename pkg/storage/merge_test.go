@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeLegacyCatalogScannedRelative(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "photos")
+	writeBaselineCatalog(t, source)
+
+	// a root of the default name at another place
+	localDir := t.TempDir()
+	s := newRootCatalog(t, DefaultRootName, localDir, map[string]string{"x.jpg": "b1"})
+	report, err := s.MergeCatalog(filepath.Join(source, dbSubPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Roots != 1 || report.Added != 2 {
+		t.Errorf("merge report %+v", report)
+	}
+	merged := DefaultRootName + "-2"
+	roots := s.Roots()
+	if len(roots) != 2 || roots[1].Name != merged || roots[1].Path != source {
+		t.Fatalf("roots %+v", roots)
+	}
+	for _, name := range []string{"a/x.jpg", "a/y.jpg"} {
+		path := filepath.Join(source, filepath.FromSlash(name))
+		m, err := s.GetFileByPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m == nil {
+			t.Fatalf("no media at %v", path)
+		}
+		if m.Key != mediaSourceKeyPrefix+merged+"/"+name || m.Root != merged || m.RelPath != name || m.Path != path {
+			t.Errorf("merged media %+v", m)
+		}
+	}
+	has, err := s.HasFile(filepath.Join(source, dbSubPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has {
+		t.Errorf("the catalog file is cataloged after merge")
+	}
+	count, err := s.MediaCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("%d media after merge, want 3", count)
+	}
+
+	cs, err := s.GetChecksum("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{merged + "/a/x.jpg", merged + "/a/y.jpg"}
+	if cs == nil || !reflect.DeepEqual(cs.Sources, want) {
+		t.Errorf("checksum group c1 is %+v, want sources %v", cs, want)
+	}
+	cs, err = s.GetChecksum("c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs != nil && len(cs.Sources) > 0 {
+		t.Errorf("checksum group of the catalog file is %+v after merge", cs)
+	}
+}
+
+func TestMergeCatalogSkipsEmptyRoots(t *testing.T) {
+	other := newRootCatalog(t, "card", t.TempDir(), map[string]string{"x.jpg": "a1"})
+	err := other.AddRoot("empty", t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPath := other.dbClient.Path()
+	other.CloseDb()
+
+	s := newRootCatalog(t, "local", t.TempDir(), nil)
+	report, err := s.MergeCatalog(otherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Roots != 1 || report.Added != 1 {
+		t.Errorf("merge report %+v", report)
+	}
+	roots := s.Roots()
+	if len(roots) != 2 || roots[0].Name != "card" || roots[1].Name != "local" {
+		t.Errorf("roots %+v", roots)
+	}
+}
@@ -0,0 +1,429 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// rootsBucket maps the name of a source root to its SourceRoot record
+var rootsBucket = []byte("roots")
+
+const recordTypeRoot = "root"
+const rootRecordVersion = 1
+
+// DefaultRootName is the root of catalogs opened with NewSourceDbStorage
+const DefaultRootName = "default"
+
+// SourceRoot is a named directory whose media are cataloged with paths
+// relative to it, so one catalog can hold several sources. Roots on
+// removable volumes are found by VolumeID wherever the volume is mounted.
+type SourceRoot struct {
+	Name string `json:"name"`
+	// Path is where the root was last found
+	Path string `json:"path"`
+	// VolumeID identifies the volume by filesystem uuid, label or marker
+	// file, VolumeRel is the root relative to the top of the volume
+	VolumeID  string `json:"volumeId,omitempty"`
+	VolumeRel string `json:"volumeRel,omitempty"`
+	// Mounted is false for roots whose volume was not found
+	Mounted bool `json:"-"`
+}
+
+func (r *SourceRoot) marshalRoot() ([]byte, error) {
+	return marshalRecord(recordTypeRoot, rootRecordVersion, r)
+}
+
+func (r *SourceRoot) unmarshalRoot(d []byte) error {
+	return unmarshalRecord(d, recordTypeRoot, rootRecordVersion, r)
+}
+
+// AddRoot registers path as source root name. Adding a root again is a
+// no-op, and a root on the same volume found at another path is moved
+// there. Otherwise a name or path already used by another root is
+// refused, unless that root is on a volume which is not mounted.
+// writeMarker writes a VolumeMarkerName file to path when the volume has
+// neither uuid nor label, without it such a root is only found by path.
+func (s *DbSourceStorage) AddRoot(name string, path string, writeMarker bool) error {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid root name %q", name)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	volumeID, volumeRel := identifyVolume(abs, writeMarker)
+	root := &SourceRoot{Name: name, Path: abs, VolumeID: volumeID, VolumeRel: volumeRel}
+	err = s.dbClient.Update(func(txn *bolt.Tx) error {
+		bucket, err := getBucket(rootsBucket, txn)
+		if err != nil {
+			return err
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			other := SourceRoot{}
+			err = other.unmarshalRoot(v)
+			if err != nil {
+				return err
+			}
+			sameVolume := other.VolumeID != "" && other.VolumeID == volumeID && other.VolumeRel == volumeRel
+			if other.Name == name {
+				switch {
+				case other.Path == abs && (sameVolume || volumeID == ""):
+					return nil
+				case other.Path == abs && other.VolumeID == "":
+					// registered before volumes were identified
+				case other.Path == abs:
+					return fmt.Errorf("%v holds another volume than root %q", abs, name)
+				case sameVolume:
+					log.Printf("source root %q moved from %v to %v", name, other.Path, abs)
+				default:
+					return fmt.Errorf("root %q is registered for %v", name, other.Path)
+				}
+				continue
+			}
+			if other.Path == abs && (other.VolumeID == "" || other.VolumeID == volumeID) {
+				return fmt.Errorf("%v is registered as root %q", abs, other.Name)
+			}
+		}
+		item, err := root.marshalRoot()
+		if err != nil {
+			return err
+		}
+		log.Printf("add source root %q at %v %v", name, abs, volumeID)
+		return bucket.Put([]byte(name), item)
+	})
+	if err != nil {
+		return err
+	}
+	return s.loadRoots()
+}
+
+// Roots returns the source roots of the catalog ordered by name
+func (s *DbSourceStorage) Roots() []SourceRoot {
+	roots := make([]SourceRoot, 0, len(s.roots))
+	for _, r := range s.roots {
+		roots = append(roots, r)
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Name < roots[j].Name })
+	return roots
+}
+
+// loadRoots caches the source roots, they are needed to map paths to
+// keys. Roots whose volume is mounted elsewhere are updated to the new path.
+func (s *DbSourceStorage) loadRoots() error {
+	roots := make(map[string]SourceRoot)
+	err := s.dbClient.View(func(txn *bolt.Tx) error {
+		bucket := txn.Bucket(rootsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			r := SourceRoot{}
+			err := r.unmarshalRoot(v)
+			if err != nil {
+				return err
+			}
+			roots[r.Name] = r
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	var moved []SourceRoot
+	for name, r := range roots {
+		r.Mounted = true
+		if r.VolumeID != "" {
+			if id, _ := identifyVolume(r.Path, false); id != r.VolumeID {
+				path, ok := findVolume(r.VolumeID, r.VolumeRel)
+				if ok {
+					log.Printf("source root %q found at %v", r.Name, path)
+					r.Path = path
+					moved = append(moved, r)
+				} else {
+					log.Printf("source root %q is not mounted", r.Name)
+					r.Mounted = false
+				}
+			}
+		}
+		roots[name] = r
+	}
+	s.roots = roots
+	if len(moved) == 0 {
+		return nil
+	}
+	return s.dbClient.Update(func(txn *bolt.Tx) error {
+		bucket, err := getBucket(rootsBucket, txn)
+		if err != nil {
+			return err
+		}
+		for i := range moved {
+			item, err := moved[i].marshalRoot()
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte(moved[i].Name), item)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rootOf returns the innermost root containing path and the slash
+// separated path relative to it
+func (s *DbSourceStorage) rootOf(path string) (string, string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", false
+	}
+	name := ""
+	rel := ""
+	length := -1
+	for _, r := range s.roots {
+		if !r.Mounted {
+			continue
+		}
+		rp, ok := relativePath(r.Path, abs)
+		if ok && len(r.Path) > length {
+			name, rel, length = r.Name, rp, len(r.Path)
+		}
+	}
+	return name, rel, length >= 0
+}
+
+// relativePath returns path relative to dir if path is inside dir
+func relativePath(dir string, path string) (string, bool) {
+	rel, ok := withinDir(dir, path)
+	if !ok || rel == "." {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// mediaKeyOfPath returns the key of the media at path, "source:<root>/<rel>"
+// inside a root, "source:<path>" otherwise
+func (s *DbSourceStorage) mediaKeyOfPath(path string) string {
+	if root, rel, ok := s.rootOf(path); ok {
+		return mediaSourceKeyPrefix + root + "/" + rel
+	}
+	return mediaSourceKeyPrefix + path
+}
+
+// resolvePath returns the current path of a media inside a root
+func (s *DbSourceStorage) resolvePath(m *DbSourceMedia) string {
+	if m.Root == "" {
+		return m.Path
+	}
+	r, ok := s.roots[m.Root]
+	if !ok {
+		return m.Path
+	}
+	return filepath.Join(r.Path, filepath.FromSlash(m.RelPath))
+}
+
+// checksumSourceOf returns the name of a media in a checksum group, its
+// key without prefix
+func checksumSourceOf(mediaKey string) string {
+	return strings.TrimPrefix(mediaKey, mediaSourceKeyPrefix)
+}
+
+// migrateToRoots moves the media of a catalog kept inside its source
+// directory under the default root. Media of other catalogs keep their
+// absolute path as key.
+func (s *DbSourceStorage) migrateToRoots() error {
+	rootPath, ok := legacyRootPath(s.dbClient.Path())
+	if !ok {
+		return nil
+	}
+	var last []byte
+	count := 0
+	removed := 0
+	done := false
+	for !done {
+		err := s.dbClient.Update(func(txn *bolt.Tx) error {
+			bucket := txn.Bucket(mediaSourceBucket)
+			if bucket == nil {
+				done = true
+				return nil
+			}
+			var moves []*DbSourceMedia
+			c := bucket.Cursor()
+			k, v := c.First()
+			if last != nil {
+				k, v = c.Seek(last)
+				if k != nil && bytes.Equal(k, last) {
+					k, v = c.Next()
+				}
+			}
+			n := 0
+			for ; k != nil && n < migrationBatchSize; k, v = c.Next() {
+				last = append(last[:0], k...)
+				n++
+				m := &DbSourceMedia{}
+				err := m.unmarshalMedia(v)
+				if err != nil {
+					return fmt.Errorf("record %s: %w", k, err)
+				}
+				if m.Root == "" {
+					moves = append(moves, m)
+				}
+			}
+			done = k == nil
+			// cursors must not be used while the bucket is modified
+			for i := range moves {
+				path := legacyAbsPath(rootPath, moves[i].Path)
+				rel, ok := relativePath(rootPath, path)
+				if !ok {
+					continue
+				}
+				if rel == dbSubPath {
+					// the scans before roots cataloged the catalog file itself
+					err := deleteMedia(txn, moves[i])
+					if err != nil {
+						return err
+					}
+					removed++
+					continue
+				}
+				err := s.putMigratedRoot(txn, rootPath)
+				if err != nil {
+					return err
+				}
+				err = moveMedia(txn, moves[i], path, DefaultRootName, rel)
+				if err != nil {
+					return err
+				}
+				count++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("moved %d media under root %q", count, DefaultRootName)
+	if removed > 0 {
+		log.Printf("removed the media record of the catalog file")
+	}
+	return s.loadRoots()
+}
+
+// legacyRootPath returns the source directory of a catalog kept inside it
+func legacyRootPath(dbPath string) (string, bool) {
+	abs, err := filepath.Abs(dbPath)
+	if err != nil {
+		return "", false
+	}
+	dir := filepath.Dir(abs)
+	if filepath.Base(dir) != filepath.Dir(dbSubPath) {
+		return "", false
+	}
+	return filepath.Dir(dir), true
+}
+
+// legacyAbsPath returns the absolute form of the path of a media stored
+// before roots. Scans stored the paths below the -sourcePath as given, so
+// a relative path is resolved like the -sourcePath of this process, else
+// as seen from the parent of the source directory, where -sourcePath is
+// its name, else from the source directory, where it is ".".
+func legacyAbsPath(rootPath string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		if _, ok := relativePath(rootPath, abs); ok {
+			return abs
+		}
+	}
+	abs := filepath.Join(filepath.Dir(rootPath), path)
+	if _, ok := relativePath(rootPath, abs); ok {
+		return abs
+	}
+	return filepath.Join(rootPath, path)
+}
+
+// putMigratedRoot registers the default root of a migrated catalog
+func (s *DbSourceStorage) putMigratedRoot(txn *bolt.Tx, rootPath string) error {
+	bucket, err := getBucket(rootsBucket, txn)
+	if err != nil {
+		return err
+	}
+	if bucket.Get([]byte(DefaultRootName)) != nil {
+		return nil
+	}
+	root := &SourceRoot{Name: DefaultRootName, Path: rootPath}
+	item, err := root.marshalRoot()
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(DefaultRootName), item)
+}
+
+// moveMedia rekeys old at the absolute path as rel inside root, along
+// with its index entries and its place in the checksum group
+func moveMedia(txn *bolt.Tx, old *DbSourceMedia, path string, root string, rel string) error {
+	bucket, err := getBucket(mediaSourceBucket, txn)
+	if err != nil {
+		return err
+	}
+	m := *old
+	m.Path = path
+	m.Root = root
+	m.RelPath = rel
+	m.Key = mediaSourceKeyPrefix + root + "/" + rel
+	err = bucket.Delete([]byte(old.Key))
+	if err != nil {
+		return err
+	}
+	err = updateIndexes(txn, old, &m)
+	if err != nil {
+		return err
+	}
+	if m.Checksum != "" {
+		err = renameChecksumSource(txn, m.Checksum, checksumSourceOf(old.Key), checksumSourceOf(m.Key))
+		if err != nil {
+			return err
+		}
+	}
+	item, err := m.marshalMedia()
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(m.Key), item)
+}
+
+// deleteMedia removes m along with its index entries and its place in
+// the checksum group
+func deleteMedia(txn *bolt.Tx, m *DbSourceMedia) error {
+	for name, keys := range indexEntries(m) {
+		bucket, err := getBucket([]byte(name), txn)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			err = bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if m.Checksum != "" {
+		err := removeChecksumSource(txn, m.Checksum, checksumSourceOf(m.Key))
+		if err != nil {
+			return err
+		}
+	}
+	bucket, err := getBucket(mediaSourceBucket, txn)
+	if err != nil {
+		return err
+	}
+	return bucket.Delete([]byte(m.Key))
+}
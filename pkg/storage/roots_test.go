@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// baselineMedia is a media record as the catalog stored it before records
+// were versioned
+type baselineMedia struct {
+	Key          string
+	Path         string
+	Mimetype     string
+	Checksum     string
+	CreationDate time.Time
+	Id           int
+}
+
+// writeBaselineCatalog writes a catalog inside source as a scan with the
+// relative -sourcePath "photos" did before roots, including the record of
+// the catalog file itself
+func writeBaselineCatalog(t *testing.T, source string) {
+	t.Helper()
+	for _, name := range []string{"a/x.jpg", "a/y.jpg"} {
+		path := filepath.Join(source, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err == nil {
+			err = os.WriteFile(path, []byte(name), 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dbPath := filepath.Join(source, dbSubPath)
+	err := os.MkdirAll(filepath.Dir(dbPath), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	media := []baselineMedia{
+		{Key: "source:photos/a/x.jpg", Path: "photos/a/x.jpg", Mimetype: "image/jpeg", Checksum: "c1", Id: 1},
+		{Key: "source:photos/a/y.jpg", Path: "photos/a/y.jpg", Mimetype: "image/jpeg", Checksum: "c1", Id: 2},
+		{Key: "source:photos/.boltdb/source.db", Path: "photos/.boltdb/source.db", Mimetype: "application/octet-stream", Checksum: "c2", Id: 3},
+	}
+	checksums := []DbSourceChecksum{
+		{Key: "checksum:c1", Sources: []string{"photos/a/x.jpg", "photos/a/y.jpg"}},
+		{Key: "checksum:c2", Sources: []string{"photos/.boltdb/source.db"}},
+	}
+	err = db.Update(func(txn *bolt.Tx) error {
+		bucket, err := txn.CreateBucket(mediaSourceBucket)
+		if err != nil {
+			return err
+		}
+		for i := range media {
+			err = bucket.Put([]byte(media[i].Key), gobEncode(t, media[i]))
+			if err != nil {
+				return err
+			}
+		}
+		err = bucket.SetSequence(uint64(len(media)))
+		if err != nil {
+			return err
+		}
+		bucket, err = txn.CreateBucket(mediaCheckSumBucket)
+		if err != nil {
+			return err
+		}
+		for i := range checksums {
+			err = bucket.Put([]byte(checksums[i].Key), gobEncode(t, checksums[i]))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func gobEncode(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestMigrateBaselineCatalog(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "photos")
+	writeBaselineCatalog(t, source)
+
+	s, err := NewSourceDbStorage(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseDb()
+
+	version, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != schemaVersion() {
+		t.Errorf("schema version %d, want %d", version, schemaVersion())
+	}
+	count, err := s.MediaCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("%d media after migration, want 2", count)
+	}
+	for _, name := range []string{"a/x.jpg", "a/y.jpg"} {
+		path := filepath.Join(source, filepath.FromSlash(name))
+		key := mediaSourceKeyPrefix + DefaultRootName + "/" + name
+		if got := s.mediaKeyOfPath(path); got != key {
+			t.Errorf("key of %v is %v, want %v", path, got, key)
+		}
+		// a scan must not add the migrated media again
+		has, err := s.HasFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !has {
+			t.Errorf("%v is not cataloged after migration", path)
+		}
+		m, err := s.GetFileByKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m == nil {
+			t.Fatalf("no media %v", key)
+		}
+		if m.Path != path || m.Root != DefaultRootName || m.RelPath != name {
+			t.Errorf("media %v has path %v, root %q and relative path %v", key, m.Path, m.Root, m.RelPath)
+		}
+	}
+	has, err := s.HasFile(filepath.Join(source, dbSubPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has {
+		t.Errorf("the catalog file is cataloged after migration")
+	}
+
+	cs, err := s.GetChecksum("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{DefaultRootName + "/a/x.jpg", DefaultRootName + "/a/y.jpg"}
+	if cs == nil || !reflect.DeepEqual(cs.Sources, want) {
+		t.Errorf("checksum group c1 is %+v, want sources %v", cs, want)
+	}
+	cs, err = s.GetChecksum("c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs != nil && len(cs.Sources) > 0 {
+		t.Errorf("checksum group of the catalog file is %+v after migration", cs)
+	}
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var metaBucket = []byte("meta")
+var schemaVersionKey = []byte("schemaVersion")
+
+// migrationBatchSize is the number of records rewritten per transaction
+const migrationBatchSize = 1000
+
+// migration upgrades the records of buckets to version. migrate returns
+// the new value of a record or nil to leave it unchanged. It must accept
+// records it already migrated, an interrupted migration starts over.
+// Migrations that rekey records use run instead.
+type migration struct {
+	version int
+	name    string
+	buckets [][]byte
+	migrate func(txn *bolt.Tx, bucket []byte, k, v []byte) ([]byte, error)
+	run     func(s *DbSourceStorage) error
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "encode records as versioned json",
+		buckets: [][]byte{mediaSourceBucket, mediaCheckSumBucket},
+		migrate: migrateToJsonRecords,
+	},
+	{
+		version: 2,
+		name:    "index media by mimetype, date and state",
+		buckets: [][]byte{mediaSourceBucket},
+		migrate: migrateToIndexes,
+	},
+	{
+		version: 3,
+		name:    "store media relative to source roots",
+		run:     (*DbSourceStorage).migrateToRoots,
+	},
+}
+
+// schemaVersion is the version of a catalog with all migrations applied
+func schemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the schema version stored in the catalog
+func (s *DbSourceStorage) SchemaVersion() (int, error) {
+	return schemaVersionOf(s.dbClient)
+}
+
+// schemaVersionOf returns the schema version stored in the catalog db
+func schemaVersionOf(db *bolt.DB) (int, error) {
+	version := 0
+	err := db.View(func(txn *bolt.Tx) error {
+		bucket := txn.Bucket(metaBucket)
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get(schemaVersionKey)
+		if v == nil {
+			return nil
+		}
+		var err error
+		version, err = strconv.Atoi(string(v))
+		return err
+	})
+	return version, err
+}
+
+func (s *DbSourceStorage) setSchemaVersion(version int) error {
+	return s.dbClient.Update(func(txn *bolt.Tx) error {
+		bucket, err := getBucket(metaBucket, txn)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(schemaVersionKey, []byte(strconv.Itoa(version)))
+	})
+}
+
+// migrate applies all migrations newer than the schema version of the catalog
+func (s *DbSourceStorage) migrate() error {
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > schemaVersion() {
+		return fmt.Errorf("catalog schema version %d is newer than supported version %d", current, schemaVersion())
+	}
+	for i := range migrations {
+		m := migrations[i]
+		if m.version <= current {
+			continue
+		}
+		log.Printf("migrating catalog to schema version %d: %s", m.version, m.name)
+		if m.run != nil {
+			err = m.run(s)
+			if err != nil {
+				return fmt.Errorf("migration %d: %w", m.version, err)
+			}
+		}
+		for j := range m.buckets {
+			count, err := s.migrateBucket(m.buckets[j], m.migrate)
+			if err != nil {
+				return fmt.Errorf("migration %d of bucket %s: %w", m.version, m.buckets[j], err)
+			}
+			log.Printf("migrated %d records of bucket %s", count, m.buckets[j])
+		}
+		err = s.setSchemaVersion(m.version)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateBucket passes the records of bucket to fn in batches of
+// migrationBatchSize per transaction and returns the number visited
+func (s *DbSourceStorage) migrateBucket(bucketName []byte, fn func(txn *bolt.Tx, bucket []byte, k, v []byte) ([]byte, error)) (int, error) {
+	var last []byte
+	count := 0
+	done := false
+	for !done {
+		err := s.dbClient.Update(func(txn *bolt.Tx) error {
+			bucket := txn.Bucket(bucketName)
+			if bucket == nil {
+				done = true
+				return nil
+			}
+			type update struct{ k, v []byte }
+			var updates []update
+			c := bucket.Cursor()
+			k, v := c.First()
+			if last != nil {
+				k, v = c.Seek(last)
+				if k != nil && bytes.Equal(k, last) {
+					k, v = c.Next()
+				}
+			}
+			n := 0
+			for ; k != nil && n < migrationBatchSize; k, v = c.Next() {
+				nv, err := fn(txn, bucketName, k, v)
+				if err != nil {
+					return fmt.Errorf("record %s: %w", k, err)
+				}
+				if nv != nil {
+					updates = append(updates, update{k: append([]byte{}, k...), v: nv})
+				}
+				last = append(last[:0], k...)
+				n++
+			}
+			done = k == nil
+			// cursors must not be used while the bucket is modified
+			for i := range updates {
+				err := bucket.Put(updates[i].k, updates[i].v)
+				if err != nil {
+					return err
+				}
+			}
+			count += n
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// migrateToJsonRecords re-encodes gob records as versioned json
+func migrateToJsonRecords(txn *bolt.Tx, bucket []byte, k, v []byte) ([]byte, error) {
+	if _, ok := decodeEnvelope(v); ok {
+		return nil, nil
+	}
+	if bytes.Equal(bucket, mediaCheckSumBucket) {
+		cs := DbSourceChecksum{}
+		err := cs.unmarshalChecksum(v)
+		if err != nil {
+			return nil, err
+		}
+		return cs.marshalChecksum()
+	}
+	sm := DbSourceMedia{}
+	err := sm.unmarshalMedia(v)
+	if err != nil {
+		return nil, err
+	}
+	return sm.marshalMedia()
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// withLeadingBrace pads the type name in the gob record d, so that its
+// first message, the type definition, is 123 bytes long and the record
+// starts with a '{'
+func withLeadingBrace(t *testing.T, d []byte, typeName string) []byte {
+	t.Helper()
+	name := append([]byte{byte(len(typeName))}, typeName...)
+	i := bytes.Index(d, name)
+	if i < 0 || d[0] > '{' {
+		t.Fatalf("cannot pad gob record %q", d)
+	}
+	padded := typeName + strings.Repeat("_", int('{'-d[0]))
+	result := append([]byte{'{'}, d[1:i]...)
+	result = append(result, byte(len(padded)))
+	result = append(result, padded...)
+	return append(result, d[i+len(name):]...)
+}
+
+func TestMigrateGobRecordsToJson(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "photos")
+	writeBaselineCatalog(t, source)
+	err := os.WriteFile(filepath.Join(source, "a", "z.png"), []byte("png"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	record := withLeadingBrace(t, gobEncode(t, baselineMedia{
+		Key: "source:photos/a/z.png", Path: "photos/a/z.png", Mimetype: "image/png", CreationDate: dt, Id: 4,
+	}), "baselineMedia")
+	// the record is re-encoded rather than taken for json
+	migrated, err := migrateToJsonRecords(nil, mediaSourceBucket, []byte("source:photos/a/z.png"), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env, ok := decodeEnvelope(migrated); !ok || env.Type != recordTypeMedia {
+		t.Errorf("gob record starting with a '{' migrated to %q", migrated)
+	}
+	db, err := bolt.Open(filepath.Join(source, dbSubPath), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(txn *bolt.Tx) error {
+		return txn.Bucket(mediaSourceBucket).Put([]byte("source:photos/a/z.png"), record)
+	})
+	if err == nil {
+		err = db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSourceDbStorage(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseDb()
+	versions := map[string]int{recordTypeMedia: mediaRecordVersion, recordTypeChecksum: checksumRecordVersion}
+	buckets := map[string][]byte{recordTypeMedia: mediaSourceBucket, recordTypeChecksum: mediaCheckSumBucket}
+	for recordType, bucket := range buckets {
+		count := 0
+		err = s.dbClient.View(func(txn *bolt.Tx) error {
+			return txn.Bucket(bucket).ForEach(func(k, v []byte) error {
+				count++
+				env, ok := decodeEnvelope(v)
+				if !ok || env.Type != recordType || env.Version != versions[recordType] {
+					t.Errorf("record %s is not a version %d %s record: %q", k, versions[recordType], recordType, v)
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 {
+			t.Errorf("no %s records after migration", recordType)
+		}
+	}
+	media, err := s.GetFileByPath(filepath.Join(source, "a", "z.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media == nil || media.Mimetype != "image/png" || !media.CreationDate.Equal(dt) {
+		t.Errorf("migrated media %+v", media)
+	}
+}
@@ -0,0 +1,575 @@
+// Package storagetest checks implementations of the repositories of the
+// imports service against the semantics of the bolt and file storages.
+// Like testing/fstest.TestFS the checks return an error describing the
+// first failure, so they can be run from tests and tools alike.
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"nextimagescrap/pkg/imports"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mediaKeyPrefix prefixes the keys of media, GetFileByKey accepts keys without it
+const mediaKeyPrefix = "source:"
+
+// TestSourceDbRepository checks the repositories returned by newRepo,
+// which must be empty and use the media paths unchanged in keys
+func TestSourceDbRepository(newRepo func() (imports.SourceDbRepository, error)) error {
+	checks := []struct {
+		name  string
+		check func(r imports.SourceDbRepository) error
+	}{
+		{"files", checkFiles},
+		{"save media", checkSaveMedia},
+		{"filters", checkFilters},
+		{"pages", checkPages},
+		{"checksums", checkChecksums},
+		{"modify while iterating", checkModifyWhileIterating},
+		{"failures", checkFailures},
+	}
+	for _, c := range checks {
+		r, err := newRepo()
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+		err = c.check(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+func addFiles(r imports.SourceDbRepository, paths ...string) ([]*imports.SourceMedia, error) {
+	var media []*imports.SourceMedia
+	for _, p := range paths {
+		key, err := r.AddFile(p)
+		if err != nil {
+			return nil, err
+		}
+		m, err := r.GetFileByKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			return nil, fmt.Errorf("no media for key %q of added %v", key, p)
+		}
+		media = append(media, m)
+	}
+	return media, nil
+}
+
+func checkFiles(r imports.SourceDbRepository) error {
+	media, err := addFiles(r, "a/1.jpg", "a/2.jpg")
+	if err != nil {
+		return err
+	}
+	if media[0].Path != "a/1.jpg" || media[0].Key != mediaKeyPrefix+"a/1.jpg" {
+		return fmt.Errorf("added a/1.jpg as %q at %q", media[0].Key, media[0].Path)
+	}
+	if media[0].Id <= 0 || media[0].Id == media[1].Id {
+		return fmt.Errorf("ids %d and %d are not distinct and positive", media[0].Id, media[1].Id)
+	}
+	ok, err := r.HasFile("a/1.jpg")
+	if err != nil || !ok {
+		return fmt.Errorf("HasFile of added file is %v, %v", ok, err)
+	}
+	ok, err = r.HasFile("a/3.jpg")
+	if err != nil || ok {
+		return fmt.Errorf("HasFile of unknown file is %v, %v", ok, err)
+	}
+	m, err := r.GetFileByKey(strings.TrimPrefix(media[1].Key, mediaKeyPrefix))
+	if err != nil || m == nil || m.Key != media[1].Key {
+		return fmt.Errorf("GetFileByKey without prefix returned %v, %v", m, err)
+	}
+	m, err = r.GetFileByKey("a/3.jpg")
+	if err != nil || m != nil {
+		return fmt.Errorf("GetFileByKey of unknown key returned %v, %v", m, err)
+	}
+	m, err = r.GetFileByPath("a/2.jpg")
+	if err != nil || m == nil || m.Key != media[1].Key || m.Path != "a/2.jpg" {
+		return fmt.Errorf("GetFileByPath returned %v, %v", m, err)
+	}
+	m, err = r.GetFileByPath("a/3.jpg")
+	if err != nil || m != nil {
+		return fmt.Errorf("GetFileByPath of unknown file returned %v, %v", m, err)
+	}
+	// returned media are copies
+	media[0].Mimetype = "image/jpeg"
+	m, err = r.GetFileByKey(media[0].Key)
+	if err != nil || m.Mimetype != "" {
+		return fmt.Errorf("unsaved change is visible: %v, %v", m, err)
+	}
+	return nil
+}
+
+func checkSaveMedia(r imports.SourceDbRepository) error {
+	media, err := addFiles(r, "b/1.jpg")
+	if err != nil {
+		return err
+	}
+	m := media[0]
+	m.Mimetype = "image/jpeg"
+	m.Checksum = "c1"
+	m.Size = 1234
+	m.ModTime = time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+	m.CreationDate = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	m.OriginalCreationDate = time.Date(2020, 1, 2, 4, 4, 5, 0, time.UTC)
+	m.ClockOffset = -time.Hour
+	// a recorded +00:00 offset is stored apart from the UTC date
+	m.OffsetKnown = true
+	m.DateSource = imports.DateSourceExif
+	m.Camera = imports.CameraInfo{Make: "make", Model: "model", Serial: "1"}
+	m.Sidecar = "1.jpg.json"
+	m.Description = "description"
+	m.People = []string{"a", "b"}
+	m.Location = &imports.GeoLocation{Latitude: 48.1, Longitude: 11.5, Altitude: 520}
+	m.ExportedPath = "images/2020/01/image_20200102_1.jpg"
+	m.ExportedAt = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	key, err := r.SaveMedia(m)
+	if err != nil {
+		return err
+	}
+	if key != m.Key {
+		return fmt.Errorf("SaveMedia returned key %q for %q", key, m.Key)
+	}
+	saved, err := r.GetFileByKey(key)
+	if err != nil {
+		return err
+	}
+	return compareMedia(saved, m)
+}
+
+func compareMedia(got *imports.SourceMedia, want *imports.SourceMedia) error {
+	if got == nil {
+		return fmt.Errorf("media %q is missing", want.Key)
+	}
+	if got.Key != want.Key || got.Path != want.Path || got.Id != want.Id ||
+		got.Mimetype != want.Mimetype || got.Checksum != want.Checksum ||
+		got.Size != want.Size || !got.ModTime.Equal(want.ModTime) ||
+		!got.CreationDate.Equal(want.CreationDate) || got.DateSource != want.DateSource ||
+		!got.OriginalCreationDate.Equal(want.OriginalCreationDate) || got.ClockOffset != want.ClockOffset ||
+		got.OffsetKnown != want.OffsetKnown ||
+		got.Camera != want.Camera || got.ExportedPath != want.ExportedPath ||
+		!got.ExportedAt.Equal(want.ExportedAt) || got.Sidecar != want.Sidecar ||
+		got.Description != want.Description || strings.Join(got.People, "\n") != strings.Join(want.People, "\n") ||
+		(got.Location == nil) != (want.Location == nil) ||
+		(got.Location != nil && *got.Location != *want.Location) {
+		return fmt.Errorf("saved %v, read %v", want, got)
+	}
+	return nil
+}
+
+func keysOf(media []*imports.SourceMedia) []string {
+	var keys []string
+	for i := range media {
+		keys = append(keys, strings.TrimPrefix(media[i].Key, mediaKeyPrefix))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func expectKeys(what string, media []*imports.SourceMedia, err error, want ...string) error {
+	if err != nil {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	got := keysOf(media)
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		return fmt.Errorf("%s returned %v, want %v", what, got, want)
+	}
+	return nil
+}
+
+func checkFilters(r imports.SourceDbRepository) error {
+	media, err := addFiles(r, "c/1.jpg", "c/2.png", "c/3.jpg", "c/4.mp4", "c/5")
+	if err != nil {
+		return err
+	}
+	values := []struct {
+		mimetype string
+		checksum string
+		date     time.Time
+	}{
+		{"image/jpeg", "c1", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"image/png", "c2", time.Date(2020, 2, 5, 0, 0, 0, 0, time.UTC)},
+		{"image/jpeg", "", time.Date(2019, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"video/mp4", "c4", time.Time{}},
+		{"", "", time.Time{}},
+	}
+	for i := range values {
+		media[i].Mimetype = values[i].mimetype
+		media[i].Checksum = values[i].checksum
+		media[i].CreationDate = values[i].date
+		if !values[i].date.IsZero() {
+			media[i].DateSource = imports.DateSourceExif
+		}
+		_, err = r.SaveMedia(media[i])
+		if err != nil {
+			return err
+		}
+	}
+	found, err := r.GetFilesByMimetypeFilter(nil)
+	if err = expectKeys("empty mimetype filter", found, err); err != nil {
+		return err
+	}
+	found, err = r.GetFilesByMimetypeFilter([]string{"image/jpeg", "video/mp4"})
+	if err = expectKeys("mimetype filter", found, err, "c/1.jpg", "c/3.jpg", "c/4.mp4"); err != nil {
+		return err
+	}
+	found, err = r.GetFilesByState(imports.StateNeedsHash)
+	if err = expectKeys("state needs-hash", found, err, "c/3.jpg", "c/5"); err != nil {
+		return err
+	}
+	found, err = r.GetFilesByState(imports.StateNeedsDate)
+	if err = expectKeys("state needs-date", found, err, "c/4.mp4", "c/5"); err != nil {
+		return err
+	}
+	found, err = r.GetFilesByCreationDate(2020, 0)
+	if err = expectKeys("year 2020", found, err, "c/1.jpg", "c/2.png"); err != nil {
+		return err
+	}
+	found, err = r.GetFilesByCreationDate(2020, 2)
+	if err = expectKeys("month 2020/02", found, err, "c/2.png"); err != nil {
+		return err
+	}
+	found, err = r.GetAllFiles()
+	if err = expectKeys("all files", found, err, "c/1.jpg", "c/2.png", "c/3.jpg", "c/4.mp4", "c/5"); err != nil {
+		return err
+	}
+	var visited []*imports.SourceMedia
+	err = r.ForEachMedia(imports.MediaFilter{Mimetypes: []string{"image/jpeg"}, Year: 2020}, func(media *imports.SourceMedia) error {
+		visited = append(visited, media)
+		return nil
+	})
+	return expectKeys("combined filter", visited, err, "c/1.jpg")
+}
+
+func checkPages(r imports.SourceDbRepository) error {
+	var paths []string
+	for i := 0; i < 7; i++ {
+		paths = append(paths, fmt.Sprintf("d/%d.jpg", i))
+	}
+	_, err := addFiles(r, paths...)
+	if err != nil {
+		return err
+	}
+	var all []*imports.SourceMedia
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(paths) {
+			return fmt.Errorf("paging does not end")
+		}
+		page, next, err := r.GetMediaPage(imports.MediaFilter{}, cursor, 3)
+		if err != nil {
+			return err
+		}
+		if len(page) > 3 {
+			return fmt.Errorf("page of %d media exceeds limit 3", len(page))
+		}
+		all = append(all, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	err = expectKeys("pages", all, nil, paths...)
+	if err != nil {
+		return err
+	}
+	_, _, err = r.GetMediaPage(imports.MediaFilter{}, "!invalid!", 3)
+	if err == nil {
+		return fmt.Errorf("invalid cursor accepted")
+	}
+	if !errors.Is(err, imports.ErrInvalidCursor) {
+		return fmt.Errorf("invalid cursor: got %v, want ErrInvalidCursor", err)
+	}
+	return nil
+}
+
+func checksumGroups(r imports.SourceDbRepository) (map[string][]string, error) {
+	err, cs := r.GetAllCheckSum()
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string)
+	for i := range cs {
+		sources := append([]string{}, cs[i].Sources...)
+		sort.Strings(sources)
+		groups[cs[i].Key] = sources
+	}
+	return groups, nil
+}
+
+func expectGroups(what string, r imports.SourceDbRepository, want map[string][]string) error {
+	groups, err := checksumGroups(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	if fmt.Sprint(groups) != fmt.Sprint(want) {
+		return fmt.Errorf("%s: checksum groups are %v, want %v", what, groups, want)
+	}
+	return nil
+}
+
+func setChecksum(r imports.SourceDbRepository, m *imports.SourceMedia, checksum string) error {
+	m.Checksum = checksum
+	_, err := r.SaveMedia(m)
+	if err != nil {
+		return err
+	}
+	return r.AddChecksum(m)
+}
+
+// visitChecksums returns the keys of the groups ForEachChecksum visits
+// after the checksum after, separated by commas
+func visitChecksums(r imports.SourceDbRepository, after string) (string, error) {
+	var visited []string
+	err := r.ForEachChecksum(after, func(checksum *imports.SourceChecksum) error {
+		visited = append(visited, checksum.Key)
+		return nil
+	})
+	return strings.Join(visited, ","), err
+}
+
+func checkChecksums(r imports.SourceDbRepository) error {
+	media, err := addFiles(r, "e/1.jpg", "e/2.jpg", "e/3.jpg")
+	if err != nil {
+		return err
+	}
+	err = r.AddChecksum(media[2])
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		err = setChecksum(r, media[i], "aa")
+		if err != nil {
+			return err
+		}
+	}
+	err = r.AddChecksum(media[0])
+	if err != nil {
+		return err
+	}
+	err = expectGroups("added twice", r, map[string][]string{"checksum:aa": {"e/1.jpg", "e/2.jpg"}})
+	if err != nil {
+		return err
+	}
+	err = setChecksum(r, media[1], "bb")
+	if err != nil {
+		return err
+	}
+	err = expectGroups("hash changed", r, map[string][]string{"checksum:aa": {"e/1.jpg"}, "checksum:bb": {"e/2.jpg"}})
+	if err != nil {
+		return err
+	}
+	for after, want := range map[string]string{"a": "checksum:aa,checksum:bb", "aa": "checksum:bb", "bb": ""} {
+		visited, err := visitChecksums(r, after)
+		if err != nil {
+			return err
+		}
+		if visited != want {
+			return fmt.Errorf("ForEachChecksum after %q visited %v, want %v", after, visited, want)
+		}
+	}
+	err = setChecksum(r, media[0], "bb")
+	if err != nil {
+		return err
+	}
+	err = expectGroups("group emptied", r, map[string][]string{"checksum:bb": {"e/1.jpg", "e/2.jpg"}})
+	if err != nil {
+		return err
+	}
+	visited, err := visitChecksums(r, "")
+	if err != nil {
+		return err
+	}
+	if visited != "checksum:bb" {
+		return fmt.Errorf("ForEachChecksum visited %v", visited)
+	}
+	group, err := r.GetChecksum("bb")
+	if err != nil || group == nil || group.Key != "checksum:bb" || len(group.Sources) != 2 {
+		return fmt.Errorf("GetChecksum returned %v, %v", group, err)
+	}
+	group, err = r.GetChecksum("aa")
+	if err != nil || group != nil {
+		return fmt.Errorf("GetChecksum of emptied group returned %v, %v", group, err)
+	}
+	return nil
+}
+
+func checkModifyWhileIterating(r imports.SourceDbRepository) error {
+	var paths []string
+	for i := 0; i < 20; i++ {
+		paths = append(paths, fmt.Sprintf("f/%02d.jpg", i))
+	}
+	_, err := addFiles(r, paths...)
+	if err != nil {
+		return err
+	}
+	var visited []*imports.SourceMedia
+	err = r.ForEachMedia(imports.MediaFilter{Mimetypes: []string{""}}, func(media *imports.SourceMedia) error {
+		visited = append(visited, media)
+		media.Mimetype = "image/jpeg"
+		_, err := r.SaveMedia(media)
+		return err
+	})
+	err = expectKeys("visited", visited, err, paths...)
+	if err != nil {
+		return err
+	}
+	found, err := r.GetFilesByMimetypeFilter([]string{"image/jpeg"})
+	return expectKeys("saved while iterating", found, err, paths...)
+}
+
+func checkFailures(r imports.SourceDbRepository) error {
+	recorded := []*imports.Failure{
+		{Stage: imports.StageChecksum, Key: "source:g/1.jpg", Path: "g/1.jpg", Error: "e1"},
+		{Stage: imports.StageScan, Path: "g/2", Error: "e2"},
+		{Stage: imports.StageChecksum, Key: "source:g/1.jpg", Path: "g/1.jpg", Error: "e3"},
+		{Stage: imports.StageExport, Key: "source:g/1.jpg", Path: "g/1.jpg", Error: "e4"},
+	}
+	for _, f := range recorded {
+		err := r.RecordFailure(f)
+		if err != nil {
+			return err
+		}
+	}
+	failures := make(map[string]*imports.Failure)
+	err := r.ForEachFailure(func(f *imports.Failure) error {
+		failures[string(f.Stage)+" "+f.ID()] = f
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(failures) != 3 {
+		return fmt.Errorf("ForEachFailure visited %v", failures)
+	}
+	f := failures["checksum source:g/1.jpg"]
+	if f == nil || f.Attempts != 2 || f.Error != "e3" || f.Path != "g/1.jpg" {
+		return fmt.Errorf("failure recorded twice is %+v", f)
+	}
+	if f.FirstFailedAt.IsZero() || f.LastFailedAt.Before(f.FirstFailedAt) {
+		return fmt.Errorf("failure times are %v, %v", f.FirstFailedAt, f.LastFailedAt)
+	}
+	f = failures["scan g/2"]
+	if f == nil || f.Attempts != 1 || f.Key != "" {
+		return fmt.Errorf("scan failure is %+v", f)
+	}
+	err = r.ClearFailure(imports.StageChecksum, "source:g/1.jpg")
+	if err != nil {
+		return err
+	}
+	var left []string
+	err = r.ForEachFailure(func(f *imports.Failure) error {
+		left = append(left, string(f.Stage)+" "+f.ID())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(left)
+	if strings.Join(left, ",") != "export source:g/1.jpg,scan g/2" {
+		return fmt.Errorf("failures after clearing are %v", left)
+	}
+	return nil
+}
+
+// TestSourceFileRepository checks that r finds exactly the files of
+// want, by path, with their content
+func TestSourceFileRepository(r imports.SourceFileRepository, want map[string][]byte) error {
+	found := make(map[string]bool)
+	err := r.GetSourceFiles(func(p string, info fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if _, ok := want[p]; !ok {
+			return fmt.Errorf("unexpected file %v", p)
+		}
+		found[p] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for p, content := range want {
+		if !found[p] {
+			return fmt.Errorf("file %v not found", p)
+		}
+		err = checkSourceFile(r, p, content)
+		if err != nil {
+			return fmt.Errorf("%v: %w", p, err)
+		}
+		_, err = r.GetSourceFile(p + ".missing")
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("opening missing file returned %v", err)
+		}
+	}
+	return nil
+}
+
+func checkSourceFile(r imports.SourceFileRepository, p string, content []byte) error {
+	f, err := r.GetSourceFile(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != int64(len(content)) {
+		return fmt.Errorf("size %d, want %d", info.Size(), len(content))
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, content) {
+		return fmt.Errorf("content differs")
+	}
+	return nil
+}
+
+// TestDestinationFileRepository exports content to r and reads the
+// exports back with read
+func TestDestinationFileRepository(r imports.DestinationFileRepository, read func(name string) ([]byte, error), content []byte) error {
+	exports := []struct {
+		media *imports.SourceMedia
+		ext   string
+		want  string
+	}{
+		{&imports.SourceMedia{Id: 7, Mimetype: "image/jpeg", CreationDate: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}, "jpg", "images/2020/01/image_20200102_7.jpg"},
+		{&imports.SourceMedia{Id: 8, Mimetype: "video/mp4", CreationDate: time.Date(2019, 12, 2, 3, 4, 5, 0, time.UTC)}, "mp4", "video/2019/12/image_20191202_8.mp4"},
+		{&imports.SourceMedia{Id: 9, Mimetype: "image/png"}, "png", "unknown/image_00010101_9.png"},
+	}
+	for _, e := range exports {
+		name, err := r.ExportToDirectory(e.media, e.ext, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(filepath.ToSlash(name), e.want) {
+			return fmt.Errorf("exported to %v, want %v", name, e.want)
+		}
+		data, err := read(name)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, content) {
+			return fmt.Errorf("content of %v differs", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VolumeMarkerName is the file identifying a source root on volumes
+// without filesystem uuid or label
+const VolumeMarkerName = ".nextimagescrap-volume"
+
+// volume ids are "uuid:<uuid>", "label:<label>" or "marker:<id>"
+const (
+	volumeUuidPrefix   = "uuid:"
+	volumeLabelPrefix  = "label:"
+	volumeMarkerPrefix = "marker:"
+)
+
+// mount is a mounted filesystem, root is the directory of the
+// filesystem mounted at point
+type mount struct {
+	point  string
+	root   string
+	device string
+}
+
+// identifyVolume returns the id of the volume holding path and the path
+// relative to the root of its filesystem. Without uuid or label a marker
+// file is written to path if writeMarker is set, otherwise the volume
+// stays unidentified.
+func identifyVolume(path string, writeMarker bool) (string, string) {
+	m, rel, ok := mountOf(path)
+	if !ok {
+		return "", ""
+	}
+	volumeRel := filepath.ToSlash(filepath.Join(m.root, rel))
+	if id := deviceId(m.device); id != "" {
+		return id, volumeRel
+	}
+	if id := readVolumeMarker(path); id != "" {
+		return volumeMarkerPrefix + id, volumeRel
+	}
+	if !writeMarker {
+		return "", ""
+	}
+	id, err := writeVolumeMarker(path)
+	if err != nil {
+		log.Printf("cannot write volume marker to %v: %v", path, err)
+		return "", ""
+	}
+	return volumeMarkerPrefix + id, volumeRel
+}
+
+// findVolume returns where the root at volumeRel of volume id is mounted
+func findVolume(id string, volumeRel string) (string, bool) {
+	mounts, err := mounts()
+	if err != nil {
+		log.Printf("cannot list mounts %v", err)
+		return "", false
+	}
+	for i := range mounts {
+		m := mounts[i]
+		rel, ok := withinDir(filepath.FromSlash(m.root), filepath.FromSlash(volumeRel))
+		if !ok {
+			continue
+		}
+		path := filepath.Join(m.point, rel)
+		if strings.HasPrefix(id, volumeMarkerPrefix) {
+			if readVolumeMarker(path) != strings.TrimPrefix(id, volumeMarkerPrefix) {
+				continue
+			}
+		} else if deviceId(m.device) != id {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// mountOf returns the innermost mount holding path and path relative to
+// the mount point
+func mountOf(path string) (mount, string, bool) {
+	mounts, err := mounts()
+	if err != nil {
+		log.Printf("cannot list mounts %v", err)
+		return mount{}, "", false
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return mount{}, "", false
+	}
+	found := mount{}
+	foundRel := ""
+	length := -1
+	for i := range mounts {
+		rel, ok := withinDir(mounts[i].point, resolved)
+		if ok && len(mounts[i].point) > length {
+			found, foundRel, length = mounts[i], rel, len(mounts[i].point)
+		}
+	}
+	return found, foundRel, length >= 0
+}
+
+// withinDir returns path relative to dir, "." for dir itself
+func withinDir(dir string, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+func readVolumeMarker(path string) string {
+	d, err := os.ReadFile(filepath.Join(path, VolumeMarkerName))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(d))
+}
+
+func writeVolumeMarker(path string) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	err = os.WriteFile(filepath.Join(path, VolumeMarkerName), []byte(id+"\n"), 0644)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mountInfoPath is read to list the mounts, tests replace it
+var mountInfoPath = "/proc/self/mountinfo"
+
+// mounts lists the mounted filesystems
+func mounts() ([]mount, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+// parseMountInfo reads the mounts from r in the format of
+// /proc/self/mountinfo
+func parseMountInfo(r io.Reader) ([]mount, error) {
+	var ms []mount
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// id parent major:minor root point options [optional...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		ms = append(ms, mount{
+			root:   unescapeMountInfo(fields[3]),
+			point:  unescapeMountInfo(fields[4]),
+			device: unescapeMountInfo(fields[sep+2]),
+		})
+	}
+	return ms, scanner.Err()
+}
+
+// unescapeMountInfo decodes the octal escapes of spaces and tabs
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// deviceId returns the volume id of a block device from the udev links
+// in /dev/disk, preferring the uuid over the label
+func deviceId(device string) string {
+	if !strings.HasPrefix(device, "/dev/") {
+		return ""
+	}
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return ""
+	}
+	dirs := []struct{ dir, prefix string }{
+		{"/dev/disk/by-uuid", volumeUuidPrefix},
+		{"/dev/disk/by-label", volumeLabelPrefix},
+	}
+	for _, d := range dirs {
+		entries, err := os.ReadDir(d.dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			target, err := filepath.EvalSymlinks(filepath.Join(d.dir, e.Name()))
+			if err == nil && target == resolved {
+				return d.prefix + unescapeUdev(e.Name())
+			}
+		}
+	}
+	return ""
+}
+
+// unescapeUdev decodes the \xNN escapes of udev link names
+func unescapeUdev(s string) string {
+	if !strings.Contains(s, "\\x") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if c, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
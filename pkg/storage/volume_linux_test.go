@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useMountInfo makes mounts read the mountinfo lines
+func useMountInfo(t *testing.T, lines ...string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := mountInfoPath
+	mountInfoPath = path
+	t.Cleanup(func() { mountInfoPath = previous })
+}
+
+// volumeDir returns a directory below a temp dir with symlinks resolved,
+// as mountOf compares resolved paths
+func volumeDir(t *testing.T) string {
+	t.Helper()
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func mkdir(t *testing.T, path string) string {
+	t.Helper()
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseMountInfo(t *testing.T) {
+	info := strings.Join([]string{
+		"22 1 0:21 / / rw,relatime - overlay overlay rw",
+		`36 22 8:17 /photos /media/my\040card rw,noatime shared:1 master:2 - vfat /dev/sdb1 rw`,
+		"37 22 0:5 / /mnt rw - tmpfs none rw",
+		"38 22 0:6 / /broken rw no separator",
+		"",
+	}, "\n")
+	got, err := parseMountInfo(strings.NewReader(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mount{
+		{point: "/", root: "/", device: "overlay"},
+		{point: "/media/my card", root: "/photos", device: "/dev/sdb1"},
+		{point: "/mnt", root: "/", device: "none"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mounts %+v, want %+v", got, want)
+	}
+}
+
+func TestIdentifyVolumeByMarker(t *testing.T) {
+	dir := volumeDir(t)
+	photos := mkdir(t, filepath.Join(dir, "card", "photos"))
+	useMountInfo(t,
+		"1 0 0:1 / / rw - tmpfs none rw",
+		"2 1 0:2 /volume "+filepath.Join(dir, "card")+" rw - tmpfs card rw",
+	)
+	id, rel := identifyVolume(photos, false)
+	if id != "" || rel != "" {
+		t.Errorf("volume %q at %q identified without marker", id, rel)
+	}
+	if _, err := os.Stat(filepath.Join(photos, VolumeMarkerName)); !os.IsNotExist(err) {
+		t.Fatalf("marker written without writeMarker: %v", err)
+	}
+	id, rel = identifyVolume(photos, true)
+	if !strings.HasPrefix(id, volumeMarkerPrefix) || rel != "/volume/photos" {
+		t.Fatalf("volume %q at %q", id, rel)
+	}
+	// the marker identifies the volume once it is written
+	if again, _ := identifyVolume(photos, false); again != id {
+		t.Errorf("volume %q identified again as %q", id, again)
+	}
+
+	// the card is mounted elsewhere, next to a volume without the marker
+	moved := mkdir(t, filepath.Join(dir, "elsewhere", "photos"))
+	marker, err := os.ReadFile(filepath.Join(photos, VolumeMarkerName))
+	if err == nil {
+		err = os.WriteFile(filepath.Join(moved, VolumeMarkerName), marker, 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdir(t, filepath.Join(dir, "other", "photos"))
+	useMountInfo(t,
+		"1 0 0:1 / / rw - tmpfs none rw",
+		"2 1 0:3 /volume "+filepath.Join(dir, "other")+" rw - tmpfs other rw",
+		"3 1 0:2 /volume "+filepath.Join(dir, "elsewhere")+" rw - tmpfs card rw",
+	)
+	path, ok := findVolume(id, rel)
+	if !ok || path != moved {
+		t.Errorf("volume found at %q %v, want %v", path, ok, moved)
+	}
+}
+
+func TestAddRootWritesMarkerOnRequest(t *testing.T) {
+	dir := volumeDir(t)
+	photos := mkdir(t, filepath.Join(dir, "photos"))
+	useMountInfo(t, "1 0 0:1 / / rw - tmpfs none rw")
+	s, err := NewCatalogDbStorage(filepath.Join(dir, "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseDb()
+
+	err = s.AddRoot("card", photos, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(photos, VolumeMarkerName)); !os.IsNotExist(err) {
+		t.Fatalf("marker written without request: %v", err)
+	}
+	if roots := s.Roots(); len(roots) != 1 || roots[0].VolumeID != "" {
+		t.Errorf("roots %+v", roots)
+	}
+
+	err = s.AddRoot("card", photos, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marker := readVolumeMarker(photos)
+	if marker == "" {
+		t.Fatal("no marker written")
+	}
+	if roots := s.Roots(); len(roots) != 1 || roots[0].VolumeID != volumeMarkerPrefix+marker || roots[0].VolumeRel != photos {
+		t.Errorf("roots %+v", roots)
+	}
+}
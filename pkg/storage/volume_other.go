@@ -0,0 +1,14 @@
+//go:build !linux
+
+package storage
+
+import "errors"
+
+// mounts is only implemented for linux, elsewhere roots are found by path
+func mounts() ([]mount, error) {
+	return nil, errors.New("listing mounts is not supported")
+}
+
+func deviceId(device string) string {
+	return ""
+}
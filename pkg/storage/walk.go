@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+)
+
+// SourceOptions changes how SourceFileStorage walks the source
+type SourceOptions struct {
+	// FollowSymlinks walks symlinks to files and directories outside of
+	// the source as if they were the target, otherwise symlinks are
+	// skipped. Symlinks into the source are always skipped, their target
+	// is walked at its own path.
+	FollowSymlinks bool
+}
+
+// WalkReport counts the entries GetSourceFiles left out
+type WalkReport struct {
+	Symlinks int
+	// Loops counts followed directories which were walked before
+	Loops int
+	// Hardlinks counts further links of a file walked before
+	Hardlinks int
+	// Special counts sockets, fifos and devices
+	Special int
+}
+
+// fileID identifies a file by device and inode
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// sourceWalk walks the source like fs.WalkDir, following symlinks as
+// configured and leaving out special files and further hardlinks
+type sourceWalk struct {
+	s          *SourceFileStorage
+	walkFunc   func(path string, info fs.DirEntry, err error) error
+	realSource string
+	// dirs are the directories walked while following symlinks
+	dirs map[fileID]string
+	// links are the files which may be walked again by their first path
+	links  map[fileID]string
+	report WalkReport
+}
+
+// walk visits the entry at the slash separated name inside the source
+func (w *sourceWalk) walk(name string, d fs.DirEntry) error {
+	fpath := filepath.Join(w.s.sourcePath, filepath.FromSlash(name))
+	if containsString(w.s.excluded, fpath) {
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	}
+	switch {
+	case d.Type()&fs.ModeSymlink != 0:
+		return w.walkSymlink(name, fpath)
+	case d.IsDir():
+		return w.walkDir(name, fpath, d)
+	case d.Type().IsRegular():
+		return w.walkFile(fpath, d)
+	default:
+		log.Printf("skip special file %v %v", fpath, d.Type())
+		w.report.Special++
+		return nil
+	}
+}
+
+func (w *sourceWalk) walkDir(name string, fpath string, d fs.DirEntry) error {
+	if w.s.options.FollowSymlinks {
+		if id, ok := fileIDOfEntry(d); ok {
+			if first, seen := w.dirs[id]; seen {
+				log.Printf("skip %v, the directory was walked as %v", fpath, first)
+				w.report.Loops++
+				return nil
+			}
+			w.dirs[id] = fpath
+		}
+	}
+	err := w.walkFunc(fpath, d, nil)
+	if err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(w.s.fsys, name)
+	if err != nil {
+		err = w.walkFunc(fpath, d, err)
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		err = w.walk(path.Join(name, e.Name()), e)
+		if err == fs.SkipDir {
+			if e.IsDir() {
+				continue
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkFile visits a regular file. While following symlinks every file is
+// remembered, otherwise only files with several hardlinks.
+func (w *sourceWalk) walkFile(fpath string, d fs.DirEntry) error {
+	// the volume marker is not a media
+	if d.Name() == VolumeMarkerName {
+		return nil
+	}
+	if id, ok := fileIDOfEntry(d); ok && (w.s.options.FollowSymlinks || hasLinks(d)) {
+		if first, seen := w.links[id]; seen {
+			log.Printf("skip %v, it is the same file as %v", fpath, first)
+			w.report.Hardlinks++
+			return nil
+		}
+		w.links[id] = fpath
+	}
+	return w.walkFunc(fpath, d, nil)
+}
+
+func (w *sourceWalk) walkSymlink(name string, fpath string) error {
+	target, err := filepath.EvalSymlinks(fpath)
+	if err != nil {
+		log.Printf("skip symlink %v: %v", fpath, err)
+		w.report.Symlinks++
+		return nil
+	}
+	if _, inside := withinDir(w.realSource, target); inside {
+		log.Printf("skip symlink %v to %v inside the source", fpath, target)
+		w.report.Symlinks++
+		return nil
+	}
+	if !w.s.options.FollowSymlinks {
+		log.Printf("skip symlink %v to %v", fpath, target)
+		w.report.Symlinks++
+		return nil
+	}
+	info, err := fs.Stat(w.s.fsys, name)
+	if err != nil {
+		log.Printf("skip symlink %v: %v", fpath, err)
+		w.report.Symlinks++
+		return nil
+	}
+	d := fs.FileInfoToDirEntry(info)
+	switch {
+	case info.IsDir():
+		err = w.walkDir(name, fpath, d)
+		if err == fs.SkipDir {
+			return nil
+		}
+		return err
+	case info.Mode().IsRegular():
+		return w.walkFile(fpath, d)
+	default:
+		log.Printf("skip special file %v %v", target, info.Mode().Type())
+		w.report.Special++
+		return nil
+	}
+}
+
+// fileIDOfEntry returns the device and inode of d, if the filesystem has them
+func fileIDOfEntry(d fs.DirEntry) (fileID, bool) {
+	info, err := d.Info()
+	if err != nil {
+		return fileID{}, false
+	}
+	return fileIDOf(info)
+}
+
+// hasLinks reports whether the file of d has more than one hardlink
+func hasLinks(d fs.DirEntry) bool {
+	info, err := d.Info()
+	return err == nil && linkCount(info) > 1
+}
+
+// walkSource walks the source, see GetSourceFiles
+func (s *SourceFileStorage) walkSource(walkFunc func(path string, info fs.DirEntry, err error) error) (WalkReport, error) {
+	return s.walkTree(".", walkFunc)
+}
+
+// walkTree walks the directory at the slash separated name inside the
+// source, an archive is walked by its name with ArchiveSuffix
+func (s *SourceFileStorage) walkTree(name string, walkFunc func(path string, info fs.DirEntry, err error) error) (WalkReport, error) {
+	w := &sourceWalk{
+		s:        s,
+		walkFunc: walkFunc,
+		dirs:     make(map[fileID]string),
+		links:    make(map[fileID]string),
+	}
+	w.realSource = s.sourcePath
+	if target, err := filepath.EvalSymlinks(s.sourcePath); err == nil {
+		w.realSource = target
+	}
+	fpath := s.sourcePath
+	if name != "." {
+		fpath = filepath.Join(s.sourcePath, filepath.FromSlash(name))
+	}
+	info, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		err = walkFunc(fpath, nil, err)
+	} else {
+		err = w.walkDir(name, fpath, fs.FileInfoToDirEntry(info))
+	}
+	if errors.Is(err, fs.SkipDir) {
+		err = nil
+	}
+	return w.report, err
+}
@@ -0,0 +1,119 @@
+//go:build unix
+
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// walkedFiles walks the source with options and returns the files passed
+// to the walk function, relative to the source
+func walkedFiles(t *testing.T, source string, options SourceOptions) ([]string, WalkReport) {
+	t.Helper()
+	s, err := NewSourceFileStorageWithOptions(source, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	report, err := s.walkSource(func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			rel, err := filepath.Rel(source, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files, report
+}
+
+func writeFile(t *testing.T, path string) {
+	t.Helper()
+	err := os.WriteFile(path, []byte("jpeg"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalkFollowedSymlinkCycle(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{source, outside} {
+		err := os.Mkdir(d, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(outside, "x.jpg"))
+	// the followed directory links back to itself
+	for link, target := range map[string]string{
+		filepath.Join(source, "ext"):   outside,
+		filepath.Join(outside, "back"): outside,
+	} {
+		err := os.Symlink(target, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, report := walkedFiles(t, source, SourceOptions{FollowSymlinks: true})
+	if want := []string{"ext/x.jpg"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("walked %v, want %v", files, want)
+	}
+	if report.Loops != 1 {
+		t.Errorf("walk report %+v, want one loop", report)
+	}
+
+	files, report = walkedFiles(t, source, SourceOptions{})
+	if len(files) != 0 || report.Symlinks != 1 {
+		t.Errorf("walked %v with report %+v without following symlinks", files, report)
+	}
+}
+
+func TestWalkHardlinks(t *testing.T) {
+	source := t.TempDir()
+	writeFile(t, filepath.Join(source, "a.jpg"))
+	err := os.Link(filepath.Join(source, "a.jpg"), filepath.Join(source, "b.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(source, "c.jpg"))
+
+	files, report := walkedFiles(t, source, SourceOptions{})
+	if want := []string{"a.jpg", "c.jpg"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("walked %v, want %v", files, want)
+	}
+	if report.Hardlinks != 1 {
+		t.Errorf("walk report %+v, want one hardlink", report)
+	}
+}
+
+func TestWalkSkipsFifo(t *testing.T) {
+	source := t.TempDir()
+	writeFile(t, filepath.Join(source, "a.jpg"))
+	err := syscall.Mkfifo(filepath.Join(source, "pipe"), 0644)
+	if err != nil {
+		t.Skipf("cannot make a fifo: %v", err)
+	}
+
+	files, report := walkedFiles(t, source, SourceOptions{})
+	if want := []string{"a.jpg"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("walked %v, want %v", files, want)
+	}
+	if report.Special != 1 {
+		t.Errorf("walk report %+v, want one special file", report)
+	}
+}
@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"nextimagescrap/pkg/imports"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask selects the events which start or extend the settle time of a
+// file and the changes of directories
+const watchMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO |
+	unix.IN_MOVED_FROM | unix.IN_DELETE | unix.IN_ONLYDIR
+
+// watchPollInterval is how often settled files and stop are checked
+const watchPollInterval = 250 * time.Millisecond
+
+// sourceWatch follows the directories of the source with inotify
+type sourceWatch struct {
+	s  *SourceFileStorage
+	fd int
+	// dirs maps watch descriptors to the slash separated directory
+	dirs map[int32]string
+	// pending holds the time of the last event of the files not yet reported
+	pending map[string]time.Time
+}
+
+// WatchSourceFiles calls fn with the files created or written below the
+// source once no write happened to them for settle. The files of
+// directories moved into the source are reported as well, archives are
+// reported by the files inside. It returns when stop is closed, a nil stop
+// watches until the process ends.
+func (s *SourceFileStorage) WatchSourceFiles(settle time.Duration, stop <-chan struct{}, fn func(files []imports.WatchedFile) error) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	defer unix.Close(fd)
+	w := &sourceWatch{
+		s:       s,
+		fd:      fd,
+		dirs:    make(map[int32]string),
+		pending: make(map[string]time.Time),
+	}
+	err = w.addTree(".", false)
+	if err != nil {
+		return err
+	}
+	log.Printf("watching %d directories of %v", len(w.dirs), s.sourcePath)
+	buf := make([]byte, 64*1024)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		n, err := unix.Poll(fds, int(watchPollInterval/time.Millisecond))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return os.NewSyscallError("poll", err)
+		}
+		if n > 0 {
+			err = w.readEvents(buf)
+			if err != nil {
+				return err
+			}
+		}
+		files := w.settled(settle)
+		if len(files) > 0 {
+			err = fn(files)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// addTree watches the directory at name and the directories below it,
+// with pend the files found are reported once settled
+func (w *sourceWatch) addTree(name string, pend bool) error {
+	if w.excluded(name) {
+		return nil
+	}
+	dirPath := filepath.Join(w.s.sourcePath, filepath.FromSlash(name))
+	wd, err := unix.InotifyAddWatch(w.fd, dirPath, watchMask)
+	if err != nil {
+		return &fs.PathError{Op: "watch", Path: dirPath, Err: err}
+	}
+	w.dirs[int32(wd)] = name
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		child := path.Join(name, e.Name())
+		switch {
+		case e.IsDir():
+			err = w.addTree(child, pend)
+			if err != nil {
+				log.Printf("cannot watch %v: %v", child, err)
+			}
+		case pend && e.Type().IsRegular():
+			w.pending[child] = now
+		}
+	}
+	return nil
+}
+
+// removeTree forgets the directory at name, moved out of the source,
+// and the directories below it
+func (w *sourceWatch) removeTree(name string) {
+	for wd, dir := range w.dirs {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+	for p := range w.pending {
+		if strings.HasPrefix(p, name+"/") {
+			delete(w.pending, p)
+		}
+	}
+}
+
+// readEvents handles the queued events
+func (w *sourceWatch) readEvents(buf []byte) error {
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			return nil
+		}
+		if err != nil {
+			return os.NewSyscallError("read", err)
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + unix.SizeofInotifyEvent
+			offset = start + int(ev.Len)
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			w.handle(ev.Wd, ev.Mask, name)
+		}
+	}
+}
+
+func (w *sourceWatch) handle(wd int32, mask uint32, name string) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		log.Printf("events of the source were lost, run scan-source to catalog the files missed")
+		return
+	}
+	dir, ok := w.dirs[wd]
+	if !ok {
+		return
+	}
+	if mask&unix.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		return
+	}
+	if name == "" {
+		return
+	}
+	p := path.Join(dir, name)
+	if w.excluded(p) {
+		return
+	}
+	isDir := mask&unix.IN_ISDIR != 0
+	switch {
+	case isDir && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		err := w.addTree(p, true)
+		if err != nil {
+			log.Printf("cannot watch %v: %v", p, err)
+		}
+	case isDir && mask&unix.IN_MOVED_FROM != 0:
+		w.removeTree(p)
+	case isDir:
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		delete(w.pending, p)
+	default:
+		w.pending[p] = time.Now()
+	}
+}
+
+// settled returns the pending files without events for settle
+func (w *sourceWatch) settled(settle time.Duration) []imports.WatchedFile {
+	var names []string
+	now := time.Now()
+	for p, last := range w.pending {
+		if now.Sub(last) >= settle {
+			names = append(names, p)
+			delete(w.pending, p)
+		}
+	}
+	sort.Strings(names)
+	var files []imports.WatchedFile
+	for _, name := range names {
+		if w.excluded(name) {
+			continue
+		}
+		fpath := filepath.Join(w.s.sourcePath, filepath.FromSlash(name))
+		info, err := os.Lstat(fpath)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("skip %v: %v", fpath, err)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			log.Printf("skip %v %v", fpath, info.Mode().Type())
+			continue
+		}
+		if info.Name() == VolumeMarkerName {
+			continue
+		}
+		if archiveKind(info.Name()) != "" {
+			files = append(files, w.archiveFiles(name)...)
+			continue
+		}
+		files = append(files, imports.WatchedFile{Path: fpath, Rel: name, Info: fs.FileInfoToDirEntry(info)})
+	}
+	return files
+}
+
+// excluded reports whether the file at name is excluded from the source,
+// like the catalog kept inside it
+func (w *sourceWatch) excluded(name string) bool {
+	return containsString(w.s.excluded, filepath.Join(w.s.sourcePath, filepath.FromSlash(name)))
+}
+
+// archiveFiles lists the files of the archive at name
+func (w *sourceWatch) archiveFiles(name string) []imports.WatchedFile {
+	var files []imports.WatchedFile
+	_, err := w.s.walkTree(name+ArchiveSuffix, func(fpath string, info fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(w.s.sourcePath, fpath)
+		if err != nil {
+			return err
+		}
+		files = append(files, imports.WatchedFile{Path: fpath, Rel: filepath.ToSlash(rel), Info: info})
+		return nil
+	})
+	if err != nil {
+		log.Printf("cannot read archive %v: %v", name, err)
+	}
+	return files
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"nextimagescrap/pkg/imports"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sha1Hex(data string) string {
+	sum := sha1.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// waitForMedia polls the media at path until done accepts it
+func waitForMedia(t *testing.T, s *MemSourceStorage, path string, done func(media *imports.SourceMedia) bool) *imports.SourceMedia {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		media, err := s.GetFileByPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if media != nil && done(media) {
+			return media
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("media %v is %v", path, media)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWatchRewrittenFile(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewSourceFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMemSourceStorage()
+	service := imports.NewConfiguredService(fs, s, nil, imports.Config{})
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- service.Watch(10*time.Millisecond, stop)
+	}()
+	defer func() {
+		close(stop)
+		err := <-done
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	// the watch is set up before the first poll returns
+	time.Sleep(100 * time.Millisecond)
+
+	path := filepath.Join(dir, "a.txt")
+	err = os.WriteFile(path, []byte("first"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := waitForMedia(t, s, path, func(media *imports.SourceMedia) bool {
+		return media.Checksum == sha1Hex("first")
+	})
+	if first.Size != 5 || first.Mimetype == "" {
+		t.Errorf("imported %v", first)
+	}
+
+	// a sync tool replacing the file by a renamed temp file
+	tmp := filepath.Join(dir, ".a.txt.tmp")
+	err = os.WriteFile(tmp, []byte("second version"), 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := waitForMedia(t, s, path, func(media *imports.SourceMedia) bool {
+		return media.Checksum == sha1Hex("second version")
+	})
+	if second.Key != first.Key || second.Size != 14 {
+		t.Errorf("rewritten file imported as %v", second)
+	}
+	group, err := s.GetChecksum(sha1Hex("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group != nil {
+		t.Errorf("the former content is still in group %v", group)
+	}
+}
+
+func TestWatchSkipsExcludedFile(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewSourceFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := filepath.Join(dir, "catalog.db")
+	fs.ExcludePath(catalog)
+	s := NewMemSourceStorage()
+	service := imports.NewConfiguredService(fs, s, nil, imports.Config{})
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- service.Watch(10*time.Millisecond, stop)
+	}()
+	defer func() {
+		close(stop)
+		err := <-done
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	// the watch is set up before the first poll returns
+	time.Sleep(100 * time.Millisecond)
+
+	// the catalog is written before the file, both settle together
+	err = os.WriteFile(catalog, []byte("catalog"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "a.txt")
+	err = os.WriteFile(path, []byte("media"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForMedia(t, s, path, func(media *imports.SourceMedia) bool {
+		return media.Checksum == sha1Hex("media")
+	})
+	media, err := s.GetFileByPath(catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media != nil {
+		t.Errorf("the excluded catalog is cataloged as %v", media)
+	}
+}
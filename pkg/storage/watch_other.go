@@ -0,0 +1,15 @@
+//go:build !linux
+
+package storage
+
+import (
+	"errors"
+	"nextimagescrap/pkg/imports"
+	"time"
+)
+
+// WatchSourceFiles is only implemented for linux, elsewhere the source
+// has to be scanned
+func (s *SourceFileStorage) WatchSourceFiles(settle time.Duration, stop <-chan struct{}, fn func(files []imports.WatchedFile) error) error {
+	return errors.New("watching the source is not supported")
+}